@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"redis-learning/internal/server"
+)
+
+func main() {
+	fix := flag.Bool("fix", false, "Truncate the AOF to its last valid command, after confirmation")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [--fix] <file.aof|file.manifest|aof-dir>\n", os.Args[0])
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	check, err := server.CheckAOF(flag.Arg(0), os.Stdout)
+	if err != nil {
+		fmt.Printf("Cannot check the AOF: %v\n", err)
+		os.Exit(1)
+	}
+	if check.Valid {
+		return
+	}
+	if check.Path == "" {
+		fmt.Println("The AOF is corrupt before its last file, it can't be fixed by truncation.")
+		os.Exit(1)
+	}
+	if !*fix {
+		fmt.Printf("AOF %s is not valid. Use the --fix option to try fixing it.\n", check.Path)
+		os.Exit(1)
+	}
+
+	fmt.Printf("This will shrink the AOF %s from %d bytes, with %d bytes, to %d bytes\n",
+		check.Path, check.Size, check.Size-check.ValidUpTo, check.ValidUpTo)
+	fmt.Print("Continue? [y/N]: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "y") {
+		fmt.Println("Aborting...")
+		os.Exit(1)
+	}
+	if err := os.Truncate(check.Path, check.ValidUpTo); err != nil {
+		fmt.Printf("Failed to truncate AOF %s: %v\n", check.Path, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Successfully truncated AOF %s\n", check.Path)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"redis-learning/internal/server"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s <rdb-file-name>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	if err := server.CheckRDB(os.Args[1], os.Stdout); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
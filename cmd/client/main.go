@@ -90,7 +90,7 @@ func printResponse(value resp.Value) {
 		} else {
 			fmt.Printf("\"%s\"\n", value.Bulk)
 		}
-	case "array":
+	case "array", "push", "map":
 		if value.Null {
 			fmt.Println("(nil)")
 		} else {
@@ -0,0 +1,9 @@
+package main
+
+import (
+	"redis-learning/pkg/redisserver"
+)
+
+func main() {
+	redisserver.SentinelMain()
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-learning/pkg/redisserver"
+	"redis-learning/pkg/resp"
+)
+
+func main() {
+	fmt.Println("=== Testing Append Only File ===")
+
+	// Servers run in-process on a scratch directory, so that the log can
+	// be replayed by a fresh server
+	dir, err := os.MkdirTemp("", "redis-aof")
+	if err != nil {
+		log.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// A fresh log has no base file, just a first incremental file
+	aofDir := filepath.Join(dir, "appendonlydir")
+	aofPath := filepath.Join(aofDir, "appendonly.aof.1.incr.aof")
+
+	writer, parser, err := startServer(dir, "6394", "appendfsync", "always")
+	if err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+	fmt.Println()
+
+	fmt.Println("Test 1: Writes are logged, in deterministic form")
+	sendCommand(writer, parser, []string{"SET", "a:string", "hello"})
+	sendCommand(writer, parser, []string{"GET", "a:string"})
+	sendCommand(writer, parser, []string{"DEL", "a:missing"})
+	sendCommand(writer, parser, []string{"RPUSH", "a:list", "a", "b", "c", "d"})
+	sendCommand(writer, parser, []string{"LMPOP", "1", "a:list", "LEFT", "COUNT", "2"})
+	sendCommand(writer, parser, []string{"BRPOP", "a:list", "0"})
+	id := sendCommand(writer, parser, []string{"XADD", "a:stream", "*", "name", "alice"})
+	sendCommand(writer, parser, []string{"XGROUP", "CREATE", "a:stream", "workers", "0"})
+	sendCommand(writer, parser, []string{"XREADGROUP", "GROUP", "workers", "w1", "STREAMS", "a:stream", ">"})
+	sendCommand(writer, parser, []string{"MULTI"})
+	sendCommand(writer, parser, []string{"SET", "a:tx1", "1"})
+	sendCommand(writer, parser, []string{"SET", "a:tx2", "2"})
+	sendCommand(writer, parser, []string{"EXEC"})
+	sendCommand(writer, parser, []string{"EVAL", "redis.call('SET', KEYS[1], 'x'); return redis.call('RPUSH', KEYS[2], 'y')", "2", "a:script", "a:list2"})
+	sendCommand(writer, parser, []string{"FUNCTION", "LOAD", "#!lua name=aoflib\nredis.register_function('ping', function() return 'pong' end)"})
+
+	// A client blocked on a key is served when another one pushes to it
+	other, otherParser, err := connect("6394")
+	if err != nil {
+		log.Fatalf("Failed to connect: %v", err)
+	}
+	if err := other.Write(commandValue([]string{"BLMOVE", "a:queue", "a:done", "LEFT", "RIGHT", "0"})); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	sendCommand(writer, parser, []string{"LPUSH", "a:queue", "job"})
+	if reply, err := otherParser.Read(); err == nil {
+		fmt.Printf("[BLMOVE a:queue a:done LEFT RIGHT 0] -> %s\n", formatResponse(reply))
+	}
+	fmt.Println()
+
+	fmt.Println("Logged commands:")
+	data, err := os.ReadFile(aofPath)
+	if err != nil {
+		log.Fatalf("Failed to read the AOF: %v", err)
+	}
+	for _, argv := range parseCommands(data) {
+		line := strings.Join(argv, " ")
+		line = strings.ReplaceAll(line, id.Bulk, "<id>")
+		line = strings.ReplaceAll(line, "\n", "\\n")
+		if strings.HasPrefix(line, "XCLAIM") {
+			// Mask the delivery time
+			fields := strings.Fields(line)
+			fields[7] = "<time>"
+			line = strings.Join(fields, " ")
+		}
+		fmt.Println("  " + line)
+	}
+	fmt.Println()
+
+	fmt.Println("Test 2: A new server replays the log")
+	sendCommand(writer, parser, []string{"CONFIG", "GET", "append*"})
+	if err := writer.Write(commandValue([]string{"SHUTDOWN", "NOSAVE"})); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	parser.Read()
+
+	writer, parser, err = startServer(dir, "6395")
+	if err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+	sendCommand(writer, parser, []string{"GET", "a:string"})
+	sendCommand(writer, parser, []string{"RPOP", "a:list"})
+	sendCommand(writer, parser, []string{"RPOP", "a:list2"})
+	sendCommand(writer, parser, []string{"GET", "a:tx2"})
+	sendCommand(writer, parser, []string{"GET", "a:script"})
+	sendCommand(writer, parser, []string{"RPOP", "a:done"})
+	sendCommand(writer, parser, []string{"XRANGE", "a:stream", "-", "+"})
+	sendCommand(writer, parser, []string{"XINFO", "GROUPS", "a:stream"})
+	sendCommand(writer, parser, []string{"FCALL", "ping", "0"})
+	info := sendQuiet(writer, parser, []string{"INFO", "persistence"})
+	for _, line := range strings.Split(info.Bulk, "\r\n") {
+		if strings.HasPrefix(line, "aof_") {
+			fmt.Println(line)
+		}
+	}
+	if err := writer.Write(commandValue([]string{"SHUTDOWN", "NOSAVE"})); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	parser.Read()
+	fmt.Println()
+
+	fmt.Println("Test 3: A truncated last command")
+	appendTo(aofPath, "*3\r\n$3\r\nSET\r\n$9\r\na:partial\r\n$5\r\nval")
+	_, _, err = startServer(dir, "6396", "aof-load-truncated", "no")
+	fmt.Printf("aof-load-truncated no refuses to start: %v\n", err != nil)
+
+	before, _ := os.Stat(aofPath)
+	writer, parser, err = startServer(dir, "6397")
+	if err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+	after, _ := os.Stat(aofPath)
+	fmt.Printf("aof-load-truncated yes truncates the file: %v\n", after.Size() < before.Size())
+	sendCommand(writer, parser, []string{"GET", "a:string"})
+	sendCommand(writer, parser, []string{"GET", "a:partial"})
+	if err := writer.Write(commandValue([]string{"SHUTDOWN", "NOSAVE"})); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	parser.Read()
+
+	// An unfinished transaction is dropped as a whole
+	before, _ = os.Stat(aofPath)
+	appendTo(aofPath, "*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$5\r\na:txn\r\n$1\r\n1\r\n")
+	writer, parser, err = startServer(dir, "6398")
+	if err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+	sendCommand(writer, parser, []string{"GET", "a:txn"})
+	after, _ = os.Stat(aofPath)
+	fmt.Printf("Incomplete transaction removed from the file: %v\n", after.Size() == before.Size())
+	fmt.Println()
+
+	fmt.Println("Test 4: BGREWRITEAOF compacts the log, keeping the writes made meanwhile")
+	populate(writer, parser, 100000)
+	// In a transaction, so that the rewrite is still running
+	sendCommand(writer, parser, []string{"MULTI"})
+	sendCommand(writer, parser, []string{"BGREWRITEAOF"})
+	sendCommand(writer, parser, []string{"BGREWRITEAOF"})
+	sendCommand(writer, parser, []string{"BGSAVE"})
+	sendCommand(writer, parser, []string{"BGSAVE", "SCHEDULE"})
+	sendCommand(writer, parser, []string{"EXEC"})
+	// Modify keys while the base file is being written
+	sendCommand(writer, parser, []string{"SET", "rw:0", "changed"})
+	sendCommand(writer, parser, []string{"DEL", "rw:1"})
+	sendCommand(writer, parser, []string{"SET", "rw:new", "1"})
+	waitFor(writer, parser, "aof_rewrite_in_progress:0")
+	waitFor(writer, parser, "rdb_bgsave_in_progress:0")
+	printInfo(writer, parser, "aof_rewrites:", "aof_last_bgrewrite_status:", "rdb_last_bgsave_status:")
+	printManifest(aofDir)
+	if err := writer.Write(commandValue([]string{"SHUTDOWN", "NOSAVE"})); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	parser.Read()
+
+	writer, parser, err = startServer(dir, "6399")
+	if err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+	sendCommand(writer, parser, []string{"GET", "rw:0"})
+	sendCommand(writer, parser, []string{"GET", "rw:1"})
+	sendCommand(writer, parser, []string{"GET", "rw:new"})
+	sendCommand(writer, parser, []string{"GET", "rw:99999"})
+	sendCommand(writer, parser, []string{"GET", "a:string"})
+	sendCommand(writer, parser, []string{"FCALL", "ping", "0"})
+	if err := writer.Write(commandValue([]string{"SHUTDOWN", "NOSAVE"})); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	parser.Read()
+	fmt.Println()
+
+	fmt.Println("Test 5: Without the RDB preamble, the base file is made of commands")
+	dir2 := filepath.Join(dir, "commands")
+	if err := os.Mkdir(dir2, 0755); err != nil {
+		log.Fatalf("Failed to create directory: %v", err)
+	}
+	writer, parser, err = startServer(dir2, "6400", "aof-use-rdb-preamble", "no")
+	if err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+	sendCommand(writer, parser, []string{"SET", "c:string", "value"})
+	sendCommand(writer, parser, []string{"RPUSH", "c:list", "a", "b", "c"})
+	sendCommand(writer, parser, []string{"XADD", "c:stream", "1-1", "f", "1"})
+	sendCommand(writer, parser, []string{"XADD", "c:stream", "1-2", "f", "2"})
+	sendCommand(writer, parser, []string{"XADD", "c:stream", "1-3", "f", "3"})
+	sendCommand(writer, parser, []string{"XDEL", "c:stream", "1-3"})
+	sendCommand(writer, parser, []string{"XGROUP", "CREATE", "c:stream", "g", "0"})
+	sendCommand(writer, parser, []string{"XREADGROUP", "GROUP", "g", "alice", "COUNT", "1", "STREAMS", "c:stream", ">"})
+	sendCommand(writer, parser, []string{"XGROUP", "CREATECONSUMER", "c:stream", "g", "bob"})
+	sendCommand(writer, parser, []string{"XGROUP", "CREATE", "c:empty", "g", "$", "MKSTREAM"})
+	sendCommand(writer, parser, []string{"GEOADD", "c:geo", "13.361389", "38.115556", "Palermo"})
+	payload := sendQuiet(writer, parser, []string{"DUMP", "c:string"})
+	restored := sendQuiet(writer, parser, []string{"RESTORE", "c:ttl", "3600000", payload.Bulk})
+	fmt.Printf("[RESTORE c:ttl 3600000 <payload>] -> %s\n", formatResponse(restored))
+	sendCommand(writer, parser, []string{"FUNCTION", "LOAD", "#!lua name=baselib\nredis.register_function('hi', function() return 'hi' end)"})
+	sendCommand(writer, parser, []string{"BGREWRITEAOF"})
+	waitFor(writer, parser, "aof_rewrite_in_progress:0")
+	printManifest(filepath.Join(dir2, "appendonlydir"))
+	fmt.Println("Base file commands:")
+	data, err = os.ReadFile(filepath.Join(dir2, "appendonlydir", "appendonly.aof.1.base.aof"))
+	if err != nil {
+		log.Fatalf("Failed to read the base file: %v", err)
+	}
+	for _, argv := range parseCommands(data) {
+		if argv[0] == "RESTORE" {
+			argv[3] = "<payload>"
+			if argv[2] != "0" {
+				argv[2] = "<time>"
+			}
+		}
+		line := strings.ReplaceAll(strings.Join(argv, " "), "\n", "\\n")
+		if strings.HasPrefix(line, "XCLAIM") {
+			fields := strings.Fields(line)
+			fields[7] = "<time>"
+			line = strings.Join(fields, " ")
+		}
+		fmt.Println("  " + line)
+	}
+	if err := writer.Write(commandValue([]string{"SHUTDOWN", "NOSAVE"})); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	parser.Read()
+
+	writer, parser, err = startServer(dir2, "6401")
+	if err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+	sendCommand(writer, parser, []string{"RPOP", "c:list"})
+	sendCommand(writer, parser, []string{"XRANGE", "c:stream", "-", "+"})
+	sendCommand(writer, parser, []string{"XPENDING", "c:stream", "g"})
+	sendCommand(writer, parser, []string{"XINFO", "GROUPS", "c:stream"})
+	sendCommand(writer, parser, []string{"XADD", "c:stream", "1-3", "f", "3"})
+	sendCommand(writer, parser, []string{"XLEN", "c:empty"})
+	sendCommand(writer, parser, []string{"XSETID", "c:stream", "1-1"})
+	sendCommand(writer, parser, []string{"XSETID", "c:missing", "1-1"})
+	sendCommand(writer, parser, []string{"FCALL", "hi", "0"})
+	sendCommand(writer, parser, []string{"GEOPOS", "c:geo", "Palermo"})
+	sendCommand(writer, parser, []string{"GET", "c:ttl"})
+	if err := writer.Write(commandValue([]string{"SHUTDOWN", "NOSAVE"})); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	parser.Read()
+	fmt.Println()
+
+	fmt.Println("Test 6: Turning the AOF on at runtime writes the dataset first")
+	dir3 := filepath.Join(dir, "runtime")
+	if err := os.Mkdir(dir3, 0755); err != nil {
+		log.Fatalf("Failed to create directory: %v", err)
+	}
+	writer, parser, err = startServer(dir3, "6402", "appendonly", "no")
+	if err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+	sendCommand(writer, parser, []string{"SET", "r:before", "1"})
+	sendCommand(writer, parser, []string{"CONFIG", "SET", "appendonly", "yes"})
+	sendCommand(writer, parser, []string{"SET", "r:after", "2"})
+	waitFor(writer, parser, "aof_rewrite_in_progress:0")
+	printManifest(filepath.Join(dir3, "appendonlydir"))
+	if err := writer.Write(commandValue([]string{"SHUTDOWN", "NOSAVE"})); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	parser.Read()
+
+	writer, parser, err = startServer(dir3, "6403")
+	if err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+	sendCommand(writer, parser, []string{"GET", "r:before"})
+	sendCommand(writer, parser, []string{"GET", "r:after"})
+	fmt.Println()
+
+	fmt.Println("Test 7: The log is rewritten automatically once it doubled")
+	sendCommand(writer, parser, []string{"CONFIG", "SET", "auto-aof-rewrite-min-size", "1kb", "auto-aof-rewrite-percentage", "100"})
+	value := strings.Repeat("x", 100)
+	for i := 0; i < 20; i++ {
+		sendQuiet(writer, parser, []string{"SET", fmt.Sprintf("r:%d", i), value})
+	}
+	time.Sleep(300 * time.Millisecond)
+	waitFor(writer, parser, "aof_rewrite_in_progress:0")
+	printInfo(writer, parser, "aof_rewrites:")
+	printManifest(filepath.Join(dir3, "appendonlydir"))
+	sendCommand(writer, parser, []string{"CONFIG", "GET", "auto-aof-*"})
+	fmt.Println()
+
+	fmt.Println("=== All AOF tests completed! ===")
+}
+
+// populate creates n string keys, pipelining the commands
+func populate(writer *resp.Writer, parser *resp.Parser, n int) {
+	go func() {
+		for i := 0; i < n; i++ {
+			writer.Write(commandValue([]string{"SET", fmt.Sprintf("rw:%d", i), strconv.Itoa(i)}))
+		}
+	}()
+	for i := 0; i < n; i++ {
+		if _, err := parser.Read(); err != nil {
+			log.Fatalf("Error reading response: %v", err)
+		}
+	}
+	fmt.Printf("Created %d keys\n", n)
+}
+
+// waitFor polls INFO until it contains the given line
+func waitFor(writer *resp.Writer, parser *resp.Parser, line string) {
+	for {
+		info := sendQuiet(writer, parser, []string{"INFO", "persistence"})
+		if strings.Contains(info.Bulk, line+"\r\n") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// printInfo prints the INFO persistence fields with the given prefixes
+func printInfo(writer *resp.Writer, parser *resp.Parser, prefixes ...string) {
+	info := sendQuiet(writer, parser, []string{"INFO", "persistence"})
+	for _, line := range strings.Split(info.Bulk, "\r\n") {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(line, prefix) {
+				fmt.Println(line)
+			}
+		}
+	}
+}
+
+// printManifest prints the manifest and the files of an AOF directory
+func printManifest(dir string) {
+	data, err := os.ReadFile(filepath.Join(dir, "appendonly.aof.manifest"))
+	if err != nil {
+		log.Fatalf("Failed to read the manifest: %v", err)
+	}
+	fmt.Println("Manifest:")
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fmt.Println("  " + line)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Fatalf("Failed to list %s: %v", dir, err)
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	fmt.Printf("Files: %s\n", strings.Join(names, " "))
+}
+
+// startServer runs a server with the AOF enabled in dir, applying extra
+// settings given as name/value pairs, and connects to it
+func startServer(dir, port string, settings ...string) (*resp.Writer, *resp.Parser, error) {
+	srv := redisserver.New("localhost", port)
+	settings = append([]string{"dir", dir, "appendonly", "yes", "save", ""}, settings...)
+	for i := 0; i < len(settings); i += 2 {
+		if err := srv.SetConfig(settings[i], settings[i+1]); err != nil {
+			log.Fatalf("Failed to configure server: %v", err)
+		}
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Start()
+	}()
+	var writer *resp.Writer
+	var parser *resp.Parser
+	for writer == nil {
+		select {
+		case err := <-errs:
+			return nil, nil, err
+		case <-time.After(10 * time.Millisecond):
+		}
+		writer, parser, _ = connect(port)
+	}
+	// Loading a large dataset takes a while, and fails if the log is corrupt
+	for {
+		if err := writer.Write(commandValue([]string{"INFO", "persistence"})); err != nil {
+			return nil, nil, <-errs
+		}
+		info, err := parser.Read()
+		if err != nil {
+			return nil, nil, <-errs
+		}
+		if strings.Contains(info.Bulk, "loading:0\r\n") {
+			return writer, parser, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func connect(port string) (*resp.Writer, *resp.Parser, error) {
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Printf("Connected to Redis server on port %s!\n", port)
+	return resp.NewWriter(conn), resp.NewParser(conn), nil
+}
+
+// appendTo appends raw bytes to a file
+func appendTo(path, data string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		log.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+// parseCommands splits the content of an AOF into commands
+func parseCommands(data []byte) [][]string {
+	parser := resp.NewParser(strings.NewReader(string(data)))
+	var commands [][]string
+	for {
+		value, err := parser.Read()
+		if err != nil {
+			return commands
+		}
+		argv := make([]string, len(value.Array))
+		for i, arg := range value.Array {
+			argv[i] = arg.Bulk
+		}
+		commands = append(commands, argv)
+	}
+}
+
+func commandValue(args []string) resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+	return resp.NewArray(values)
+}
+
+// sendQuiet sends a command without printing the exchange
+func sendQuiet(writer *resp.Writer, parser *resp.Parser, args []string) resp.Value {
+	if err := writer.Write(commandValue(args)); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	response, err := parser.Read()
+	if err != nil {
+		log.Fatalf("Error reading response: %v", err)
+	}
+	return response
+}
+
+func sendCommand(writer *resp.Writer, parser *resp.Parser, args []string) resp.Value {
+	if err := writer.Write(commandValue(args)); err != nil {
+		log.Printf("Error sending command: %v", err)
+		return resp.Value{}
+	}
+
+	response, err := parser.Read()
+	if err != nil {
+		log.Printf("Error reading response: %v", err)
+		return resp.Value{}
+	}
+
+	fmt.Printf("%v -> %s\n", args, formatResponse(response))
+	return response
+}
+
+func formatResponse(value resp.Value) string {
+	switch value.Type {
+	case "string":
+		return value.Str
+	case "bulk":
+		if value.Null {
+			return "(nil)"
+		}
+		return value.Bulk
+	case "integer":
+		return fmt.Sprintf("(integer) %d", value.Num)
+	case "error":
+		return fmt.Sprintf("(error) %s", value.Str)
+	case "array", "push", "map":
+		if value.Null {
+			return "(nil)"
+		}
+		result := "["
+		for i, v := range value.Array {
+			if i > 0 {
+				result += ", "
+			}
+			result += formatResponse(v)
+		}
+		return result + "]"
+	default:
+		return fmt.Sprintf("Unknown type: %s", value.Type)
+	}
+}
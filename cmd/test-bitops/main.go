@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"redis-learning/pkg/resp"
+)
+
+const (
+	offsetErr   = "(error) ERR bit offset is not an integer or out of range"
+	intErr      = "(error) ERR value is not an integer or out of range"
+	bitfieldErr = "(error) ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."
+)
+
+func main() {
+	fmt.Println("=== Testing Redis Bitmap Commands ===")
+
+	conn, err := net.Dial("tcp", "localhost:6379")
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	defer conn.Close()
+
+	writer, parser := resp.NewWriter(conn), resp.NewParser(conn)
+	fmt.Println("Connected to Redis server!")
+	fmt.Println()
+
+	// Test SETBIT and GETBIT, including growth and bad arguments
+	fmt.Println("Test 1: SETBIT and GETBIT")
+	run(writer, parser, []string{"DEL", "bits"})
+	expect(writer, parser, []string{"SETBIT", "bits", "7", "1"}, "(integer) 0")
+	expect(writer, parser, []string{"SETBIT", "bits", "7", "0"}, "(integer) 1")
+	expect(writer, parser, []string{"SETBIT", "bits", "1", "1"}, "(integer) 0")
+	expect(writer, parser, []string{"GET", "bits"}, "@")
+	expect(writer, parser, []string{"SETBIT", "bits", "100", "1"}, "(integer) 0")
+	expect(writer, parser, []string{"GETBIT", "bits", "100"}, "(integer) 1")
+	expect(writer, parser, []string{"GETBIT", "bits", "99"}, "(integer) 0")
+	expect(writer, parser, []string{"GETBIT", "bits", "100000"}, "(integer) 0")
+	expect(writer, parser, []string{"GETBIT", "nobits", "0"}, "(integer) 0")
+	expect(writer, parser, []string{"SETBIT", "bits", "4294967296", "1"}, offsetErr)
+	expect(writer, parser, []string{"SETBIT", "bits", "-1", "1"}, offsetErr)
+	expect(writer, parser, []string{"GETBIT", "bits", "abc"}, offsetErr)
+	expect(writer, parser, []string{"SETBIT", "bits", "0", "2"}, "(error) ERR bit is not an integer or out of range")
+	run(writer, parser, []string{"DEL", "list"})
+	run(writer, parser, []string{"RPUSH", "list", "a"})
+	expect(writer, parser, []string{"SETBIT", "list", "0", "1"}, "(error) WRONGTYPE Operation against a key holding the wrong kind of value")
+	fmt.Println()
+
+	// Test BITCOUNT with byte and bit ranges
+	fmt.Println("Test 2: BITCOUNT")
+	run(writer, parser, []string{"SET", "foo", "foobar"})
+	expect(writer, parser, []string{"BITCOUNT", "foo"}, "(integer) 26")
+	expect(writer, parser, []string{"BITCOUNT", "foo", "0", "0"}, "(integer) 4")
+	expect(writer, parser, []string{"BITCOUNT", "foo", "1", "1"}, "(integer) 6")
+	expect(writer, parser, []string{"BITCOUNT", "foo", "1", "1", "BYTE"}, "(integer) 6")
+	expect(writer, parser, []string{"BITCOUNT", "foo", "-2", "-1"}, "(integer) 7")
+	expect(writer, parser, []string{"BITCOUNT", "foo", "-100", "100"}, "(integer) 26")
+	expect(writer, parser, []string{"BITCOUNT", "foo", "5", "30", "BIT"}, "(integer) 17")
+	expect(writer, parser, []string{"BITCOUNT", "foo", "-8", "-1", "BIT"}, "(integer) 4")
+	expect(writer, parser, []string{"BITCOUNT", "foo", "3", "1"}, "(integer) 0")
+	expect(writer, parser, []string{"BITCOUNT", "nobits"}, "(integer) 0")
+	expect(writer, parser, []string{"BITCOUNT", "foo", "0"}, "(error) ERR syntax error")
+	expect(writer, parser, []string{"BITCOUNT", "foo", "0", "1", "WORD"}, "(error) ERR syntax error")
+	expect(writer, parser, []string{"BITCOUNT", "foo", "a", "1"}, intErr)
+	fmt.Println()
+
+	// Test BITPOS with byte and bit ranges
+	fmt.Println("Test 3: BITPOS")
+	run(writer, parser, []string{"SET", "pos", "\xff\xf0\x00"})
+	expect(writer, parser, []string{"BITPOS", "pos", "0"}, "(integer) 12")
+	run(writer, parser, []string{"SET", "pos", "\x00\xff\xf0"})
+	expect(writer, parser, []string{"BITPOS", "pos", "1", "0"}, "(integer) 8")
+	expect(writer, parser, []string{"BITPOS", "pos", "1", "2"}, "(integer) 16")
+	expect(writer, parser, []string{"BITPOS", "pos", "1", "2", "-1", "BYTE"}, "(integer) 16")
+	expect(writer, parser, []string{"BITPOS", "pos", "1", "7", "15", "BIT"}, "(integer) 8")
+	expect(writer, parser, []string{"BITPOS", "pos", "1", "7", "-3", "BIT"}, "(integer) 8")
+	expect(writer, parser, []string{"BITPOS", "pos", "0", "-1"}, "(integer) 20")
+	expect(writer, parser, []string{"BITPOS", "pos", "0", "-4", "-1", "BIT"}, "(integer) 20")
+	run(writer, parser, []string{"SET", "zeros", "\x00\x00\x00"})
+	expect(writer, parser, []string{"BITPOS", "zeros", "1"}, "(integer) -1")
+	expect(writer, parser, []string{"BITPOS", "nobits", "0"}, "(integer) 0")
+	expect(writer, parser, []string{"BITPOS", "nobits", "1"}, "(integer) -1")
+	expect(writer, parser, []string{"BITPOS", "pos", "2"}, "(error) ERR The bit argument must be 1 or 0.")
+	fmt.Println()
+
+	// Test BITPOS looking for a clear bit in a string of ones: without an
+	// end the string counts as padded with zeros
+	fmt.Println("Test 4: BITPOS on all ones")
+	run(writer, parser, []string{"SET", "ones", "\xff\xff\xff"})
+	expect(writer, parser, []string{"BITPOS", "ones", "0"}, "(integer) 24")
+	expect(writer, parser, []string{"BITPOS", "ones", "0", "0"}, "(integer) 24")
+	expect(writer, parser, []string{"BITPOS", "ones", "0", "1"}, "(integer) 24")
+	expect(writer, parser, []string{"BITPOS", "ones", "0", "0", "-1"}, "(integer) -1")
+	expect(writer, parser, []string{"BITPOS", "ones", "0", "0", "-1", "BIT"}, "(integer) -1")
+	expect(writer, parser, []string{"BITPOS", "ones", "1", "1"}, "(integer) 8")
+	fmt.Println()
+
+	// Test BITOP with operands of different lengths
+	fmt.Println("Test 5: BITOP AND, OR, XOR and NOT")
+	run(writer, parser, []string{"SET", "key1", "foobar"})
+	run(writer, parser, []string{"SET", "key2", "abcdef"})
+	expect(writer, parser, []string{"BITOP", "AND", "dest", "key1", "key2"}, "(integer) 6")
+	expect(writer, parser, []string{"GET", "dest"}, "`bc`ab")
+	run(writer, parser, []string{"SET", "long", "\xff\xff"})
+	run(writer, parser, []string{"SET", "short", "\x0f"})
+	expect(writer, parser, []string{"BITOP", "AND", "dest", "long", "short"}, "(integer) 2")
+	expect(writer, parser, []string{"GET", "dest"}, "\x0f\x00")
+	expect(writer, parser, []string{"BITOP", "OR", "dest", "short", "long"}, "(integer) 2")
+	expect(writer, parser, []string{"GET", "dest"}, "\xff\xff")
+	expect(writer, parser, []string{"BITOP", "XOR", "dest", "long", "short"}, "(integer) 2")
+	expect(writer, parser, []string{"GET", "dest"}, "\xf0\xff")
+	expect(writer, parser, []string{"BITOP", "XOR", "dest", "long", "short", "nobits"}, "(integer) 2")
+	expect(writer, parser, []string{"GET", "dest"}, "\xf0\xff")
+	expect(writer, parser, []string{"BITOP", "NOT", "dest", "short"}, "(integer) 1")
+	expect(writer, parser, []string{"GET", "dest"}, "\xf0")
+	expect(writer, parser, []string{"BITOP", "AND", "dest", "nobits", "nobits2"}, "(integer) 0")
+	expect(writer, parser, []string{"TYPE", "dest"}, "none")
+	expect(writer, parser, []string{"BITOP", "NOT", "dest", "long", "short"}, "(error) ERR BITOP NOT must be called with a single source key.")
+	expect(writer, parser, []string{"BITOP", "NAND", "dest", "long", "short"}, "(error) ERR syntax error")
+	expect(writer, parser, []string{"BITOP", "AND", "dest", "long", "list"}, "(error) WRONGTYPE Operation against a key holding the wrong kind of value")
+	fmt.Println()
+
+	// Test the operators comparing the first key with the others
+	fmt.Println("Test 6: BITOP DIFF, DIFF1, ANDOR and ONE")
+	run(writer, parser, []string{"SET", "x", "\xf0\xff"})
+	run(writer, parser, []string{"SET", "y1", "\x0f"})
+	run(writer, parser, []string{"SET", "y2", "\x30\x01\x80"})
+	expect(writer, parser, []string{"BITOP", "DIFF", "dest", "x", "y1", "y2"}, "(integer) 3")
+	expect(writer, parser, []string{"GET", "dest"}, "\xc0\xfe\x00")
+	expect(writer, parser, []string{"BITOP", "DIFF1", "dest", "x", "y1", "y2"}, "(integer) 3")
+	expect(writer, parser, []string{"GET", "dest"}, "\x0f\x00\x80")
+	expect(writer, parser, []string{"BITOP", "ANDOR", "dest", "x", "y1", "y2"}, "(integer) 3")
+	expect(writer, parser, []string{"GET", "dest"}, "\x30\x01\x00")
+	expect(writer, parser, []string{"BITOP", "ONE", "dest", "x", "y1", "y2"}, "(integer) 3")
+	expect(writer, parser, []string{"GET", "dest"}, "\xcf\xfe\x80")
+	expect(writer, parser, []string{"BITOP", "ONE", "dest", "x"}, "(integer) 2")
+	expect(writer, parser, []string{"GET", "dest"}, "\xf0\xff")
+	for _, op := range []string{"DIFF", "DIFF1", "ANDOR"} {
+		expect(writer, parser, []string{"BITOP", op, "dest", "x"}, "(error) ERR BITOP "+op+" must be called with at least two source keys.")
+	}
+	fmt.Println()
+
+	// Test BITFIELD overflow handling and # offsets
+	fmt.Println("Test 7: BITFIELD")
+	run(writer, parser, []string{"DEL", "bf"})
+	expect(writer, parser, []string{"BITFIELD", "bf", "INCRBY", "i5", "100", "1", "GET", "u4", "0"}, "[(integer) 1, (integer) 0]")
+	expect(writer, parser, []string{"BITFIELD", "bf", "SET", "i8", "#0", "100", "SET", "i8", "#1", "200"}, "[(integer) 0, (integer) 0]")
+	expect(writer, parser, []string{"BITFIELD", "bf", "GET", "i8", "#1", "GET", "u8", "#1", "GET", "u8", "8"}, "[(integer) -56, (integer) 200, (integer) 200]")
+	expect(writer, parser, []string{"BITFIELD", "bf", "SET", "i8", "0", "127", "INCRBY", "i8", "0", "1"}, "[(integer) 100, (integer) -128]")
+	expect(writer, parser, []string{"BITFIELD", "bf", "OVERFLOW", "WRAP", "INCRBY", "u8", "0", "200"}, "[(integer) 72]")
+	expect(writer, parser, []string{"BITFIELD", "bf", "SET", "i8", "0", "127", "OVERFLOW", "SAT", "INCRBY", "i8", "0", "1", "INCRBY", "i8", "0", "-300"}, "[(integer) 72, (integer) 127, (integer) -128]")
+	expect(writer, parser, []string{"BITFIELD", "bf", "OVERFLOW", "SAT", "SET", "u8", "0", "255", "INCRBY", "u8", "0", "-300"}, "[(integer) 128, (integer) 0]")
+	run(writer, parser, []string{"DEL", "bf"})
+	for _, want := range []string{"[(integer) 1, (integer) 1]", "[(integer) 2, (integer) 2]", "[(integer) 3, (integer) 3]", "[(integer) 0, (integer) 3]"} {
+		expect(writer, parser, []string{"BITFIELD", "bf", "INCRBY", "u2", "100", "1", "OVERFLOW", "SAT", "INCRBY", "u2", "102", "1"}, want)
+	}
+	expect(writer, parser, []string{"BITFIELD", "bf", "OVERFLOW", "FAIL", "INCRBY", "u2", "102", "1", "INCRBY", "u2", "100", "1"}, "[(nil), (integer) 1]")
+	expect(writer, parser, []string{"BITFIELD", "bf", "GET", "u2", "102"}, "[(integer) 3]")
+	expect(writer, parser, []string{"BITFIELD", "bf", "SET", "i64", "0", "-1", "GET", "i64", "0", "GET", "u63", "1"}, "[(integer) 0, (integer) -1, (integer) 9223372036854775807]")
+	expect(writer, parser, []string{"BITFIELD", "bf", "GET", "u64", "0"}, bitfieldErr)
+	expect(writer, parser, []string{"BITFIELD", "bf", "GET", "i65", "0"}, bitfieldErr)
+	expect(writer, parser, []string{"BITFIELD", "bf", "GET", "u8", "-1"}, offsetErr)
+	expect(writer, parser, []string{"BITFIELD", "bf", "OVERFLOW", "NONE", "GET", "u8", "0"}, "(error) ERR Invalid OVERFLOW type specified")
+	expect(writer, parser, []string{"BITFIELD", "bf", "SET", "u8", "0", "x"}, intErr)
+	expect(writer, parser, []string{"BITFIELD", "bf", "GET", "u8"}, "(error) ERR syntax error")
+	expect(writer, parser, []string{"BITFIELD", "nobits"}, "[]")
+	fmt.Println()
+
+	// Test BITFIELD_RO
+	fmt.Println("Test 8: BITFIELD_RO")
+	run(writer, parser, []string{"SET", "ro", "\x12\x34"})
+	expect(writer, parser, []string{"BITFIELD_RO", "ro", "GET", "u8", "#1", "GET", "u4", "4", "GET", "i16", "0"}, "[(integer) 52, (integer) 2, (integer) 4660]")
+	expect(writer, parser, []string{"BITFIELD_RO", "ro", "SET", "u8", "0", "1"}, "(error) ERR BITFIELD_RO only supports the GET subcommand")
+	expect(writer, parser, []string{"BITFIELD_RO", "ro", "INCRBY", "u8", "0", "1"}, "(error) ERR BITFIELD_RO only supports the GET subcommand")
+	expect(writer, parser, []string{"GET", "ro"}, "\x12\x34")
+	fmt.Println()
+
+	fmt.Println("=== All bitmap tests completed! ===")
+}
+
+func expect(writer *resp.Writer, parser *resp.Parser, args []string, want string) {
+	got := formatResponse(run(writer, parser, args))
+	status := "OK"
+	if got != want {
+		status = fmt.Sprintf("FAILED, want %q", want)
+	}
+	fmt.Printf("%q -> %q (%s)\n", args, got, status)
+}
+
+func run(writer *resp.Writer, parser *resp.Parser, args []string) resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+
+	if err := writer.Write(resp.NewArray(values)); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+
+	response, err := parser.Read()
+	if err != nil {
+		log.Fatalf("Error reading response: %v", err)
+	}
+	return response
+}
+
+func formatResponse(value resp.Value) string {
+	switch value.Type {
+	case "string":
+		return value.Str
+	case "bulk":
+		if value.Null {
+			return "(nil)"
+		}
+		return value.Bulk
+	case "integer":
+		return fmt.Sprintf("(integer) %d", value.Num)
+	case "error":
+		return fmt.Sprintf("(error) %s", value.Str)
+	case "array":
+		if value.Null {
+			return "(nil)"
+		}
+		result := "["
+		for i, v := range value.Array {
+			if i > 0 {
+				result += ", "
+			}
+			result += formatResponse(v)
+		}
+		return result + "]"
+	default:
+		return fmt.Sprintf("Unknown type: %s", value.Type)
+	}
+}
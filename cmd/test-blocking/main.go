@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"redis-learning/pkg/resp"
+)
+
+func main() {
+	fmt.Println("=== Testing Redis Blocking List Operations ===")
+
+	consumer := connect()
+	defer consumer.Close()
+	producer := connect()
+	defer producer.Close()
+
+	cw, cp := resp.NewWriter(consumer), resp.NewParser(consumer)
+	pw, pp := resp.NewWriter(producer), resp.NewParser(producer)
+	fmt.Println("Connected to Redis server!")
+	fmt.Println()
+
+	// Test BLPOP on a list that already has data
+	fmt.Println("Test 1: BLPOP with data available")
+	sendCommand(pw, pp, []string{"RPUSH", "jobs", "job1"})
+	sendCommand(cw, cp, []string{"BLPOP", "jobs", "0"})
+	fmt.Println()
+
+	// Test BLPOP timing out
+	fmt.Println("Test 2: BLPOP timeout")
+	start := time.Now()
+	sendCommand(cw, cp, []string{"BLPOP", "jobs", "0.2"})
+	fmt.Printf("Returned after %v\n", time.Since(start).Round(10*time.Millisecond))
+	fmt.Println()
+
+	// Test BRPOP woken up by a push from another connection
+	fmt.Println("Test 3: BRPOP woken by another client")
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		sendCommand(pw, pp, []string{"LPUSH", "other", "a", "b"})
+	}()
+	sendCommand(cw, cp, []string{"BRPOP", "jobs", "other", "5"})
+	fmt.Println()
+
+	// Test BLMOVE between two lists
+	fmt.Println("Test 4: BLMOVE")
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		sendCommand(pw, pp, []string{"RPUSH", "pending", "task"})
+	}()
+	sendCommand(cw, cp, []string{"BLMOVE", "pending", "processing", "LEFT", "RIGHT", "5"})
+	sendCommand(cw, cp, []string{"LLEN", "processing"})
+	fmt.Println()
+
+	// Test BLMPOP with COUNT
+	fmt.Println("Test 5: BLMPOP with COUNT")
+	sendCommand(pw, pp, []string{"RPUSH", "batch", "1", "2", "3"})
+	sendCommand(cw, cp, []string{"BLMPOP", "1", "2", "empty", "batch", "LEFT", "COUNT", "2"})
+	fmt.Println()
+
+	// Test error handling
+	fmt.Println("Test 6: Errors")
+	sendCommand(cw, cp, []string{"BLPOP", "jobs", "-1"})
+	sendCommand(cw, cp, []string{"BLPOP", "jobs", "abc"})
+	sendCommand(pw, pp, []string{"SET", "str", "value"})
+	sendCommand(cw, cp, []string{"BLPOP", "str", "1"})
+	sendCommand(cw, cp, []string{"LMPOP", "9223372036854775807", "batch", "LEFT"})
+	sendCommand(cw, cp, []string{"BLMPOP", "1", "9223372036854775807", "batch", "LEFT"})
+	sendCommand(cw, cp, []string{"LMPOP", "0", "batch", "LEFT"})
+	sendCommand(pw, pp, []string{"PING"})
+	fmt.Println()
+
+	fmt.Println("=== All blocking tests completed! ===")
+}
+
+func connect() net.Conn {
+	conn, err := net.Dial("tcp", "localhost:6379")
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	return conn
+}
+
+func sendCommand(writer *resp.Writer, parser *resp.Parser, args []string) {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+
+	if err := writer.Write(resp.NewArray(values)); err != nil {
+		log.Printf("Error sending command: %v", err)
+		return
+	}
+
+	response, err := parser.Read()
+	if err != nil {
+		log.Printf("Error reading response: %v", err)
+		return
+	}
+
+	fmt.Printf("%v -> %s\n", args, formatResponse(response))
+}
+
+func formatResponse(value resp.Value) string {
+	switch value.Type {
+	case "string":
+		return value.Str
+	case "bulk":
+		if value.Null {
+			return "(nil)"
+		}
+		return value.Bulk
+	case "integer":
+		return fmt.Sprintf("(integer) %d", value.Num)
+	case "error":
+		return fmt.Sprintf("(error) %s", value.Str)
+	case "array":
+		if value.Null {
+			return "(nil)"
+		}
+		result := "["
+		for i, v := range value.Array {
+			if i > 0 {
+				result += ", "
+			}
+			result += formatResponse(v)
+		}
+		return result + "]"
+	default:
+		return fmt.Sprintf("Unknown type: %s", value.Type)
+	}
+}
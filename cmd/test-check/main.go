@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"redis-learning/internal/server"
+	"redis-learning/pkg/redisserver"
+	"redis-learning/pkg/resp"
+)
+
+func main() {
+	fmt.Println("=== Testing check-rdb and check-aof ===")
+
+	dir, err := os.MkdirTemp("", "redis-check")
+	if err != nil {
+		log.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	aofDir := filepath.Join(dir, "appendonlydir")
+
+	// Write an RDB file and a log with a base and an incremental file
+	srv := redisserver.New("localhost", "6404")
+	for _, setting := range [][2]string{{"dir", dir}, {"save", ""}, {"appendonly", "yes"}} {
+		if err := srv.SetConfig(setting[0], setting[1]); err != nil {
+			log.Fatalf("Failed to configure server: %v", err)
+		}
+	}
+	go func() {
+		if err := srv.Start(); err != nil {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	conn, err := net.Dial("tcp", "localhost:6404")
+	if err != nil {
+		log.Fatalf("Failed to connect: %v", err)
+	}
+	writer, parser := resp.NewWriter(conn), resp.NewParser(conn)
+	for _, args := range [][]string{
+		{"SET", "s:1", "one"},
+		{"SET", "s:2", "two"},
+		{"RPUSH", "l:1", "a", "b", "c"},
+		{"XADD", "x:1", "1-1", "f", "v"},
+		{"FUNCTION", "LOAD", "#!lua name=checklib\nredis.register_function('f', function() return 1 end)"},
+		{"SAVE"},
+		{"BGREWRITEAOF"},
+	} {
+		send(writer, parser, args)
+	}
+	time.Sleep(200 * time.Millisecond)
+	send(writer, parser, []string{"SET", "s:3", "three"})
+	send(writer, parser, []string{"SHUTDOWN", "NOSAVE"})
+	fmt.Println()
+
+	fmt.Println("Test 1: A valid RDB file")
+	rdbPath := filepath.Join(dir, "dump.rdb")
+	fmt.Printf("valid: %v\n", server.CheckRDB(rdbPath, filtered{}) == nil)
+	fmt.Println()
+
+	fmt.Println("Test 2: A truncated RDB file")
+	data, err := os.ReadFile(rdbPath)
+	if err != nil {
+		log.Fatalf("Failed to read the RDB file: %v", err)
+	}
+	broken := filepath.Join(dir, "broken.rdb")
+	os.WriteFile(broken, data[:len(data)-20], 0644)
+	fmt.Printf("valid: %v\n", server.CheckRDB(broken, filtered{}) == nil)
+	fmt.Println()
+
+	fmt.Println("Test 3: A flipped byte fails the checksum")
+	data[len(data)-12] ^= 0xff
+	os.WriteFile(broken, data, 0644)
+	fmt.Printf("valid: %v\n", server.CheckRDB(broken, filtered{}) == nil)
+	fmt.Println()
+
+	fmt.Println("Test 4: A valid multi part AOF")
+	check, err := server.CheckAOF(aofDir, filtered{})
+	if err != nil {
+		log.Fatalf("Failed to check the AOF: %v", err)
+	}
+	fmt.Printf("valid: %v\n", check.Valid)
+	fmt.Println()
+
+	// The rewrite started a second incremental file
+	fmt.Println("Test 5: A truncated command at the end of the last file")
+	incrPath := filepath.Join(aofDir, "appendonly.aof.2.incr.aof")
+	appendTo(incrPath, "*3\r\n$3\r\nSET\r\n$3\r\ns:4\r\n$4\r\nfo")
+	check = checkAOF(aofDir)
+	fmt.Printf("valid: %v, fixable: %v, truncate from %d to %d\n",
+		check.Valid, check.Path == incrPath, check.Size, check.ValidUpTo)
+	os.Truncate(check.Path, check.ValidUpTo)
+	fmt.Printf("valid after truncating: %v\n", checkAOF(incrPath).Valid)
+	fmt.Println()
+
+	fmt.Println("Test 6: An unfinished transaction is dropped as a whole")
+	info, _ := os.Stat(incrPath)
+	appendTo(incrPath, "*1\r\n$5\r\nMULTI\r\n*2\r\n$3\r\nDEL\r\n$3\r\ns:1\r\n")
+	check = checkAOF(incrPath)
+	fmt.Printf("valid: %v, truncated back to the previous end: %v\n", check.Valid, check.ValidUpTo == info.Size())
+	os.Truncate(check.Path, check.ValidUpTo)
+	fmt.Println()
+
+	fmt.Println("Test 7: Garbage in the middle of a file")
+	appendTo(incrPath, "garbage\r\n*1\r\n$4\r\nPING\r\n")
+	check = checkAOF(incrPath)
+	fmt.Printf("valid: %v, fixable: %v\n", check.Valid, check.Path != "")
+	os.Truncate(check.Path, check.ValidUpTo)
+	fmt.Println()
+
+	fmt.Println("Test 8: A corrupt base file can't be fixed")
+	base := filepath.Join(aofDir, "appendonly.aof.1.base.rdb")
+	data, _ = os.ReadFile(base)
+	os.WriteFile(base, data[:len(data)/2], 0644)
+	check = checkAOF(aofDir)
+	fmt.Printf("valid: %v, fixable: %v\n", check.Valid, check.Path != "")
+	fmt.Println()
+
+	fmt.Println("=== All check tests completed! ===")
+}
+
+// filtered prints reports with the temporary directory masked
+type filtered struct{}
+
+func (filtered) Write(p []byte) (int, error) {
+	dir := filepath.Dir(os.TempDir() + "/")
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if line == "" {
+			continue
+		}
+		if i := strings.Index(line, dir); i >= 0 {
+			// Keep the file name only
+			end := strings.IndexAny(line[i:], ", \n")
+			if end < 0 {
+				end = len(line) - i
+			}
+			line = line[:i] + "<dir>/" + filepath.Base(line[i:i+end]) + line[i+end:]
+		}
+		if strings.Contains(line, "ctime") {
+			line = "[offset 41] AUX FIELD ctime = <time>\n"
+		}
+		fmt.Print("  " + line)
+	}
+	return len(p), nil
+}
+
+func checkAOF(path string) *server.AOFCheck {
+	check, err := server.CheckAOF(path, filtered{})
+	if err != nil {
+		log.Fatalf("Failed to check the AOF: %v", err)
+	}
+	return check
+}
+
+// appendTo appends raw bytes to a file
+func appendTo(path, data string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		log.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+func send(writer *resp.Writer, parser *resp.Parser, args []string) {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+	if err := writer.Write(resp.NewArray(values)); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	if args[0] == "SHUTDOWN" {
+		parser.Read()
+		return
+	}
+	if _, err := parser.Read(); err != nil {
+		log.Fatalf("Error reading response: %v", err)
+	}
+}
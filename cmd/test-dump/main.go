@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-learning/pkg/resp"
+)
+
+func main() {
+	fmt.Println("=== Testing Redis DUMP and RESTORE ===")
+
+	conn, err := net.Dial("tcp", "localhost:6379")
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	defer conn.Close()
+
+	writer, parser := resp.NewWriter(conn), resp.NewParser(conn)
+	fmt.Println("Connected to Redis server!")
+	fmt.Println()
+
+	for _, key := range []string{"d:string", "d:list", "d:geo", "d:hll", "d:stream", "d:copy", "d:ttl", "d:doc", "d:lzf"} {
+		run(writer, parser, []string{"DEL", key})
+	}
+
+	fmt.Println("Test 1: Every type survives a DUMP and RESTORE")
+	sendCommand(writer, parser, []string{"SET", "d:string", "hello"})
+	sendCommand(writer, parser, []string{"RPUSH", "d:list", "a", "b", "12345"})
+	sendCommand(writer, parser, []string{"GEOADD", "d:geo", "13.361389", "38.115556", "Palermo"})
+	sendCommand(writer, parser, []string{"PFADD", "d:hll", "a", "b", "c"})
+	sendCommand(writer, parser, []string{"XADD", "d:stream", "1-1", "name", "alice"})
+	sendCommand(writer, parser, []string{"XGROUP", "CREATE", "d:stream", "workers", "0"})
+	sendCommand(writer, parser, []string{"XREADGROUP", "GROUP", "workers", "w1", "STREAMS", "d:stream", ">"})
+	checks := map[string][]string{
+		"d:string": {"GET", "d:copy"},
+		"d:list":   {"RPOP", "d:copy"},
+		"d:geo":    {"GEOPOS", "d:copy", "Palermo"},
+		"d:hll":    {"PFCOUNT", "d:copy"},
+		"d:stream": {"XPENDING", "d:copy", "workers"},
+	}
+	for _, key := range []string{"d:string", "d:list", "d:geo", "d:hll", "d:stream"} {
+		payload := run(writer, parser, []string{"DUMP", key})
+		fmt.Printf("[DUMP %s] -> %d bytes\n", key, len(payload.Bulk))
+		sendCommand(writer, parser, []string{"RESTORE", "d:copy", "0", payload.Bulk, "REPLACE"})
+		sendCommand(writer, parser, []string{"TYPE", "d:copy"})
+		sendCommand(writer, parser, checks[key])
+	}
+	sendCommand(writer, parser, []string{"DUMP", "d:missing"})
+	fmt.Println()
+
+	fmt.Println("Test 2: Payloads of Redis itself are restored")
+	// DUMP of SET mykey 10, as shown in the Redis documentation
+	sendCommand(writer, parser, []string{"RESTORE", "d:doc", "0", "\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n"})
+	sendCommand(writer, parser, []string{"GET", "d:doc"})
+	fmt.Println()
+
+	fmt.Println("Test 3: Errors")
+	payload := run(writer, parser, []string{"DUMP", "d:string"}).Bulk
+	sendCommand(writer, parser, []string{"RESTORE", "d:copy", "0", payload})
+	corrupt := []byte(payload)
+	corrupt[2] ^= 0xff
+	sendCommand(writer, parser, []string{"RESTORE", "d:copy", "0", string(corrupt), "REPLACE"})
+	sendCommand(writer, parser, []string{"RESTORE", "d:copy", "-1", payload, "REPLACE"})
+	sendCommand(writer, parser, []string{"RESTORE", "d:copy", "abc", payload, "REPLACE"})
+	sendCommand(writer, parser, []string{"RESTORE", "d:copy", "0", payload, "REPLACE", "IDLETIME", "-1"})
+	sendCommand(writer, parser, []string{"RESTORE", "d:copy", "0", payload, "REPLACE", "FREQ", "256"})
+	sendCommand(writer, parser, []string{"RESTORE", "d:copy", "0", payload, "REPLACE", "IDLETIME", "10", "FREQ", "5"})
+	sendCommand(writer, parser, []string{"RESTORE", "d:copy", "0", payload, "REPLACE", "BOGUS"})
+	sendCommand(writer, parser, []string{"RESTORE", "d:copy", "0", "not a payload", "REPLACE"})
+	sendCommand(writer, parser, []string{"RESTORE", "d:copy", "0", payload, "REPLACE", "IDLETIME", "10"})
+	sendCommand(writer, parser, []string{"RESTORE", "d:copy", "0", payload, "REPLACE", "FREQ", "5"})
+	fmt.Println()
+
+	fmt.Println("Test 4: Expiry")
+	sendCommand(writer, parser, []string{"RESTORE", "d:ttl", "100", payload})
+	sendCommand(writer, parser, []string{"GET", "d:ttl"})
+	time.Sleep(200 * time.Millisecond)
+	sendCommand(writer, parser, []string{"GET", "d:ttl"})
+	past := strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10)
+	sendCommand(writer, parser, []string{"RESTORE", "d:ttl", past, payload, "ABSTTL"})
+	sendCommand(writer, parser, []string{"TYPE", "d:ttl"})
+	// Restoring an expired key over another one just deletes it
+	sendCommand(writer, parser, []string{"RESTORE", "d:copy", past, payload, "ABSTTL", "REPLACE"})
+	sendCommand(writer, parser, []string{"TYPE", "d:copy"})
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	sendCommand(writer, parser, []string{"RESTORE", "d:ttl", future, payload, "ABSTTL"})
+	sendCommand(writer, parser, []string{"GET", "d:ttl"})
+	fmt.Println()
+
+	fmt.Println("Test 5: Compressed strings")
+	// 100 times "a" compressed with LZF, as Redis dumps long strings: a
+	// literal "a" and a back reference repeating it
+	sendCommand(writer, parser, []string{"RESTORE", "d:lzf", "0", "\x00\xc3\x05@d\x00a\xe0Z\x00\x09\x00\xa1\x90\xf5\x7f\x81\x9c;\xf0"})
+	value := run(writer, parser, []string{"GET", "d:lzf"})
+	fmt.Printf("[GET d:lzf] -> 100 times \"a\": %v\n", value.Bulk == strings.Repeat("a", 100))
+	// The same data claiming to expand to 1000 bytes, more than 5 bytes of
+	// LZF can, and to 4GiB, over the 512MB limit on strings
+	sendCommand(writer, parser, []string{"RESTORE", "d:lzf", "0", "\x00\xc3\x05C\xe8\x00a\xe0Z\x00\x09\x00\xefZ\x0f \x8bs$\xeb", "REPLACE"})
+	sendCommand(writer, parser, []string{"RESTORE", "d:lzf", "0", "\x00\xc3\x05\x80\xff\xff\xff\xff\x00a\xe0Z\x00\x09\x00 #\x7f\xbc&O\x9a\x83", "REPLACE"})
+	// A back reference to before the start of the data
+	sendCommand(writer, parser, []string{"RESTORE", "d:lzf", "0", "\x00\xc3\x03@d\xe0Z\x00\x09\x00R\x81\xcd\x9c\xa9\xe1\xf6K", "REPLACE"})
+	value = run(writer, parser, []string{"GET", "d:lzf"})
+	fmt.Printf("[GET d:lzf] -> unchanged: %v\n", value.Bulk == strings.Repeat("a", 100))
+	fmt.Println()
+
+	fmt.Println("=== All DUMP and RESTORE tests completed! ===")
+}
+
+func run(writer *resp.Writer, parser *resp.Parser, args []string) resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+
+	if err := writer.Write(resp.NewArray(values)); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+
+	response, err := parser.Read()
+	if err != nil {
+		log.Fatalf("Error reading response: %v", err)
+	}
+	return response
+}
+
+// sendCommand runs a command and prints the exchange, with binary payloads
+// shown by their size
+func sendCommand(writer *resp.Writer, parser *resp.Parser, args []string) {
+	printed := make([]string, len(args))
+	for i, arg := range args {
+		printed[i] = arg
+		if strconv.Quote(arg) != `"`+arg+`"` {
+			printed[i] = fmt.Sprintf("<%d byte payload>", len(arg))
+		}
+	}
+	fmt.Printf("%v -> %s\n", printed, formatResponse(run(writer, parser, args)))
+}
+
+func formatResponse(value resp.Value) string {
+	switch value.Type {
+	case "string":
+		return value.Str
+	case "bulk":
+		if value.Null {
+			return "(nil)"
+		}
+		return value.Bulk
+	case "integer":
+		return fmt.Sprintf("(integer) %d", value.Num)
+	case "error":
+		return fmt.Sprintf("(error) %s", value.Str)
+	case "array":
+		if value.Null {
+			return "(nil)"
+		}
+		result := "["
+		for i, v := range value.Array {
+			if i > 0 {
+				result += ", "
+			}
+			result += formatResponse(v)
+		}
+		return result + "]"
+	default:
+		return fmt.Sprintf("Unknown type: %s", value.Type)
+	}
+}
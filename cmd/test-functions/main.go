@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"redis-learning/pkg/resp"
+)
+
+const counterLib = `#!lua name=counters
+local function incr_by(keys, args)
+  local current = tonumber(redis.call('GET', keys[1]) or '0')
+  local updated = current + tonumber(args[1])
+  redis.call('SET', keys[1], tostring(updated))
+  return updated
+end
+
+redis.register_function('incr_by', incr_by)
+redis.register_function{
+  function_name = 'peek',
+  callback = function(keys) return redis.call('GET', keys[1]) end,
+  flags = {'no-writes'},
+  description = 'Reads a counter',
+}
+`
+
+func main() {
+	fmt.Println("=== Testing Redis Functions ===")
+
+	conn, err := net.Dial("tcp", "localhost:6379")
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	defer conn.Close()
+
+	writer, parser := resp.NewWriter(conn), resp.NewParser(conn)
+	fmt.Println("Connected to Redis server!")
+	fmt.Println()
+
+	sendCommand(writer, parser, []string{"FUNCTION", "FLUSH"})
+	sendCommand(writer, parser, []string{"DEL", "fn:counter"})
+	fmt.Println()
+
+	fmt.Println("Test 1: FUNCTION LOAD and FCALL")
+	sendCommand(writer, parser, []string{"FUNCTION", "LOAD", counterLib})
+	sendCommand(writer, parser, []string{"FCALL", "incr_by", "1", "fn:counter", "5"})
+	sendCommand(writer, parser, []string{"FCALL", "incr_by", "1", "fn:counter", "2"})
+	sendCommand(writer, parser, []string{"FCALL", "nosuchfunction", "0"})
+	sendCommand(writer, parser, []string{"FUNCTION", "LOAD", counterLib})
+	sendCommand(writer, parser, []string{"FUNCTION", "LOAD", "REPLACE", counterLib})
+	fmt.Println()
+
+	fmt.Println("Test 2: FCALL_RO and no-writes")
+	sendCommand(writer, parser, []string{"FCALL_RO", "peek", "1", "fn:counter"})
+	sendCommand(writer, parser, []string{"FCALL_RO", "incr_by", "1", "fn:counter", "1"})
+	sendCommand(writer, parser, []string{"FUNCTION", "LOAD", "#!lua name=bad\nredis.register_function{function_name='sneaky', callback=function(keys) return redis.call('DEL', keys[1]) end, flags={'no-writes'}}"})
+	sendCommand(writer, parser, []string{"FCALL", "sneaky", "1", "fn:counter"})
+	fmt.Println()
+
+	fmt.Println("Test 3: Load errors")
+	sendCommand(writer, parser, []string{"FUNCTION", "LOAD", "return 1"})
+	sendCommand(writer, parser, []string{"FUNCTION", "LOAD", "#!lua name=empty\nlocal x = 1"})
+	sendCommand(writer, parser, []string{"FUNCTION", "LOAD", "#!lua name=clash\nredis.register_function('peek', function() return 1 end)"})
+	sendCommand(writer, parser, []string{"FUNCTION", "LOAD", "#!lua name=calls\nredis.call('PING')"})
+	sendCommand(writer, parser, []string{"FUNCTION", "LOAD", "#!lua name=spin\nwhile true do end"})
+	fmt.Println()
+
+	fmt.Println("Test 4: FUNCTION LIST and STATS")
+	sendCommand(writer, parser, []string{"FUNCTION", "LIST"})
+	sendCommand(writer, parser, []string{"FUNCTION", "LIST", "LIBRARYNAME", "count*"})
+	sendCommand(writer, parser, []string{"FUNCTION", "STATS"})
+	fmt.Println()
+
+	fmt.Println("Test 5: FUNCTION DUMP, DELETE and RESTORE")
+	// The payload is binary, so only its size is shown
+	if err := writer.Write(commandValue([]string{"FUNCTION", "DUMP"})); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	response, err := parser.Read()
+	if err != nil {
+		log.Fatalf("Error reading response: %v", err)
+	}
+	dump := response.Bulk
+	fmt.Printf("[FUNCTION DUMP] -> %d bytes\n", len(dump))
+	sendCommand(writer, parser, []string{"FUNCTION", "DELETE", "counters"})
+	sendCommand(writer, parser, []string{"FUNCTION", "DELETE", "counters"})
+	sendCommand(writer, parser, []string{"FCALL", "peek", "1", "fn:counter"})
+	sendCommandAs(writer, parser, "[FUNCTION RESTORE <dump>]", []string{"FUNCTION", "RESTORE", dump})
+	sendCommandAs(writer, parser, "[FUNCTION RESTORE <dump> FLUSH]", []string{"FUNCTION", "RESTORE", dump, "FLUSH"})
+	sendCommand(writer, parser, []string{"FCALL", "peek", "1", "fn:counter"})
+	sendCommand(writer, parser, []string{"FUNCTION", "RESTORE", "garbage"})
+	fmt.Println()
+
+	fmt.Println("=== All function tests completed! ===")
+}
+
+func commandValue(args []string) resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+	return resp.NewArray(values)
+}
+
+func sendCommand(writer *resp.Writer, parser *resp.Parser, args []string) resp.Value {
+	return sendCommandAs(writer, parser, fmt.Sprint(args), args)
+}
+
+// sendCommandAs prints label in place of the arguments, which may be binary
+func sendCommandAs(writer *resp.Writer, parser *resp.Parser, label string, args []string) resp.Value {
+	if err := writer.Write(commandValue(args)); err != nil {
+		log.Printf("Error sending command: %v", err)
+		return resp.Value{}
+	}
+
+	response, err := parser.Read()
+	if err != nil {
+		log.Printf("Error reading response: %v", err)
+		return resp.Value{}
+	}
+
+	fmt.Printf("%s -> %s\n", label, formatResponse(response))
+	return response
+}
+
+func formatResponse(value resp.Value) string {
+	switch value.Type {
+	case "string":
+		return value.Str
+	case "bulk":
+		if value.Null {
+			return "(nil)"
+		}
+		return value.Bulk
+	case "integer":
+		return fmt.Sprintf("(integer) %d", value.Num)
+	case "error":
+		return fmt.Sprintf("(error) %s", value.Str)
+	case "array", "push":
+		if value.Null {
+			return "(nil)"
+		}
+		result := "["
+		for i, v := range value.Array {
+			if i > 0 {
+				result += ", "
+			}
+			result += formatResponse(v)
+		}
+		return result + "]"
+	default:
+		return fmt.Sprintf("Unknown type: %s", value.Type)
+	}
+}
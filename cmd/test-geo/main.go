@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net"
+
+	"redis-learning/pkg/resp"
+)
+
+// The expected replies are what Redis returns for the same commands
+const (
+	palermoPos = "[13.36138933897018433, 38.11555639549629859]"
+	cataniaPos = "[15.08726745843887329, 37.50266842333162032]"
+	edge1Pos   = "[12.7584877610206604, 38.78813451624225195]"
+	edge2Pos   = "[17.24151045083999634, 38.78813451624225195]"
+)
+
+func main() {
+	fmt.Println("=== Testing Redis Geospatial Commands ===")
+
+	conn, err := net.Dial("tcp", "localhost:6379")
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	defer conn.Close()
+
+	writer, parser := resp.NewWriter(conn), resp.NewParser(conn)
+	fmt.Println("Connected to Redis server!")
+	fmt.Println()
+
+	// Test GEOADD and its NX, XX and CH options
+	fmt.Println("Test 1: GEOADD")
+	run(writer, parser, []string{"DEL", "Sicily"})
+	expect(writer, parser, []string{"GEOADD", "Sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania"}, "(integer) 2")
+	expect(writer, parser, []string{"GEOADD", "Sicily", "NX", "13.361389", "38.115556", "Palermo", "13.583333", "37.316667", "Agrigento"}, "(integer) 1")
+	expect(writer, parser, []string{"GEOADD", "Sicily", "XX", "13.5", "37.3", "Agrigento", "14", "38", "Cefalu"}, "(integer) 0")
+	expect(writer, parser, []string{"GEOPOS", "Sicily", "Cefalu"}, "[(nil)]")
+	expect(writer, parser, []string{"GEOADD", "Sicily", "XX", "CH", "13.583333", "37.316667", "Agrigento", "14", "38", "Cefalu"}, "(integer) 1")
+	expect(writer, parser, []string{"GEOADD", "Sicily", "CH", "13.583333", "37.316667", "Agrigento"}, "(integer) 0")
+	expect(writer, parser, []string{"GEOADD", "Sicily", "NX", "XX", "13", "38", "x"}, "(error) ERR XX and NX options at the same time are not compatible")
+	expect(writer, parser, []string{"GEOADD", "Sicily", "13", "86", "x"}, "(error) ERR invalid longitude,latitude pair 13.000000,86.000000")
+	run(writer, parser, []string{"DEL", "Sicily"})
+	run(writer, parser, []string{"GEOADD", "Sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania"})
+	fmt.Println()
+
+	// Test GEOPOS, GEODIST and GEOHASH against the Redis replies
+	fmt.Println("Test 2: GEOPOS, GEODIST and GEOHASH")
+	expect(writer, parser, []string{"GEOPOS", "Sicily", "Palermo", "Catania", "NonExisting"}, "["+palermoPos+", "+cataniaPos+", (nil)]")
+	expect(writer, parser, []string{"GEODIST", "Sicily", "Palermo", "Catania"}, "166274.1516")
+	expect(writer, parser, []string{"GEODIST", "Sicily", "Palermo", "Catania", "m"}, "166274.1516")
+	expect(writer, parser, []string{"GEODIST", "Sicily", "Palermo", "Catania", "km"}, "166.2742")
+	expect(writer, parser, []string{"GEODIST", "Sicily", "Palermo", "Catania", "mi"}, "103.3182")
+	expect(writer, parser, []string{"GEODIST", "Sicily", "Palermo", "Catania", "ft"}, "545518.8700")
+	expect(writer, parser, []string{"GEODIST", "Sicily", "Palermo", "NonExisting"}, "(nil)")
+	expect(writer, parser, []string{"GEODIST", "Sicily", "Palermo", "Catania", "yd"}, "(error) ERR unsupported unit provided. please use M, KM, FT, MI")
+	expect(writer, parser, []string{"GEOHASH", "Sicily", "Palermo", "Catania", "NonExisting"}, "[sqc8b49rny0, sqdtr74hyu0, (nil)]")
+	fmt.Println()
+
+	// Test GEOSEARCH with both centers, both shapes and every reply option
+	fmt.Println("Test 3: GEOSEARCH")
+	run(writer, parser, []string{"GEOADD", "Sicily", "12.758489", "38.788135", "edge1", "17.241510", "38.788135", "edge2"})
+	expect(writer, parser, []string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC"}, "[Catania, Palermo]")
+	expect(writer, parser, []string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "DESC", "WITHDIST"},
+		"[[Palermo, 190.4424], [Catania, 56.4413]]")
+	expect(writer, parser, []string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC", "WITHHASH"},
+		"[[Catania, (integer) 3479447370796909], [Palermo, (integer) 3479099956230698]]")
+	expect(writer, parser, []string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC", "WITHCOORD", "WITHDIST"},
+		"[[Catania, 56.4413, "+cataniaPos+"], [Palermo, 190.4424, "+palermoPos+"], [edge2, 279.7403, "+edge2Pos+"], [edge1, 279.7405, "+edge1Pos+"]]")
+	expect(writer, parser, []string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC", "WITHCOORD", "WITHDIST", "WITHHASH"},
+		"[[Catania, 56.4413, (integer) 3479447370796909, "+cataniaPos+"], [Palermo, 190.4424, (integer) 3479099956230698, "+palermoPos+"], "+
+			"[edge2, 279.7403, (integer) 3481342659049484, "+edge2Pos+"], [edge1, 279.7405, (integer) 3479273021651468, "+edge1Pos+"]]")
+	expect(writer, parser, []string{"GEOSEARCH", "Sicily", "FROMMEMBER", "Palermo", "BYRADIUS", "200", "km", "ASC", "WITHDIST"},
+		"[[Palermo, 0.0000], [edge1, 91.4007], [Catania, 166.2742]]")
+	expect(writer, parser, []string{"GEOSEARCH", "Sicily", "FROMMEMBER", "Palermo", "BYBOX", "200", "200", "km", "DESC"}, "[edge1, Palermo]")
+	expect(writer, parser, []string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC", "COUNT", "2"}, "[Catania, Palermo]")
+	anyReply := run(writer, parser, []string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "COUNT", "1", "ANY"})
+	check("COUNT 1 ANY returns one member", len(anyReply.Array) == 1)
+	expect(writer, parser, []string{"GEOSEARCH", "Sicily", "FROMMEMBER", "NonExisting", "BYRADIUS", "200", "km"}, "(error) ERR could not decode requested zset member")
+	expect(writer, parser, []string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "COUNT", "0"}, "(error) ERR COUNT must be > 0")
+	expect(writer, parser, []string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "COUNT", "1"}, "(error) ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH")
+	expect(writer, parser, []string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ANY"}, "(error) ERR the ANY argument requires COUNT argument")
+	expect(writer, parser, []string{"GEOSEARCH", "NonExisting", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km"}, "[]")
+	fmt.Println()
+
+	// Test GEOSEARCHSTORE with geohash and distance scores
+	fmt.Println("Test 4: GEOSEARCHSTORE")
+	run(writer, parser, []string{"DEL", "near"})
+	expect(writer, parser, []string{"GEOSEARCHSTORE", "near", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC"}, "(integer) 2")
+	expect(writer, parser, []string{"GEOPOS", "near", "Palermo", "Catania"}, "["+palermoPos+", "+cataniaPos+"]")
+	expect(writer, parser, []string{"GEOSEARCHSTORE", "near", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC", "COUNT", "1", "STOREDIST"}, "(integer) 1")
+	scores := zsetScores(run(writer, parser, []string{"DUMP", "near"}).Bulk)
+	check("STOREDIST keeps only Catania", len(scores) == 1)
+	check("STOREDIST score is the distance in km", math.Abs(scores["Catania"]-56.4413) < 0.0001)
+	expect(writer, parser, []string{"GEOSEARCHSTORE", "near", "Sicily", "FROMLONLAT", "0", "0", "BYRADIUS", "1", "km"}, "(integer) 0")
+	expect(writer, parser, []string{"TYPE", "near"}, "none")
+	expect(writer, parser, []string{"GEOSEARCHSTORE", "near", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "WITHDIST"}, "(error) ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+	expect(writer, parser, []string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "STOREDIST"}, "(error) ERR syntax error")
+	fmt.Println()
+
+	fmt.Println("=== All geospatial tests completed! ===")
+}
+
+// zsetScores reads the members and scores out of a DUMP of a small sorted set
+func zsetScores(payload string) map[string]float64 {
+	scores := make(map[string]float64)
+	data := []byte(payload)
+	if len(data) < 2 || data[0] != 5 {
+		return scores
+	}
+	count, pos := int(data[1]), 2
+	for i := 0; i < count && pos < len(data); i++ {
+		n := int(data[pos])
+		member := string(data[pos+1 : pos+1+n])
+		pos += 1 + n
+		scores[member] = math.Float64frombits(binary.LittleEndian.Uint64(data[pos:]))
+		pos += 8
+	}
+	return scores
+}
+
+func expect(writer *resp.Writer, parser *resp.Parser, args []string, want string) {
+	got := formatResponse(run(writer, parser, args))
+	status := "OK"
+	if got != want {
+		status = fmt.Sprintf("FAILED, want %s", want)
+	}
+	fmt.Printf("%v -> %s (%s)\n", args, got, status)
+}
+
+func check(what string, ok bool) {
+	status := "OK"
+	if !ok {
+		status = "FAILED"
+	}
+	fmt.Printf("%s (%s)\n", what, status)
+}
+
+func run(writer *resp.Writer, parser *resp.Parser, args []string) resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+
+	if err := writer.Write(resp.NewArray(values)); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+
+	response, err := parser.Read()
+	if err != nil {
+		log.Fatalf("Error reading response: %v", err)
+	}
+	return response
+}
+
+func formatResponse(value resp.Value) string {
+	switch value.Type {
+	case "string":
+		return value.Str
+	case "bulk":
+		if value.Null {
+			return "(nil)"
+		}
+		return value.Bulk
+	case "integer":
+		return fmt.Sprintf("(integer) %d", value.Num)
+	case "error":
+		return fmt.Sprintf("(error) %s", value.Str)
+	case "array":
+		if value.Null {
+			return "(nil)"
+		}
+		result := "["
+		for i, v := range value.Array {
+			if i > 0 {
+				result += ", "
+			}
+			result += formatResponse(v)
+		}
+		return result + "]"
+	default:
+		return fmt.Sprintf("Unknown type: %s", value.Type)
+	}
+}
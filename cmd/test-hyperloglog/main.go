@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+
+	"redis-learning/pkg/resp"
+)
+
+func main() {
+	fmt.Println("=== Testing Redis HyperLogLog ===")
+
+	conn, err := net.Dial("tcp", "localhost:6379")
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	defer conn.Close()
+
+	writer, parser := resp.NewWriter(conn), resp.NewParser(conn)
+	fmt.Println("Connected to Redis server!")
+	fmt.Println()
+
+	// Test PFADD and PFCOUNT on a small set
+	fmt.Println("Test 1: PFADD and PFCOUNT")
+	sendCommand(writer, parser, []string{"DEL", "hll"})
+	sendCommand(writer, parser, []string{"PFADD", "hll", "a", "b", "c", "d", "e", "f", "g"})
+	sendCommand(writer, parser, []string{"PFADD", "hll", "a"})
+	sendCommand(writer, parser, []string{"PFCOUNT", "hll"})
+	sendCommand(writer, parser, []string{"PFDEBUG", "ENCODING", "hll"})
+	fmt.Println()
+
+	// Test that the estimation error stays within the expected bounds. The
+	// standard error with 16384 registers is 1.04/sqrt(16384) = 0.81%.
+	fmt.Println("Test 2: Error bounds")
+	maxErr := 3 * 1.04 / math.Sqrt(16384)
+	added := 0
+	for _, card := range []int{100, 1000, 10000, 100000} {
+		key := fmt.Sprintf("visitors:%d", card)
+		run(writer, parser, []string{"DEL", key})
+		for added = 0; added < card; {
+			batch := []string{"PFADD", key}
+			for i := 0; i < 1000 && added < card; i++ {
+				batch = append(batch, fmt.Sprintf("user:%d", added))
+				added++
+			}
+			run(writer, parser, batch)
+		}
+
+		estimate := run(writer, parser, []string{"PFCOUNT", key}).Num
+		relErr := math.Abs(float64(estimate-card)) / float64(card)
+		status := "OK"
+		if relErr > maxErr {
+			status = "FAILED"
+		}
+		fmt.Printf("cardinality %d -> estimate %d, error %.3f%% (%s)\n", card, estimate, relErr*100, status)
+	}
+	fmt.Println()
+
+	// Test PFMERGE and multi-key PFCOUNT
+	fmt.Println("Test 3: PFMERGE")
+	sendCommand(writer, parser, []string{"DEL", "hll2"})
+	sendCommand(writer, parser, []string{"DEL", "merged"})
+	sendCommand(writer, parser, []string{"PFADD", "hll2", "foo", "bar", "zap", "a"})
+	sendCommand(writer, parser, []string{"PFCOUNT", "hll", "hll2"})
+	sendCommand(writer, parser, []string{"PFMERGE", "merged", "hll", "hll2"})
+	sendCommand(writer, parser, []string{"PFCOUNT", "merged"})
+	fmt.Println()
+
+	// Test that the raw registers survive GET and SET
+	fmt.Println("Test 4: GET/SET round trip")
+	raw := run(writer, parser, []string{"GET", "visitors:1000"}).Bulk
+	fmt.Printf("GET visitors:1000 -> %d bytes\n", len(raw))
+	sendCommand(writer, parser, []string{"DEL", "copy"})
+	run(writer, parser, []string{"SET", "copy", raw})
+	sendCommand(writer, parser, []string{"PFCOUNT", "copy"})
+	fmt.Println()
+
+	// Test error handling
+	fmt.Println("Test 5: Errors and self test")
+	sendCommand(writer, parser, []string{"SET", "notahll", "value"})
+	sendCommand(writer, parser, []string{"PFADD", "notahll", "x"})
+	sendCommand(writer, parser, []string{"PFSELFTEST"})
+	fmt.Println()
+
+	fmt.Println("=== All HyperLogLog tests completed! ===")
+}
+
+func run(writer *resp.Writer, parser *resp.Parser, args []string) resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+
+	if err := writer.Write(resp.NewArray(values)); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+
+	response, err := parser.Read()
+	if err != nil {
+		log.Fatalf("Error reading response: %v", err)
+	}
+	return response
+}
+
+func sendCommand(writer *resp.Writer, parser *resp.Parser, args []string) {
+	fmt.Printf("%v -> %s\n", args, formatResponse(run(writer, parser, args)))
+}
+
+func formatResponse(value resp.Value) string {
+	switch value.Type {
+	case "string":
+		return value.Str
+	case "bulk":
+		if value.Null {
+			return "(nil)"
+		}
+		return value.Bulk
+	case "integer":
+		return fmt.Sprintf("(integer) %d", value.Num)
+	case "error":
+		return fmt.Sprintf("(error) %s", value.Str)
+	case "array":
+		if value.Null {
+			return "(nil)"
+		}
+		result := "["
+		for i, v := range value.Array {
+			if i > 0 {
+				result += ", "
+			}
+			result += formatResponse(v)
+		}
+		return result + "]"
+	default:
+		return fmt.Sprintf("Unknown type: %s", value.Type)
+	}
+}
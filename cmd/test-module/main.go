@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-learning/pkg/module"
+	"redis-learning/pkg/redisserver"
+	"redis-learning/pkg/resp"
+)
+
+// counterType is a module type holding a single int64. Type names are
+// always 9 characters long.
+var counterType = &module.Type{
+	Name:            "gocounter",
+	EncodingVersion: 1,
+	Save: func(value any) []byte {
+		return binary.BigEndian.AppendUint64(nil, uint64(value.(int64)))
+	},
+	Load: func(data []byte, encodingVersion int) (any, error) {
+		if len(data) != 8 {
+			return nil, errors.New("bad counter encoding")
+		}
+		return int64(binary.BigEndian.Uint64(data)), nil
+	},
+}
+
+func init() {
+	module.MustRegisterType(counterType)
+	module.MustRegisterCommand(module.Command{
+		Name:    "COUNTER.INCRBY",
+		Arity:   3,
+		Flags:   module.Write,
+		Keys:    module.KeySpec{FirstKey: 1, LastKey: 1, Step: 1},
+		Handler: counterIncrBy,
+	})
+	module.MustRegisterCommand(module.Command{
+		Name:    "COUNTER.GET",
+		Arity:   2,
+		Keys:    module.KeySpec{FirstKey: 1, LastKey: 1, Step: 1},
+		Handler: counterGet,
+	})
+	// Not flagged as a write, so that on a replica only the checks of Call
+	// stop the SET it runs
+	module.MustRegisterCommand(module.Command{
+		Name:    "COUNTER.SAVEAS",
+		Arity:   3,
+		Keys:    module.KeySpec{FirstKey: 1, LastKey: 2, Step: 1},
+		Handler: counterSaveAs,
+	})
+	module.MustRegisterCommand(module.Command{
+		Name:    "COUNTER.CASHOUT",
+		Arity:   3,
+		Flags:   module.Write,
+		Keys:    module.KeySpec{FirstKey: 1, LastKey: 2, Step: 1},
+		Handler: counterCashOut,
+	})
+}
+
+func counterIncrBy(ctx module.Context, args []string) resp.Value {
+	delta, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return resp.NewError("ERR value is not an integer or out of range")
+	}
+	value, _, err := ctx.GetValue(args[0], counterType)
+	if err != nil {
+		return resp.NewError(err.Error())
+	}
+	current, _ := value.(int64)
+	ctx.SetValue(args[0], counterType, current+delta)
+	ctx.NotifyKeyspaceEvent("counter.incrby", args[0])
+	return resp.NewInteger(int(current + delta))
+}
+
+func counterGet(ctx module.Context, args []string) resp.Value {
+	value, exists, err := ctx.GetValue(args[0], counterType)
+	if err != nil {
+		return resp.NewError(err.Error())
+	}
+	if !exists {
+		return resp.NewNullBulkString()
+	}
+	return resp.NewInteger(int(value.(int64)))
+}
+
+func counterSaveAs(ctx module.Context, args []string) resp.Value {
+	value, exists, err := ctx.GetValue(args[0], counterType)
+	if err != nil {
+		return resp.NewError(err.Error())
+	}
+	if !exists {
+		return resp.NewNullBulkString()
+	}
+	return ctx.Call("SET", args[1], strconv.FormatInt(value.(int64), 10))
+}
+
+// counterCashOut moves a counter into a string key
+func counterCashOut(ctx module.Context, args []string) resp.Value {
+	value, exists, err := ctx.GetValue(args[0], counterType)
+	if err != nil {
+		return resp.NewError(err.Error())
+	}
+	if !exists {
+		return resp.NewNullBulkString()
+	}
+	ctx.Set(args[1], strconv.FormatInt(value.(int64), 10))
+	ctx.Delete(args[0])
+	return resp.NewSimpleString("OK")
+}
+
+func main() {
+	fmt.Println("=== Testing Go Modules ===")
+
+	// The server runs in-process, with the module registered above
+	dir, err := os.MkdirTemp("", "redis-module")
+	if err != nil {
+		log.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv, writer, parser := startServer(filepath.Join(dir, "master"), "6390", nil)
+	defer srv.Stop()
+	fmt.Println("Connected to Redis server!")
+	fmt.Println()
+
+	fmt.Println("Test 1: Module commands")
+	sendCommand(writer, parser, []string{"COUNTER.INCRBY", "visits", "5"})
+	sendCommand(writer, parser, []string{"counter.incrby", "visits", "2"})
+	sendCommand(writer, parser, []string{"COUNTER.GET", "visits"})
+	sendCommand(writer, parser, []string{"COUNTER.GET", "missing"})
+	sendCommand(writer, parser, []string{"TYPE", "visits"})
+	sendCommand(writer, parser, []string{"COUNTER.INCRBY", "visits"})
+	fmt.Println()
+
+	fmt.Println("Test 2: Type checks")
+	sendCommand(writer, parser, []string{"SET", "plain", "x"})
+	sendCommand(writer, parser, []string{"COUNTER.GET", "plain"})
+	sendCommand(writer, parser, []string{"GET", "visits"})
+	fmt.Println()
+
+	fmt.Println("Test 3: Transactions and scripts")
+	sendCommand(writer, parser, []string{"MULTI"})
+	sendCommand(writer, parser, []string{"COUNTER.INCRBY", "visits", "1"})
+	sendCommand(writer, parser, []string{"COUNTER.GET", "visits"})
+	sendCommand(writer, parser, []string{"EXEC"})
+	sendCommand(writer, parser, []string{"EVAL", "return redis.call('COUNTER.INCRBY', KEYS[1], 10)", "1", "visits"})
+	sendCommand(writer, parser, []string{"EVAL_RO", "return redis.call('COUNTER.INCRBY', KEYS[1], 10)", "1", "visits"})
+	fmt.Println()
+
+	fmt.Println("Test 4: Key specs")
+	sendCommand(writer, parser, []string{"COMMAND", "GETKEYS", "COUNTER.INCRBY", "visits", "1"})
+	sendCommand(writer, parser, []string{"COMMAND", "GETKEYS", "LMOVE", "src", "dst", "LEFT", "RIGHT"})
+	sendCommand(writer, parser, []string{"COMMAND", "GETKEYS", "EVAL", "return 1", "2", "a", "b", "c"})
+	sendCommand(writer, parser, []string{"COMMAND", "GETKEYS", "XREAD", "COUNT", "1", "STREAMS", "s1", "s2", "0", "0"})
+	sendCommand(writer, parser, []string{"COMMAND", "GETKEYS", "EVAL", "return 1", "5", "a"})
+	sendCommand(writer, parser, []string{"COMMAND", "GETKEYS", "PING"})
+	sendCommand(writer, parser, []string{"COMMAND", "GETKEYS", "NOSUCH"})
+	fmt.Println()
+
+	fmt.Println("Test 5: Module calls obey the replica's read-only mode")
+	sendCommand(writer, parser, []string{"COUNTER.SAVEAS", "visits", "visits:saved"})
+	replica, rw, rp := startServer(filepath.Join(dir, "replica"), "6391", map[string]string{"replicaof": "localhost 6390"})
+	defer replica.Stop()
+	waitForSync(rw, rp)
+	sendCommand(rw, rp, []string{"GET", "visits:saved"})
+	sendCommand(rw, rp, []string{"COUNTER.GET", "visits"})
+	sendCommand(rw, rp, []string{"COUNTER.INCRBY", "visits", "1"})
+	sendCommand(rw, rp, []string{"COUNTER.SAVEAS", "visits", "visits:replica"})
+	sendCommand(rw, rp, []string{"GET", "visits:replica"})
+	fmt.Println()
+
+	// Writes through the module API raise the events of the commands
+	// doing the same, next to the ones the module raises itself
+	fmt.Println("Test 6: Keyspace events of module writes")
+	sendCommand(writer, parser, []string{"CONFIG", "SET", "notify-keyspace-events", "KEA"})
+	conn, err := net.Dial("tcp", "localhost:6390")
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	defer conn.Close()
+	sw, sp := resp.NewWriter(conn), resp.NewParser(conn)
+	sendCommand(sw, sp, []string{"PSUBSCRIBE", "__keyevent@0__:*"})
+	sendCommand(writer, parser, []string{"COUNTER.INCRBY", "visits", "1"})
+	sendCommand(writer, parser, []string{"COUNTER.CASHOUT", "visits", "visits:cash"})
+	for i := 0; i < 4; i++ {
+		message, err := sp.Read()
+		if err != nil {
+			log.Fatalf("Error reading response: %v", err)
+		}
+		fmt.Printf("event -> %s\n", formatResponse(message))
+	}
+	fmt.Println()
+
+	fmt.Println("=== All module tests completed! ===")
+}
+
+// startServer starts a server in-process, saving into dir, and connects to it
+func startServer(dir, port string, config map[string]string) (*redisserver.Server, *resp.Writer, *resp.Parser) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Failed to create directory: %v", err)
+	}
+	srv := redisserver.New("localhost", port)
+	settings := map[string]string{"dir": dir, "save": "", "repl-diskless-sync-delay": "0"}
+	for name, value := range config {
+		settings[name] = value
+	}
+	for name, value := range settings {
+		if err := srv.SetConfig(name, value); err != nil {
+			log.Fatalf("Failed to configure server: %v", err)
+		}
+	}
+	go func() {
+		if err := srv.Start(); err != nil {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	return srv, resp.NewWriter(conn), resp.NewParser(conn)
+}
+
+// waitForSync polls INFO until the replica's link to its master is up
+func waitForSync(writer *resp.Writer, parser *resp.Parser) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		writer.Write(commandValue([]string{"INFO", "replication"}))
+		info, err := parser.Read()
+		if err != nil {
+			log.Fatalf("Error reading response: %v", err)
+		}
+		if strings.Contains(info.Bulk, "master_link_status:up") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Fatalf("Replica did not sync with its master")
+}
+
+func commandValue(args []string) resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+	return resp.NewArray(values)
+}
+
+func sendCommand(writer *resp.Writer, parser *resp.Parser, args []string) resp.Value {
+	if err := writer.Write(commandValue(args)); err != nil {
+		log.Printf("Error sending command: %v", err)
+		return resp.Value{}
+	}
+
+	response, err := parser.Read()
+	if err != nil {
+		log.Printf("Error reading response: %v", err)
+		return resp.Value{}
+	}
+
+	fmt.Printf("%v -> %s\n", args, formatResponse(response))
+	return response
+}
+
+func formatResponse(value resp.Value) string {
+	switch value.Type {
+	case "string":
+		return value.Str
+	case "bulk":
+		if value.Null {
+			return "(nil)"
+		}
+		return value.Bulk
+	case "integer":
+		return fmt.Sprintf("(integer) %d", value.Num)
+	case "error":
+		return fmt.Sprintf("(error) %s", value.Str)
+	case "array", "push":
+		if value.Null {
+			return "(nil)"
+		}
+		result := "["
+		for i, v := range value.Array {
+			if i > 0 {
+				result += ", "
+			}
+			result += formatResponse(v)
+		}
+		return result + "]"
+	default:
+		return fmt.Sprintf("Unknown type: %s", value.Type)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"redis-learning/pkg/resp"
+)
+
+func main() {
+	fmt.Println("=== Testing Redis Keyspace Notifications ===")
+
+	subscriber := connect()
+	defer subscriber.Close()
+	client := connect()
+	defer client.Close()
+
+	sw, sp := resp.NewWriter(subscriber), resp.NewParser(subscriber)
+	cw, cp := resp.NewWriter(client), resp.NewParser(client)
+	fmt.Println("Connected to Redis server!")
+	fmt.Println()
+
+	// Notifications are off by default
+	fmt.Println("Test 1: CONFIG GET/SET notify-keyspace-events")
+	sendCommand(cw, cp, []string{"CONFIG", "GET", "notify-keyspace-events"})
+	sendCommand(cw, cp, []string{"CONFIG", "SET", "notify-keyspace-events", "KQ"})
+	sendCommand(cw, cp, []string{"CONFIG", "SET", "notify-keyspace-events", "KEA"})
+	sendCommand(cw, cp, []string{"CONFIG", "GET", "notify-*"})
+	fmt.Println()
+
+	// Every event is published to both the keyspace and keyevent channels
+	fmt.Println("Test 2: String and generic events")
+	send(sw, []string{"PSUBSCRIBE", "__key*__:*"})
+	readMessages(sp, 1)
+	sendCommand(cw, cp, []string{"SET", "notify:str", "v"})
+	readMessages(sp, 2)
+	sendCommand(cw, cp, []string{"DEL", "notify:str"})
+	readMessages(sp, 2)
+	fmt.Println()
+
+	// Popping the last element also deletes the key
+	fmt.Println("Test 3: List events")
+	sendCommand(cw, cp, []string{"RPUSH", "notify:list", "a"})
+	readMessages(sp, 2)
+	sendCommand(cw, cp, []string{"LPOP", "notify:list"})
+	readMessages(sp, 4)
+	fmt.Println()
+
+	fmt.Println("Test 4: Stream events")
+	sendCommand(cw, cp, []string{"XADD", "notify:stream", "*", "field", "value"})
+	readMessages(sp, 2)
+	sendCommand(cw, cp, []string{"XGROUP", "CREATE", "notify:stream", "group", "0"})
+	readMessages(sp, 2)
+	sendCommand(cw, cp, []string{"DEL", "notify:stream"})
+	readMessages(sp, 2)
+	fmt.Println()
+
+	// Key misses are only sent when the m class is enabled explicitly
+	fmt.Println("Test 5: Key miss events")
+	sendCommand(cw, cp, []string{"CONFIG", "SET", "notify-keyspace-events", "Em"})
+	sendCommand(cw, cp, []string{"GET", "notify:missing"})
+	readMessages(sp, 1)
+	sendCommand(cw, cp, []string{"CONFIG", "SET", "notify-keyspace-events", ""})
+	fmt.Println()
+
+	fmt.Println("=== All keyspace notification tests completed! ===")
+}
+
+func connect() net.Conn {
+	conn, err := net.Dial("tcp", "localhost:6379")
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	return conn
+}
+
+func send(writer *resp.Writer, args []string) {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+
+	if err := writer.Write(resp.NewArray(values)); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	fmt.Printf("%v\n", args)
+}
+
+func readMessages(parser *resp.Parser, n int) {
+	for i := 0; i < n; i++ {
+		msg, err := parser.Read()
+		if err != nil {
+			log.Fatalf("Error reading message: %v", err)
+		}
+		fmt.Printf("  <- %s\n", formatResponse(msg))
+	}
+}
+
+func sendCommand(writer *resp.Writer, parser *resp.Parser, args []string) {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+
+	if err := writer.Write(resp.NewArray(values)); err != nil {
+		log.Printf("Error sending command: %v", err)
+		return
+	}
+
+	response, err := parser.Read()
+	if err != nil {
+		log.Printf("Error reading response: %v", err)
+		return
+	}
+
+	fmt.Printf("%v -> %s\n", args, formatResponse(response))
+}
+
+func formatResponse(value resp.Value) string {
+	switch value.Type {
+	case "string":
+		return value.Str
+	case "bulk":
+		if value.Null {
+			return "(nil)"
+		}
+		return value.Bulk
+	case "integer":
+		return fmt.Sprintf("(integer) %d", value.Num)
+	case "error":
+		return fmt.Sprintf("(error) %s", value.Str)
+	case "array", "push":
+		if value.Null {
+			return "(nil)"
+		}
+		result := "["
+		for i, v := range value.Array {
+			if i > 0 {
+				result += ", "
+			}
+			result += formatResponse(v)
+		}
+		return result + "]"
+	default:
+		return fmt.Sprintf("Unknown type: %s", value.Type)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-learning/pkg/redisserver"
+	"redis-learning/pkg/resp"
+)
+
+const lib = "#!lua name=persisted\nredis.register_function('hello', function() return 'world' end)"
+
+func main() {
+	fmt.Println("=== Testing RDB Persistence ===")
+
+	// Servers run in-process on a scratch directory, so that the dataset
+	// can be reloaded by a fresh server
+	dir, err := os.MkdirTemp("", "redis-persistence")
+	if err != nil {
+		log.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writer, parser := startServer(dir, "6391")
+	fmt.Println()
+
+	fmt.Println("Test 1: Populate every type")
+	sendCommand(writer, parser, []string{"SET", "p:string", "hello"})
+	sendCommand(writer, parser, []string{"RPUSH", "p:list", "a", "b", "12345"})
+	sendCommand(writer, parser, []string{"GEOADD", "p:geo", "13.361389", "38.115556", "Palermo"})
+	sendCommand(writer, parser, []string{"SETBIT", "p:bitmap", "7", "1"})
+	sendCommand(writer, parser, []string{"PFADD", "p:hll", "a", "b", "c"})
+	sendCommand(writer, parser, []string{"XADD", "p:stream", "1-1", "name", "alice", "age", "30"})
+	sendCommand(writer, parser, []string{"XADD", "p:stream", "1-2", "name", "bob", "age", "-7"})
+	sendCommand(writer, parser, []string{"XADD", "p:stream", "2-0", "other", "fields"})
+	sendCommand(writer, parser, []string{"XGROUP", "CREATE", "p:stream", "workers", "0"})
+	sendCommand(writer, parser, []string{"XREADGROUP", "GROUP", "workers", "w1", "COUNT", "1", "STREAMS", "p:stream", ">"})
+	sendCommand(writer, parser, []string{"FUNCTION", "LOAD", lib})
+	fmt.Println()
+
+	fmt.Println("Test 2: SAVE, BGSAVE, LASTSAVE and INFO")
+	sendCommand(writer, parser, []string{"SAVE"})
+	sendCommand(writer, parser, []string{"SET", "p:after-save", "1"})
+	sendCommand(writer, parser, []string{"BGSAVE"})
+	time.Sleep(200 * time.Millisecond)
+	sendCommand(writer, parser, []string{"INFO", "persistence"})
+	lastSave := sendCommand(writer, parser, []string{"LASTSAVE"})
+	fmt.Printf("LASTSAVE is recent: %v\n", time.Now().Unix()-int64(lastSave.Num) < 5)
+	fmt.Println()
+
+	fmt.Println("Test 3: SHUTDOWN saves and a new server loads the snapshot")
+	sendCommand(writer, parser, []string{"SET", "p:before-shutdown", "1"})
+	// The server closes the connection instead of replying
+	if err := writer.Write(commandValue([]string{"SHUTDOWN", "SAVE"})); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	_, err = parser.Read()
+	fmt.Printf("[SHUTDOWN SAVE] -> connection closed: %v\n", err != nil)
+	fmt.Println()
+
+	writer, parser = startServer(dir, "6392")
+	sendCommand(writer, parser, []string{"GET", "p:string"})
+	sendCommand(writer, parser, []string{"GET", "p:before-shutdown"})
+	sendCommand(writer, parser, []string{"RPOP", "p:list"})
+	sendCommand(writer, parser, []string{"GEOPOS", "p:geo", "Palermo"})
+	sendCommand(writer, parser, []string{"GETBIT", "p:bitmap", "7"})
+	sendCommand(writer, parser, []string{"PFCOUNT", "p:hll"})
+	sendCommand(writer, parser, []string{"XRANGE", "p:stream", "-", "+"})
+	sendCommand(writer, parser, []string{"XPENDING", "p:stream", "workers"})
+	sendCommand(writer, parser, []string{"XINFO", "GROUPS", "p:stream"})
+	sendCommand(writer, parser, []string{"FCALL", "hello", "0"})
+	sendCommand(writer, parser, []string{"INFO", "persistence"})
+	fmt.Println()
+
+	fmt.Println("Test 4: BGSAVE writes the dataset as it was when it started")
+	populate(writer, parser, 1000)
+	sendCommand(writer, parser, []string{"RPUSH", "cow:list", "a", "b", "c"})
+	// Slow saving down to 1ms per key, so that the writes below certainly
+	// land while the snapshot is being written
+	sendCommand(writer, parser, []string{"CONFIG", "SET", "rdb-key-save-delay", "1000"})
+	sendCommand(writer, parser, []string{"BGSAVE"})
+	sendCommand(writer, parser, []string{"RPUSH", "cow:list", "d"})
+	sendCommand(writer, parser, []string{"SET", "cow:0", "changed"})
+	sendCommand(writer, parser, []string{"SETBIT", "cow:1", "0", "1"})
+	sendCommand(writer, parser, []string{"DEL", "cow:2"})
+	sendCommand(writer, parser, []string{"SET", "cow:new", "1"})
+	info := sendQuiet(writer, parser, []string{"INFO", "persistence"})
+	fmt.Printf("Writes landed during the save: %v\n", infoField(info, "rdb_bgsave_in_progress") == "1")
+	waitForBgsave(writer, parser)
+	info = sendQuiet(writer, parser, []string{"INFO", "persistence"})
+	fmt.Printf("rdb_last_bgsave_status:%s\n", infoField(info, "rdb_last_bgsave_status"))
+	cowSize, _ := strconv.Atoi(infoField(info, "rdb_last_cow_size"))
+	fmt.Printf("rdb_last_cow_size > 0: %v\n", cowSize > 0)
+	if err := writer.Write(commandValue([]string{"SHUTDOWN", "NOSAVE"})); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	parser.Read()
+
+	// The snapshot holds the values as they were when BGSAVE started
+	writer, parser = startServer(dir, "6393")
+	expect(writer, parser, []string{"LLEN", "cow:list"}, "(integer) 3")
+	expect(writer, parser, []string{"RPOP", "cow:list"}, "c")
+	expect(writer, parser, []string{"GET", "cow:0"}, "0")
+	expect(writer, parser, []string{"GETBIT", "cow:1", "0"}, "(integer) 0")
+	expect(writer, parser, []string{"GET", "cow:2"}, "2")
+	expect(writer, parser, []string{"GET", "cow:new"}, "(nil)")
+	expect(writer, parser, []string{"GET", "cow:999"}, "999")
+	fmt.Println()
+
+	fmt.Println("Test 5: Clients get LOADING errors until the dataset is loaded")
+	sendCommand(writer, parser, []string{"FLUSHALL"})
+	populate(writer, parser, 1000)
+	if err := writer.Write(commandValue([]string{"SHUTDOWN", "SAVE"})); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	parser.Read()
+
+	srv := redisserver.New("localhost", "6405")
+	srv.SetConfig("dir", dir)
+	// Slow loading down to 2ms per key
+	srv.SetConfig("key-load-delay", "2000")
+	go func() {
+		if err := srv.Start(); err != nil {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	conn, err := net.Dial("tcp", "localhost:6405")
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	writer, parser = resp.NewWriter(conn), resp.NewParser(conn)
+	sendCommand(writer, parser, []string{"GET", "cow:0"})
+	sendCommand(writer, parser, []string{"PING"})
+	sendCommand(writer, parser, []string{"MULTI"})
+	sendCommand(writer, parser, []string{"GET", "cow:0"})
+	sendCommand(writer, parser, []string{"EXEC"})
+	info = sendQuiet(writer, parser, []string{"INFO", "persistence"})
+	for _, line := range strings.Split(info.Bulk, "\r\n") {
+		if line == "loading:1" {
+			fmt.Println(line)
+		}
+		if strings.HasPrefix(line, "loading_") {
+			fmt.Println(strings.SplitN(line, ":", 2)[0] + " is reported")
+		}
+	}
+	waitForLoading(writer, parser)
+	sendCommand(writer, parser, []string{"GET", "cow:999"})
+	fmt.Println()
+
+	fmt.Println("=== All persistence tests completed! ===")
+}
+
+// populate creates n string keys, pipelining the commands
+func populate(writer *resp.Writer, parser *resp.Parser, n int) {
+	go func() {
+		for i := 0; i < n; i++ {
+			writer.Write(commandValue([]string{"SET", fmt.Sprintf("cow:%d", i), strconv.Itoa(i)}))
+		}
+	}()
+	for i := 0; i < n; i++ {
+		if _, err := parser.Read(); err != nil {
+			log.Fatalf("Error reading response: %v", err)
+		}
+	}
+	fmt.Printf("Created %d keys\n", n)
+}
+
+// infoField returns the value of a field of an INFO reply
+func infoField(info resp.Value, name string) string {
+	for _, line := range strings.Split(info.Bulk, "\r\n") {
+		if value, ok := strings.CutPrefix(line, name+":"); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// waitForBgsave polls INFO until no background save is running
+func waitForBgsave(writer *resp.Writer, parser *resp.Parser) {
+	for {
+		info := sendQuiet(writer, parser, []string{"INFO", "persistence"})
+		if strings.Contains(info.Bulk, "rdb_bgsave_in_progress:0") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startServer runs a server on port saving into dir, and connects to it
+func startServer(dir, port string) (*resp.Writer, *resp.Parser) {
+	srv := redisserver.New("localhost", port)
+	if err := srv.SetConfig("dir", dir); err != nil {
+		log.Fatalf("Failed to configure server: %v", err)
+	}
+	go func() {
+		if err := srv.Start(); err != nil {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	fmt.Printf("Connected to Redis server on port %s!\n", port)
+	writer, parser := resp.NewWriter(conn), resp.NewParser(conn)
+	waitForLoading(writer, parser)
+	return writer, parser
+}
+
+// waitForLoading polls INFO until the dataset is loaded
+func waitForLoading(writer *resp.Writer, parser *resp.Parser) {
+	for {
+		info := sendQuiet(writer, parser, []string{"INFO", "persistence"})
+		if strings.Contains(info.Bulk, "loading:0") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func commandValue(args []string) resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+	return resp.NewArray(values)
+}
+
+// sendQuiet sends a command without printing the exchange
+func sendQuiet(writer *resp.Writer, parser *resp.Parser, args []string) resp.Value {
+	if err := writer.Write(commandValue(args)); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	response, err := parser.Read()
+	if err != nil {
+		log.Fatalf("Error reading response: %v", err)
+	}
+	return response
+}
+
+func sendCommand(writer *resp.Writer, parser *resp.Parser, args []string) resp.Value {
+	if err := writer.Write(commandValue(args)); err != nil {
+		log.Printf("Error sending command: %v", err)
+		return resp.Value{}
+	}
+
+	response, err := parser.Read()
+	if err != nil {
+		log.Printf("Error reading response: %v", err)
+		return resp.Value{}
+	}
+
+	fmt.Printf("%v -> %s\n", args, formatResponse(response))
+	return response
+}
+
+// expect sends a command and checks its reply
+func expect(writer *resp.Writer, parser *resp.Parser, args []string, want string) {
+	got := formatResponse(sendQuiet(writer, parser, args))
+	status := "OK"
+	if got != want {
+		status = fmt.Sprintf("FAILED, want %s", want)
+	}
+	fmt.Printf("%v -> %s (%s)\n", args, got, status)
+}
+
+func formatResponse(value resp.Value) string {
+	switch value.Type {
+	case "string":
+		return value.Str
+	case "bulk":
+		if value.Null {
+			return "(nil)"
+		}
+		return value.Bulk
+	case "integer":
+		return fmt.Sprintf("(integer) %d", value.Num)
+	case "error":
+		return fmt.Sprintf("(error) %s", value.Str)
+	case "array", "push":
+		if value.Null {
+			return "(nil)"
+		}
+		result := "["
+		for i, v := range value.Array {
+			if i > 0 {
+				result += ", "
+			}
+			result += formatResponse(v)
+		}
+		return result + "]"
+	default:
+		return fmt.Sprintf("Unknown type: %s", value.Type)
+	}
+}
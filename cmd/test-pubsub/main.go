@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"redis-learning/pkg/resp"
+)
+
+func main() {
+	fmt.Println("=== Testing Redis Pub/Sub ===")
+
+	subscriber := connect()
+	defer subscriber.Close()
+	publisher := connect()
+	defer publisher.Close()
+
+	sw, sp := resp.NewWriter(subscriber), resp.NewParser(subscriber)
+	pw, pp := resp.NewWriter(publisher), resp.NewParser(publisher)
+	fmt.Println("Connected to Redis server!")
+	fmt.Println()
+
+	// Test SUBSCRIBE, which confirms each channel separately
+	fmt.Println("Test 1: SUBSCRIBE")
+	send(sw, []string{"SUBSCRIBE", "news", "sports"})
+	readMessages(sp, 2)
+	fmt.Println()
+
+	// Test PUBLISH to a subscribed channel
+	fmt.Println("Test 2: PUBLISH")
+	sendCommand(pw, pp, []string{"PUBLISH", "news", "hello"})
+	sendCommand(pw, pp, []string{"PUBLISH", "weather", "nobody listens"})
+	readMessages(sp, 1)
+	fmt.Println()
+
+	// Test pattern subscriptions
+	fmt.Println("Test 3: PSUBSCRIBE")
+	send(sw, []string{"PSUBSCRIBE", "sp*"})
+	readMessages(sp, 1)
+	sendCommand(pw, pp, []string{"PUBLISH", "sports", "goal"})
+	readMessages(sp, 2)
+	fmt.Println()
+
+	// Test the restricted command set while subscribed
+	fmt.Println("Test 4: Subscribed mode")
+	sendCommand(sw, sp, []string{"GET", "key"})
+	sendCommand(sw, sp, []string{"PING"})
+	fmt.Println()
+
+	// Test PUBSUB introspection
+	fmt.Println("Test 5: PUBSUB")
+	sendCommand(pw, pp, []string{"PUBSUB", "CHANNELS"})
+	sendCommand(pw, pp, []string{"PUBSUB", "NUMSUB", "news", "weather"})
+	sendCommand(pw, pp, []string{"PUBSUB", "NUMPAT"})
+	fmt.Println()
+
+	// Test unsubscribing from everything
+	fmt.Println("Test 6: UNSUBSCRIBE and PUNSUBSCRIBE")
+	send(sw, []string{"UNSUBSCRIBE"})
+	readMessages(sp, 2)
+	send(sw, []string{"PUNSUBSCRIBE"})
+	readMessages(sp, 1)
+	sendCommand(sw, sp, []string{"GET", "key"})
+	fmt.Println()
+
+	// Test HELLO, which switches the connection to RESP3
+	fmt.Println("Test 7: HELLO")
+	client := connect()
+	defer client.Close()
+	cw, cp := resp.NewWriter(client), resp.NewParser(client)
+	sendCommand(cw, cp, []string{"HELLO", "4"})
+	sendCommand(cw, cp, []string{"HELLO", "three"})
+	sendCommand(cw, cp, []string{"HELLO", "3", "AUTH", "someone", "secret"})
+	sendCommand(cw, cp, []string{"HELLO", "3", "SETNAME", "bad name"})
+	sendCommand(cw, cp, []string{"HELLO", "3", "SETNAME"})
+	sendCommand(cw, cp, []string{"HELLO", "3", "AUTH", "default", "", "SETNAME", "tester"})
+	fmt.Println()
+
+	// Test RESP3 Pub/Sub, where messages are push frames and other
+	// commands still run while subscribed
+	fmt.Println("Test 8: RESP3 Pub/Sub")
+	send(cw, []string{"SUBSCRIBE", "news"})
+	readMessages(cp, 1)
+	sendCommand(cw, cp, []string{"GET", "key"})
+	sendCommand(pw, pp, []string{"PUBLISH", "news", "pushed"})
+	readMessages(cp, 1)
+	fmt.Println()
+
+	// Test RESET, which leaves MULTI, subscribed mode and RESP3
+	fmt.Println("Test 9: RESET")
+	sendCommand(sw, sp, []string{"MULTI"})
+	sendCommand(sw, sp, []string{"SET", "key", "value"})
+	sendCommand(sw, sp, []string{"RESET"})
+	sendCommand(sw, sp, []string{"EXEC"})
+	sendCommand(sw, sp, []string{"GET", "key"})
+	send(sw, []string{"SUBSCRIBE", "news"})
+	readMessages(sp, 1)
+	sendCommand(sw, sp, []string{"RESET"})
+	sendCommand(sw, sp, []string{"GET", "key"})
+	sendCommand(cw, cp, []string{"RESET"})
+	sendCommand(cw, cp, []string{"GET", "key"})
+	sendCommand(pw, pp, []string{"PUBLISH", "news", "nobody listens"})
+	fmt.Println()
+
+	// Test the pubsub output buffer limit, which disconnects a subscriber
+	// that doesn't read its messages
+	fmt.Println("Test 10: Output buffer limit")
+	sendCommand(pw, pp, []string{"CONFIG", "SET", "client-output-buffer-limit", "pubsub 1mb 0 0"})
+	slow := connect()
+	defer slow.Close()
+	slowWriter, slowParser := resp.NewWriter(slow), resp.NewParser(slow)
+	send(slowWriter, []string{"SUBSCRIBE", "firehose"})
+	readMessages(slowParser, 1)
+	fmt.Printf("Slow subscriber disconnected: %v\n", floodUntilDisconnected(pw, pp, "firehose"))
+	sendCommand(pw, pp, []string{"PUBSUB", "NUMSUB", "firehose"})
+	sendCommand(pw, pp, []string{"CONFIG", "SET", "client-output-buffer-limit", "pubsub 32mb 8mb 60"})
+	fmt.Println()
+
+	// Test sharded Pub/Sub, whose channels are separate from the others.
+	// Without cluster mode, channels of different slots can be combined.
+	fmt.Println("Test 11: Sharded Pub/Sub")
+	send(sw, []string{"SSUBSCRIBE", "orders", "{user1}.events"})
+	readMessages(sp, 2)
+	sendCommand(pw, pp, []string{"SPUBLISH", "orders", "created"})
+	readMessages(sp, 1)
+	sendCommand(pw, pp, []string{"PUBLISH", "orders", "nobody listens"})
+	sendCommand(sw, sp, []string{"GET", "key"})
+	sendCommand(pw, pp, []string{"PUBSUB", "SHARDCHANNELS", "ord*"})
+	sendCommand(pw, pp, []string{"PUBSUB", "SHARDNUMSUB", "orders", "{user1}.events", "missing"})
+	sendCommand(pw, pp, []string{"PUBSUB", "CHANNELS"})
+	send(sw, []string{"SUNSUBSCRIBE", "orders"})
+	readMessages(sp, 1)
+	sendCommand(pw, pp, []string{"SPUBLISH", "orders", "nobody listens"})
+	send(sw, []string{"SUNSUBSCRIBE"})
+	readMessages(sp, 1)
+	sendCommand(pw, pp, []string{"PUBSUB", "SHARDCHANNELS"})
+	fmt.Println()
+
+	fmt.Println("=== All Pub/Sub tests completed! ===")
+}
+
+// floodUntilDisconnected publishes large messages to channel until it has
+// no subscribers left, and reports whether that happened
+func floodUntilDisconnected(writer *resp.Writer, parser *resp.Parser, channel string) bool {
+	payload := strings.Repeat("x", 64*1024)
+	for i := 0; i < 2000; i++ {
+		if err := writer.Write(commandValue([]string{"PUBLISH", channel, payload})); err != nil {
+			log.Fatalf("Error sending command: %v", err)
+		}
+		response, err := parser.Read()
+		if err != nil {
+			log.Fatalf("Error reading response: %v", err)
+		}
+		if response.Num == 0 {
+			return true
+		}
+		if i >= 1000 {
+			// The limit has certainly been hit, the subscriber is being
+			// freed
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return false
+}
+
+func connect() net.Conn {
+	conn, err := net.Dial("tcp", "localhost:6379")
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	return conn
+}
+
+func commandValue(args []string) resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+	return resp.NewArray(values)
+}
+
+func send(writer *resp.Writer, args []string) {
+	if err := writer.Write(commandValue(args)); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	fmt.Printf("%v\n", args)
+}
+
+func readMessages(parser *resp.Parser, n int) {
+	for i := 0; i < n; i++ {
+		msg, err := parser.Read()
+		if err != nil {
+			log.Fatalf("Error reading message: %v", err)
+		}
+		fmt.Printf("  <- %s\n", formatResponse(msg))
+	}
+}
+
+func sendCommand(writer *resp.Writer, parser *resp.Parser, args []string) {
+	if err := writer.Write(commandValue(args)); err != nil {
+		log.Printf("Error sending command: %v", err)
+		return
+	}
+
+	response, err := parser.Read()
+	if err != nil {
+		log.Printf("Error reading response: %v", err)
+		return
+	}
+
+	fmt.Printf("%v -> %s\n", args, formatResponse(response))
+}
+
+func formatResponse(value resp.Value) string {
+	switch value.Type {
+	case "string":
+		return value.Str
+	case "bulk":
+		if value.Null {
+			return "(nil)"
+		}
+		return value.Bulk
+	case "integer":
+		return fmt.Sprintf("(integer) %d", value.Num)
+	case "error":
+		return fmt.Sprintf("(error) %s", value.Str)
+	case "array":
+		if value.Null {
+			return "(nil)"
+		}
+		result := "["
+		for i, v := range value.Array {
+			if i > 0 {
+				result += ", "
+			}
+			result += formatResponse(v)
+		}
+		return result + "]"
+	case "push":
+		return "(push) " + formatResponse(resp.NewArray(value.Array))
+	case "map":
+		result := "{"
+		for i := 0; i+1 < len(value.Array); i += 2 {
+			if i > 0 {
+				result += ", "
+			}
+			result += formatResponse(value.Array[i]) + ": " + formatResponse(value.Array[i+1])
+		}
+		return result + "}"
+	default:
+		return fmt.Sprintf("Unknown type: %s", value.Type)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"redis-learning/pkg/resp"
+)
+
+func main() {
+	fmt.Println("=== Testing Redis Lua Scripting ===")
+
+	conn, err := net.Dial("tcp", "localhost:6379")
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	defer conn.Close()
+
+	writer, parser := resp.NewWriter(conn), resp.NewParser(conn)
+	fmt.Println("Connected to Redis server!")
+	fmt.Println()
+
+	sendCommand(writer, parser, []string{"DEL", "lua:counter"})
+	sendCommand(writer, parser, []string{"DEL", "lua:lock"})
+	fmt.Println()
+
+	fmt.Println("Test 1: EVAL with KEYS and ARGV")
+	sendCommand(writer, parser, []string{"EVAL", "return {KEYS[1], ARGV[1], 10, 3.7, true, false}", "1", "k", "a"})
+	sendCommand(writer, parser, []string{"EVAL", "return redis.call('SET', KEYS[1], ARGV[1])", "1", "lua:counter", "5"})
+	sendCommand(writer, parser, []string{"EVAL", "return redis.call('GET', KEYS[1])", "1", "lua:counter"})
+	sendCommand(writer, parser, []string{"EVAL", "return redis.call('GET', 'lua:missing')", "0"})
+	fmt.Println()
+
+	// The classic lock release script
+	fmt.Println("Test 2: SCRIPT LOAD and EVALSHA")
+	release := "if redis.call('GET', KEYS[1]) == ARGV[1] then return redis.call('DEL', KEYS[1]) else return 0 end"
+	sha := sendCommand(writer, parser, []string{"SCRIPT", "LOAD", release}).Bulk
+	sendCommand(writer, parser, []string{"SCRIPT", "EXISTS", sha, "0000000000000000000000000000000000000000"})
+	sendCommand(writer, parser, []string{"SET", "lua:lock", "owner-1"})
+	sendCommand(writer, parser, []string{"EVALSHA", sha, "1", "lua:lock", "owner-2"})
+	sendCommand(writer, parser, []string{"EVALSHA", sha, "1", "lua:lock", "owner-1"})
+	sendCommand(writer, parser, []string{"SCRIPT", "FLUSH"})
+	sendCommand(writer, parser, []string{"EVALSHA", sha, "1", "lua:lock", "owner-1"})
+	fmt.Println()
+
+	fmt.Println("Test 3: Errors")
+	sendCommand(writer, parser, []string{"EVAL", "return redis.call('LPUSH', KEYS[1], 'x')", "1", "lua:counter"})
+	sendCommand(writer, parser, []string{"EVAL", "local r = redis.pcall('LPUSH', KEYS[1], 'x'); return r['err']", "1", "lua:counter"})
+	sendCommand(writer, parser, []string{"EVAL", "return redis.error_reply('MY custom error')", "0"})
+	sendCommand(writer, parser, []string{"EVAL", "return redis.status_reply('DONE')", "0"})
+	sendCommand(writer, parser, []string{"EVAL", "return redis.call('MULTI')", "0"})
+	sendCommand(writer, parser, []string{"EVAL", "x = 1", "0"})
+	sendCommand(writer, parser, []string{"EVAL", "return (", "0"})
+	fmt.Println()
+
+	fmt.Println("Test 4: Read-only scripts")
+	sendCommand(writer, parser, []string{"EVAL_RO", "return redis.call('GET', KEYS[1])", "1", "lua:counter"})
+	sendCommand(writer, parser, []string{"EVAL_RO", "return redis.call('SET', KEYS[1], '1')", "1", "lua:counter"})
+	sendCommand(writer, parser, []string{"EVAL", "#!lua flags=no-writes\nreturn redis.call('DEL', KEYS[1])", "1", "lua:counter"})
+	fmt.Println()
+
+	// Other clients get BUSY once a script exceeds busy-reply-threshold,
+	// and can kill it as long as it hasn't written anything
+	fmt.Println("Test 5: Busy scripts and SCRIPT KILL")
+	other, err := net.Dial("tcp", "localhost:6379")
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	defer other.Close()
+	ow, op := resp.NewWriter(other), resp.NewParser(other)
+
+	sendCommand(ow, op, []string{"CONFIG", "SET", "busy-reply-threshold", "100"})
+	if err := writer.Write(commandValue([]string{"EVAL", "while true do end", "0"})); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	sendCommand(ow, op, []string{"GET", "lua:counter"})
+	sendCommand(ow, op, []string{"SCRIPT", "KILL"})
+	if response, err := parser.Read(); err == nil {
+		fmt.Printf("[EVAL while true do end 0] -> %s\n", formatResponse(response))
+	}
+	sendCommand(ow, op, []string{"CONFIG", "SET", "busy-reply-threshold", "5000"})
+	sendCommand(writer, parser, []string{"SCRIPT", "KILL"})
+	fmt.Println()
+
+	// cjson, cmsgpack, struct and bit are loaded next to the standard
+	// library, and numbers out of the integer range convert as Redis does
+	fmt.Println("Test 6: Bundled libraries and number conversion")
+	sendCommand(writer, parser, []string{"EVAL", "return cjson.encode({1, 2, {path = 'a/b', n = 2.5}})", "0"})
+	sendCommand(writer, parser, []string{"EVAL", "local t = cjson.decode(ARGV[1]); return {t.a[1], t.a[2] == cjson.null, t.b}", "0", `{"a": [7, null], "b": "\u00e9"}`})
+	sendCommand(writer, parser, []string{"EVAL", "return cjson.decode('{\"a\":')", "0"})
+	sendCommand(writer, parser, []string{"EVAL", "local n, s, t = cmsgpack.unpack(cmsgpack.pack(300, 'x', {1, 2})); return {n, s, #t}", "0"})
+	sendCommand(writer, parser, []string{"EVAL", "return {struct.unpack('>hI', struct.pack('>hI', -2, 70000))}", "0"})
+	sendCommand(writer, parser, []string{"EVAL", "return {bit.tohex(bit.band(0xff0, 0x0ff)), bit.lshift(1, 31), bit.bxor(5, 3)}", "0"})
+	sendCommand(writer, parser, []string{"EVAL", "return {1e20, -1e20, 3.99}", "0"})
+	fmt.Println()
+
+	fmt.Println("=== All scripting tests completed! ===")
+}
+
+func commandValue(args []string) resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+	return resp.NewArray(values)
+}
+
+func sendCommand(writer *resp.Writer, parser *resp.Parser, args []string) resp.Value {
+	if err := writer.Write(commandValue(args)); err != nil {
+		log.Printf("Error sending command: %v", err)
+		return resp.Value{}
+	}
+
+	response, err := parser.Read()
+	if err != nil {
+		log.Printf("Error reading response: %v", err)
+		return resp.Value{}
+	}
+
+	fmt.Printf("%v -> %s\n", args, formatResponse(response))
+	return response
+}
+
+func formatResponse(value resp.Value) string {
+	switch value.Type {
+	case "string":
+		return value.Str
+	case "bulk":
+		if value.Null {
+			return "(nil)"
+		}
+		return value.Bulk
+	case "integer":
+		return fmt.Sprintf("(integer) %d", value.Num)
+	case "error":
+		return fmt.Sprintf("(error) %s", value.Str)
+	case "array", "push":
+		if value.Null {
+			return "(nil)"
+		}
+		result := "["
+		for i, v := range value.Array {
+			if i > 0 {
+				result += ", "
+			}
+			result += formatResponse(v)
+		}
+		return result + "]"
+	default:
+		return fmt.Sprintf("Unknown type: %s", value.Type)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"redis-learning/pkg/redisserver"
+	"redis-learning/pkg/resp"
+)
+
+// client is a connection to one of the servers or sentinels
+type client struct {
+	name   string
+	port   string
+	srv    *redisserver.Server
+	writer *resp.Writer
+	parser *resp.Parser
+}
+
+func main() {
+	fmt.Println("=== Testing Sentinel ===")
+
+	// Servers run in-process, each saving into its own scratch directory
+	dir, err := os.MkdirTemp("", "redis-sentinel")
+	if err != nil {
+		log.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	master := startServer(dir, "master", "6411", nil)
+	// The replica with the lowest priority is promoted first
+	replica1 := startServer(dir, "replica1", "6412", map[string]string{"replicaof": "127.0.0.1 6411", "replica-priority": "10"})
+	replica2 := startServer(dir, "replica2", "6413", map[string]string{"replicaof": "127.0.0.1 6411"})
+	master.run([]string{"SET", "s:key", "before"})
+	waitForSync(master, replica1)
+	waitForSync(master, replica2)
+	sentinels := []*client{
+		startSentinel("sentinel1", "26411"),
+		startSentinel("sentinel2", "26412"),
+		startSentinel("sentinel3", "26413"),
+	}
+	s1 := sentinels[0]
+	fmt.Println()
+
+	fmt.Println("Test 1: Sentinels discover the replicas and each other")
+	for _, s := range sentinels {
+		waitFor(s.name+" to discover the others", 20*time.Second, func() bool {
+			fields := masterFields(s, "mymaster")
+			return fields["num-slaves"] == "2" && fields["num-other-sentinels"] == "2"
+		})
+	}
+	s1.send([]string{"SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster"})
+	fields := masterFields(s1, "mymaster")
+	for _, name := range []string{"name", "ip", "port", "flags", "role-reported", "num-slaves", "num-other-sentinels", "quorum", "down-after-milliseconds", "parallel-syncs"} {
+		fmt.Printf("%s master %s:%s\n", s1.name, name, fields[name])
+	}
+	printInstances(s1, "REPLICAS", "name", "flags", "master-port", "slave-priority")
+	printInstances(s1, "SENTINELS", "flags")
+	fmt.Printf("%s SENTINEL MYID is 40 characters: %v\n", s1.name, len(s1.run([]string{"SENTINEL", "MYID"}).Bulk) == 40)
+	s1.send([]string{"SENTINEL", "CKQUORUM", "mymaster"})
+	s1.send([]string{"ROLE"})
+	printInfo(s1, "server", "redis_mode")
+	printInfo(s1, "sentinel", "sentinel_masters", "master0")
+	fmt.Println()
+
+	fmt.Println("Test 2: Sentinels only run their own commands")
+	s1.send([]string{"SET", "s:key", "value"})
+	s1.send([]string{"PUBLISH", "news", "hello"})
+	s1.send([]string{"SENTINEL", "MASTER", "nosuch"})
+	s1.send([]string{"SENTINEL", "GET-MASTER-ADDR-BY-NAME", "nosuch"})
+	s1.send([]string{"SENTINEL", "MONITOR", "mymaster", "127.0.0.1", "6411", "2"})
+	s1.send([]string{"SENTINEL", "MONITOR", "other", "127.0.0.1", "6499", "0"})
+	s1.send([]string{"SENTINEL", "MONITOR", "other", "127.0.0.1", "6499", "1"})
+	s1.send([]string{"SENTINEL", "SET", "other", "quorum", "0"})
+	s1.send([]string{"SENTINEL", "SET", "other", "no-such-option", "1"})
+	s1.send([]string{"SENTINEL", "SET", "other", "quorum", "2", "parallel-syncs", "2"})
+	fields = masterFields(s1, "other")
+	fmt.Printf("%s other quorum:%s parallel-syncs:%s\n", s1.name, fields["quorum"], fields["parallel-syncs"])
+	fmt.Printf("%s SENTINEL MASTERS -> %d masters\n", s1.name, len(s1.run([]string{"SENTINEL", "MASTERS"}).Array))
+	s1.send([]string{"SENTINEL", "REMOVE", "other"})
+	s1.send([]string{"SENTINEL", "REMOVE", "other"})
+	fmt.Printf("%s SENTINEL MASTERS -> %d masters\n", s1.name, len(s1.run([]string{"SENTINEL", "MASTERS"}).Array))
+	s1.send([]string{"SENTINEL", "IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", "6411", "0", "*"})
+	s1.send([]string{"SENTINEL", "RESET", "nosuch*"})
+	s1.send([]string{"SENTINEL", "NOSUCH"})
+	fmt.Println()
+
+	fmt.Println("Test 3: A master that goes down is failed over to the best replica")
+	events := subscribe(s1, "+switch-master")
+	master.srv.Stop()
+	msg := events.receive(60 * time.Second)
+	fmt.Printf("%s received %s\n", s1.name, formatResponse(msg))
+	for _, s := range sentinels {
+		waitForMaster(s, "6412")
+		s.send([]string{"SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster"})
+	}
+	printRole(replica1)
+	waitForReplicaOf(replica2, "6412")
+	replica1.send([]string{"SET", "s:key", "after"})
+	waitForSync(replica1, replica2)
+	replica2.send([]string{"GET", "s:key"})
+	fields = masterFields(s1, "mymaster")
+	fmt.Printf("%s master port:%s flags:%s config-epoch>0:%v\n", s1.name, fields["port"], fields["flags"], fields["config-epoch"] != "0")
+	fmt.Println()
+
+	fmt.Println("Test 4: The old master comes back as a replica of the new one")
+	// It wins the next failover
+	master = startServer(dir, "master", "6411", map[string]string{"replica-priority": "1"})
+	printRole(master)
+	waitForReplicaOf(master, "6412")
+	waitForSync(replica1, master)
+	printRole(master)
+	master.send([]string{"GET", "s:key"})
+	waitFor("the sentinel to see the old master as a replica", 20*time.Second, func() bool {
+		fields := replicaFields(s1, "127.0.0.1:6411")
+		return fields["flags"] == "slave" && fields["master-link-status"] == "ok" && fields["slave-priority"] == "1"
+	})
+	printInstances(s1, "REPLICAS", "name", "flags", "master-port", "slave-priority")
+	fmt.Println()
+
+	fmt.Println("Test 5: SENTINEL FAILOVER promotes a replica without agreement")
+	s1.send([]string{"SENTINEL", "FAILOVER", "mymaster"})
+	s1.send([]string{"SENTINEL", "FAILOVER", "mymaster"})
+	for _, s := range sentinels {
+		waitForMaster(s, "6411")
+		s.send([]string{"SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster"})
+	}
+	printRole(master)
+	waitForReplicaOf(replica1, "6411")
+	waitForReplicaOf(replica2, "6411")
+	master.send([]string{"SET", "s:key", "back"})
+	waitForSync(master, replica1)
+	waitForSync(master, replica2)
+	replica1.send([]string{"GET", "s:key"})
+	replica2.send([]string{"GET", "s:key"})
+	s1.send([]string{"SENTINEL", "FAILOVER", "nosuch"})
+	fmt.Println()
+
+	for _, s := range sentinels {
+		s.srv.Stop()
+	}
+	for _, c := range []*client{master, replica1, replica2} {
+		c.srv.Stop()
+	}
+	fmt.Println("=== All sentinel tests completed! ===")
+}
+
+// startServer runs a server on port with the given settings, and connects
+// to it
+func startServer(parent, name, port string, config map[string]string) *client {
+	dir, err := os.MkdirTemp(parent, name)
+	if err != nil {
+		log.Fatalf("Failed to create directory: %v", err)
+	}
+	srv := redisserver.New("127.0.0.1", port)
+	settings := map[string]string{"dir": dir, "save": "", "repl-diskless-sync-delay": "0"}
+	for name, value := range config {
+		settings[name] = value
+	}
+	for name, value := range settings {
+		if err := srv.SetConfig(name, value); err != nil {
+			log.Fatalf("Failed to configure server: %v", err)
+		}
+	}
+	return start(srv, name, port)
+}
+
+// startSentinel runs a sentinel monitoring the master on port 6411, quick
+// to consider it down
+func startSentinel(name, port string) *client {
+	srv := redisserver.NewSentinel("127.0.0.1", port)
+	configs := [][]string{
+		{"MONITOR", "mymaster", "127.0.0.1", "6411", "2"},
+		{"SET", "mymaster", "down-after-milliseconds", "500", "failover-timeout", "5000"},
+	}
+	for _, args := range configs {
+		if err := srv.SentinelConfig(args...); err != nil {
+			log.Fatalf("Failed to configure sentinel: %v", err)
+		}
+	}
+	return start(srv, name, port)
+}
+
+func start(srv *redisserver.Server, name, port string) *client {
+	go func() {
+		if err := srv.Start(); err != nil {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	fmt.Printf("Connected to the %s on port %s!\n", name, port)
+	return &client{name: name, port: port, srv: srv, writer: resp.NewWriter(conn), parser: resp.NewParser(conn)}
+}
+
+// waitFor polls cond until it holds
+func waitFor(what string, timeout time.Duration, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	log.Fatalf("Timed out waiting for %s", what)
+}
+
+// waitForSync polls INFO until the replica is connected and processed the
+// whole stream of the master
+func waitForSync(master, replica *client) {
+	waitFor(replica.name+" to sync", 10*time.Second, func() bool {
+		return infoField(replica, "replication", "master_link_status") == "up" &&
+			infoField(replica, "replication", "slave_repl_offset") == infoField(master, "replication", "master_repl_offset")
+	})
+}
+
+// waitForReplicaOf polls INFO until the server replicates the master on
+// port
+func waitForReplicaOf(c *client, port string) {
+	waitFor(c.name+" to replicate "+port, 30*time.Second, func() bool {
+		return infoField(c, "replication", "master_port") == port &&
+			infoField(c, "replication", "master_link_status") == "up"
+	})
+}
+
+// waitForMaster polls the sentinel until it gives port as the address of
+// the master
+func waitForMaster(s *client, port string) {
+	waitFor(s.name+" to switch to "+port, 60*time.Second, func() bool {
+		addr := s.run([]string{"SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster"})
+		return len(addr.Array) == 2 && addr.Array[1].Bulk == port
+	})
+}
+
+// infoField returns a field of an INFO section
+func infoField(c *client, section, name string) string {
+	info := c.run([]string{"INFO", section})
+	for _, line := range strings.Split(info.Bulk, "\r\n") {
+		if value, ok := strings.CutPrefix(line, name+":"); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func printInfo(c *client, section string, names ...string) {
+	for _, name := range names {
+		fmt.Printf("%s %s:%s\n", c.name, name, infoField(c, section, name))
+	}
+}
+
+// fieldMap turns the field-value pairs of SENTINEL MASTER and the like into
+// a map
+func fieldMap(value resp.Value) map[string]string {
+	fields := make(map[string]string)
+	for i := 0; i+1 < len(value.Array); i += 2 {
+		fields[value.Array[i].Bulk] = value.Array[i+1].Bulk
+	}
+	return fields
+}
+
+// masterFields returns the fields the sentinel has for a master
+func masterFields(s *client, name string) map[string]string {
+	return fieldMap(s.run([]string{"SENTINEL", "MASTER", name}))
+}
+
+// replicaFields returns the fields the sentinel has for a replica of
+// mymaster
+func replicaFields(s *client, name string) map[string]string {
+	for _, r := range s.run([]string{"SENTINEL", "REPLICAS", "mymaster"}).Array {
+		if fields := fieldMap(r); fields["name"] == name {
+			return fields
+		}
+	}
+	return nil
+}
+
+// printInstances prints fields of the replicas or sentinels of mymaster
+func printInstances(s *client, sub string, names ...string) {
+	instances := s.run([]string{"SENTINEL", sub, "mymaster"}).Array
+	fmt.Printf("%s SENTINEL %s mymaster -> %d entries\n", s.name, sub, len(instances))
+	for _, instance := range instances {
+		fields := fieldMap(instance)
+		parts := make([]string, len(names))
+		for i, name := range names {
+			parts[i] = name + "=" + fields[name]
+		}
+		fmt.Printf("  %s\n", strings.Join(parts, " "))
+	}
+}
+
+// printRole prints ROLE with the offsets, which depend on timing, masked
+func printRole(c *client) {
+	role := c.run([]string{"ROLE"})
+	parts := make([]string, 0, len(role.Array))
+	for i, v := range role.Array {
+		switch {
+		case role.Array[0].Bulk == "master" && i == 1:
+			parts = append(parts, "<offset>")
+		case role.Array[0].Bulk == "master" && i == 2:
+			parts = append(parts, fmt.Sprintf("<%d replicas>", len(v.Array)))
+		case role.Array[0].Bulk == "slave" && i == 3:
+			// connecting while the link comes up
+			parts = append(parts, "<state>")
+		case role.Array[0].Bulk == "slave" && i == 4:
+			parts = append(parts, "<offset>")
+		default:
+			parts = append(parts, formatResponse(v))
+		}
+	}
+	fmt.Printf("%s [ROLE] -> [%s]\n", c.name, strings.Join(parts, ", "))
+}
+
+// subscriber is a connection subscribed to sentinel events
+type subscriber struct {
+	conn   net.Conn
+	parser *resp.Parser
+}
+
+func subscribe(s *client, channel string) *subscriber {
+	conn, err := net.Dial("tcp", "127.0.0.1:"+s.port)
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	sub := &subscriber{conn: conn, parser: resp.NewParser(conn)}
+	if err := resp.NewWriter(conn).Write(commandValue([]string{"SUBSCRIBE", channel})); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	sub.receive(time.Second)
+	return sub
+}
+
+// receive reads the next message
+func (sub *subscriber) receive(timeout time.Duration) resp.Value {
+	sub.conn.SetReadDeadline(time.Now().Add(timeout))
+	msg, err := sub.parser.Read()
+	if err != nil {
+		log.Fatalf("Error reading message: %v", err)
+	}
+	return msg
+}
+
+func commandValue(args []string) resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+	return resp.NewArray(values)
+}
+
+// run sends a command without printing the exchange
+func (c *client) run(args []string) resp.Value {
+	if err := c.writer.Write(commandValue(args)); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+	response, err := c.parser.Read()
+	if err != nil {
+		log.Fatalf("Error reading response: %v", err)
+	}
+	return response
+}
+
+func (c *client) send(args []string) resp.Value {
+	response := c.run(args)
+	fmt.Printf("%s %v -> %s\n", c.name, args, formatResponse(response))
+	return response
+}
+
+func formatResponse(value resp.Value) string {
+	switch value.Type {
+	case "string":
+		return value.Str
+	case "bulk":
+		if value.Null {
+			return "(nil)"
+		}
+		return value.Bulk
+	case "integer":
+		return fmt.Sprintf("(integer) %d", value.Num)
+	case "error":
+		return fmt.Sprintf("(error) %s", value.Str)
+	case "array", "push", "map":
+		if value.Null {
+			return "(nil)"
+		}
+		result := "["
+		for i, v := range value.Array {
+			if i > 0 {
+				result += ", "
+			}
+			result += formatResponse(v)
+		}
+		return result + "]"
+	default:
+		return fmt.Sprintf("Unknown type: %s", value.Type)
+	}
+}
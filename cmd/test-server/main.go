@@ -40,6 +40,9 @@ func main() {
 	// Test error handling
 	testErrors(writer, parser)
 
+	// Test a client that closes its side right after its commands
+	testHalfClose()
+
 	fmt.Println("\n=== All tests completed! ===")
 }
 
@@ -121,3 +124,39 @@ func testErrors(writer *resp.Writer, parser *resp.Parser) {
 	response = sendCommand(writer, parser, []string{"GET"})
 	fmt.Printf("GET (missing key) -> (error) %s\n", response.Str)
 }
+
+func testHalfClose() {
+	fmt.Println("\nTest 5: Replies after the client half-closes")
+
+	conn, err := net.Dial("tcp", "localhost:6379")
+	if err != nil {
+		fmt.Printf("Failed to connect to server: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	writer := resp.NewWriter(conn)
+	parser := resp.NewParser(conn)
+	for _, command := range [][]string{{"SET", "halfclose", "value"}, {"GET", "halfclose"}} {
+		var args []resp.Value
+		for _, arg := range command {
+			args = append(args, resp.NewBulkString(arg))
+		}
+		writer.Write(resp.NewArray(args))
+	}
+	// The server still owes the replies of the commands sent before
+	conn.(*net.TCPConn).CloseWrite()
+
+	response, err := parser.Read()
+	if err != nil {
+		fmt.Printf("SET halfclose value -> lost: %v\n", err)
+		return
+	}
+	fmt.Printf("SET halfclose value -> %s\n", response.Str)
+	response, err = parser.Read()
+	if err != nil {
+		fmt.Printf("GET halfclose -> lost: %v\n", err)
+		return
+	}
+	fmt.Printf("GET halfclose -> %s\n", response.Bulk)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-learning/pkg/resp"
+)
+
+const smallerIDErr = "(error) ERR The ID specified in XADD is equal or smaller than the target stream top item"
+
+func main() {
+	fmt.Println("=== Testing Redis Streams ===")
+
+	consumer := connect()
+	defer consumer.Close()
+	producer := connect()
+	defer producer.Close()
+
+	cw, cp := resp.NewWriter(consumer), resp.NewParser(consumer)
+	pw, pp := resp.NewWriter(producer), resp.NewParser(producer)
+	fmt.Println("Connected to Redis server!")
+	fmt.Println()
+
+	// Test XADD with explicit, partial and automatic IDs
+	fmt.Println("Test 1: XADD IDs")
+	run(cw, cp, []string{"DEL", "s"})
+	expect(cw, cp, []string{"XADD", "s", "1-1", "f", "a"}, "1-1")
+	expect(cw, cp, []string{"XADD", "s", "1-*", "f", "b"}, "1-2")
+	expect(cw, cp, []string{"XADD", "s", "2-*", "f", "c"}, "2-0")
+	expect(cw, cp, []string{"XADD", "s", "2", "f", "d"}, smallerIDErr)
+	expect(cw, cp, []string{"XADD", "s", "1-5", "f", "d"}, smallerIDErr)
+	expect(cw, cp, []string{"XADD", "s", "2-0", "f", "d"}, smallerIDErr)
+	expect(cw, cp, []string{"XADD", "s", "1-*", "f", "d"}, smallerIDErr)
+	expect(cw, cp, []string{"XADD", "s", "5", "f", "d"}, "5-0")
+	auto := run(cw, cp, []string{"XADD", "s", "*", "f", "e"}).Bulk
+	ms, _, _ := strings.Cut(auto, "-")
+	autoMs, _ := strconv.ParseInt(ms, 10, 64)
+	check(fmt.Sprintf("XADD * generated %s from the clock", auto), time.Since(time.UnixMilli(autoMs)).Abs() < time.Minute)
+	expect(cw, cp, []string{"XADD", "s", "5-1", "f", "d"}, smallerIDErr)
+	expect(cw, cp, []string{"XLEN", "s"}, "(integer) 5")
+	run(cw, cp, []string{"DEL", "zero"})
+	expect(cw, cp, []string{"XADD", "zero", "0-0", "f", "v"}, "(error) ERR The ID specified in XADD must be greater than 0-0")
+	expect(cw, cp, []string{"XADD", "zero", "0-*", "f", "v"}, "0-1")
+	expect(cw, cp, []string{"XADD", "s", "abc", "f", "v"}, "(error) ERR Invalid stream ID specified as stream command argument")
+	expect(cw, cp, []string{"XADD", "s", "*", "f"}, "(error) ERR wrong number of arguments for 'xadd' command")
+	run(cw, cp, []string{"DEL", "nostream"})
+	expect(cw, cp, []string{"XADD", "nostream", "NOMKSTREAM", "*", "f", "v"}, "(nil)")
+	expect(cw, cp, []string{"TYPE", "nostream"}, "none")
+	expect(cw, cp, []string{"XADD", "zero", "NOMKSTREAM", "1-0", "f", "v"}, "1-0")
+	fmt.Println()
+
+	// Test trimming with MAXLEN and MINID, exact and approximate. Nodes hold
+	// 100 entries, and approximate trimming only removes whole nodes.
+	fmt.Println("Test 2: MAXLEN, MINID and LIMIT")
+	fill(cw, cp, "t", 250)
+	expect(cw, cp, []string{"XADD", "t", "MAXLEN", "=", "200", "251-1", "f", "v"}, "251-1")
+	expect(cw, cp, []string{"XLEN", "t"}, "(integer) 200")
+	expect(cw, cp, []string{"XRANGE", "t", "-", "+", "COUNT", "1"}, "[[52-1, [f, 52]]]")
+	expect(cw, cp, []string{"XTRIM", "t", "MAXLEN", "150"}, "(integer) 50")
+	expect(cw, cp, []string{"XTRIM", "t", "MAXLEN", "150"}, "(integer) 0")
+	fill(cw, cp, "t", 250)
+	expect(cw, cp, []string{"XTRIM", "t", "MAXLEN", "~", "120"}, "(integer) 100")
+	expect(cw, cp, []string{"XLEN", "t"}, "(integer) 150")
+	expect(cw, cp, []string{"XTRIM", "t", "MAXLEN", "~", "120"}, "(integer) 0")
+	fill(cw, cp, "t", 250)
+	expect(cw, cp, []string{"XTRIM", "t", "MAXLEN", "~", "0", "LIMIT", "100"}, "(integer) 100")
+	expect(cw, cp, []string{"XTRIM", "t", "MAXLEN", "~", "0", "LIMIT", "99"}, "(integer) 0")
+	fill(cw, cp, "t", 250)
+	expect(cw, cp, []string{"XTRIM", "t", "MINID", "200"}, "(integer) 199")
+	expect(cw, cp, []string{"XRANGE", "t", "-", "+", "COUNT", "1"}, "[[200-1, [f, 200]]]")
+	fill(cw, cp, "t", 250)
+	expect(cw, cp, []string{"XTRIM", "t", "MINID", "~", "150"}, "(integer) 100")
+	expect(cw, cp, []string{"XTRIM", "t", "MINID", "=", "150"}, "(integer) 49")
+	expect(cw, cp, []string{"XADD", "t", "MINID", "~", "300", "LIMIT", "100", "251-1", "f", "v"}, "251-1")
+	expect(cw, cp, []string{"XLEN", "t"}, "(integer) 51")
+	expect(cw, cp, []string{"XTRIM", "t", "MAXLEN", "10", "LIMIT", "10"}, "(error) ERR syntax error, LIMIT cannot be used without the special ~ option")
+	expect(cw, cp, []string{"XTRIM", "t", "MAXLEN", "-1"}, "(error) ERR The MAXLEN argument must be >= 0.")
+	expect(cw, cp, []string{"XTRIM", "t", "MAXLEN", "1", "MINID", "1"}, "(error) ERR syntax error, MAXLEN and MINID options at the same time are not compatible")
+	fmt.Println()
+
+	// Test XRANGE and XREVRANGE with exclusive bounds and COUNT
+	fmt.Println("Test 3: XRANGE and XREVRANGE")
+	run(cw, cp, []string{"DEL", "r"})
+	for _, id := range []string{"1-1", "1-2", "2-1", "3-1"} {
+		run(cw, cp, []string{"XADD", "r", id, "id", id})
+	}
+	expect(cw, cp, []string{"XRANGE", "r", "-", "+"}, "[[1-1, [id, 1-1]], [1-2, [id, 1-2]], [2-1, [id, 2-1]], [3-1, [id, 3-1]]]")
+	expect(cw, cp, []string{"XRANGE", "r", "1", "2"}, "[[1-1, [id, 1-1]], [1-2, [id, 1-2]], [2-1, [id, 2-1]]]")
+	expect(cw, cp, []string{"XRANGE", "r", "(1-1", "+", "COUNT", "2"}, "[[1-2, [id, 1-2]], [2-1, [id, 2-1]]]")
+	expect(cw, cp, []string{"XRANGE", "r", "(1-2", "(3-1"}, "[[2-1, [id, 2-1]]]")
+	expect(cw, cp, []string{"XRANGE", "r", "(2-1", "(3-1"}, "[]")
+	expect(cw, cp, []string{"XRANGE", "r", "-", "+", "COUNT", "0"}, "[]")
+	expect(cw, cp, []string{"XREVRANGE", "r", "+", "-", "COUNT", "2"}, "[[3-1, [id, 3-1]], [2-1, [id, 2-1]]]")
+	expect(cw, cp, []string{"XREVRANGE", "r", "(3-1", "(1-1"}, "[[2-1, [id, 2-1]], [1-2, [id, 1-2]]]")
+	expect(cw, cp, []string{"XREVRANGE", "r", "2", "1"}, "[[2-1, [id, 2-1]], [1-2, [id, 1-2]], [1-1, [id, 1-1]]]")
+	expect(cw, cp, []string{"XRANGE", "r", "(18446744073709551615-18446744073709551615", "+"}, "(error) ERR invalid start ID for the interval")
+	expect(cw, cp, []string{"XRANGE", "r", "-", "(0-0"}, "(error) ERR invalid end ID for the interval")
+	expect(cw, cp, []string{"XRANGE", "r", "-", "+", "COUNT"}, "(error) ERR syntax error")
+	expect(cw, cp, []string{"XRANGE", "r", "-", "+", "COUNT", "3", "COUNT", "1"}, "[[1-1, [id, 1-1]]]")
+	expect(cw, cp, []string{"XRANGE", "nostream", "-", "+"}, "[]")
+	fmt.Println()
+
+	// Test XDEL and XLEN
+	fmt.Println("Test 4: XDEL and XLEN")
+	expect(cw, cp, []string{"XDEL", "r", "1-2", "9-9"}, "(integer) 1")
+	expect(cw, cp, []string{"XDEL", "r", "1-2"}, "(integer) 0")
+	expect(cw, cp, []string{"XLEN", "r"}, "(integer) 3")
+	expect(cw, cp, []string{"XRANGE", "r", "-", "+"}, "[[1-1, [id, 1-1]], [2-1, [id, 2-1]], [3-1, [id, 3-1]]]")
+	expect(cw, cp, []string{"XLEN", "nostream"}, "(integer) 0")
+	run(cw, cp, []string{"SET", "str", "value"})
+	expect(cw, cp, []string{"XLEN", "str"}, "(error) WRONGTYPE Operation against a key holding the wrong kind of value")
+	fmt.Println()
+
+	// Test XREAD across several streams
+	fmt.Println("Test 5: XREAD")
+	run(cw, cp, []string{"DEL", "r2"})
+	run(cw, cp, []string{"XADD", "r2", "5-1", "id", "5-1"})
+	run(cw, cp, []string{"XADD", "r2", "6-1", "id", "6-1"})
+	expect(cw, cp, []string{"XREAD", "COUNT", "1", "STREAMS", "r", "r2", "0", "0"},
+		"[[r, [[1-1, [id, 1-1]]]], [r2, [[5-1, [id, 5-1]]]]]")
+	expect(cw, cp, []string{"XREAD", "COUNT", "2", "STREAMS", "r", "r2", "1-1", "5-1"},
+		"[[r, [[2-1, [id, 2-1]], [3-1, [id, 3-1]]]], [r2, [[6-1, [id, 6-1]]]]]")
+	expect(cw, cp, []string{"XREAD", "STREAMS", "r", "nostream", "r2", "3-1", "0", "5-1"}, "[[r2, [[6-1, [id, 6-1]]]]]")
+	expect(cw, cp, []string{"XREAD", "STREAMS", "r", "r2", "3-1", "6-1"}, "(nil)")
+	expect(cw, cp, []string{"XREAD", "STREAMS", "r", "r2", "0"}, "(error) ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+	expect(cw, cp, []string{"XREAD", "BLOCK", "-1", "STREAMS", "r", "0"}, "(error) ERR timeout is negative")
+	fmt.Println()
+
+	// Test XREAD BLOCK with $ waiting for entries added later
+	fmt.Println("Test 6: XREAD BLOCK")
+	start := time.Now()
+	expect(cw, cp, []string{"XREAD", "BLOCK", "200", "STREAMS", "r", "$"}, "(nil)")
+	check("XREAD BLOCK 200 timed out after 200ms", time.Since(start) >= 200*time.Millisecond)
+	done := later(pw, pp, []string{"XADD", "r2", "7-1", "id", "7-1"})
+	expect(cw, cp, []string{"XREAD", "BLOCK", "5000", "STREAMS", "r", "r2", "$", "$"}, "[[r2, [[7-1, [id, 7-1]]]]]")
+	<-done
+	run(cw, cp, []string{"DEL", "fresh"})
+	done = later(pw, pp, []string{"XADD", "fresh", "1-1", "id", "1-1"})
+	expect(cw, cp, []string{"XREAD", "BLOCK", "0", "STREAMS", "fresh", "$"}, "[[fresh, [[1-1, [id, 1-1]]]]]")
+	<-done
+	expect(pw, pp, []string{"PING"}, "PONG")
+	fmt.Println()
+
+	// Test creating and deleting groups and consumers
+	fmt.Println("Test 7: XGROUP")
+	run(cw, cp, []string{"DEL", "g"})
+	expect(cw, cp, []string{"XGROUP", "CREATE", "g", "grp", "$"}, "(error) ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	expect(cw, cp, []string{"XGROUP", "CREATE", "g", "grp", "$", "MKSTREAM"}, "OK")
+	expect(cw, cp, []string{"TYPE", "g"}, "stream")
+	expect(cw, cp, []string{"XLEN", "g"}, "(integer) 0")
+	expect(cw, cp, []string{"XGROUP", "CREATE", "g", "grp", "$"}, "(error) BUSYGROUP Consumer Group name already exists")
+	expect(cw, cp, []string{"XGROUP", "CREATECONSUMER", "g", "grp", "alice"}, "(integer) 1")
+	expect(cw, cp, []string{"XGROUP", "CREATECONSUMER", "g", "grp", "alice"}, "(integer) 0")
+	expect(cw, cp, []string{"XGROUP", "CREATECONSUMER", "g", "nogrp", "alice"}, "(error) NOGROUP No such key 'g' or consumer group 'nogrp'")
+	expectFields(cw, cp, []string{"XINFO", "CONSUMERS", "g", "grp"}, []string{"name", "pending", "inactive"}, "[name=alice pending=0 inactive=-1]")
+	expect(cw, cp, []string{"XGROUP", "DELCONSUMER", "g", "grp", "alice"}, "(integer) 0")
+	expect(cw, cp, []string{"XINFO", "CONSUMERS", "g", "grp"}, "[]")
+	expect(cw, cp, []string{"XGROUP", "DESTROY", "g", "grp"}, "(integer) 1")
+	expect(cw, cp, []string{"XGROUP", "DESTROY", "g", "grp"}, "(integer) 0")
+	expect(cw, cp, []string{"XGROUP", "CREATE", "g", "grp", "0", "ENTRIESREAD", "-2"}, "(error) ERR value for ENTRIESREAD must be positive or -1")
+	expect(cw, cp, []string{"XGROUP", "SETID", "g", "nogrp", "0"}, "(error) NOGROUP No such key 'g' or consumer group 'nogrp'")
+	expect(cw, cp, []string{"XGROUP", "FOO", "g"}, "(error) ERR unknown subcommand 'FOO'. Try XGROUP HELP.")
+	fmt.Println()
+
+	// Test entries-read and lag, following the example in the XINFO GROUPS
+	// documentation
+	fmt.Println("Test 8: Consumer group lag")
+	run(cw, cp, []string{"DEL", "x"})
+	for i, data := range []string{"a", "b", "c", "d", "e"} {
+		run(cw, cp, []string{"XADD", "x", fmt.Sprintf("%d-0", i+1), "data", data})
+	}
+	expect(cw, cp, []string{"XGROUP", "CREATE", "x", "g1", "0"}, "OK")
+	expect(cw, cp, []string{"XINFO", "GROUPS", "x"}, "[[name, g1, consumers, (integer) 0, pending, (integer) 0, last-delivered-id, 0-0, entries-read, (nil), lag, (integer) 5]]")
+	expect(cw, cp, []string{"XREADGROUP", "GROUP", "g1", "c1", "COUNT", "1", "STREAMS", "x", ">"}, "[[x, [[1-0, [data, a]]]]]")
+	expect(cw, cp, []string{"XINFO", "GROUPS", "x"}, "[[name, g1, consumers, (integer) 1, pending, (integer) 1, last-delivered-id, 1-0, entries-read, (integer) 1, lag, (integer) 4]]")
+	expect(cw, cp, []string{"XGROUP", "SETID", "x", "g1", "3-0", "ENTRIESREAD", "3"}, "OK")
+	expect(cw, cp, []string{"XINFO", "GROUPS", "x"}, "[[name, g1, consumers, (integer) 1, pending, (integer) 1, last-delivered-id, 3-0, entries-read, (integer) 3, lag, (integer) 2]]")
+	expect(cw, cp, []string{"XGROUP", "CREATE", "x", "g2", "$"}, "OK")
+	expect(cw, cp, []string{"XGROUP", "CREATE", "x", "g3", "0", "ENTRIESREAD", "4"}, "OK")
+	expect(cw, cp, []string{"XINFO", "GROUPS", "x"}, "[[name, g1, consumers, (integer) 1, pending, (integer) 1, last-delivered-id, 3-0, entries-read, (integer) 3, lag, (integer) 2], "+
+		"[name, g2, consumers, (integer) 0, pending, (integer) 0, last-delivered-id, 5-0, entries-read, (integer) 5, lag, (integer) 0], "+
+		"[name, g3, consumers, (integer) 0, pending, (integer) 0, last-delivered-id, 0-0, entries-read, (integer) 4, lag, (integer) 1]]")
+	fmt.Println()
+
+	// Test reading new entries, history and NOACK
+	fmt.Println("Test 9: XREADGROUP")
+	run(cw, cp, []string{"DEL", "q"})
+	for i, f := range []string{"a", "b", "c"} {
+		run(cw, cp, []string{"XADD", "q", fmt.Sprintf("%d-0", i+1), "f", f})
+	}
+	run(cw, cp, []string{"XGROUP", "CREATE", "q", "grp", "0"})
+	expect(cw, cp, []string{"XREADGROUP", "GROUP", "grp", "alice", "COUNT", "2", "STREAMS", "q", ">"}, "[[q, [[1-0, [f, a]], [2-0, [f, b]]]]]")
+	expect(cw, cp, []string{"XREADGROUP", "GROUP", "grp", "bob", "STREAMS", "q", ">"}, "[[q, [[3-0, [f, c]]]]]")
+	expect(cw, cp, []string{"XREADGROUP", "GROUP", "grp", "bob", "STREAMS", "q", ">"}, "(nil)")
+	expect(cw, cp, []string{"XREADGROUP", "GROUP", "grp", "alice", "STREAMS", "q", "0"}, "[[q, [[1-0, [f, a]], [2-0, [f, b]]]]]")
+	expect(cw, cp, []string{"XREADGROUP", "GROUP", "grp", "alice", "COUNT", "1", "STREAMS", "q", "1-0"}, "[[q, [[2-0, [f, b]]]]]")
+	expect(cw, cp, []string{"XREADGROUP", "GROUP", "grp", "carol", "STREAMS", "q", "0"}, "[[q, []]]")
+	run(cw, cp, []string{"XADD", "q", "4-0", "f", "d"})
+	expect(cw, cp, []string{"XREADGROUP", "GROUP", "grp", "carol", "NOACK", "STREAMS", "q", ">"}, "[[q, [[4-0, [f, d]]]]]")
+	expect(cw, cp, []string{"XREADGROUP", "GROUP", "grp", "carol", "STREAMS", "q", "0"}, "[[q, []]]")
+	expect(cw, cp, []string{"XPENDING", "q", "grp"}, "[(integer) 3, 1-0, 3-0, [[alice, 2], [bob, 1]]]")
+	expect(cw, cp, []string{"XREADGROUP", "GROUP", "grp", "alice", "STREAMS", "q", "$"}, "(error) ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.")
+	expect(cw, cp, []string{"XREADGROUP", "GROUP", "nogrp", "alice", "STREAMS", "q", ">"}, "(error) NOGROUP No such key 'q' or consumer group 'nogrp' in XREADGROUP with GROUP option")
+	fmt.Println()
+
+	// Test the extended form of XPENDING. Idle times vary, so only the ID,
+	// owner and delivery count of each entry are compared.
+	fmt.Println("Test 10: XPENDING")
+	expect(cw, cp, []string{"XPENDING", "q", "nogrp"}, "(error) NOGROUP No such key 'q' or consumer group 'nogrp'")
+	expectPending(cw, cp, []string{"XPENDING", "q", "grp", "-", "+", "10"}, "1-0/alice/2 2-0/alice/3 3-0/bob/1")
+	expectPending(cw, cp, []string{"XPENDING", "q", "grp", "-", "+", "10", "bob"}, "3-0/bob/1")
+	expectPending(cw, cp, []string{"XPENDING", "q", "grp", "(1-0", "+", "1"}, "2-0/alice/3")
+	expectPending(cw, cp, []string{"XPENDING", "q", "grp", "-", "+", "10", "nobody"}, "")
+	expectPending(cw, cp, []string{"XPENDING", "q", "grp", "IDLE", "4000", "-", "+", "10"}, "")
+	expect(cw, cp, []string{"XCLAIM", "q", "grp", "bob", "0", "3-0", "IDLE", "5000", "JUSTID"}, "[3-0]")
+	expectPending(cw, cp, []string{"XPENDING", "q", "grp", "IDLE", "4000", "-", "+", "10"}, "3-0/bob/1")
+	expect(cw, cp, []string{"XPENDING", "q", "grp", "-", "+"}, "(error) ERR syntax error")
+	fmt.Println()
+
+	// Test XCLAIM and XAUTOCLAIM, including entries deleted from the stream
+	fmt.Println("Test 11: XCLAIM and XAUTOCLAIM")
+	expect(cw, cp, []string{"XCLAIM", "q", "grp", "bob", "3600000", "1-0"}, "[]")
+	expect(cw, cp, []string{"XCLAIM", "q", "grp", "bob", "0", "1-0"}, "[[1-0, [f, a]]]")
+	expectPending(cw, cp, []string{"XPENDING", "q", "grp", "-", "+", "10"}, "1-0/bob/3 2-0/alice/3 3-0/bob/1")
+	expect(cw, cp, []string{"XDEL", "q", "2-0"}, "(integer) 1")
+	expect(cw, cp, []string{"XREADGROUP", "GROUP", "grp", "alice", "STREAMS", "q", "0"}, "[[q, [[2-0, (nil)]]]]")
+	expect(cw, cp, []string{"XCLAIM", "q", "grp", "bob", "0", "2-0"}, "[]")
+	expect(cw, cp, []string{"XPENDING", "q", "grp"}, "[(integer) 2, 1-0, 3-0, [[bob, 2]]]")
+	run(cw, cp, []string{"XADD", "q", "5-0", "f", "e"})
+	run(cw, cp, []string{"XADD", "q", "6-0", "f", "f"})
+	expect(cw, cp, []string{"XREADGROUP", "GROUP", "grp", "alice", "STREAMS", "q", ">"}, "[[q, [[5-0, [f, e]], [6-0, [f, f]]]]]")
+	expect(cw, cp, []string{"XDEL", "q", "5-0"}, "(integer) 1")
+	expect(cw, cp, []string{"XAUTOCLAIM", "q", "grp", "carol", "0", "0-0", "COUNT", "2"}, "[5-0, [[1-0, [f, a]], [3-0, [f, c]]], []]")
+	expect(cw, cp, []string{"XAUTOCLAIM", "q", "grp", "carol", "0", "5-0", "JUSTID"}, "[0-0, [6-0], [5-0]]")
+	expect(cw, cp, []string{"XAUTOCLAIM", "q", "grp", "carol", "3600000", "-"}, "[0-0, [], []]")
+	expectPending(cw, cp, []string{"XPENDING", "q", "grp", "-", "+", "10"}, "1-0/carol/4 3-0/carol/2 6-0/carol/1")
+	expect(cw, cp, []string{"XAUTOCLAIM", "q", "grp", "carol", "0", "0-0", "COUNT", "0"}, "(error) ERR COUNT must be > 0")
+	expect(cw, cp, []string{"XCLAIM", "q", "grp", "carol", "abc", "1-0"}, "(error) ERR Invalid min-idle-time argument for XCLAIM")
+	fmt.Println()
+
+	// Test XACK and the XINFO views of the stream, groups and consumers
+	fmt.Println("Test 12: XACK and XINFO")
+	expect(cw, cp, []string{"XACK", "q", "grp", "1-0", "3-0", "9-0"}, "(integer) 2")
+	expect(cw, cp, []string{"XACK", "q", "grp", "1-0"}, "(integer) 0")
+	expect(cw, cp, []string{"XACK", "q", "nogrp", "1-0"}, "(integer) 0")
+	expect(cw, cp, []string{"XPENDING", "q", "grp"}, "[(integer) 1, 6-0, 6-0, [[carol, 1]]]")
+	expectFields(cw, cp, []string{"XINFO", "CONSUMERS", "q", "grp"}, []string{"name", "pending"}, "[name=alice pending=0] [name=bob pending=0] [name=carol pending=1]")
+	expect(cw, cp, []string{"XINFO", "GROUPS", "q"}, "[[name, grp, consumers, (integer) 3, pending, (integer) 1, last-delivered-id, 6-0, entries-read, (integer) 6, lag, (integer) 0]]")
+	expectFields(cw, cp, []string{"XINFO", "STREAM", "q"}, []string{"length", "last-generated-id", "max-deleted-entry-id", "entries-added", "recorded-first-entry-id", "groups"},
+		"[length=4 last-generated-id=6-0 max-deleted-entry-id=5-0 entries-added=6 recorded-first-entry-id=1-0 groups=1]")
+	run(cw, cp, []string{"XADD", "q", "7-0", "f", "g"})
+	expect(cw, cp, []string{"XINFO", "GROUPS", "q"}, "[[name, grp, consumers, (integer) 3, pending, (integer) 1, last-delivered-id, 6-0, entries-read, (integer) 6, lag, (integer) 1]]")
+	expect(cw, cp, []string{"XINFO", "GROUPS", "nostream"}, "(error) ERR no such key")
+	fmt.Println()
+
+	// Test XREADGROUP BLOCK woken by XADD, and by the group going away
+	fmt.Println("Test 13: XREADGROUP BLOCK")
+	expect(cw, cp, []string{"XREADGROUP", "GROUP", "grp", "dave", "BLOCK", "5000", "STREAMS", "q", ">"}, "[[q, [[7-0, [f, g]]]]]")
+	done = later(pw, pp, []string{"XADD", "q", "8-0", "f", "h"})
+	expect(cw, cp, []string{"XREADGROUP", "GROUP", "grp", "dave", "BLOCK", "5000", "STREAMS", "q", ">"}, "[[q, [[8-0, [f, h]]]]]")
+	<-done
+	expectPending(cw, cp, []string{"XPENDING", "q", "grp", "-", "+", "10", "dave"}, "7-0/dave/1 8-0/dave/1")
+	start = time.Now()
+	expect(cw, cp, []string{"XREADGROUP", "GROUP", "grp", "dave", "BLOCK", "200", "STREAMS", "q", ">"}, "(nil)")
+	check("XREADGROUP BLOCK 200 timed out after 200ms", time.Since(start) >= 200*time.Millisecond)
+	done = later(pw, pp, []string{"XGROUP", "DESTROY", "q", "grp"})
+	reply := run(cw, cp, []string{"XREADGROUP", "GROUP", "grp", "dave", "BLOCK", "5000", "STREAMS", "q", ">"})
+	<-done
+	check("XGROUP DESTROY fails a blocked XREADGROUP with NOGROUP: "+formatResponse(reply), reply.Type == "error" && strings.HasPrefix(reply.Str, "NOGROUP"))
+	fmt.Println()
+
+	fmt.Println("=== All stream tests completed! ===")
+}
+
+// fill replaces key with a stream of n entries with IDs 1-1 to n-1
+func fill(writer *resp.Writer, parser *resp.Parser, key string, n int) {
+	run(writer, parser, []string{"DEL", key})
+	for i := 1; i <= n; i++ {
+		run(writer, parser, []string{"XADD", key, fmt.Sprintf("%d-1", i), "f", strconv.Itoa(i)})
+	}
+}
+
+// later sends args 200ms from now, from another goroutine. The returned
+// channel is closed once the reply has been read.
+func later(writer *resp.Writer, parser *resp.Parser, args []string) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		time.Sleep(200 * time.Millisecond)
+		run(writer, parser, args)
+	}()
+	return done
+}
+
+func connect() net.Conn {
+	conn, err := net.Dial("tcp", "localhost:6379")
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	return conn
+}
+
+func expect(writer *resp.Writer, parser *resp.Parser, args []string, want string) {
+	got := formatResponse(run(writer, parser, args))
+	status := "OK"
+	if got != want {
+		status = fmt.Sprintf("FAILED, want %s", want)
+	}
+	fmt.Printf("%v -> %s (%s)\n", args, got, status)
+}
+
+// expectPending compares the entries of an extended XPENDING reply as
+// id/consumer/deliveries, ignoring idle times
+func expectPending(writer *resp.Writer, parser *resp.Parser, args []string, want string) {
+	reply := run(writer, parser, args)
+	got := formatResponse(reply)
+	if reply.Type == "array" {
+		var entries []string
+		for _, pe := range reply.Array {
+			entries = append(entries, fmt.Sprintf("%s/%s/%d", pe.Array[0].Bulk, pe.Array[1].Bulk, pe.Array[3].Num))
+		}
+		got = strings.Join(entries, " ")
+	}
+	status := "OK"
+	if got != want {
+		status = fmt.Sprintf("FAILED, want %s", want)
+	}
+	fmt.Printf("%v -> %s (%s)\n", args, got, status)
+}
+
+// expectFields compares some fields of an XINFO reply, which is either a
+// single field/value list or an array of them
+func expectFields(writer *resp.Writer, parser *resp.Parser, args []string, names []string, want string) {
+	reply := run(writer, parser, args)
+	lists := reply.Array
+	if len(lists) > 0 && lists[0].Type != "array" {
+		lists = []resp.Value{reply}
+	}
+	var parts []string
+	for _, list := range lists {
+		var fields []string
+		for _, name := range names {
+			for i := 0; i+1 < len(list.Array); i += 2 {
+				if list.Array[i].Bulk == name {
+					fields = append(fields, name+"="+strings.TrimPrefix(formatResponse(list.Array[i+1]), "(integer) "))
+				}
+			}
+		}
+		parts = append(parts, "["+strings.Join(fields, " ")+"]")
+	}
+	got := strings.Join(parts, " ")
+	status := "OK"
+	if got != want {
+		status = fmt.Sprintf("FAILED, want %s", want)
+	}
+	fmt.Printf("%v -> %s (%s)\n", args, got, status)
+}
+
+func check(what string, ok bool) {
+	status := "OK"
+	if !ok {
+		status = "FAILED"
+	}
+	fmt.Printf("%s (%s)\n", what, status)
+}
+
+func run(writer *resp.Writer, parser *resp.Parser, args []string) resp.Value {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+
+	if err := writer.Write(resp.NewArray(values)); err != nil {
+		log.Fatalf("Error sending command: %v", err)
+	}
+
+	response, err := parser.Read()
+	if err != nil {
+		log.Fatalf("Error reading response: %v", err)
+	}
+	return response
+}
+
+func formatResponse(value resp.Value) string {
+	switch value.Type {
+	case "string":
+		return value.Str
+	case "bulk":
+		if value.Null {
+			return "(nil)"
+		}
+		return value.Bulk
+	case "integer":
+		return fmt.Sprintf("(integer) %d", value.Num)
+	case "error":
+		return fmt.Sprintf("(error) %s", value.Str)
+	case "array":
+		if value.Null {
+			return "(nil)"
+		}
+		result := "["
+		for i, v := range value.Array {
+			if i > 0 {
+				result += ", "
+			}
+			result += formatResponse(v)
+		}
+		return result + "]"
+	default:
+		return fmt.Sprintf("Unknown type: %s", value.Type)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"redis-learning/pkg/resp"
+)
+
+func main() {
+	fmt.Println("=== Testing Redis Transactions ===")
+
+	conn, err := net.Dial("tcp", "localhost:6379")
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	defer conn.Close()
+
+	writer, parser := resp.NewWriter(conn), resp.NewParser(conn)
+	fmt.Println("Connected to Redis server!")
+	fmt.Println()
+
+	sendCommand(writer, parser, []string{"DEL", "tx:counter"})
+	sendCommand(writer, parser, []string{"DEL", "tx:list"})
+	fmt.Println()
+
+	// Commands are queued and run together by EXEC
+	fmt.Println("Test 1: MULTI/EXEC")
+	sendCommand(writer, parser, []string{"MULTI"})
+	sendCommand(writer, parser, []string{"SET", "tx:counter", "1"})
+	sendCommand(writer, parser, []string{"RPUSH", "tx:list", "a", "b"})
+	sendCommand(writer, parser, []string{"LPOP", "tx:list"})
+	sendCommand(writer, parser, []string{"EXEC"})
+	fmt.Println()
+
+	// A runtime error only fails its own command
+	fmt.Println("Test 2: Runtime errors")
+	sendCommand(writer, parser, []string{"MULTI"})
+	sendCommand(writer, parser, []string{"LPUSH", "tx:counter", "x"})
+	sendCommand(writer, parser, []string{"GET", "tx:counter"})
+	sendCommand(writer, parser, []string{"EXEC"})
+	fmt.Println()
+
+	// Errors detected while queuing abort the whole transaction
+	fmt.Println("Test 3: EXECABORT")
+	sendCommand(writer, parser, []string{"MULTI"})
+	sendCommand(writer, parser, []string{"SET", "tx:counter"})
+	sendCommand(writer, parser, []string{"NOSUCHCOMMAND"})
+	sendCommand(writer, parser, []string{"SET", "tx:counter", "2"})
+	sendCommand(writer, parser, []string{"EXEC"})
+	sendCommand(writer, parser, []string{"GET", "tx:counter"})
+	fmt.Println()
+
+	fmt.Println("Test 4: DISCARD")
+	sendCommand(writer, parser, []string{"MULTI"})
+	sendCommand(writer, parser, []string{"SET", "tx:counter", "3"})
+	sendCommand(writer, parser, []string{"DISCARD"})
+	sendCommand(writer, parser, []string{"GET", "tx:counter"})
+	sendCommand(writer, parser, []string{"EXEC"})
+	fmt.Println()
+
+	// Blocking commands don't block inside a transaction
+	fmt.Println("Test 5: Blocking commands")
+	sendCommand(writer, parser, []string{"MULTI"})
+	sendCommand(writer, parser, []string{"BLPOP", "tx:list", "0"})
+	sendCommand(writer, parser, []string{"BLPOP", "tx:list", "0"})
+	sendCommand(writer, parser, []string{"EXEC"})
+	fmt.Println()
+
+	// A watched key modified by another client makes EXEC fail
+	fmt.Println("Test 6: WATCH")
+	other, err := net.Dial("tcp", "localhost:6379")
+	if err != nil {
+		log.Fatalf("Failed to connect to Redis server: %v", err)
+	}
+	defer other.Close()
+	ow, op := resp.NewWriter(other), resp.NewParser(other)
+
+	sendCommand(writer, parser, []string{"WATCH", "tx:counter"})
+	sendCommand(ow, op, []string{"SET", "tx:counter", "10"})
+	sendCommand(writer, parser, []string{"MULTI"})
+	sendCommand(writer, parser, []string{"SET", "tx:counter", "4"})
+	sendCommand(writer, parser, []string{"EXEC"})
+	sendCommand(writer, parser, []string{"GET", "tx:counter"})
+
+	sendCommand(writer, parser, []string{"WATCH", "tx:counter"})
+	sendCommand(writer, parser, []string{"MULTI"})
+	sendCommand(writer, parser, []string{"SET", "tx:counter", "4"})
+	sendCommand(writer, parser, []string{"EXEC"})
+	sendCommand(writer, parser, []string{"GET", "tx:counter"})
+	fmt.Println()
+
+	fmt.Println("Test 7: UNWATCH and FLUSHALL")
+	sendCommand(writer, parser, []string{"WATCH", "tx:counter"})
+	sendCommand(ow, op, []string{"SET", "tx:counter", "11"})
+	sendCommand(writer, parser, []string{"UNWATCH"})
+	sendCommand(writer, parser, []string{"MULTI"})
+	sendCommand(writer, parser, []string{"GET", "tx:counter"})
+	sendCommand(writer, parser, []string{"EXEC"})
+	sendCommand(writer, parser, []string{"WATCH", "tx:counter"})
+	sendCommand(ow, op, []string{"FLUSHALL"})
+	sendCommand(writer, parser, []string{"MULTI"})
+	sendCommand(writer, parser, []string{"GET", "tx:counter"})
+	sendCommand(writer, parser, []string{"EXEC"})
+	fmt.Println()
+
+	fmt.Println("=== All transaction tests completed! ===")
+}
+
+func sendCommand(writer *resp.Writer, parser *resp.Parser, args []string) {
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+
+	if err := writer.Write(resp.NewArray(values)); err != nil {
+		log.Printf("Error sending command: %v", err)
+		return
+	}
+
+	response, err := parser.Read()
+	if err != nil {
+		log.Printf("Error reading response: %v", err)
+		return
+	}
+
+	fmt.Printf("%v -> %s\n", args, formatResponse(response))
+}
+
+func formatResponse(value resp.Value) string {
+	switch value.Type {
+	case "string":
+		return value.Str
+	case "bulk":
+		if value.Null {
+			return "(nil)"
+		}
+		return value.Bulk
+	case "integer":
+		return fmt.Sprintf("(integer) %d", value.Num)
+	case "error":
+		return fmt.Sprintf("(error) %s", value.Str)
+	case "array", "push":
+		if value.Null {
+			return "(nil)"
+		}
+		result := "["
+		for i, v := range value.Array {
+			if i > 0 {
+				result += ", "
+			}
+			result += formatResponse(v)
+		}
+		return result + "]"
+	default:
+		return fmt.Sprintf("Unknown type: %s", value.Type)
+	}
+}
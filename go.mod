@@ -1,3 +1,5 @@
 module redis-learning
 
 go 1.23.0
+
+require github.com/yuin/gopher-lua v1.1.1
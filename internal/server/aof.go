@@ -0,0 +1,692 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"redis-learning/pkg/resp"
+)
+
+// appendfsync policies: how often the append only file is synced to disk
+const (
+	aofFsyncNo       = iota // let the OS decide
+	aofFsyncEverysec        // once per second, in the background
+	aofFsyncAlways          // before replying to the commands written
+)
+
+var aofFsyncNames = []string{"no", "everysec", "always"}
+
+// Append only file defaults
+const (
+	defaultAppendFilename           = "appendonly.aof"
+	defaultAppendDirname            = "appendonlydir"
+	defaultAutoAOFRewritePercentage = 100
+	defaultAutoAOFRewriteMinSize    = 64 * 1024 * 1024
+
+	// After a failed rewrite, scheduled ones are only retried after this
+	// long
+	aofRewriteRetryDelay = 5 * time.Second
+)
+
+// aofState is what the server tracks about the append only file.
+//
+// The log is split in several files, listed by a manifest in the AOF
+// directory: a base file holding the dataset as it was when it was last
+// rewritten, as an RDB file or as commands, followed by incremental files
+// holding the commands run since. A rewrite starts a new incremental file,
+// so that nothing written meanwhile is lost, and replaces the base file
+// and the older incremental files once done.
+type aofState struct {
+	enabled        bool
+	dirname        string
+	filename       string
+	fsync          int
+	loadTruncated  bool // whether a truncated last command is tolerated
+	useRDBPreamble bool // whether base files are written as RDB files
+
+	// Rewrite automatically once the log grew by rewritePercentage since
+	// the last rewrite, and is at least rewriteMinSize bytes
+	rewritePercentage int
+	rewriteMinSize    int64
+
+	// manifest lists the files of the log, from loading or enabling it
+	manifest *aofManifest
+
+	// file is the last incremental file, open from the end of loading
+	// while the AOF is enabled. buf holds the commands propagated since the
+	// last write to it.
+	file *os.File
+	buf  []byte
+
+	unsynced        bool // written to since the last fsync
+	lastFsync       time.Time
+	fsyncInProgress atomic.Bool
+
+	// fsyncedOffset is the replication offset the log is synced up to, for
+	// WAITAOF. It is -1 while the AOF is off, or until the first rewrite
+	// after turning it on completes.
+	fsyncedOffset atomic.Int64
+
+	// Writes are refused while the file can't be written
+	lastWriteErr error
+
+	currentSize     int64 // bytes in the files of the manifest
+	incrSize        int64 // bytes in the last incremental file
+	rewriteBaseSize int64 // currentSize after the last rewrite or load
+
+	// When the AOF is turned on at runtime, its files only become the ones
+	// loaded at startup once the first rewrite wrote the dataset
+	waitRewrite bool
+
+	// The running rewrite, if any
+	rewrite          *aofRewriteJob
+	rewriteScheduled bool
+	lastRewriteTry   time.Time
+	lastRewriteOK    bool
+	lastRewriteTime  time.Duration
+	lastCowSize      int64 // bytes the last rewrite preserved for writes
+	rewrites         int
+}
+
+// parseAppendFsync parses an appendfsync policy name
+func parseAppendFsync(value string) (int, error) {
+	for policy, name := range aofFsyncNames {
+		if strings.EqualFold(value, name) {
+			return policy, nil
+		}
+	}
+	return 0, errors.New("argument(s) must be one of the following: always, everysec, no")
+}
+
+// Kinds of files listed in the manifest
+const (
+	aofBaseFile    = 'b'
+	aofHistoryFile = 'h' // replaced by a rewrite, not deleted yet
+	aofIncrFile    = 'i'
+)
+
+// aofFile is a file of the append only log
+type aofFile struct {
+	name string
+	seq  int
+	kind byte
+}
+
+// aofManifest lists the files making up the append only log, in the order
+// they are loaded
+type aofManifest struct {
+	base    *aofFile
+	incrs   []*aofFile
+	history []*aofFile
+
+	// Last sequence numbers used, so that names are never reused
+	baseSeq int
+	incrSeq int
+}
+
+// String renders the manifest as written to disk, one file per line
+func (m *aofManifest) String() string {
+	var b strings.Builder
+	files := make([]*aofFile, 0, 1+len(m.history)+len(m.incrs))
+	if m.base != nil {
+		files = append(files, m.base)
+	}
+	files = append(files, m.history...)
+	files = append(files, m.incrs...)
+	for _, f := range files {
+		fmt.Fprintf(&b, "file %s seq %d type %c\n", f.name, f.seq, f.kind)
+	}
+	return b.String()
+}
+
+// files returns the files to load, in order
+func (m *aofManifest) files() []*aofFile {
+	files := make([]*aofFile, 0, 1+len(m.incrs))
+	if m.base != nil {
+		files = append(files, m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+// parseAOFManifest parses a manifest. Each line is made of key/value pairs:
+// file, seq and type, in any order. Empty lines and comments are skipped.
+func parseAOFManifest(data string) (*aofManifest, error) {
+	m := &aofManifest{}
+	for n, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid AOF manifest file format at line %d", n+1)
+		}
+		f := &aofFile{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				f.name = fields[i+1]
+			case "seq":
+				seq, err := strconv.Atoi(fields[i+1])
+				if err != nil || seq < 1 {
+					return nil, fmt.Errorf("invalid AOF file sequence at line %d", n+1)
+				}
+				f.seq = seq
+			case "type":
+				if len(fields[i+1]) != 1 {
+					return nil, fmt.Errorf("invalid AOF file type at line %d", n+1)
+				}
+				f.kind = fields[i+1][0]
+			}
+		}
+		if f.name == "" || f.seq == 0 || strings.ContainsAny(f.name, "/\\") {
+			return nil, fmt.Errorf("invalid AOF manifest file format at line %d", n+1)
+		}
+
+		switch f.kind {
+		case aofBaseFile:
+			if m.base != nil {
+				return nil, errors.New("found duplicate base file information")
+			}
+			m.base = f
+			m.baseSeq = f.seq
+		case aofHistoryFile:
+			m.history = append(m.history, f)
+		case aofIncrFile:
+			if f.seq <= m.incrSeq {
+				return nil, errors.New("found a non-monotonic sequence number")
+			}
+			m.incrs = append(m.incrs, f)
+			m.incrSeq = f.seq
+		default:
+			return nil, fmt.Errorf("unknown AOF file type '%c' at line %d", f.kind, n+1)
+		}
+	}
+	return m, nil
+}
+
+// aofDir returns the directory holding the files of the log
+func (s *Server) aofDir() string {
+	return filepath.Join(s.persist.dir, s.aof.dirname)
+}
+
+// aofManifestPath returns where the manifest is written and loaded from
+func (s *Server) aofManifestPath() string {
+	return filepath.Join(s.aofDir(), s.aof.filename+".manifest")
+}
+
+// aofFilePath returns the path of a file listed in the manifest
+func (s *Server) aofFilePath(f *aofFile) string {
+	return filepath.Join(s.aofDir(), f.name)
+}
+
+// readAOFManifest reads the manifest from disk. It returns nil if there is
+// none.
+func (s *Server) readAOFManifest() (*aofManifest, error) {
+	data, err := os.ReadFile(s.aofManifestPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseAOFManifest(string(data))
+}
+
+// persistAOFManifest writes a manifest to disk, replacing the previous one
+// at once
+func (s *Server) persistAOFManifest(m *aofManifest) error {
+	return writeFileAtomically(s.aofManifestPath(), func(w io.Writer) error {
+		_, err := io.WriteString(w, m.String())
+		return err
+	})
+}
+
+// upgradeAppendOnlyFile moves an append only file written before the log
+// was split into the AOF directory, as its base file
+func (s *Server) upgradeAppendOnlyFile() error {
+	old := filepath.Join(s.persist.dir, s.aof.filename)
+	if _, err := os.Stat(s.aofManifestPath()); !errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if _, err := os.Stat(old); err != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(s.aofDir(), 0755); err != nil {
+		return fmt.Errorf("can't create the AOF directory %s: %v", s.aofDir(), err)
+	}
+	m := &aofManifest{base: &aofFile{name: s.aof.filename, seq: 1, kind: aofBaseFile}, baseSeq: 1}
+	if err := os.Rename(old, s.aofFilePath(m.base)); err != nil {
+		return fmt.Errorf("error moving the old AOF file %s into the AOF directory: %v", old, err)
+	}
+	if err := s.persistAOFManifest(m); err != nil {
+		return fmt.Errorf("can't write the AOF manifest %s: %v", s.aofManifestPath(), err)
+	}
+	log.Printf("Successfully migrated an old-style AOF into the AOF directory")
+	return nil
+}
+
+// aofAppendCommand appends a command in the RESP form it is logged as
+func aofAppendCommand(buf []byte, argv []string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(argv)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range argv {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// feedAppendOnlyFile buffers a command for the append only file, which is
+// written before replying to the client that ran it
+func (s *Server) feedAppendOnlyFile(argv []string) {
+	if s.aof.file == nil {
+		return
+	}
+	s.aof.buf = aofAppendCommand(s.aof.buf, argv)
+}
+
+// openAppendOnlyFile opens the last incremental file for appending once the
+// dataset has been loaded, starting a new one if there is none
+func (s *Server) openAppendOnlyFile() error {
+	if !s.aof.enabled {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(s.aofDir(), 0755); err != nil {
+		return fmt.Errorf("can't create the AOF directory %s: %v", s.aofDir(), err)
+	}
+	if s.aof.manifest == nil {
+		s.aof.manifest = &aofManifest{}
+	}
+	m := s.aof.manifest
+	if n := len(m.incrs); n > 0 {
+		path := s.aofFilePath(m.incrs[n-1])
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("can't open the append-only file %s: %v", path, err)
+		}
+		s.aof.file = f
+	} else {
+		f, err := s.openNewIncrFile()
+		if err != nil {
+			return err
+		}
+		if err := s.persistAOFManifest(m); err != nil {
+			f.Close()
+			return fmt.Errorf("can't write the AOF manifest %s: %v", s.aofManifestPath(), err)
+		}
+		log.Printf("Creating AOF incr file %s on server start", m.incrs[len(m.incrs)-1].name)
+		s.aof.file = f
+	}
+	s.aof.lastFsync = time.Now()
+	s.createReplicationBacklogForAOF()
+	return nil
+}
+
+// createReplicationBacklogForAOF makes a master keep the replication
+// stream while the AOF is on, even without replicas, since WAITAOF relies
+// on the offset advancing. The caller must hold the server lock.
+func (s *Server) createReplicationBacklogForAOF() {
+	if s.repl.backlog == nil && s.repl.masterHost == "" {
+		s.createReplicationBacklog()
+	}
+}
+
+// openNewIncrFile creates the next incremental file and adds it to the
+// manifest, without persisting it. The caller must hold the server lock.
+func (s *Server) openNewIncrFile() (*os.File, error) {
+	m := s.aof.manifest
+	incr := &aofFile{
+		name: fmt.Sprintf("%s.%d.incr.aof", s.aof.filename, m.incrSeq+1),
+		seq:  m.incrSeq + 1,
+		kind: aofIncrFile,
+	}
+	path := s.aofFilePath(incr)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("can't open the append-only file %s: %v", path, err)
+	}
+	m.incrSeq++
+	m.incrs = append(m.incrs, incr)
+	s.aof.incrSize = 0
+	return f, nil
+}
+
+// flushAppendOnlyFile writes the buffered commands to the append only file
+// and syncs it as the fsync policy requires. The caller must hold the
+// server lock.
+func (s *Server) flushAppendOnlyFile() {
+	a := &s.aof
+	if a.file == nil {
+		return
+	}
+
+	if len(a.buf) > 0 {
+		n, err := a.file.Write(a.buf)
+		if n > 0 {
+			a.unsynced = true
+			a.currentSize += int64(n)
+			a.incrSize += int64(n)
+		}
+		// Whatever wasn't written is retried next time, so the file
+		// stays a valid sequence of commands
+		a.buf = a.buf[:copy(a.buf, a.buf[n:])]
+		if err != nil {
+			if a.lastWriteErr == nil {
+				log.Printf("Error writing to the AOF file: %v", err)
+			}
+			a.lastWriteErr = err
+			return
+		}
+		if a.lastWriteErr != nil {
+			log.Printf("AOF write error looks solved, Redis can write again.")
+			a.lastWriteErr = nil
+		}
+	}
+	// The offset is only tracked once the log holds the whole dataset
+	offset := s.repl.offset
+	if a.waitRewrite {
+		offset = -1
+	}
+	if !a.unsynced {
+		// Everything written is synced, so whatever advanced the offset
+		// since, like pings to the replicas, isn't in the log
+		if a.fsync != aofFsyncNo && !a.fsyncInProgress.Load() {
+			a.fsyncedOffset.Store(offset)
+		}
+		return
+	}
+
+	switch a.fsync {
+	case aofFsyncAlways:
+		if err := a.file.Sync(); err != nil {
+			log.Printf("Can't persist AOF for fsync error when the AOF fsync policy is 'always': %v", err)
+			a.lastWriteErr = err
+			return
+		}
+		a.unsynced = false
+		a.lastFsync = time.Now()
+		a.fsyncedOffset.Store(offset)
+
+	case aofFsyncEverysec:
+		if time.Since(a.lastFsync) < time.Second || a.fsyncInProgress.Load() {
+			return
+		}
+		a.unsynced = false
+		a.lastFsync = time.Now()
+		a.fsyncInProgress.Store(true)
+		go func(f *os.File, offset int64) {
+			defer a.fsyncInProgress.Store(false)
+			if err := f.Sync(); err != nil {
+				if !errors.Is(err, os.ErrClosed) {
+					log.Printf("Error syncing the AOF file: %v", err)
+				}
+				return
+			}
+			a.fsyncedOffset.Store(offset)
+		}(a.file, offset)
+	}
+}
+
+// closeAppendOnlyFile flushes and syncs the append only file before the
+// server exits. The caller must hold the server lock.
+func (s *Server) closeAppendOnlyFile() {
+	if s.aof.file == nil {
+		return
+	}
+	log.Printf("Calling fsync() on the AOF file.")
+	s.flushAppendOnlyFile()
+	if err := s.aof.file.Sync(); err != nil {
+		log.Printf("Error syncing the AOF file: %v", err)
+	}
+	s.aof.file.Close()
+	s.aof.file = nil
+	s.aof.buf = s.aof.buf[:0]
+	// A background fsync finishing later would still store its offset
+	for s.aof.fsyncInProgress.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	s.aof.fsyncedOffset.Store(-1)
+	s.aof.lastWriteErr = nil
+}
+
+// errAOFFormat is returned by aofReader for anything but a RESP array of
+// bulk strings
+var errAOFFormat = errors.New("bad file format")
+
+// aofReader reads the commands of an append only file, keeping track of
+// where the last complete one ends
+type aofReader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+// readCommand reads the next command. It returns io.EOF at the end of the
+// file and io.ErrUnexpectedEOF if the file ends in the middle of a command.
+func (r *aofReader) readCommand() ([]string, error) {
+	read := int64(0)
+	readLine := func(prefix byte) (int, error) {
+		line, err := r.r.ReadString('\n')
+		read += int64(len(line))
+		if err == io.EOF {
+			if read == 0 {
+				return 0, io.EOF
+			}
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if len(line) < 3 || line[0] != prefix || line[len(line)-2] != '\r' {
+			return 0, errAOFFormat
+		}
+		n, err := strconv.Atoi(line[1 : len(line)-2])
+		if err != nil || n < 0 {
+			return 0, errAOFFormat
+		}
+		return n, nil
+	}
+
+	argc, err := readLine('*')
+	if err != nil {
+		return nil, err
+	}
+	if argc == 0 {
+		return nil, errAOFFormat
+	}
+	argv := make([]string, argc)
+	for i := range argv {
+		n, err := readLine('$')
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		m, err := io.ReadFull(r.r, buf)
+		read += int64(m)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return nil, errAOFFormat
+		}
+		argv[i] = string(buf[:n])
+	}
+	r.offset += read
+	return argv, nil
+}
+
+// loadAppendOnlyFiles loads the base file and then the incremental files
+// listed in the manifest, if there is one
+func (s *Server) loadAppendOnlyFiles() error {
+	if err := s.upgradeAppendOnlyFile(); err != nil {
+		return err
+	}
+	m, err := s.readAOFManifest()
+	if err != nil {
+		return fmt.Errorf("fatal error reading the AOF manifest %s: %v", s.aofManifestPath(), err)
+	}
+	if m == nil {
+		return nil
+	}
+
+	start := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aof.manifest = m
+	files := m.files()
+	for _, f := range files {
+		if info, err := os.Stat(s.aofFilePath(f)); err == nil {
+			s.persist.loadingTotalBytes += info.Size()
+		}
+	}
+	total := int64(0)
+	for i, f := range files {
+		size, err := s.loadAppendOnlyFile(s.aofFilePath(f), i == len(files)-1)
+		if err != nil {
+			return err
+		}
+		total += size
+		s.persist.loadingDoneBytes = total
+		if f.kind == aofIncrFile {
+			s.aof.incrSize = size
+		}
+	}
+	s.aof.currentSize = total
+	s.aof.rewriteBaseSize = total
+
+	// Files a rewrite replaced just before a crash
+	if len(m.history) > 0 {
+		for _, f := range m.history {
+			os.Remove(s.aofFilePath(f))
+		}
+		m.history = nil
+		if err := s.persistAOFManifest(m); err != nil {
+			return fmt.Errorf("can't write the AOF manifest %s: %v", s.aofManifestPath(), err)
+		}
+	}
+
+	// What was replayed is already on disk
+	s.persist.dirty = 0
+	log.Printf("DB loaded from append only file: %.3f seconds", time.Since(start).Seconds())
+	return nil
+}
+
+// loadAppendOnlyFile replays a file of the log, returning its size. A base
+// file may be an RDB file. Other files are replayed through the same path
+// as commands sent by clients. A command cut short at the end of the last
+// file, as left by a crash, is dropped along with the transaction it is
+// part of, and the file is truncated to match, unless aof-load-truncated is
+// off. The caller must hold the server lock.
+func (s *Server) loadAppendOnlyFile(path string, last bool) (int64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("fatal error: the AOF file %s doesn't exist", path)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("fatal error: can't open the append log file %s for reading: %v", path, err)
+	}
+	defer f.Close()
+
+	br := bufio.NewReaderSize(f, 64*1024)
+	if prefix, _ := br.Peek(5); string(prefix) == "REDIS" {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return 0, fmt.Errorf("error reading the AOF file %s: %v", path, err)
+		}
+		if err := s.rdbLoad(data); err == errLoadingAborted {
+			return 0, err
+		} else if err != nil {
+			return 0, fmt.Errorf("error loading the RDB preamble of the AOF file %s: %v", path, err)
+		}
+		return int64(len(data)), nil
+	}
+
+	// Replayed commands must not block, nor be propagated again
+	c := newClient(nil)
+	c.denyBlocking = true
+	c.aofLoader = true
+	r := &aofReader{r: br}
+	validUpTo, multiStart := int64(0), int64(0)
+	truncated := false
+	for {
+		argv, err := r.readCommand()
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			truncated = true
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("bad file format reading the append only file %s: make a backup of your AOF file, then use check-aof --fix <filename>", path)
+		}
+
+		cmd := strings.ToUpper(argv[0])
+		if _, ok := s.lookupCommand(cmd); !ok {
+			return 0, fmt.Errorf("unknown command '%s' reading the append only file %s", argv[0], path)
+		}
+		if cmd == "MULTI" {
+			multiStart = validUpTo
+		}
+		s.processCommand(c, commandValue(argv))
+		s.handleClientsBlockedOnKeys()
+		validUpTo = r.offset
+		if err := s.loadingProgress(validUpTo); err != nil {
+			return 0, err
+		}
+	}
+
+	if c.mstate != nil {
+		log.Printf("Revert incomplete MULTI/EXEC transaction in AOF file %s", path)
+		s.discardTransaction(c)
+		validUpTo = multiStart
+		truncated = true
+	}
+	if truncated {
+		if !last {
+			return 0, fmt.Errorf("unexpected end of file reading the append only file %s, which is not the last one", path)
+		}
+		if !s.aof.loadTruncated {
+			return 0, fmt.Errorf("unexpected end of file reading the append only file %s. You can: 1) Make a backup of your AOF file, then use check-aof --fix <filename>. 2) Alternatively you can set the 'aof-load-truncated' configuration option to yes and restart the server", path)
+		}
+		log.Printf("!!! Warning: short read while loading the AOF file %s!!!", path)
+		log.Printf("!!! Truncating the AOF %s at offset %d !!!", path, validUpTo)
+		if err := os.Truncate(path, validUpTo); err != nil {
+			return 0, fmt.Errorf("error truncating the AOF file %s: %v", path, err)
+		}
+		log.Printf("AOF %s loaded anyway because aof-load-truncated is enabled", path)
+	}
+	return validUpTo, nil
+}
+
+// commandValue builds the RESP array a client would send for argv
+func commandValue(argv []string) resp.Value {
+	values := make([]resp.Value, len(argv))
+	for i, arg := range argv {
+		values[i] = resp.NewBulkString(arg)
+	}
+	return resp.NewArray(values)
+}
@@ -0,0 +1,394 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"redis-learning/pkg/resp"
+)
+
+// aofRewriteJob is a base file being written in the background
+type aofRewriteJob struct {
+	start    time.Time
+	snapshot *snapshot
+	incr     *aofFile // the incremental file started with the rewrite
+	tmp      string
+	canceled atomic.Bool // e.g. by SHUTDOWN or turning the AOF off
+}
+
+// aofRewriteItemsPerCmd caps the elements per command rebuilding a list
+const aofRewriteItemsPerCmd = 64
+
+// hasActiveChild reports whether a BGSAVE or an AOF rewrite is running.
+// Only one of them runs at a time, as they would compete for the disk.
+func (s *Server) hasActiveChild() bool {
+	return s.persist.bgsave != nil || s.aof.rewrite != nil
+}
+
+// rewriteAppendOnlyFileBackground starts an AOF rewrite. Writes go to a new
+// incremental file from now on, while the dataset as it is now is written
+// as the new base file by another goroutine. The caller must hold the
+// server lock.
+func (s *Server) rewriteAppendOnlyFileBackground() error {
+	if s.hasActiveChild() {
+		return errors.New("another background operation is in progress")
+	}
+	a := &s.aof
+	if err := os.MkdirAll(s.aofDir(), 0755); err != nil {
+		return fmt.Errorf("can't create the AOF directory %s: %v", s.aofDir(), err)
+	}
+	if a.manifest == nil {
+		// Files left by an earlier run are replaced by the rewrite
+		m, err := s.readAOFManifest()
+		if err != nil {
+			log.Printf("Ignoring the AOF manifest %s: %v", s.aofManifestPath(), err)
+		}
+		if m == nil {
+			m = &aofManifest{}
+		}
+		a.manifest = m
+	}
+	a.lastRewriteTry = time.Now()
+
+	// Switch to a new incremental file, so that the ones the new base file
+	// replaces stop growing. Until the first rewrite after turning the AOF
+	// on completes, the manifest on disk still describes older files.
+	var incr *aofFile
+	if a.enabled {
+		s.flushAppendOnlyFile()
+		f, err := s.openNewIncrFile()
+		if err != nil {
+			return err
+		}
+		incr = a.manifest.incrs[len(a.manifest.incrs)-1]
+		if !a.waitRewrite {
+			if err := s.persistAOFManifest(a.manifest); err != nil {
+				f.Close()
+				os.Remove(s.aofFilePath(incr))
+				a.manifest.incrs = a.manifest.incrs[:len(a.manifest.incrs)-1]
+				a.manifest.incrSeq--
+				return fmt.Errorf("can't write the AOF manifest %s: %v", s.aofManifestPath(), err)
+			}
+		}
+		if a.file != nil {
+			if err := a.file.Sync(); err != nil {
+				log.Printf("Error syncing the AOF file: %v", err)
+			}
+			a.file.Close()
+		}
+		a.file = f
+		a.unsynced = false
+		log.Printf("Creating AOF incr file %s on background rewrite", incr.name)
+	}
+
+	format := snapshotAOF
+	if a.useRDBPreamble {
+		format = snapshotRDB
+	}
+	snap := s.newSnapshot(format)
+	s.db.snapshot = snap
+	job := &aofRewriteJob{
+		start:    a.lastRewriteTry,
+		snapshot: snap,
+		incr:     incr,
+		tmp:      filepath.Join(s.aofDir(), fmt.Sprintf("temp-rewriteaof-bg-%d-%d.aof", os.Getpid(), time.Now().UnixNano())),
+	}
+	a.rewrite = job
+	a.rewriteScheduled = false
+	log.Printf("Background append only file rewriting started")
+
+	go func() {
+		err := writeFileAtomically(job.tmp, func(w io.Writer) error {
+			if err := snap.write(w); err != nil {
+				return err
+			}
+			if job.canceled.Load() {
+				return errors.New("canceled")
+			}
+			return nil
+		})
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.backgroundRewriteDone(job, err)
+	}()
+	return nil
+}
+
+// backgroundRewriteDone installs the base file a rewrite wrote, replacing
+// the files it covers in the manifest. The caller must hold the server
+// lock.
+func (s *Server) backgroundRewriteDone(job *aofRewriteJob, err error) {
+	if s.db.snapshot == job.snapshot {
+		s.db.snapshot = nil
+	}
+	if job.canceled.Load() {
+		os.Remove(job.tmp)
+		return
+	}
+	a := &s.aof
+	a.rewrite = nil
+	a.lastRewriteTime = time.Since(job.start)
+	a.lastCowSize = job.snapshot.cowBytes()
+	if a.lastCowSize > 0 {
+		log.Printf("AOF rewrite: %d bytes of memory used by copy-on-write", a.lastCowSize)
+	}
+	if err == nil {
+		err = s.installRewrittenBase(job)
+	}
+	if err != nil {
+		log.Printf("Background AOF rewrite failed: %v", err)
+		os.Remove(job.tmp)
+		a.lastRewriteOK = false
+		if a.waitRewrite {
+			// The AOF can't be loaded until a rewrite succeeds
+			a.rewriteScheduled = true
+		}
+		return
+	}
+	log.Printf("Background AOF rewrite finished successfully")
+	a.lastRewriteOK = true
+	a.rewrites++
+}
+
+// installRewrittenBase renames the file a rewrite wrote into the base file
+// and persists the new manifest. The caller must hold the server lock.
+func (s *Server) installRewrittenBase(job *aofRewriteJob) error {
+	a := &s.aof
+	old := a.manifest
+	ext := "aof"
+	if job.snapshot.format == snapshotRDB {
+		ext = "rdb"
+	}
+	base := &aofFile{
+		name: fmt.Sprintf("%s.%d.base.%s", a.filename, old.baseSeq+1, ext),
+		seq:  old.baseSeq + 1,
+		kind: aofBaseFile,
+	}
+	m := &aofManifest{base: base, baseSeq: base.seq, incrSeq: old.incrSeq}
+	// Incremental files started after the rewrite's are kept, in case the
+	// AOF was turned off and on again meanwhile
+	for i, incr := range old.incrs {
+		if incr == job.incr {
+			m.incrs = append(m.incrs, old.incrs[i:]...)
+			break
+		}
+	}
+
+	if err := os.Rename(job.tmp, s.aofFilePath(base)); err != nil {
+		return err
+	}
+	if err := s.persistAOFManifest(m); err != nil {
+		os.Remove(s.aofFilePath(base))
+		return fmt.Errorf("can't write the AOF manifest %s: %v", s.aofManifestPath(), err)
+	}
+
+	// The replaced files aren't needed anymore
+	kept := make(map[*aofFile]bool, len(m.incrs))
+	for _, incr := range m.incrs {
+		kept[incr] = true
+	}
+	for _, f := range append(old.files(), old.history...) {
+		if !kept[f] && f.name != base.name {
+			os.Remove(s.aofFilePath(f))
+		}
+	}
+	a.manifest = m
+
+	baseSize := int64(0)
+	if info, err := os.Stat(s.aofFilePath(base)); err == nil {
+		baseSize = info.Size()
+	}
+	a.currentSize = baseSize
+	for _, incr := range m.incrs {
+		if info, err := os.Stat(s.aofFilePath(incr)); err == nil {
+			a.currentSize += info.Size()
+		}
+	}
+	a.rewriteBaseSize = a.currentSize
+	if job.incr != nil {
+		a.waitRewrite = false
+	}
+	return nil
+}
+
+// cancelAOFRewrite stops the running rewrite, if any. The caller must hold
+// the server lock.
+func (s *Server) cancelAOFRewrite() {
+	job := s.aof.rewrite
+	if job == nil {
+		return
+	}
+	job.canceled.Store(true)
+	s.aof.rewrite = nil
+	if s.db.snapshot == job.snapshot {
+		s.db.snapshot = nil
+	}
+}
+
+// startAppendOnly turns the AOF on at runtime. The dataset is first written
+// as a base file, and commands are logged to a new incremental file from
+// now on. The caller must hold the server lock.
+func (s *Server) startAppendOnly() error {
+	s.aof.enabled = true
+	s.aof.waitRewrite = true
+	s.createReplicationBacklogForAOF()
+	if s.hasActiveChild() {
+		log.Printf("AOF was enabled but there is already another background operation. An AOF background was scheduled to start when possible.")
+		s.aof.rewriteScheduled = true
+		return nil
+	}
+	if err := s.rewriteAppendOnlyFileBackground(); err != nil {
+		log.Printf("Redis needs to enable the AOF but can't trigger a background AOF rewrite operation: %v", err)
+		s.aof.enabled = false
+		s.aof.waitRewrite = false
+		return errors.New("Unable to turn on AOF. Check server logs.")
+	}
+	return nil
+}
+
+// stopAppendOnly turns the AOF off at runtime. The caller must hold the
+// server lock.
+func (s *Server) stopAppendOnly() {
+	s.closeAppendOnlyFile()
+	if s.aof.rewrite != nil {
+		log.Printf("Killing running AOF rewrite child")
+		s.cancelAOFRewrite()
+	}
+	s.aof.enabled = false
+	s.aof.waitRewrite = false
+	s.aof.rewriteScheduled = false
+}
+
+// aofRewriteCron starts scheduled rewrites, and rewrites the log once it
+// grew enough since the last one. The caller must hold the server lock.
+func (s *Server) aofRewriteCron() {
+	a := &s.aof
+	if s.hasActiveChild() {
+		return
+	}
+	if a.rewriteScheduled {
+		// After an error, wait a bit before trying again
+		if a.lastRewriteOK || time.Since(a.lastRewriteTry) > aofRewriteRetryDelay {
+			if err := s.rewriteAppendOnlyFileBackground(); err != nil {
+				log.Printf("Can't rewrite the append only file in background: %v", err)
+				a.lastRewriteOK = false
+			}
+		}
+		return
+	}
+	if !a.enabled || a.waitRewrite || a.rewritePercentage == 0 || a.currentSize <= a.rewriteMinSize {
+		return
+	}
+	if !a.lastRewriteOK && time.Since(a.lastRewriteTry) <= aofRewriteRetryDelay {
+		return
+	}
+	base := a.rewriteBaseSize
+	if base == 0 {
+		base = 1
+	}
+	growth := a.currentSize*100/base - 100
+	if growth >= int64(a.rewritePercentage) {
+		log.Printf("Starting automatic rewriting of AOF on %d%% growth", growth)
+		if err := s.rewriteAppendOnlyFileBackground(); err != nil {
+			log.Printf("Can't rewrite the append only file in background: %v", err)
+			a.lastRewriteOK = false
+		}
+	}
+}
+
+// handleBgrewriteaof handles the BGREWRITEAOF command
+func (s *Server) handleBgrewriteaof(args []resp.Value) resp.Value {
+	if s.aof.rewrite != nil {
+		return resp.NewError("ERR Background append only file rewriting already in progress")
+	}
+	if s.hasActiveChild() {
+		s.aof.rewriteScheduled = true
+		return resp.NewSimpleString("Background append only file rewriting scheduled")
+	}
+	if err := s.rewriteAppendOnlyFileBackground(); err != nil {
+		log.Printf("Can't rewrite the append only file in background: %v", err)
+		s.aof.lastRewriteOK = false
+		return resp.NewError("ERR Can't execute an AOF background rewriting. Please check the server logs for more information.")
+	}
+	return resp.NewSimpleString("Background append only file rewriting started")
+}
+
+// aofAppendKeyValue appends the commands rebuilding a key, for AOF base
+// files written without an RDB preamble. Keys with an expiry, and types
+// no command rebuilds, are restored from their DUMP payload.
+func aofAppendKeyValue(buf []byte, key string, val *RedisValue) []byte {
+	if val.ExpiresAt != nil {
+		return aofAppendCommand(buf, []string{"RESTORE", key,
+			strconv.FormatInt(val.ExpiresAt.UnixMilli(), 10), string(dumpPayload(val)), "ABSTTL"})
+	}
+
+	switch val.Type {
+	case "string":
+		return aofAppendCommand(buf, []string{"SET", key, val.String})
+
+	case "list":
+		for i := 0; i < len(val.List); i += aofRewriteItemsPerCmd {
+			end := min(i+aofRewriteItemsPerCmd, len(val.List))
+			argv := append([]string{"RPUSH", key}, val.List[i:end]...)
+			buf = aofAppendCommand(buf, argv)
+		}
+		return buf
+
+	case "stream":
+		return aofAppendStream(buf, key, val.Stream)
+	}
+	return aofAppendCommand(buf, []string{"RESTORE", key, "0", string(dumpPayload(val))})
+}
+
+// aofAppendStream appends the commands rebuilding a stream with its
+// metadata, consumer groups and pending entries
+func aofAppendStream(buf []byte, key string, st *Stream) []byte {
+	if st.Len() == 0 {
+		// XADD can't create an empty stream, so the entry it adds is
+		// trimmed right away. XSETID below restores the last ID.
+		id := st.LastID
+		if id.IsZero() {
+			id = StreamID{0, 1}
+		}
+		buf = aofAppendCommand(buf, []string{"XADD", key, "MAXLEN", "0", id.String(), "x", "y"})
+	}
+	for _, e := range st.Entries() {
+		argv := append([]string{"XADD", key, e.ID.String()}, e.Fields...)
+		buf = aofAppendCommand(buf, argv)
+	}
+	buf = aofAppendCommand(buf, []string{"XSETID", key, st.LastID.String(),
+		"ENTRIESADDED", strconv.FormatUint(st.EntriesAdded, 10),
+		"MAXDELETEDID", st.MaxDeletedID.String()})
+
+	for _, name := range st.GroupNames() {
+		group := st.Groups[name]
+		buf = aofAppendCommand(buf, []string{"XGROUP", "CREATE", key, name, group.LastID.String(),
+			"ENTRIESREAD", strconv.FormatInt(group.EntriesRead, 10)})
+		for _, pe := range sortedPending(group.Pending) {
+			buf = aofAppendCommand(buf, []string{"XCLAIM", key, name, pe.Consumer.Name, "0", pe.ID.String(),
+				"TIME", strconv.FormatInt(pe.DeliveryTime.UnixMilli(), 10),
+				"RETRYCOUNT", strconv.FormatInt(pe.DeliveryCount, 10),
+				"JUSTID", "FORCE"})
+		}
+		// Consumers with pending entries were created by XCLAIM
+		consumers := make([]string, 0, len(group.Consumers))
+		for cname, consumer := range group.Consumers {
+			if len(consumer.Pending) == 0 {
+				consumers = append(consumers, cname)
+			}
+		}
+		sort.Strings(consumers)
+		for _, cname := range consumers {
+			buf = aofAppendCommand(buf, []string{"XGROUP", "CREATECONSUMER", key, name, cname})
+		}
+	}
+	return buf
+}
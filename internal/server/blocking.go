@@ -0,0 +1,183 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"redis-learning/pkg/resp"
+)
+
+// blockedState describes what a blocked client is waiting for.
+//
+// Blocking works the same way it does in Redis: a blocking command first
+// tries to run as its non-blocking counterpart. If there is nothing to pop it
+// registers the client under every key it is interested in and returns
+// without a reply. Whenever a command makes one of those keys ready (e.g. a
+// push), the server walks the waiters of that key in FIFO order once the
+// command has finished and lets each of them retry via serve.
+type blockedState struct {
+	keys         []string
+	timeout      time.Duration // zero means block forever
+	timeoutReply resp.Value
+
+	// serve retries the command against the given key. It returns false if
+	// the key still cannot satisfy the client.
+	serve func(key string) (resp.Value, bool)
+
+	// Set for WAIT and WAITAOF, which wait for acknowledgements instead
+	// of keys
+	wait *waitRequest
+
+	// reply receives the result once the client has been served
+	reply chan resp.Value
+}
+
+// parseTimeout parses a blocking command timeout expressed in seconds, which
+// may be fractional
+func parseTimeout(arg string) (time.Duration, resp.Value, bool) {
+	secs, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) {
+		return 0, resp.NewError("ERR timeout is not a float or out of range"), false
+	}
+	if secs < 0 {
+		return 0, resp.NewError("ERR timeout is negative"), false
+	}
+	if secs > float64(math.MaxInt64/int64(time.Second)) {
+		return 0, resp.NewError("ERR timeout is out of range"), false
+	}
+	return time.Duration(secs * float64(time.Second)), resp.Value{}, true
+}
+
+// blockClient registers c as waiting on keys and returns the empty reply the
+// command should return, or timeoutReply straight away if the client isn't
+// allowed to block. The caller must hold s.mu.
+func (s *Server) blockClient(c *Client, keys []string, timeout time.Duration, timeoutReply resp.Value, serve func(key string) (resp.Value, bool)) resp.Value {
+	if c.denyBlocking {
+		return timeoutReply
+	}
+	c.bstate = &blockedState{
+		keys:         keys,
+		timeout:      timeout,
+		timeoutReply: timeoutReply,
+		serve:        serve,
+		reply:        make(chan resp.Value, 1),
+	}
+	for _, key := range keys {
+		s.blockingKeys[key] = append(s.blockingKeys[key], c)
+	}
+	return resp.Value{}
+}
+
+// unblockClient removes c from the wait queues of all its keys. The caller
+// must hold s.mu.
+func (s *Server) unblockClient(c *Client) {
+	if c.bstate == nil {
+		return
+	}
+	if c.bstate.wait != nil {
+		s.removeWaitingClient(c)
+	}
+	for _, key := range c.bstate.keys {
+		waiters := s.blockingKeys[key]
+		for i, w := range waiters {
+			if w == c {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(s.blockingKeys, key)
+		} else {
+			s.blockingKeys[key] = waiters
+		}
+	}
+}
+
+// signalKeyAsReady records that key may now satisfy blocked clients. The
+// caller must hold s.mu.
+func (s *Server) signalKeyAsReady(key string) {
+	if _, blocked := s.blockingKeys[key]; !blocked || s.readySet[key] {
+		return
+	}
+	s.readySet[key] = true
+	s.readyKeys = append(s.readyKeys, key)
+}
+
+// handleClientsBlockedOnKeys serves clients blocked on keys that became
+// ready during the last command. Serving a client may itself make other keys
+// ready (BLMOVE pushes to its destination), so it loops until nothing is
+// left. The caller must hold s.mu.
+func (s *Server) handleClientsBlockedOnKeys() {
+	if len(s.readyKeys) > 0 && !s.db.writing {
+		// Serving clients pops from the keys
+		s.db.writing = true
+		defer func() { s.db.writing = false }()
+	}
+	for len(s.readyKeys) > 0 {
+		keys := s.readyKeys
+		s.readyKeys = nil
+		s.readySet = make(map[string]bool)
+
+		for _, key := range keys {
+			// Copy the queue since serving a client removes it
+			waiters := append([]*Client(nil), s.blockingKeys[key]...)
+			for _, c := range waiters {
+				if c.bstate == nil {
+					continue
+				}
+				reply, ok := c.bstate.serve(key)
+				if !ok {
+					// Try the next waiter only if this one simply could not
+					// use the key; an empty key cannot serve anybody
+					if _, exists := s.db.GetValue(key); !exists {
+						break
+					}
+					continue
+				}
+				bstate := c.bstate
+				s.unblockClient(c)
+				c.bstate = nil
+				bstate.reply <- reply
+			}
+		}
+	}
+}
+
+// waitForUnblock parks the calling connection until it is served, its
+// timeout expires or the connection goes away. It must be called without
+// holding s.mu. The returned bool is false if no reply should be sent.
+func (s *Server) waitForUnblock(c *Client, bstate *blockedState) (resp.Value, bool) {
+	var timeout <-chan time.Time
+	if bstate.timeout > 0 {
+		timer := time.NewTimer(bstate.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case reply := <-bstate.reply:
+		return reply, true
+	case <-timeout:
+	case <-c.closed:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// We may have been served while waiting for the lock
+	select {
+	case reply := <-bstate.reply:
+		return reply, !c.isClosed()
+	default:
+	}
+
+	// WAIT and WAITAOF reply with the acknowledgements they got so far
+	reply := bstate.timeoutReply
+	if bstate.wait != nil {
+		reply, _ = s.waitReply(bstate.wait)
+	}
+	s.unblockClient(c)
+	c.bstate = nil
+	return reply, !c.isClosed()
+}
@@ -0,0 +1,373 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file holds the offline checks behind check-rdb and check-aof, which
+// validate persistence files without loading them into a server.
+
+// rdbCheckError is the first corruption found in RDB data
+type rdbCheckError struct {
+	offset int64
+	err    error
+	doing  string // what was being read
+}
+
+func (e *rdbCheckError) Error() string {
+	return fmt.Sprintf("[offset %d] %v while doing: %s", e.offset, e.err, e.doing)
+}
+
+// rdbTypeStats counts the keys of a type and the bytes they take
+type rdbTypeStats struct {
+	keys  int
+	bytes int64
+}
+
+// checkRDB reads RDB data the way loading it would, reporting the records
+// it contains and statistics per key type to out
+func checkRDB(data []byte, out io.Writer) error {
+	fail := func(pos int, err error, doing string) error {
+		if errors.Is(err, errRDBShort) {
+			err = errors.New("unexpected EOF reading RDB file")
+		}
+		return &rdbCheckError{offset: int64(pos), err: err, doing: doing}
+	}
+
+	if len(data) < 9 || string(data[:5]) != "REDIS" {
+		return fail(0, errors.New("wrong signature trying to load DB from file"), "check-header")
+	}
+	version, err := strconv.Atoi(string(data[5:9]))
+	if err != nil || version < 1 || version > rdbVersion {
+		return fail(5, fmt.Errorf("can't handle RDB format version %s", data[5:9]), "check-header")
+	}
+	fmt.Fprintf(out, "[offset 0] RDB format version %d\n", version)
+
+	stats := make(map[string]*rdbTypeStats)
+	keys, expires, expired, libraries := 0, 0, 0, 0
+	r := &rdbReader{buf: data, pos: 9}
+	now := time.Now()
+	var expiresAt *time.Time
+	for {
+		start := r.pos
+		opcode, err := r.readByte()
+		if err != nil {
+			return fail(start, err, "read-type")
+		}
+
+		switch opcode {
+		case rdbOpcodeEOF:
+			if version >= 5 {
+				sum, err := r.readBytes(8)
+				if err != nil {
+					return fail(r.pos, err, "check-sum")
+				}
+				expected := binary.LittleEndian.Uint64(sum)
+				switch {
+				case expected == 0:
+					fmt.Fprintf(out, "[offset %d] Checksum is disabled\n", r.pos)
+				case expected != crc64(0, data[:r.pos-8]):
+					return fail(r.pos-8, errors.New("wrong RDB checksum"), "check-sum")
+				default:
+					fmt.Fprintf(out, "[offset %d] Checksum OK\n", r.pos)
+				}
+			}
+			if r.pos != len(data) {
+				fmt.Fprintf(out, "[offset %d] %d bytes of trailing data after EOF\n", r.pos, len(data)-r.pos)
+			}
+			fmt.Fprintf(out, "[offset %d] \\o/ RDB looks OK! \\o/\n", r.pos)
+			fmt.Fprintf(out, "[info] %d keys read\n", keys)
+			fmt.Fprintf(out, "[info] %d expires\n", expires)
+			fmt.Fprintf(out, "[info] %d already expired\n", expired)
+			fmt.Fprintf(out, "[info] %d function libraries\n", libraries)
+			names := make([]string, 0, len(stats))
+			for name := range stats {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(out, "[info] %s: %d keys, %d bytes\n", name, stats[name].keys, stats[name].bytes)
+			}
+			return nil
+
+		case rdbOpcodeAux:
+			key, err := r.readString()
+			if err != nil {
+				return fail(r.pos, err, "read-aux-key")
+			}
+			value, err := r.readString()
+			if err != nil {
+				return fail(r.pos, err, "read-aux-value")
+			}
+			fmt.Fprintf(out, "[offset %d] AUX FIELD %s = '%s'\n", start, key, value)
+			continue
+
+		case rdbOpcodeSelectDB:
+			dbid, _, err := r.readLen()
+			if err != nil {
+				return fail(r.pos, err, "read-db-id")
+			}
+			fmt.Fprintf(out, "[offset %d] Selecting DB ID %d\n", start, dbid)
+			continue
+
+		case rdbOpcodeResizeDB:
+			if _, _, err := r.readLen(); err != nil {
+				return fail(r.pos, err, "read-resize-db")
+			}
+			if _, _, err := r.readLen(); err != nil {
+				return fail(r.pos, err, "read-resize-db")
+			}
+			continue
+
+		case rdbOpcodeExpireTimeMs:
+			p, err := r.readBytes(8)
+			if err != nil {
+				return fail(r.pos, err, "read-expire")
+			}
+			t := time.UnixMilli(int64(binary.LittleEndian.Uint64(p)))
+			expiresAt = &t
+			continue
+
+		case rdbOpcodeExpireTime:
+			p, err := r.readBytes(4)
+			if err != nil {
+				return fail(r.pos, err, "read-expire")
+			}
+			t := time.Unix(int64(int32(binary.LittleEndian.Uint32(p))), 0)
+			expiresAt = &t
+			continue
+
+		case rdbOpcodeIdle:
+			if _, _, err := r.readLen(); err != nil {
+				return fail(r.pos, err, "read-idle")
+			}
+			continue
+
+		case rdbOpcodeFreq:
+			if _, err := r.readByte(); err != nil {
+				return fail(r.pos, err, "read-freq")
+			}
+			continue
+
+		case rdbOpcodeFunction2:
+			if _, err := r.readString(); err != nil {
+				return fail(r.pos, err, "read-function")
+			}
+			libraries++
+			continue
+
+		case rdbOpcodeFunctionPreGA:
+			return fail(start, errors.New("pre-release function format not supported"), "read-function")
+
+		case rdbOpcodeModuleAux:
+			return fail(start, errors.New("module auxiliary data is not supported"), "read-module-aux")
+		}
+
+		key, err := r.readString()
+		if err != nil {
+			return fail(r.pos, err, "read-key")
+		}
+		val, err := rdbLoadObject(r, opcode)
+		if err != nil {
+			return fail(r.pos, err, fmt.Sprintf("read-object-value of key '%s' (type %d)", key, opcode))
+		}
+		keys++
+		if expiresAt != nil {
+			expires++
+			if expiresAt.Before(now) {
+				expired++
+			}
+		}
+		expiresAt = nil
+		st := stats[val.Type]
+		if st == nil {
+			st = &rdbTypeStats{}
+			stats[val.Type] = st
+		}
+		st.keys++
+		st.bytes += int64(r.pos - start)
+	}
+}
+
+// CheckRDB checks an RDB file, reporting what it contains, or the first
+// corruption found, to out. It returns an error if the file isn't valid.
+func CheckRDB(path string, out io.Writer) error {
+	fmt.Fprintf(out, "[offset 0] Checking RDB file %s\n", path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := checkRDB(data, out); err != nil {
+		fmt.Fprintf(out, "--- RDB ERROR DETECTED ---\n%v\n", err)
+		return errors.New("RDB file is not valid")
+	}
+	return nil
+}
+
+// AOFCheck is the outcome of checking an append only file
+type AOFCheck struct {
+	Valid bool
+
+	// How an invalid log can be fixed: the file to truncate to the end of
+	// its last valid command. Path is empty if it can't be fixed, e.g. a
+	// corrupt file that isn't the last one of the log.
+	Path      string
+	Size      int64
+	ValidUpTo int64
+}
+
+// CheckAOF checks an append only file, or every file of a log split by a
+// manifest given as the manifest itself or its directory, reporting to
+// out. Only the last file can be fixed, by truncating it.
+func CheckAOF(path string, out io.Writer) (*AOFCheck, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		matches, _ := filepath.Glob(filepath.Join(path, "*.manifest"))
+		if len(matches) != 1 {
+			return nil, fmt.Errorf("expected one manifest in %s, found %d", path, len(matches))
+		}
+		path = matches[0]
+	}
+	if !strings.HasSuffix(path, ".manifest") {
+		fmt.Fprintf(out, "Start checking Old-Style AOF\n")
+		return checkAOFFile(path, true, out)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseAOFManifest(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid AOF manifest %s: %v", path, err)
+	}
+	fmt.Fprintf(out, "Start checking Multi Part AOF\n")
+	files := m.files()
+	dir := filepath.Dir(path)
+	for i, f := range files {
+		kind := "INCR"
+		if f.kind == aofBaseFile {
+			kind = "BASE"
+		}
+		fmt.Fprintf(out, "Start to check %s AOF %s.\n", kind, f.name)
+		check, err := checkAOFFile(filepath.Join(dir, f.name), i == len(files)-1, out)
+		if err != nil || !check.Valid {
+			return check, err
+		}
+	}
+	fmt.Fprintf(out, "All AOF files and manifest are valid\n")
+	return &AOFCheck{Valid: true}, nil
+}
+
+// checkAOFFile checks a file of the log. A file with an RDB preamble is
+// checked as an RDB file, and can't be fixed.
+func checkAOFFile(path string, last bool, out io.Writer) (*AOFCheck, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	check := &AOFCheck{Size: info.Size()}
+
+	br := bufio.NewReaderSize(f, 64*1024)
+	if prefix, _ := br.Peek(5); string(prefix) == "REDIS" {
+		fmt.Fprintf(out, "The AOF appears to start with an RDB preamble.\nChecking the RDB preamble to start:\n")
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkRDB(data, out); err != nil {
+			fmt.Fprintf(out, "--- RDB ERROR DETECTED ---\n%v\n", err)
+			fmt.Fprintf(out, "RDB preamble of AOF file is not sane, aborting.\n")
+			return check, nil
+		}
+		fmt.Fprintf(out, "RDB preamble is OK\n")
+		check.Valid = true
+		return check, nil
+	}
+
+	counts := make(map[string]int)
+	r := &aofReader{r: br}
+	inMulti := false
+	multiStart := int64(0)
+	var problem string
+	for problem == "" {
+		argv, err := r.readCommand()
+		if err == io.EOF {
+			if inMulti {
+				problem = "Reached EOF before reading EXEC for MULTI"
+				check.ValidUpTo = multiStart
+			}
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			problem = "Unexpected EOF reading a command"
+			break
+		}
+		if err != nil {
+			problem = "Bad file format reading a command"
+			break
+		}
+
+		cmd := strings.ToUpper(argv[0])
+		switch {
+		case cmd == "MULTI" && inMulti:
+			problem = "Unexpected MULTI"
+		case cmd == "MULTI":
+			inMulti, multiStart = true, check.ValidUpTo
+		case cmd == "EXEC" && !inMulti:
+			problem = "Unexpected EXEC"
+		case cmd == "EXEC":
+			inMulti = false
+		}
+		if problem != "" {
+			break
+		}
+		counts[cmd]++
+		check.ValidUpTo = r.offset
+	}
+	if problem != "" && inMulti {
+		// A transaction cut short goes as a whole
+		check.ValidUpTo = multiStart
+	}
+	if problem != "" {
+		fmt.Fprintf(out, "0x%16x: %s\n", check.ValidUpTo, problem)
+	}
+
+	fmt.Fprintf(out, "AOF analyzed: filename=%s, size=%d, ok_up_to=%d, diff=%d\n",
+		path, check.Size, check.ValidUpTo, check.Size-check.ValidUpTo)
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "[info] %s: %d\n", name, counts[name])
+	}
+	if problem == "" {
+		fmt.Fprintf(out, "AOF %s is valid\n", path)
+		check.Valid = true
+		return check, nil
+	}
+	if last {
+		check.Path = path
+	}
+	return check, nil
+}
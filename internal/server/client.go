@@ -0,0 +1,345 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"redis-learning/pkg/resp"
+)
+
+// nextClientID hands out unique, monotonically increasing client IDs
+var nextClientID int64
+
+// Client holds the state of a single client connection
+type Client struct {
+	id     int64
+	conn   net.Conn
+	closed chan struct{} // closed once the connection has gone away
+
+	// Replies are serialized into out and flushed to the connection by
+	// writeLoop, so other clients (e.g. publishers) can queue replies
+	// without waiting on a slow reader
+	outMu    sync.Mutex
+	out      bytes.Buffer
+	writer   *resp.Writer
+	outReady chan struct{}
+	closing  bool      // output limit reached, drop further replies
+	softTime time.Time // when out first went over the soft limit
+
+	proto int // RESP protocol version, 2 or 3
+	name  string
+
+	// Set while the client is waiting on a blocking command
+	bstate *blockedState
+
+	// Set between MULTI and EXEC/DISCARD
+	mstate *multiState
+
+	// Keys WATCHed by the client, mapped to whether they had already
+	// expired when watched, and whether one of them has been modified since
+	watchedKeys map[string]bool
+	dirtyCAS    bool
+
+	// Blocking commands time out right away instead of blocking, e.g.
+	// inside a transaction
+	denyBlocking bool
+
+	// Replays the append only file, so it runs commands while loading
+	aofLoader bool
+
+	// Set on the connections of replicas, once they sent REPLCONF or
+	// PSYNC. master is set on the client running the stream of our master.
+	replica *replicaState
+	master  bool
+
+	// The replication offset right after the last command of the client
+	// that was propagated, which WAIT and WAITAOF wait for
+	woff int64
+
+	// Pub/Sub subscriptions
+	channels      map[string]struct{}
+	patterns      map[string]struct{}
+	shardChannels map[string]struct{}
+}
+
+// outputBufferLimit disconnects clients whose pending output goes over hard
+// bytes, or stays over soft bytes for more than softSeconds
+type outputBufferLimit struct {
+	hard        int
+	soft        int
+	softSeconds int
+}
+
+// Client classes with their own output buffer limits
+const (
+	clientClassNormal = iota
+	clientClassReplica
+	clientClassPubSub
+	clientClassCount
+)
+
+var clientClassNames = [clientClassCount]string{"normal", "slave", "pubsub"}
+
+// clientClassByName returns the class for a client-output-buffer-limit
+// class name, or -1
+func clientClassByName(name string) int {
+	switch strings.ToLower(name) {
+	case "normal":
+		return clientClassNormal
+	case "slave", "replica":
+		return clientClassReplica
+	case "pubsub":
+		return clientClassPubSub
+	}
+	return -1
+}
+
+// defaultOutputBufferLimits match Redis's default client-output-buffer-limit
+var defaultOutputBufferLimits = [clientClassCount]outputBufferLimit{
+	clientClassNormal:  {},
+	clientClassReplica: {hard: 256 * 1024 * 1024, soft: 64 * 1024 * 1024, softSeconds: 60},
+	clientClassPubSub:  {hard: 32 * 1024 * 1024, soft: 8 * 1024 * 1024, softSeconds: 60},
+}
+
+// newClient wraps an accepted connection
+func newClient(conn net.Conn) *Client {
+	c := &Client{
+		id:            atomic.AddInt64(&nextClientID, 1),
+		conn:          conn,
+		closed:        make(chan struct{}),
+		outReady:      make(chan struct{}, 1),
+		proto:         2,
+		watchedKeys:   make(map[string]bool),
+		channels:      make(map[string]struct{}),
+		patterns:      make(map[string]struct{}),
+		shardChannels: make(map[string]struct{}),
+	}
+	c.writer = resp.NewWriter(&c.out)
+	return c
+}
+
+// isClosed reports whether the connection has gone away
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// mustObey reports whether the client replays writes already accepted
+// elsewhere, i.e. our master's stream or the append only file, so writes
+// are never refused to it
+func (c *Client) mustObey() bool {
+	return c.master || c.aofLoader
+}
+
+// addReply queues a reply for the client
+func (c *Client) addReply(v resp.Value) {
+	c.outMu.Lock()
+	if !c.closing {
+		c.writer.Write(v)
+	}
+	c.outMu.Unlock()
+
+	select {
+	case c.outReady <- struct{}{}:
+	default:
+	}
+}
+
+// addReplyRaw queues bytes already encoded, e.g. the replication stream
+func (c *Client) addReplyRaw(p []byte) {
+	c.outMu.Lock()
+	if !c.closing {
+		c.out.Write(p)
+	}
+	c.outMu.Unlock()
+
+	select {
+	case c.outReady <- struct{}{}:
+	default:
+	}
+}
+
+// setProtocol switches the client between RESP2 and RESP3
+func (c *Client) setProtocol(proto int) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	c.proto = proto
+	c.writer.SetProtocol(proto)
+}
+
+// writeLoop flushes queued replies to the connection until done is closed,
+// once the client runs no more commands. What is still queued then is
+// written before returning: a client that half-closed the connection after
+// its last command still gets the replies.
+func (c *Client) writeLoop(done <-chan struct{}) {
+	var buf []byte
+	for {
+		stop := false
+		select {
+		case <-c.outReady:
+		case <-done:
+			stop = true
+		}
+
+		c.outMu.Lock()
+		buf = append(buf[:0], c.out.Bytes()...)
+		c.out.Reset()
+		c.outMu.Unlock()
+
+		if len(buf) > 0 {
+			if _, err := c.conn.Write(buf); err != nil {
+				log.Printf("Error writing to client %s: %v", c.conn.RemoteAddr(), err)
+				c.conn.Close()
+				return
+			}
+		}
+		if stop {
+			return
+		}
+	}
+}
+
+// checkOutputBufferLimit closes the connection if the pending output is
+// over limit. It returns true if the client is being disconnected.
+func (c *Client) checkOutputBufferLimit(limit outputBufferLimit) bool {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+
+	if c.closing {
+		return true
+	}
+
+	used := c.out.Len()
+	hard := limit.hard > 0 && used >= limit.hard
+	soft := limit.soft > 0 && used >= limit.soft
+
+	// The soft limit only counts once it has been exceeded continuously for
+	// more than softSeconds
+	if soft {
+		if c.softTime.IsZero() {
+			c.softTime = time.Now()
+			soft = false
+		} else if time.Since(c.softTime) <= time.Duration(limit.softSeconds)*time.Second {
+			soft = false
+		}
+	} else {
+		c.softTime = time.Time{}
+	}
+
+	if !hard && !soft {
+		return false
+	}
+
+	log.Printf("Client id=%d addr=%s scheduled to be closed ASAP for overcoming of output buffer limits.", c.id, c.conn.RemoteAddr())
+	c.closing = true
+	c.out.Reset()
+	c.conn.Close()
+	return true
+}
+
+// freeClient releases the server side state of a disconnected client
+func (s *Server) freeClient(c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unwatchAllKeys(c)
+	s.pubsubUnsubscribeAll(c)
+	if c.replica != nil {
+		s.removeReplica(c)
+	}
+}
+
+// handleHello handles the HELLO command
+func (s *Server) handleHello(c *Client, args []resp.Value) resp.Value {
+	proto := c.proto
+	if len(args) > 0 {
+		ver, err := strconv.Atoi(args[0].Bulk)
+		if err != nil {
+			return resp.NewError("ERR Protocol version is not an integer or out of range")
+		}
+		if ver < 2 || ver > 3 {
+			return resp.NewError("NOPROTO unsupported protocol version")
+		}
+		proto = ver
+	}
+
+	name := c.name
+	setName := false
+	for i := 1; i < len(args); i++ {
+		remaining := len(args) - i - 1
+		switch opt := strings.ToUpper(args[i].Bulk); {
+		case opt == "AUTH" && remaining >= 2:
+			// There are no ACL users yet: only the passwordless default
+			// user exists
+			if args[i+1].Bulk != "default" {
+				return resp.NewError("WRONGPASS invalid username-password pair or user is disabled.")
+			}
+			i += 2
+		case opt == "SETNAME" && remaining >= 1:
+			if !validClientName(args[i+1].Bulk) {
+				return resp.NewError("ERR Client names cannot contain spaces, newlines or special characters.")
+			}
+			name = args[i+1].Bulk
+			setName = true
+			i++
+		default:
+			return resp.NewError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i].Bulk))
+		}
+	}
+
+	if setName {
+		c.name = name
+	}
+	c.setProtocol(proto)
+
+	mode, role := "standalone", "master"
+	if s.sentinel != nil {
+		mode = "sentinel"
+	}
+	if s.repl.masterHost != "" {
+		role = "replica"
+	}
+	return resp.NewMap([]resp.Value{
+		resp.NewBulkString("server"), resp.NewBulkString("redis"),
+		resp.NewBulkString("version"), resp.NewBulkString(redisVersion),
+		resp.NewBulkString("proto"), resp.NewInteger(proto),
+		resp.NewBulkString("id"), resp.NewInteger(int(c.id)),
+		resp.NewBulkString("mode"), resp.NewBulkString(mode),
+		resp.NewBulkString("role"), resp.NewBulkString(role),
+		resp.NewBulkString("modules"), resp.NewArray([]resp.Value{}),
+	})
+}
+
+// validClientName reports whether name only has printable characters and
+// no spaces
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// handleReset handles the RESET command, returning the connection to its
+// default state
+func (s *Server) handleReset(c *Client, args []resp.Value) resp.Value {
+	if len(args) != 0 {
+		return resp.NewError("ERR wrong number of arguments for 'reset' command")
+	}
+	s.discardTransaction(c)
+	s.pubsubUnsubscribeAll(c)
+	c.name = ""
+	c.setProtocol(2)
+	return resp.NewSimpleString("RESET")
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"redis-learning/pkg/module"
+	"redis-learning/pkg/resp"
+)
+
+// commandInfo describes a command's arity and behaviour, the metadata
+// processCommand checks before dispatching it
+type commandInfo struct {
+	// arity counts the command name itself. A negative arity -N means at
+	// least N arguments.
+	arity int
+	flags int
+
+	// keys is where the key arguments are, for commands that take them at
+	// fixed positions. getKeys finds them for the others, and reports
+	// false if the arguments don't make sense.
+	keys    keySpec
+	getKeys func(argv []string) ([]string, bool)
+
+	// module is set for commands registered through package module
+	module *module.Command
+}
+
+// keySpec gives the positions of the first and last key arguments, and
+// the step between keys, counting the command name as 0. A negative last
+// counts back from the last argument. A zero first means no keys.
+type keySpec struct {
+	first, last, step int
+}
+
+// Command flags
+const (
+	cmdWrite        = 1 << iota // may modify the dataset
+	cmdNoMulti                  // can't be queued inside MULTI
+	cmdNoScript                 // can't be called from scripts
+	cmdMayReplicate             // not a write, but may be propagated
+	cmdLoading                  // allowed while the dataset is loading
+)
+
+// commandTable lists every command processCommand knows about, keyed by
+// upper case name. Arities are the ones Redis uses, narrowed where only
+// part of a command's syntax is supported.
+var commandTable = map[string]commandInfo{
+	"PING":           {arity: -1, flags: cmdLoading},
+	"SET":            {arity: 3, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"GET":            {arity: 2, keys: keySpec{1, 1, 1}},
+	"DEL":            {arity: 2, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"TYPE":           {arity: 2, keys: keySpec{1, 1, 1}},
+	"DUMP":           {arity: 2, keys: keySpec{1, 1, 1}},
+	"RESTORE":        {arity: -4, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"LPUSH":          {arity: -3, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"RPUSH":          {arity: -3, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"LPOP":           {arity: 2, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"RPOP":           {arity: 2, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"LLEN":           {arity: 2, keys: keySpec{1, 1, 1}},
+	"LMOVE":          {arity: 5, flags: cmdWrite, keys: keySpec{1, 2, 1}},
+	"LMPOP":          {arity: -4, flags: cmdWrite, getKeys: keysAfterNumKeys(1)},
+	"BLPOP":          {arity: -3, flags: cmdWrite, keys: keySpec{1, -2, 1}},
+	"BRPOP":          {arity: -3, flags: cmdWrite, keys: keySpec{1, -2, 1}},
+	"BLMOVE":         {arity: 6, flags: cmdWrite, keys: keySpec{1, 2, 1}},
+	"BLMPOP":         {arity: -5, flags: cmdWrite, getKeys: keysAfterNumKeys(2)},
+	"XADD":           {arity: -5, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"XRANGE":         {arity: -4, keys: keySpec{1, 1, 1}},
+	"XREVRANGE":      {arity: -4, keys: keySpec{1, 1, 1}},
+	"XLEN":           {arity: 2, keys: keySpec{1, 1, 1}},
+	"XDEL":           {arity: -3, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"XTRIM":          {arity: -4, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"XSETID":         {arity: -3, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"XINFO":          {arity: -2, keys: keySpec{2, 2, 1}},
+	"XREAD":          {arity: -4, getKeys: streamsKeys},
+	"XGROUP":         {arity: -2, flags: cmdWrite, keys: keySpec{2, 2, 1}},
+	"XREADGROUP":     {arity: -7, flags: cmdWrite, getKeys: streamsKeys},
+	"XACK":           {arity: -4, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"XPENDING":       {arity: -3, keys: keySpec{1, 1, 1}},
+	"XCLAIM":         {arity: -6, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"XAUTOCLAIM":     {arity: -6, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"GEOADD":         {arity: -5, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"GEOPOS":         {arity: -2, keys: keySpec{1, 1, 1}},
+	"GEODIST":        {arity: -4, keys: keySpec{1, 1, 1}},
+	"GEOHASH":        {arity: -2, keys: keySpec{1, 1, 1}},
+	"GEOSEARCH":      {arity: -7, keys: keySpec{1, 1, 1}},
+	"GEOSEARCHSTORE": {arity: -8, flags: cmdWrite, keys: keySpec{1, 2, 1}},
+	"SETBIT":         {arity: 4, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"GETBIT":         {arity: 3, keys: keySpec{1, 1, 1}},
+	"BITCOUNT":       {arity: -2, keys: keySpec{1, 1, 1}},
+	"BITPOS":         {arity: -3, keys: keySpec{1, 1, 1}},
+	"BITOP":          {arity: -4, flags: cmdWrite, keys: keySpec{2, -1, 1}},
+	"BITFIELD":       {arity: -2, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"BITFIELD_RO":    {arity: -2, keys: keySpec{1, 1, 1}},
+	"PFADD":          {arity: -2, flags: cmdWrite, keys: keySpec{1, 1, 1}},
+	"PFCOUNT":        {arity: -2, flags: cmdMayReplicate, keys: keySpec{1, -1, 1}},
+	"PFMERGE":        {arity: -2, flags: cmdWrite, keys: keySpec{1, -1, 1}},
+	"PFDEBUG":        {arity: 3, flags: cmdWrite, keys: keySpec{2, 2, 1}},
+	"PFSELFTEST":     {arity: 1},
+	// Subscribing queues its replies straight away rather than returning
+	// them, so it can't take part in an EXEC reply
+	"SUBSCRIBE":    {arity: -2, flags: cmdNoMulti | cmdNoScript | cmdLoading},
+	"UNSUBSCRIBE":  {arity: -1, flags: cmdNoMulti | cmdNoScript | cmdLoading},
+	"PSUBSCRIBE":   {arity: -2, flags: cmdNoMulti | cmdNoScript | cmdLoading},
+	"PUNSUBSCRIBE": {arity: -1, flags: cmdNoMulti | cmdNoScript | cmdLoading},
+	"SSUBSCRIBE":   {arity: -2, flags: cmdNoMulti | cmdNoScript | cmdLoading, keys: keySpec{1, -1, 1}},
+	"SUNSUBSCRIBE": {arity: -1, flags: cmdNoMulti | cmdNoScript | cmdLoading, keys: keySpec{1, -1, 1}},
+	"PUBLISH":      {arity: 3, flags: cmdLoading | cmdMayReplicate},
+	"SPUBLISH":     {arity: 3, flags: cmdLoading | cmdMayReplicate, keys: keySpec{1, 1, 1}},
+	"PUBSUB":       {arity: -2, flags: cmdLoading},
+	"MULTI":        {arity: 1, flags: cmdNoScript | cmdLoading},
+	"EXEC":         {arity: 1, flags: cmdNoScript | cmdLoading},
+	"DISCARD":      {arity: 1, flags: cmdNoScript | cmdLoading},
+	"WATCH":        {arity: -2, flags: cmdNoScript, keys: keySpec{1, -1, 1}},
+	"UNWATCH":      {arity: 1, flags: cmdNoScript},
+	"FLUSHDB":      {arity: -1, flags: cmdWrite},
+	"FLUSHALL":     {arity: -1, flags: cmdWrite},
+	"EVAL":         {arity: -3, flags: cmdNoScript, getKeys: keysAfterNumKeys(2)},
+	"EVALSHA":      {arity: -3, flags: cmdNoScript, getKeys: keysAfterNumKeys(2)},
+	"EVAL_RO":      {arity: -3, flags: cmdNoScript, getKeys: keysAfterNumKeys(2)},
+	"EVALSHA_RO":   {arity: -3, flags: cmdNoScript, getKeys: keysAfterNumKeys(2)},
+	"SCRIPT":       {arity: -2, flags: cmdNoScript},
+	"FCALL":        {arity: -3, flags: cmdNoScript, getKeys: keysAfterNumKeys(2)},
+	"FCALL_RO":     {arity: -3, flags: cmdNoScript, getKeys: keysAfterNumKeys(2)},
+	"FUNCTION":     {arity: -2, flags: cmdNoScript | cmdMayReplicate},
+	"SAVE":         {arity: 1, flags: cmdNoScript},
+	"BGSAVE":       {arity: -1, flags: cmdNoScript},
+	"LASTSAVE":     {arity: 1, flags: cmdLoading},
+	"BGREWRITEAOF": {arity: 1, flags: cmdNoScript},
+	"SHUTDOWN":     {arity: -1, flags: cmdNoMulti | cmdNoScript | cmdLoading},
+	"INFO":         {arity: -1, flags: cmdLoading},
+	"HELLO":        {arity: -1, flags: cmdNoScript | cmdLoading},
+	"RESET":        {arity: 1, flags: cmdNoScript | cmdLoading},
+	"CONFIG":       {arity: -2, flags: cmdNoScript | cmdLoading},
+	"QUIT":         {arity: -1, flags: cmdNoScript | cmdLoading},
+	"PSYNC":        {arity: -3, flags: cmdNoMulti | cmdNoScript},
+	"REPLCONF":     {arity: -1, flags: cmdNoScript | cmdLoading},
+	"REPLICAOF":    {arity: 3, flags: cmdNoScript},
+	"SLAVEOF":      {arity: 3, flags: cmdNoScript},
+	"ROLE":         {arity: 1, flags: cmdNoScript | cmdLoading},
+	"WAIT":         {arity: 3, flags: cmdNoScript},
+	"WAITAOF":      {arity: 4, flags: cmdNoScript},
+	"COMMAND":      {arity: -2, flags: cmdLoading},
+}
+
+// lookupCommand finds a built-in or module command by its upper case name
+func (s *Server) lookupCommand(cmd string) (commandInfo, bool) {
+	if s.sentinel != nil {
+		info, ok := sentinelCommandTable[cmd]
+		return info, ok
+	}
+	if info, ok := commandTable[cmd]; ok {
+		return info, true
+	}
+	info, ok := s.moduleCommands[cmd]
+	return info, ok
+}
+
+// checkArity returns an error reply if args (without the command name)
+// don't fit the command's arity
+func checkArity(name string, info commandInfo, args []resp.Value) (resp.Value, bool) {
+	n := len(args) + 1
+	if (info.arity > 0 && n != info.arity) || n < -info.arity {
+		return resp.NewError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name))), false
+	}
+	return resp.Value{}, true
+}
+
+// keysAfterNumKeys finds the keys of commands that take a numkeys argument
+// at position pos, followed by the keys
+func keysAfterNumKeys(pos int) func(argv []string) ([]string, bool) {
+	return func(argv []string) ([]string, bool) {
+		if pos >= len(argv) {
+			return nil, false
+		}
+		n, err := strconv.Atoi(argv[pos])
+		if err != nil || n < 0 || n > len(argv)-pos-1 {
+			return nil, false
+		}
+		return argv[pos+1 : pos+1+n], true
+	}
+}
+
+// streamsKeys finds the keys of XREAD and XREADGROUP: the first half of
+// what follows STREAMS, the rest being IDs
+func streamsKeys(argv []string) ([]string, bool) {
+	for i, arg := range argv {
+		if strings.ToUpper(arg) != "STREAMS" {
+			continue
+		}
+		rest := argv[i+1:]
+		if len(rest) == 0 || len(rest)%2 != 0 {
+			return nil, false
+		}
+		return rest[:len(rest)/2], true
+	}
+	return nil, false
+}
+
+// commandKeys returns the key arguments of argv, which includes the
+// command name
+func commandKeys(info commandInfo, argv []string) ([]string, bool) {
+	if info.getKeys != nil {
+		return info.getKeys(argv)
+	}
+	ks := module.KeySpec{FirstKey: info.keys.first, LastKey: info.keys.last, Step: info.keys.step}
+	return ks.Keys(argv), true
+}
+
+// handleCommand handles COMMAND COUNT and COMMAND GETKEYS
+func (s *Server) handleCommand(args []resp.Value) resp.Value {
+	switch sub := strings.ToUpper(args[0].Bulk); {
+	case sub == "COUNT" && len(args) == 1:
+		return resp.NewInteger(len(commandTable) + len(s.moduleCommands))
+
+	case sub == "GETKEYS" && len(args) >= 2:
+		info, known := s.lookupCommand(strings.ToUpper(args[1].Bulk))
+		if !known {
+			return resp.NewError("ERR Invalid command specified")
+		}
+		if _, ok := checkArity(args[1].Bulk, info, args[2:]); !ok {
+			return resp.NewError("ERR Invalid number of arguments specified for command")
+		}
+		argv := make([]string, len(args)-1)
+		for i, arg := range args[1:] {
+			argv[i] = arg.Bulk
+		}
+		keys, ok := commandKeys(info, argv)
+		if !ok {
+			return resp.NewError("ERR Invalid arguments specified for command")
+		}
+		if len(keys) == 0 {
+			return resp.NewError("ERR The command has no key arguments")
+		}
+		replies := make([]resp.Value, len(keys))
+		for i, key := range keys {
+			replies[i] = resp.NewBulkString(key)
+		}
+		return resp.NewArray(replies)
+	}
+	return resp.NewError(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'. Try COMMAND HELP.", args[0].Bulk))
+}
@@ -0,0 +1,620 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-learning/pkg/resp"
+)
+
+// configParam is a server setting exposed through CONFIG GET and SET
+type configParam struct {
+	name      string
+	alias     string
+	immutable bool
+	get       func(s *Server) string
+	set       func(s *Server, value string) error
+}
+
+// configTable lists the supported settings
+var configTable = []*configParam{
+	{
+		name:      "bind",
+		immutable: true,
+		get:       func(s *Server) string { return s.host },
+	},
+	{
+		name:      "port",
+		immutable: true,
+		get:       func(s *Server) string { return s.port },
+	},
+	{
+		name: "notify-keyspace-events",
+		get:  func(s *Server) string { return keyspaceEventsFlagsToString(s.notifyKeyspaceEvents) },
+		set: func(s *Server, value string) error {
+			flags, ok := keyspaceEventsStringToFlags(value)
+			if !ok {
+				return errors.New(invalidKeyspaceEventsErr)
+			}
+			s.notifyKeyspaceEvents = flags
+			return nil
+		},
+	},
+	{
+		name: "hll-sparse-max-bytes",
+		get:  func(s *Server) string { return strconv.Itoa(s.hllSparseMaxBytes) },
+		set: func(s *Server, value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			s.hllSparseMaxBytes = int(n)
+			return nil
+		},
+	},
+	{
+		name: "dir",
+		get: func(s *Server) string {
+			if abs, err := filepath.Abs(s.persist.dir); err == nil {
+				return abs
+			}
+			return s.persist.dir
+		},
+		set: func(s *Server, value string) error {
+			info, err := os.Stat(value)
+			if err != nil {
+				return errors.New("No such file or directory")
+			}
+			if !info.IsDir() {
+				return errors.New("Not a directory")
+			}
+			s.persist.dir = value
+			return nil
+		},
+	},
+	{
+		name: "dbfilename",
+		get:  func(s *Server) string { return s.persist.dbFilename },
+		set: func(s *Server, value string) error {
+			if value == "" || strings.ContainsAny(value, "/\\") {
+				return errors.New("dbfilename can't be a path, just a filename")
+			}
+			s.persist.dbFilename = value
+			return nil
+		},
+	},
+	{
+		name: "save",
+		get:  func(s *Server) string { return formatSaveParams(s.persist.saveParams) },
+		set: func(s *Server, value string) error {
+			params, err := parseSaveParams(value)
+			if err != nil {
+				return err
+			}
+			s.persist.saveParams = params
+			return nil
+		},
+	},
+	{
+		name: "appendonly",
+		get:  func(s *Server) string { return yesNo(s.aof.enabled) },
+		set: func(s *Server, value string) error {
+			enabled, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+			if !s.loaded || enabled == s.aof.enabled {
+				s.aof.enabled = enabled
+				return nil
+			}
+			if enabled {
+				return s.startAppendOnly()
+			}
+			s.stopAppendOnly()
+			return nil
+		},
+	},
+	{
+		name:      "appendfilename",
+		immutable: true,
+		get:       func(s *Server) string { return s.aof.filename },
+		set: func(s *Server, value string) error {
+			if value == "" || strings.ContainsAny(value, "/\\") {
+				return errors.New("appendfilename can't be a path, just a filename")
+			}
+			s.aof.filename = value
+			return nil
+		},
+	},
+	{
+		name:      "appenddirname",
+		immutable: true,
+		get:       func(s *Server) string { return s.aof.dirname },
+		set: func(s *Server, value string) error {
+			if value == "" || strings.ContainsAny(value, "/\\") {
+				return errors.New("appenddirname can't be a path, just a dirname")
+			}
+			s.aof.dirname = value
+			return nil
+		},
+	},
+	{
+		name: "appendfsync",
+		get:  func(s *Server) string { return aofFsyncNames[s.aof.fsync] },
+		set: func(s *Server, value string) error {
+			policy, err := parseAppendFsync(value)
+			if err != nil {
+				return err
+			}
+			s.aof.fsync = policy
+			return nil
+		},
+	},
+	{
+		name: "aof-load-truncated",
+		get:  func(s *Server) string { return yesNo(s.aof.loadTruncated) },
+		set: func(s *Server, value string) error {
+			enabled, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+			s.aof.loadTruncated = enabled
+			return nil
+		},
+	},
+	{
+		name: "aof-use-rdb-preamble",
+		get:  func(s *Server) string { return yesNo(s.aof.useRDBPreamble) },
+		set: func(s *Server, value string) error {
+			enabled, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+			s.aof.useRDBPreamble = enabled
+			return nil
+		},
+	},
+	{
+		name: "auto-aof-rewrite-percentage",
+		get:  func(s *Server) string { return strconv.Itoa(s.aof.rewritePercentage) },
+		set: func(s *Server, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			s.aof.rewritePercentage = n
+			return nil
+		},
+	},
+	{
+		name: "auto-aof-rewrite-min-size",
+		get:  func(s *Server) string { return strconv.FormatInt(s.aof.rewriteMinSize, 10) },
+		set: func(s *Server, value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			s.aof.rewriteMinSize = n
+			return nil
+		},
+	},
+	{
+		name: "loading-process-events-interval-bytes",
+		get:  func(s *Server) string { return strconv.FormatInt(s.persist.loadingEventsInterval, 10) },
+		set: func(s *Server, value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			if n < 1024 {
+				return errors.New("argument must be a memory value of at least 1024")
+			}
+			s.persist.loadingEventsInterval = n
+			return nil
+		},
+	},
+	{
+		name: "key-load-delay",
+		get:  func(s *Server) string { return strconv.FormatInt(s.persist.keyLoadDelay.Microseconds(), 10) },
+		set: func(s *Server, value string) error {
+			us, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || us < 0 {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			s.persist.keyLoadDelay = time.Duration(us) * time.Microsecond
+			return nil
+		},
+	},
+	{
+		name: "rdb-key-save-delay",
+		get:  func(s *Server) string { return strconv.FormatInt(s.persist.keySaveDelay.Microseconds(), 10) },
+		set: func(s *Server, value string) error {
+			us, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || us < 0 {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			s.persist.keySaveDelay = time.Duration(us) * time.Microsecond
+			return nil
+		},
+	},
+	{
+		name:  "busy-reply-threshold",
+		alias: "lua-time-limit",
+		get:   func(s *Server) string { return strconv.FormatInt(s.busyReplyThreshold.Milliseconds(), 10) },
+		set: func(s *Server, value string) error {
+			ms, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || ms < 0 {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			s.busyReplyThreshold = time.Duration(ms) * time.Millisecond
+			return nil
+		},
+	},
+	{
+		name: "client-output-buffer-limit",
+		get:  func(s *Server) string { return formatOutputBufferLimits(s.clientOutputBufferLimits) },
+		set: func(s *Server, value string) error {
+			return parseOutputBufferLimits(value, &s.clientOutputBufferLimits)
+		},
+	},
+	{
+		name:      "replicaof",
+		alias:     "slaveof",
+		immutable: true,
+		get: func(s *Server) string {
+			if s.repl.masterHost == "" {
+				return ""
+			}
+			return s.repl.masterHost + " " + s.repl.masterPort
+		},
+		set: func(s *Server, value string) error {
+			fields := strings.Fields(value)
+			if len(fields) == 0 {
+				return nil
+			}
+			if len(fields) != 2 {
+				return errors.New("wrong number of arguments")
+			}
+			if port, err := strconv.Atoi(fields[1]); err != nil || port < 0 || port > 65535 {
+				return errors.New("Invalid master port")
+			}
+			s.replicationSetMaster(fields[0], fields[1])
+			return nil
+		},
+	},
+	{
+		name:  "replica-read-only",
+		alias: "slave-read-only",
+		get:   func(s *Server) string { return yesNo(s.repl.readOnly) },
+		set: func(s *Server, value string) error {
+			b, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+			s.repl.readOnly = b
+			return nil
+		},
+	},
+	{
+		name: "repl-backlog-size",
+		get:  func(s *Server) string { return strconv.FormatInt(s.repl.backlogSize, 10) },
+		set: func(s *Server, value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			if n < 1 {
+				return errors.New("argument must be a memory value of at least 1")
+			}
+			s.repl.backlogSize = n
+			if s.repl.backlog != nil && int64(len(s.repl.backlog.buf)) != n {
+				// What the backlog held is lost
+				s.repl.backlog = newReplBacklog(n, s.repl.offset+1)
+			}
+			return nil
+		},
+	},
+	{
+		name: "repl-diskless-sync",
+		get:  func(s *Server) string { return yesNo(s.repl.disklessSync) },
+		set: func(s *Server, value string) error {
+			enabled, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+			s.repl.disklessSync = enabled
+			return nil
+		},
+	},
+	{
+		name: "repl-diskless-sync-delay",
+		get:  func(s *Server) string { return strconv.FormatInt(int64(s.repl.disklessSyncDelay/time.Second), 10) },
+		set: func(s *Server, value string) error {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			s.repl.disklessSyncDelay = time.Duration(n) * time.Second
+			return nil
+		},
+	},
+	{
+		name: "repl-diskless-sync-max-replicas",
+		get:  func(s *Server) string { return strconv.Itoa(s.repl.disklessSyncMaxReplicas) },
+		set: func(s *Server, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			s.repl.disklessSyncMaxReplicas = n
+			return nil
+		},
+	},
+	{
+		name: "repl-diskless-load",
+		get:  func(s *Server) string { return replDisklessLoadNames[s.repl.disklessLoad] },
+		set: func(s *Server, value string) error {
+			mode, err := parseReplDisklessLoad(value)
+			if err != nil {
+				return err
+			}
+			s.repl.disklessLoad = mode
+			return nil
+		},
+	},
+	{
+		name: "repl-timeout",
+		get:  func(s *Server) string { return strconv.FormatInt(int64(s.repl.timeout/time.Second), 10) },
+		set: func(s *Server, value string) error {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 1 {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			s.repl.timeout = time.Duration(n) * time.Second
+			return nil
+		},
+	},
+	{
+		name:  "repl-ping-replica-period",
+		alias: "repl-ping-slave-period",
+		get:   func(s *Server) string { return strconv.FormatInt(int64(s.repl.pingPeriod/time.Second), 10) },
+		set: func(s *Server, value string) error {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 1 {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			s.repl.pingPeriod = time.Duration(n) * time.Second
+			return nil
+		},
+	},
+	{
+		name:  "replica-priority",
+		alias: "slave-priority",
+		get:   func(s *Server) string { return strconv.Itoa(s.repl.priority) },
+		set: func(s *Server, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			s.repl.priority = n
+			return nil
+		},
+	},
+	{
+		name:  "min-replicas-to-write",
+		alias: "min-slaves-to-write",
+		get:   func(s *Server) string { return strconv.Itoa(s.repl.minReplicasToWrite) },
+		set: func(s *Server, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			s.repl.minReplicasToWrite = n
+			return nil
+		},
+	},
+	{
+		name:  "min-replicas-max-lag",
+		alias: "min-slaves-max-lag",
+		get:   func(s *Server) string { return strconv.Itoa(s.repl.minReplicasMaxLag) },
+		set: func(s *Server, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			s.repl.minReplicasMaxLag = n
+			return nil
+		},
+	},
+}
+
+// lookupConfig finds a setting by name or alias
+func lookupConfig(name string) *configParam {
+	name = strings.ToLower(name)
+	for _, param := range configTable {
+		if param.name == name || (param.alias != "" && param.alias == name) {
+			return param
+		}
+	}
+	return nil
+}
+
+// parseYesNo parses a boolean setting
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, errors.New("argument must be 'yes' or 'no'")
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// parseMemory parses a non-negative byte count with an optional k, kb, m,
+// mb, g or gb unit, where k is 1000 and kb is 1024
+func parseMemory(value string) (int64, error) {
+	lower := strings.ToLower(value)
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+
+	mul := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower = strings.TrimSuffix(lower, unit.suffix)
+			mul = unit.mul
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mul {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return n * mul, nil
+}
+
+// formatOutputBufferLimits renders the limits the way Redis does, e.g.
+// "normal 0 0 0 slave 268435456 67108864 60 pubsub 33554432 8388608 60"
+func formatOutputBufferLimits(limits [clientClassCount]outputBufferLimit) string {
+	parts := make([]string, 0, clientClassCount)
+	for class, limit := range limits {
+		parts = append(parts, fmt.Sprintf("%s %d %d %d", clientClassNames[class], limit.hard, limit.soft, limit.softSeconds))
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseOutputBufferLimits parses "<class> <hard> <soft> <seconds>" groups.
+// Classes that aren't mentioned keep their current limits.
+func parseOutputBufferLimits(value string, limits *[clientClassCount]outputBufferLimit) error {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields)%4 != 0 {
+		return errors.New("Wrong number of arguments in buffer limit configuration.")
+	}
+
+	updated := *limits
+	for i := 0; i < len(fields); i += 4 {
+		class := clientClassByName(fields[i])
+		if class < 0 {
+			return errors.New("Invalid client class specified in buffer limit configuration.")
+		}
+		hard, err1 := parseMemory(fields[i+1])
+		soft, err2 := parseMemory(fields[i+2])
+		seconds, err3 := strconv.Atoi(fields[i+3])
+		if err1 != nil || err2 != nil || err3 != nil || seconds < 0 {
+			return errors.New("Error in hard, soft or soft_seconds setting in buffer limit configuration.")
+		}
+		updated[class] = outputBufferLimit{hard: int(hard), soft: int(soft), softSeconds: seconds}
+	}
+	*limits = updated
+	return nil
+}
+
+// handleConfig handles the CONFIG command
+func (s *Server) handleConfig(args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.NewError("ERR wrong number of arguments for 'config' command")
+	}
+
+	switch strings.ToUpper(args[0].Bulk) {
+	case "GET":
+		return s.configGet(args[1:])
+	case "SET":
+		return s.configSet(args[1:])
+	default:
+		return resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", args[0].Bulk))
+	}
+}
+
+// configGet replies with every setting matching one of the glob patterns
+func (s *Server) configGet(args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.NewError("ERR wrong number of arguments for 'config|get' command")
+	}
+
+	var values []resp.Value
+	for _, param := range configTable {
+		for _, arg := range args {
+			if stringMatch(arg.Bulk, param.name, true) {
+				values = append(values, resp.NewBulkString(param.name), resp.NewBulkString(param.get(s)))
+				break
+			}
+		}
+	}
+	return resp.NewMap(values)
+}
+
+// configSet applies parameter/value pairs atomically: if one of them fails
+// the ones already applied are restored
+func (s *Server) configSet(args []resp.Value) resp.Value {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return resp.NewError("ERR wrong number of arguments for 'config|set' command")
+	}
+
+	params := make([]*configParam, 0, len(args)/2)
+	seen := make(map[*configParam]bool)
+	for i := 0; i < len(args); i += 2 {
+		param := lookupConfig(args[i].Bulk)
+		if param == nil {
+			return resp.NewError(fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i].Bulk))
+		}
+		if param.immutable {
+			return configSetErr(args[i].Bulk, "can't set immutable config")
+		}
+		if seen[param] {
+			return configSetErr(args[i].Bulk, "duplicate parameter")
+		}
+		seen[param] = true
+		params = append(params, param)
+	}
+
+	old := make([]string, len(params))
+	for i, param := range params {
+		old[i] = param.get(s)
+	}
+
+	for i, param := range params {
+		if err := param.set(s, args[2*i+1].Bulk); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				params[j].set(s, old[j])
+			}
+			return configSetErr(args[2*i].Bulk, err.Error())
+		}
+	}
+	return resp.NewSimpleString("OK")
+}
+
+// SetConfig applies a setting before the server starts, as if set in a
+// configuration file
+func (s *Server) SetConfig(name, value string) error {
+	param := lookupConfig(name)
+	if param == nil || param.set == nil {
+		return fmt.Errorf("unknown or immutable setting '%s'", name)
+	}
+	if err := param.set(s, value); err != nil {
+		return fmt.Errorf("invalid value for '%s': %v", name, err)
+	}
+	return nil
+}
+
+func configSetErr(name, reason string) resp.Value {
+	return resp.NewError(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", name, reason))
+}
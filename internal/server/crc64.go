@@ -0,0 +1,28 @@
+package server
+
+// crc64Table is the lookup table of the CRC64 variant Redis checksums RDB
+// files and DUMP payloads with (Jones: reflected polynomial
+// 0x95ac9329ac4bc9b5, initial value 0, no final xor)
+var crc64Table = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x95ac9329ac4bc9b5
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc64 continues the checksum crc with buf
+func crc64(crc uint64, buf []byte) uint64 {
+	for _, b := range buf {
+		crc = crc64Table[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
@@ -2,16 +2,21 @@ package server
 
 import (
 	"time"
+
+	"redis-learning/pkg/module"
 )
 
 // RedisValue represents different Redis data types
 type RedisValue struct {
-	Type      string                 // "string", "list", "set", "hash", "zset"
+	Type      string                 // "string", "list", "set", "hash", "zset", "stream", or a module type name
 	String    string                 // For string values
 	List      []string               // For list values
 	Set       map[string]bool        // For set values (using map for O(1) lookup)
 	Hash      map[string]string      // For hash values
 	ZSet      map[string]float64     // For sorted set values (member -> score)
+	Stream    *Stream                // For stream values
+	Module    any                    // For values of module types
+	ModType   *module.Type           // The module type of Module
 	ExpiresAt *time.Time             // For TTL support
 }
 
@@ -47,6 +52,31 @@ func NewHashValue() *RedisValue {
 	}
 }
 
+// NewZSetValue creates a new sorted set value
+func NewZSetValue() *RedisValue {
+	return &RedisValue{
+		Type: "zset",
+		ZSet: make(map[string]float64),
+	}
+}
+
+// NewStreamValue creates a new stream value
+func NewStreamValue() *RedisValue {
+	return &RedisValue{
+		Type:   "stream",
+		Stream: NewStream(),
+	}
+}
+
+// NewModuleValue creates a value of a type registered by a module
+func NewModuleValue(t *module.Type, value any) *RedisValue {
+	return &RedisValue{
+		Type:    t.Name,
+		Module:  value,
+		ModType: t,
+	}
+}
+
 // IsExpired checks if the value has expired
 func (rv *RedisValue) IsExpired() bool {
 	if rv.ExpiresAt == nil {
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-learning/pkg/resp"
+)
+
+// dumpPayload serializes a value the way DUMP does: its RDB type and
+// encoding, followed by the DUMP footer. The expiry isn't included.
+func dumpPayload(val *RedisValue) []byte {
+	buf := []byte{rdbObjectType(val)}
+	return createDumpPayload(rdbAppendObject(buf, val))
+}
+
+// handleDump handles the DUMP key command
+func (s *Server) handleDump(args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return resp.NewError("ERR wrong number of arguments for 'dump' command")
+	}
+	val, exists := s.db.GetValue(args[0].Bulk)
+	if !exists {
+		return resp.NewNullBulkString()
+	}
+	return resp.NewBulkString(string(dumpPayload(val)))
+}
+
+// handleRestore handles the RESTORE key ttl payload [REPLACE] [ABSTTL]
+// [IDLETIME seconds] [FREQ frequency] command. Keys don't track access
+// times, so IDLETIME and FREQ are validated and ignored.
+func (s *Server) handleRestore(args []resp.Value) resp.Value {
+	if len(args) < 3 {
+		return resp.NewError("ERR wrong number of arguments for 'restore' command")
+	}
+	key := args[0].Bulk
+	replace, absTTL := false, false
+	idle, freq := int64(-1), int64(-1)
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].Bulk)
+		more := i+1 < len(args)
+		switch {
+		case opt == "REPLACE":
+			replace = true
+		case opt == "ABSTTL":
+			absTTL = true
+		case opt == "IDLETIME" && more && freq == -1:
+			n, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+			if err != nil {
+				return resp.NewError("ERR value is not an integer or out of range")
+			}
+			if n < 0 {
+				return resp.NewError("ERR Invalid IDLETIME value, must be >= 0")
+			}
+			idle = n
+			i++
+		case opt == "FREQ" && more && idle == -1:
+			n, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+			if err != nil {
+				return resp.NewError("ERR value is not an integer or out of range")
+			}
+			if n < 0 || n > 255 {
+				return resp.NewError("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+			freq = n
+			i++
+		default:
+			return resp.NewError("ERR syntax error")
+		}
+	}
+
+	if _, exists := s.db.GetValue(key); exists && !replace {
+		return resp.NewError("BUSYKEY Target key name already exists.")
+	}
+	ttl, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+	if err != nil {
+		return resp.NewError("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return resp.NewError("ERR Invalid TTL value, must be >= 0")
+	}
+	body, ok := verifyDumpPayload([]byte(args[2].Bulk))
+	if !ok {
+		return resp.NewError("ERR DUMP payload version or checksum are wrong")
+	}
+	r := &rdbReader{buf: body}
+	rdbType, err := r.readByte()
+	if err != nil {
+		return resp.NewError("ERR Bad data format")
+	}
+	val, err := rdbLoadObject(r, rdbType)
+	if err != nil {
+		return resp.NewError("ERR Bad data format")
+	}
+
+	deleted := replace && s.db.Del(key)
+	if ttl > 0 && !absTTL {
+		ttl += time.Now().UnixMilli()
+	}
+	if ttl > 0 && ttl <= time.Now().UnixMilli() {
+		// Already expired, so restoring only deletes the key it replaces
+		if deleted {
+			s.signalModifiedKey(key)
+			s.notifyKeyspaceEvent(notifyGeneric, "del", key)
+			s.alsoPropagate("DEL", key)
+		}
+		return resp.NewSimpleString("OK")
+	}
+
+	if ttl > 0 {
+		expiresAt := time.UnixMilli(ttl)
+		val.ExpiresAt = &expiresAt
+		if !absTTL {
+			// Replicated with the deadline it got here
+			argv := commandArgv("RESTORE", args)
+			argv[2] = strconv.FormatInt(ttl, 10)
+			s.alsoPropagate(append(argv, "ABSTTL")...)
+		}
+	}
+	s.db.SetValue(key, val)
+	s.signalModifiedKey(key)
+	s.notifyKeyspaceEvent(notifyGeneric, "restore", key)
+	return resp.NewSimpleString("OK")
+}
@@ -0,0 +1,563 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"redis-learning/pkg/resp"
+)
+
+// functionLoadTimeout bounds how long the code of a library can run while
+// it registers its functions
+const functionLoadTimeout = 500 * time.Millisecond
+
+// functionLibrary is a library loaded with FUNCTION LOAD
+type functionLibrary struct {
+	name      string
+	code      string
+	functions map[string]*luaFunction
+}
+
+// luaFunction is a function registered by a library
+type luaFunction struct {
+	name        string
+	library     *functionLibrary
+	fn          *lua.LFunction
+	flags       int
+	description string // empty if none was given
+}
+
+// functionsLibCtx holds a set of libraries and the functions they register.
+// Libraries are never modified once loaded, so copies can share them.
+type functionsLibCtx struct {
+	libraries map[string]*functionLibrary
+	functions map[string]*luaFunction
+}
+
+func newFunctionsLibCtx() *functionsLibCtx {
+	return &functionsLibCtx{
+		libraries: make(map[string]*functionLibrary),
+		functions: make(map[string]*luaFunction),
+	}
+}
+
+// clone returns a copy of ctx that can be changed independently
+func (ctx *functionsLibCtx) clone() *functionsLibCtx {
+	copied := newFunctionsLibCtx()
+	for name, lib := range ctx.libraries {
+		copied.libraries[name] = lib
+	}
+	for name, f := range ctx.functions {
+		copied.functions[name] = f
+	}
+	return copied
+}
+
+// remove deletes a library and its functions
+func (ctx *functionsLibCtx) remove(lib *functionLibrary) {
+	for name := range lib.functions {
+		delete(ctx.functions, name)
+	}
+	delete(ctx.libraries, lib.name)
+}
+
+// validFunctionName reports whether name can name a library or function
+func validFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLibraryShebang reads the library name from the "#!lua name=<name>"
+// first line every library starts with
+func parseLibraryShebang(code string) (string, error) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", fmt.Errorf("Missing library metadata")
+	}
+	line := code
+	if i := strings.IndexByte(code, '\n'); i >= 0 {
+		line = code[:i]
+	}
+
+	parts := strings.Fields(line[2:])
+	if len(parts) == 0 || parts[0] != "lua" {
+		engine := ""
+		if len(parts) > 0 {
+			engine = parts[0]
+		}
+		return "", fmt.Errorf("Engine '%s' not found", engine)
+	}
+	name := ""
+	for _, part := range parts[1:] {
+		value, found := strings.CutPrefix(part, "name=")
+		if !found {
+			return "", fmt.Errorf("Invalid metadata value given: %s", part)
+		}
+		name = value
+	}
+	if name == "" {
+		return "", fmt.Errorf("Library name was not given")
+	}
+	if !validFunctionName(name) {
+		return "", fmt.Errorf("Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	return name, nil
+}
+
+// newFunctionsLuaState creates the interpreter libraries are loaded in. It
+// is separate from the EVAL one so that SCRIPT FLUSH leaves them alone.
+func (s *Server) newFunctionsLuaState() *lua.LState {
+	L := s.newLuaState()
+	redis := L.G.Global.RawGetString("redis").(*lua.LTable)
+	redis.RawSetString("register_function", L.NewFunction(s.luaRegisterFunction))
+	return L
+}
+
+// luaRegisterFunction implements redis.register_function, which takes
+// either a name and a callback or a table with the function_name, callback,
+// flags and description fields
+func (s *Server) luaRegisterFunction(L *lua.LState) int {
+	lib := s.functionsLoading
+	if lib == nil {
+		L.RaiseError("redis.register_function can only be called on FUNCTION LOAD command")
+	}
+
+	f := &luaFunction{library: lib}
+	switch L.GetTop() {
+	case 1:
+		t, ok := L.Get(1).(*lua.LTable)
+		if !ok {
+			L.RaiseError("calling redis.register_function with a single argument is only applicable to Lua table (representing named arguments).")
+		}
+		var errMsg string
+		t.ForEach(func(key, value lua.LValue) {
+			if errMsg != "" {
+				return
+			}
+			name, ok := key.(lua.LString)
+			if !ok {
+				errMsg = "named argument key given to redis.register_function is not a string"
+				return
+			}
+			switch name {
+			case "function_name":
+				if v, ok := value.(lua.LString); ok {
+					f.name = string(v)
+				} else {
+					errMsg = "function_name argument given to redis.register_function must be a string"
+				}
+			case "callback":
+				if v, ok := value.(*lua.LFunction); ok {
+					f.fn = v
+				} else {
+					errMsg = "callback argument given to redis.register_function must be a function"
+				}
+			case "description":
+				if v, ok := value.(lua.LString); ok {
+					f.description = string(v)
+				} else {
+					errMsg = "description argument given to redis.register_function must be a string"
+				}
+			case "flags":
+				flags, ok := luaScriptFlags(value)
+				if !ok {
+					errMsg = "unknown flag given"
+				}
+				f.flags = flags
+			default:
+				errMsg = "unknown argument given to redis.register_function"
+			}
+		})
+		if errMsg != "" {
+			L.RaiseError("%s", errMsg)
+		}
+		if f.name == "" || f.fn == nil {
+			L.RaiseError("redis.register_function must get a function name argument and a callback argument")
+		}
+	case 2:
+		name, ok := L.Get(1).(lua.LString)
+		if !ok {
+			L.RaiseError("first argument to redis.register_function must be a string")
+		}
+		fn, ok := L.Get(2).(*lua.LFunction)
+		if !ok {
+			L.RaiseError("second argument to redis.register_function must be a function")
+		}
+		f.name, f.fn = string(name), fn
+	default:
+		L.RaiseError("wrong number of arguments to redis.register_function")
+	}
+
+	if !validFunctionName(f.name) {
+		L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	if _, exists := lib.functions[f.name]; exists {
+		L.RaiseError("Function already exists in the library")
+	}
+	lib.functions[f.name] = f
+	return 0
+}
+
+// luaScriptFlags converts a Lua array of flag names
+func luaScriptFlags(value lua.LValue) (int, bool) {
+	t, ok := value.(*lua.LTable)
+	if !ok {
+		return 0, false
+	}
+	flags := 0
+	for i := 1; i <= t.Len(); i++ {
+		name, ok := t.RawGetInt(i).(lua.LString)
+		if !ok {
+			return 0, false
+		}
+		flag := scriptFlagByName(string(name))
+		if flag == 0 {
+			return 0, false
+		}
+		flags |= flag
+	}
+	return flags, true
+}
+
+// functionsCreate loads the library in code into libCtx, replacing the
+// library of the same name only if replace is set. libCtx is left
+// untouched if anything fails.
+func (s *Server) functionsCreate(code string, replace bool, libCtx *functionsLibCtx) (string, error) {
+	name, err := parseLibraryShebang(code)
+	if err != nil {
+		return "", err
+	}
+	old, exists := libCtx.libraries[name]
+	if exists && !replace {
+		return "", fmt.Errorf("Library '%s' already exists", name)
+	}
+
+	// Keep the shebang line so that error line numbers match the code
+	fn, err := s.functionsLua.Load(strings.NewReader("--"+code), "user_function")
+	if err != nil {
+		msg, _ := luaErrorMessage(err)
+		return "", fmt.Errorf("Error compiling function: %s", msg)
+	}
+
+	lib := &functionLibrary{name: name, code: code, functions: make(map[string]*luaFunction)}
+	L := s.functionsLua
+	ctx, cancel := context.WithTimeout(context.Background(), functionLoadTimeout)
+	defer cancel()
+	s.functionsLoading = lib
+	L.SetContext(ctx)
+	L.Push(fn)
+	err = L.PCall(0, 0, nil)
+	L.RemoveContext()
+	s.functionsLoading = nil
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("FUNCTION LOAD timeout")
+		}
+		msg, _ := luaErrorMessage(err)
+		return "", fmt.Errorf("Error registering functions: %s", msg)
+	}
+	if len(lib.functions) == 0 {
+		return "", fmt.Errorf("No functions registered")
+	}
+
+	for fname := range lib.functions {
+		if f, ok := libCtx.functions[fname]; ok && f.library != old {
+			return "", fmt.Errorf("Function %s already exists", fname)
+		}
+	}
+	if exists {
+		libCtx.remove(old)
+	}
+	libCtx.libraries[name] = lib
+	for fname, f := range lib.functions {
+		libCtx.functions[fname] = f
+	}
+	return name, nil
+}
+
+// functionsDump serializes every library the way FUNCTION DUMP and RDB
+// files store them: one FUNCTION2 opcode followed by the code per library
+func (s *Server) functionsDump(buf []byte) []byte {
+	names := make([]string, 0, len(s.functionsLib.libraries))
+	for name := range s.functionsLib.libraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buf = append(buf, rdbOpcodeFunction2)
+		buf = rdbAppendString(buf, s.functionsLib.libraries[name].code)
+	}
+	return buf
+}
+
+// functionsRewrite appends a FUNCTION LOAD command per library, sorted by
+// name, for AOF base files
+func (s *Server) functionsRewrite(buf []byte) []byte {
+	names := make([]string, 0, len(s.functionsLib.libraries))
+	for name := range s.functionsLib.libraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buf = aofAppendCommand(buf, []string{"FUNCTION", "LOAD", s.functionsLib.libraries[name].code})
+	}
+	return buf
+}
+
+// fcallGeneric implements FCALL and FCALL_RO
+func (s *Server) fcallGeneric(args []resp.Value, readOnly bool) resp.Value {
+	f, ok := s.functionsLib.functions[args[0].Bulk]
+	if !ok {
+		return resp.NewError("ERR Function not found")
+	}
+	keys, argv, errReply, ok := parseNumKeys(args[1:])
+	if !ok {
+		return errReply
+	}
+	if errReply, ok := s.scriptPrepareForRun(f.flags, readOnly); !ok {
+		return errReply
+	}
+
+	L := s.functionsLua
+	run := &scriptRunCtx{
+		name:     f.name,
+		chunk:    "user_function",
+		function: true,
+		readOnly: f.flags&scriptFlagNoWrites != 0,
+	}
+	return s.runScript(L, run, f.fn, luaStringTable(L, keys), luaStringTable(L, argv))
+}
+
+// handleFCall handles the FCALL command
+func (s *Server) handleFCall(args []resp.Value) resp.Value {
+	return s.fcallGeneric(args, false)
+}
+
+// handleFCallRO handles the FCALL_RO command
+func (s *Server) handleFCallRO(args []resp.Value) resp.Value {
+	return s.fcallGeneric(args, true)
+}
+
+// handleFunction handles the FUNCTION command
+func (s *Server) handleFunction(args []resp.Value) resp.Value {
+	sub := strings.ToUpper(args[0].Bulk)
+	switch sub {
+	case "LOAD":
+		return s.functionLoad(args[1:])
+	case "LIST":
+		return s.functionList(args[1:])
+	case "DELETE":
+		if len(args) != 2 {
+			return resp.NewError("ERR wrong number of arguments for 'function|delete' command")
+		}
+		lib, ok := s.functionsLib.libraries[args[1].Bulk]
+		if !ok {
+			return resp.NewError("ERR Library not found")
+		}
+		s.functionsLib.remove(lib)
+		s.persist.dirty++
+		return resp.NewSimpleString("OK")
+
+	case "FLUSH":
+		if len(args) > 2 {
+			return resp.NewError("ERR wrong number of arguments for 'function|flush' command")
+		}
+		if len(args) == 2 {
+			switch strings.ToUpper(args[1].Bulk) {
+			case "ASYNC", "SYNC":
+			default:
+				return resp.NewError("ERR FUNCTION FLUSH only supports SYNC|ASYNC option")
+			}
+		}
+		s.functionsReset()
+		s.persist.dirty++
+		return resp.NewSimpleString("OK")
+
+	case "DUMP":
+		if len(args) != 1 {
+			return resp.NewError("ERR wrong number of arguments for 'function|dump' command")
+		}
+		return resp.NewBulkString(string(createDumpPayload(s.functionsDump(nil))))
+
+	case "RESTORE":
+		return s.functionRestore(args[1:])
+
+	case "STATS":
+		if len(args) != 1 {
+			return resp.NewError("ERR wrong number of arguments for 'function|stats' command")
+		}
+		// Functions run under the server lock, so none can be running now
+		return resp.NewMap([]resp.Value{
+			resp.NewBulkString("running_script"), resp.NewNullBulkString(),
+			resp.NewBulkString("engines"), resp.NewMap([]resp.Value{
+				resp.NewBulkString("LUA"), resp.NewMap([]resp.Value{
+					resp.NewBulkString("libraries_count"), resp.NewInteger(len(s.functionsLib.libraries)),
+					resp.NewBulkString("functions_count"), resp.NewInteger(len(s.functionsLib.functions)),
+				}),
+			}),
+		})
+
+	case "KILL":
+		if len(args) != 1 {
+			return resp.NewError("ERR wrong number of arguments for 'function|kill' command")
+		}
+		return resp.NewError("NOTBUSY No scripts in execution right now.")
+
+	default:
+		return resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try FUNCTION HELP.", args[0].Bulk))
+	}
+}
+
+// functionsReset deletes every library, starting over with a fresh
+// interpreter
+func (s *Server) functionsReset() {
+	s.functionsLua.Close()
+	s.functionsLua = s.newFunctionsLuaState()
+	s.functionsLib = newFunctionsLibCtx()
+}
+
+// functionLoad implements FUNCTION LOAD [REPLACE] code
+func (s *Server) functionLoad(args []resp.Value) resp.Value {
+	replace := false
+	if len(args) == 2 && strings.ToUpper(args[0].Bulk) == "REPLACE" {
+		replace = true
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return resp.NewError("ERR wrong number of arguments for 'function|load' command")
+	}
+
+	name, err := s.functionsCreate(args[0].Bulk, replace, s.functionsLib)
+	if err != nil {
+		return resp.NewError(errorSafe("ERR " + err.Error()))
+	}
+	s.persist.dirty++
+	return resp.NewBulkString(name)
+}
+
+// functionList implements FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE]
+func (s *Server) functionList(args []resp.Value) resp.Value {
+	pattern, withCode := "", false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Bulk) {
+		case "WITHCODE":
+			if withCode {
+				return resp.NewError("ERR Unknown argument withcode")
+			}
+			withCode = true
+		case "LIBRARYNAME":
+			if pattern != "" {
+				return resp.NewError("ERR library name argument was already given")
+			}
+			if i+1 == len(args) {
+				return resp.NewError("ERR library name argument was not given")
+			}
+			i++
+			pattern = args[i].Bulk
+		default:
+			return resp.NewError(fmt.Sprintf("ERR Unknown argument %s", args[i].Bulk))
+		}
+	}
+
+	names := make([]string, 0, len(s.functionsLib.libraries))
+	for name := range s.functionsLib.libraries {
+		if pattern == "" || stringMatch(pattern, name, false) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	libs := make([]resp.Value, 0, len(names))
+	for _, name := range names {
+		lib := s.functionsLib.libraries[name]
+		fnames := make([]string, 0, len(lib.functions))
+		for fname := range lib.functions {
+			fnames = append(fnames, fname)
+		}
+		sort.Strings(fnames)
+
+		functions := make([]resp.Value, len(fnames))
+		for i, fname := range fnames {
+			f := lib.functions[fname]
+			description := resp.NewNullBulkString()
+			if f.description != "" {
+				description = resp.NewBulkString(f.description)
+			}
+			var flags []resp.Value
+			for _, flag := range scriptFlagNames {
+				if f.flags&flag.flag != 0 {
+					flags = append(flags, resp.NewBulkString(flag.name))
+				}
+			}
+			functions[i] = resp.NewMap([]resp.Value{
+				resp.NewBulkString("name"), resp.NewBulkString(f.name),
+				resp.NewBulkString("description"), description,
+				resp.NewBulkString("flags"), resp.NewArray(flags),
+			})
+		}
+
+		fields := []resp.Value{
+			resp.NewBulkString("library_name"), resp.NewBulkString(lib.name),
+			resp.NewBulkString("engine"), resp.NewBulkString("LUA"),
+			resp.NewBulkString("functions"), resp.NewArray(functions),
+		}
+		if withCode {
+			fields = append(fields, resp.NewBulkString("library_code"), resp.NewBulkString(lib.code))
+		}
+		libs = append(libs, resp.NewMap(fields))
+	}
+	return resp.NewArray(libs)
+}
+
+// functionRestore implements FUNCTION RESTORE payload [FLUSH|APPEND|REPLACE]
+func (s *Server) functionRestore(args []resp.Value) resp.Value {
+	if len(args) < 1 || len(args) > 2 {
+		return resp.NewError("ERR wrong number of arguments for 'function|restore' command")
+	}
+	policy := "APPEND"
+	if len(args) == 2 {
+		policy = strings.ToUpper(args[1].Bulk)
+		if policy != "FLUSH" && policy != "APPEND" && policy != "REPLACE" {
+			return resp.NewError("ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+		}
+	}
+
+	body, ok := verifyDumpPayload([]byte(args[0].Bulk))
+	if !ok {
+		return resp.NewError("ERR payload version or checksum are wrong")
+	}
+
+	libCtx := newFunctionsLibCtx()
+	if policy != "FLUSH" {
+		libCtx = s.functionsLib.clone()
+	}
+	r := &rdbReader{buf: body}
+	for r.pos < len(body) {
+		opcode, _ := r.readByte()
+		if opcode != rdbOpcodeFunction2 {
+			return resp.NewError("ERR given type is not a function")
+		}
+		code, err := r.readString()
+		if err != nil {
+			return resp.NewError("ERR Failed loading library")
+		}
+		if _, err := s.functionsCreate(code, policy == "REPLACE", libCtx); err != nil {
+			return resp.NewError(errorSafe("ERR " + err.Error()))
+		}
+	}
+	s.functionsLib = libCtx
+	s.persist.dirty++
+	return resp.NewSimpleString("OK")
+}
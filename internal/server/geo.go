@@ -0,0 +1,589 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"redis-learning/pkg/resp"
+)
+
+// zsetMember is a sorted set member with its score
+type zsetMember struct {
+	member string
+	score  float64
+}
+
+// sortedZSetMembers returns the members of a sorted set in score order,
+// ties broken lexicographically as Redis does
+func sortedZSetMembers(zset map[string]float64) []zsetMember {
+	members := make([]zsetMember, 0, len(zset))
+	for member, score := range zset {
+		members = append(members, zsetMember{member, score})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].score != members[j].score {
+			return members[i].score < members[j].score
+		}
+		return members[i].member < members[j].member
+	})
+	return members
+}
+
+// getZSet looks up the sorted set stored at key. The reply is an error for a
+// wrong type, and the value is nil if the key does not exist.
+func (s *Server) getZSet(key string) (*RedisValue, resp.Value, bool) {
+	val, exists := s.db.GetValue(key)
+	if !exists {
+		return nil, resp.Value{}, true
+	}
+	if val.Type != "zset" {
+		return nil, resp.NewError(wrongTypeErr), false
+	}
+	return val, resp.Value{}, true
+}
+
+// parseGeoUnit returns the number of meters in a distance unit
+func parseGeoUnit(unit string) (float64, bool) {
+	switch strings.ToLower(unit) {
+	case "m":
+		return 1, true
+	case "km":
+		return 1000, true
+	case "ft":
+		return 0.3048, true
+	case "mi":
+		return 1609.34, true
+	}
+	return 0, false
+}
+
+const geoUnitErr = "ERR unsupported unit provided. please use M, KM, FT, MI"
+
+// parseLongLat parses and validates a longitude/latitude pair
+func parseLongLat(lonArg, latArg string) (float64, float64, resp.Value, bool) {
+	longitude, err1 := strconv.ParseFloat(lonArg, 64)
+	latitude, err2 := strconv.ParseFloat(latArg, 64)
+	if err1 != nil || err2 != nil || math.IsNaN(longitude) || math.IsNaN(latitude) {
+		return 0, 0, resp.NewError("ERR value is not a valid float"), false
+	}
+	if longitude < geoLongMin || longitude > geoLongMax || latitude < geoLatMin || latitude > geoLatMax {
+		return 0, 0, resp.NewError(fmt.Sprintf("ERR invalid longitude,latitude pair %f,%f", longitude, latitude)), false
+	}
+	return longitude, latitude, resp.Value{}, true
+}
+
+// formatGeoCoord formats a coordinate like Redis's human long double output
+func formatGeoCoord(f float64) string {
+	str := strconv.FormatFloat(f, 'f', 17, 64)
+	str = strings.TrimSuffix(strings.TrimRight(str, "0"), ".")
+	if str == "-0" {
+		str = "0"
+	}
+	return str
+}
+
+// formatGeoDistance formats a distance with four decimals, rounding the
+// same way Redis does
+func formatGeoDistance(d float64) string {
+	scaled := int64(math.RoundToEven(d * 10000))
+	sign := ""
+	if scaled < 0 {
+		sign = "-"
+		scaled = -scaled
+	}
+	return fmt.Sprintf("%s%d.%04d", sign, scaled/10000, scaled%10000)
+}
+
+// geoCoordValue formats a [longitude, latitude] pair
+func geoCoordValue(longitude, latitude float64) resp.Value {
+	return resp.NewArray([]resp.Value{
+		resp.NewBulkString(formatGeoCoord(longitude)),
+		resp.NewBulkString(formatGeoCoord(latitude)),
+	})
+}
+
+// handleGeoAdd handles the GEOADD command
+func (s *Server) handleGeoAdd(args []resp.Value) resp.Value {
+	if len(args) < 4 {
+		return resp.NewError("ERR wrong number of arguments for 'geoadd' command")
+	}
+
+	key := args[0].Bulk
+	nx, xx, ch := false, false, false
+	i := 1
+parseOptions:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Bulk) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+			ch = true
+		default:
+			break parseOptions
+		}
+	}
+	if nx && xx {
+		return resp.NewError("ERR XX and NX options at the same time are not compatible")
+	}
+
+	rest := args[i:]
+	if len(rest) == 0 || len(rest)%3 != 0 {
+		return resp.NewError("ERR syntax error. Try GEOADD key [x1] [y1] [name1] [x2] [y2] [name2] ... ")
+	}
+
+	// Validate every triple before changing anything
+	scores := make([]float64, len(rest)/3)
+	for j := range scores {
+		longitude, latitude, errReply, ok := parseLongLat(rest[j*3].Bulk, rest[j*3+1].Bulk)
+		if !ok {
+			return errReply
+		}
+		hash, _ := geohashEncodeWGS84(longitude, latitude)
+		scores[j] = float64(geohashAlign52Bits(hash))
+	}
+
+	val, errReply, ok := s.getZSet(key)
+	if !ok {
+		return errReply
+	}
+	if val == nil {
+		if xx {
+			return resp.NewInteger(0)
+		}
+		val = NewZSetValue()
+		s.db.SetValue(key, val)
+	}
+
+	added, changed := 0, 0
+	for j, score := range scores {
+		member := rest[j*3+2].Bulk
+		old, exists := val.ZSet[member]
+		switch {
+		case exists && !nx:
+			if old != score {
+				val.ZSet[member] = score
+				changed++
+			}
+		case !exists && !xx:
+			val.ZSet[member] = score
+			added++
+		}
+	}
+
+	if len(val.ZSet) == 0 {
+		s.db.Del(key)
+	}
+	if added+changed > 0 {
+		s.signalModifiedKey(key)
+		s.notifyKeyspaceEvent(notifyZSet, "zadd", key)
+	}
+	if ch {
+		return resp.NewInteger(added + changed)
+	}
+	return resp.NewInteger(added)
+}
+
+// handleGeoPos handles the GEOPOS command
+func (s *Server) handleGeoPos(args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.NewError("ERR wrong number of arguments for 'geopos' command")
+	}
+
+	val, errReply, ok := s.getZSet(args[0].Bulk)
+	if !ok {
+		return errReply
+	}
+
+	result := make([]resp.Value, len(args)-1)
+	for i, arg := range args[1:] {
+		score, exists := 0.0, false
+		if val != nil {
+			score, exists = val.ZSet[arg.Bulk]
+		}
+		if !exists {
+			result[i] = resp.NewNullArray()
+			continue
+		}
+		result[i] = geoCoordValue(decodeGeohashScore(score))
+	}
+	return resp.NewArray(result)
+}
+
+// handleGeoDist handles the GEODIST command
+func (s *Server) handleGeoDist(args []resp.Value) resp.Value {
+	if len(args) != 3 && len(args) != 4 {
+		return resp.NewError("ERR wrong number of arguments for 'geodist' command")
+	}
+
+	conversion := 1.0
+	if len(args) == 4 {
+		var ok bool
+		if conversion, ok = parseGeoUnit(args[3].Bulk); !ok {
+			return resp.NewError(geoUnitErr)
+		}
+	}
+
+	val, errReply, ok := s.getZSet(args[0].Bulk)
+	if !ok {
+		return errReply
+	}
+	if val == nil {
+		return resp.NewNullBulkString()
+	}
+	score1, ok1 := val.ZSet[args[1].Bulk]
+	score2, ok2 := val.ZSet[args[2].Bulk]
+	if !ok1 || !ok2 {
+		return resp.NewNullBulkString()
+	}
+
+	lon1, lat1 := decodeGeohashScore(score1)
+	lon2, lat2 := decodeGeohashScore(score2)
+	return resp.NewBulkString(formatGeoDistance(geohashGetDistance(lon1, lat1, lon2, lat2) / conversion))
+}
+
+// handleGeoHash handles the GEOHASH command
+func (s *Server) handleGeoHash(args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.NewError("ERR wrong number of arguments for 'geohash' command")
+	}
+
+	val, errReply, ok := s.getZSet(args[0].Bulk)
+	if !ok {
+		return errReply
+	}
+
+	result := make([]resp.Value, len(args)-1)
+	for i, arg := range args[1:] {
+		score, exists := 0.0, false
+		if val != nil {
+			score, exists = val.ZSet[arg.Bulk]
+		}
+		if !exists {
+			result[i] = resp.NewNullBulkString()
+			continue
+		}
+		result[i] = resp.NewBulkString(geohashString(score))
+	}
+	return resp.NewArray(result)
+}
+
+// geoPoint is a GEOSEARCH match
+type geoPoint struct {
+	member    string
+	score     float64
+	longitude float64
+	latitude  float64
+	dist      float64 // in meters
+}
+
+// geoMembersOfAllNeighbors scans the center cell and its neighbors for
+// members inside shape, in the same order Redis visits them. limit, if
+// non-zero, stops the scan once that many matches were found.
+func geoMembersOfAllNeighbors(members []zsetMember, n geoHashRadius, shape *geoShape, limit int) []geoPoint {
+	cells := [...]geoHashBits{
+		n.hash,
+		n.neighbors.north,
+		n.neighbors.south,
+		n.neighbors.east,
+		n.neighbors.west,
+		n.neighbors.northEast,
+		n.neighbors.northWest,
+		n.neighbors.southEast,
+		n.neighbors.southWest,
+	}
+
+	var points []geoPoint
+	lastProcessed := 0
+	for i, cell := range cells {
+		if cell.isZero() {
+			continue
+		}
+		// With huge radii adjacent neighbors can be the same cell
+		if lastProcessed != 0 && cell == cells[lastProcessed] {
+			continue
+		}
+		if limit > 0 && len(points) >= limit {
+			break
+		}
+
+		// Every member whose score falls in [min, max) lies in this cell
+		minScore := float64(geohashAlign52Bits(cell))
+		maxScore := float64(geohashAlign52Bits(geoHashBits{bits: cell.bits + 1, step: cell.step}))
+		first := sort.Search(len(members), func(j int) bool {
+			return members[j].score >= minScore
+		})
+		for _, m := range members[first:] {
+			if m.score >= maxScore {
+				break
+			}
+			longitude, latitude := decodeGeohashScore(m.score)
+			if dist, ok := geoWithinShape(shape, longitude, latitude); ok {
+				points = append(points, geoPoint{m.member, m.score, longitude, latitude, dist})
+				if limit > 0 && len(points) >= limit {
+					break
+				}
+			}
+		}
+		lastProcessed = i
+	}
+	return points
+}
+
+// geoSearchArgs holds the parsed options of GEOSEARCH and GEOSEARCHSTORE
+type geoSearchArgs struct {
+	fromMember string
+	hasMember  bool
+	hasLonLat  bool
+	shape      geoShape
+	hasShape   int
+	sort       int // 0 none, 1 asc, -1 desc
+	count      int
+	any        bool
+	withDist   bool
+	withHash   bool
+	withCoord  bool
+	storeDist  bool
+}
+
+// parseGeoSearchArgs parses the options following the source key
+func parseGeoSearchArgs(args []resp.Value, store bool) (*geoSearchArgs, resp.Value, bool) {
+	opts := &geoSearchArgs{}
+	syntaxErr := resp.NewError("ERR syntax error")
+	name := "GEOSEARCH"
+	if store {
+		name = "GEOSEARCHSTORE"
+	}
+
+	for i := 0; i < len(args); i++ {
+		remaining := len(args) - i - 1
+		switch strings.ToUpper(args[i].Bulk) {
+		case "FROMMEMBER":
+			if remaining < 1 || opts.hasMember {
+				return nil, syntaxErr, false
+			}
+			opts.fromMember = args[i+1].Bulk
+			opts.hasMember = true
+			i++
+		case "FROMLONLAT":
+			if remaining < 2 || opts.hasLonLat {
+				return nil, syntaxErr, false
+			}
+			longitude, latitude, errReply, ok := parseLongLat(args[i+1].Bulk, args[i+2].Bulk)
+			if !ok {
+				return nil, errReply, false
+			}
+			opts.shape.longitude, opts.shape.latitude = longitude, latitude
+			opts.hasLonLat = true
+			i += 2
+		case "BYRADIUS":
+			if remaining < 2 {
+				return nil, syntaxErr, false
+			}
+			radius, err := strconv.ParseFloat(args[i+1].Bulk, 64)
+			if err != nil {
+				return nil, resp.NewError("ERR need numeric radius"), false
+			}
+			if radius < 0 {
+				return nil, resp.NewError("ERR radius cannot be negative"), false
+			}
+			conversion, ok := parseGeoUnit(args[i+2].Bulk)
+			if !ok {
+				return nil, resp.NewError(geoUnitErr), false
+			}
+			opts.shape.radius, opts.shape.conversion = radius, conversion
+			opts.hasShape++
+			i += 2
+		case "BYBOX":
+			if remaining < 3 {
+				return nil, syntaxErr, false
+			}
+			width, err1 := strconv.ParseFloat(args[i+1].Bulk, 64)
+			height, err2 := strconv.ParseFloat(args[i+2].Bulk, 64)
+			if err1 != nil || err2 != nil {
+				return nil, resp.NewError("ERR need numeric width and height"), false
+			}
+			if width < 0 || height < 0 {
+				return nil, resp.NewError("ERR height or width cannot be negative"), false
+			}
+			conversion, ok := parseGeoUnit(args[i+3].Bulk)
+			if !ok {
+				return nil, resp.NewError(geoUnitErr), false
+			}
+			opts.shape.byBox = true
+			opts.shape.width, opts.shape.height, opts.shape.conversion = width, height, conversion
+			opts.hasShape++
+			i += 3
+		case "ASC":
+			opts.sort = 1
+		case "DESC":
+			opts.sort = -1
+		case "COUNT":
+			if remaining < 1 {
+				return nil, syntaxErr, false
+			}
+			count, err := strconv.Atoi(args[i+1].Bulk)
+			if err != nil {
+				return nil, resp.NewError("ERR value is not an integer or out of range"), false
+			}
+			if count <= 0 {
+				return nil, resp.NewError("ERR COUNT must be > 0"), false
+			}
+			opts.count = count
+			i++
+			if i+1 < len(args) && strings.ToUpper(args[i+1].Bulk) == "ANY" {
+				opts.any = true
+				i++
+			}
+		case "ANY":
+			opts.any = true
+		case "WITHDIST":
+			opts.withDist = true
+		case "WITHHASH":
+			opts.withHash = true
+		case "WITHCOORD":
+			opts.withCoord = true
+		case "STOREDIST":
+			if !store {
+				return nil, syntaxErr, false
+			}
+			opts.storeDist = true
+		default:
+			return nil, syntaxErr, false
+		}
+	}
+
+	if opts.hasMember == opts.hasLonLat {
+		return nil, resp.NewError("ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for " + name), false
+	}
+	if opts.hasShape != 1 {
+		return nil, resp.NewError("ERR exactly one of BYRADIUS and BYBOX can be specified for " + name), false
+	}
+	if opts.any && opts.count == 0 {
+		return nil, resp.NewError("ERR the ANY argument requires COUNT argument"), false
+	}
+	if store && (opts.withDist || opts.withHash || opts.withCoord) {
+		return nil, resp.NewError("ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options"), false
+	}
+
+	// COUNT without ANY returns the closest matches
+	if opts.count > 0 && opts.sort == 0 && !opts.any {
+		opts.sort = 1
+	}
+	return opts, resp.Value{}, true
+}
+
+// geoSearch runs a parsed search against the sorted set stored at key
+func (s *Server) geoSearch(key string, opts *geoSearchArgs) ([]geoPoint, resp.Value, bool) {
+	val, errReply, ok := s.getZSet(key)
+	if !ok {
+		return nil, errReply, false
+	}
+	if val == nil {
+		return nil, resp.Value{}, true
+	}
+
+	if opts.hasMember {
+		score, exists := val.ZSet[opts.fromMember]
+		if !exists {
+			return nil, resp.NewError("ERR could not decode requested zset member"), false
+		}
+		opts.shape.longitude, opts.shape.latitude = decodeGeohashScore(score)
+	}
+
+	limit := 0
+	if opts.any {
+		limit = opts.count
+	}
+	radius := geohashCalculateAreasByShape(&opts.shape)
+	points := geoMembersOfAllNeighbors(sortedZSetMembers(val.ZSet), radius, &opts.shape, limit)
+
+	switch opts.sort {
+	case 1:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist < points[j].dist })
+	case -1:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist > points[j].dist })
+	}
+	if opts.count > 0 && len(points) > opts.count {
+		points = points[:opts.count]
+	}
+	return points, resp.Value{}, true
+}
+
+// handleGeoSearch handles the GEOSEARCH command
+func (s *Server) handleGeoSearch(args []resp.Value) resp.Value {
+	if len(args) < 5 {
+		return resp.NewError("ERR wrong number of arguments for 'geosearch' command")
+	}
+
+	opts, errReply, ok := parseGeoSearchArgs(args[1:], false)
+	if !ok {
+		return errReply
+	}
+	points, errReply, ok := s.geoSearch(args[0].Bulk, opts)
+	if !ok {
+		return errReply
+	}
+
+	result := make([]resp.Value, len(points))
+	for i, p := range points {
+		if !opts.withDist && !opts.withHash && !opts.withCoord {
+			result[i] = resp.NewBulkString(p.member)
+			continue
+		}
+		item := []resp.Value{resp.NewBulkString(p.member)}
+		if opts.withDist {
+			item = append(item, resp.NewBulkString(formatGeoDistance(p.dist/opts.shape.conversion)))
+		}
+		if opts.withHash {
+			item = append(item, resp.NewInteger(int(p.score)))
+		}
+		if opts.withCoord {
+			item = append(item, geoCoordValue(p.longitude, p.latitude))
+		}
+		result[i] = resp.NewArray(item)
+	}
+	return resp.NewArray(result)
+}
+
+// handleGeoSearchStore handles the GEOSEARCHSTORE command
+func (s *Server) handleGeoSearchStore(args []resp.Value) resp.Value {
+	if len(args) < 6 {
+		return resp.NewError("ERR wrong number of arguments for 'geosearchstore' command")
+	}
+
+	dst := args[0].Bulk
+	opts, errReply, ok := parseGeoSearchArgs(args[2:], true)
+	if !ok {
+		return errReply
+	}
+	points, errReply, ok := s.geoSearch(args[1].Bulk, opts)
+	if !ok {
+		return errReply
+	}
+
+	if len(points) == 0 {
+		if s.db.Del(dst) {
+			s.signalModifiedKey(dst)
+			s.notifyKeyspaceEvent(notifyGeneric, "del", dst)
+		}
+		return resp.NewInteger(0)
+	}
+
+	val := NewZSetValue()
+	for _, p := range points {
+		if opts.storeDist {
+			val.ZSet[p.member] = p.dist / opts.shape.conversion
+		} else {
+			val.ZSet[p.member] = p.score
+		}
+	}
+	s.db.SetValue(dst, val)
+	s.signalModifiedKey(dst)
+	s.notifyKeyspaceEvent(notifyZSet, "geosearchstore", dst)
+	return resp.NewInteger(len(points))
+}
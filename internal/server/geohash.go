@@ -0,0 +1,405 @@
+package server
+
+import (
+	"math"
+)
+
+// The geohash code below follows Redis's geohash.c and geohash_helper.c so
+// that scores, distances and search results are identical to real Redis.
+
+const (
+	geoStepMax = 26 // 26*2 = 52 bits
+
+	geoLatMin  = -85.05112878
+	geoLatMax  = 85.05112878
+	geoLongMin = -180.0
+	geoLongMax = 180.0
+
+	earthRadiusInMeters = 6372797.560856
+	mercatorMax         = 20037726.37
+
+	degToRad = math.Pi / 180.0
+)
+
+// geoHashBits is a geohash of the given precision in steps (bits per axis)
+type geoHashBits struct {
+	bits uint64
+	step uint
+}
+
+func (h geoHashBits) isZero() bool {
+	return h.bits == 0 && h.step == 0
+}
+
+// geoHashRange is the extent of one axis
+type geoHashRange struct {
+	min, max float64
+}
+
+// geoHashArea is the bounding box a hash stands for
+type geoHashArea struct {
+	hash      geoHashBits
+	longitude geoHashRange
+	latitude  geoHashRange
+}
+
+// geoHashNeighbors holds the eight cells surrounding a hash
+type geoHashNeighbors struct {
+	north, east, west, south                   geoHashBits
+	northEast, southEast, northWest, southWest geoHashBits
+}
+
+// geoHashRadius is the set of cells covering a search shape
+type geoHashRadius struct {
+	hash      geoHashBits
+	area      geoHashArea
+	neighbors geoHashNeighbors
+}
+
+var (
+	geoLongRange = geoHashRange{geoLongMin, geoLongMax}
+	geoLatRange  = geoHashRange{geoLatMin, geoLatMax}
+)
+
+// interleave64 interleaves the bits of xlo and ylo so that xlo ends up in
+// the even and ylo in the odd bit positions
+func interleave64(xlo, ylo uint32) uint64 {
+	b := [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F, 0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF}
+	s := [...]uint{1, 2, 4, 8, 16}
+
+	x, y := uint64(xlo), uint64(ylo)
+	for i := 4; i >= 0; i-- {
+		x = (x | (x << s[i])) & b[i]
+		y = (y | (y << s[i])) & b[i]
+	}
+	return x | (y << 1)
+}
+
+// deinterleave64 reverses interleave64, returning x in the low and y in the
+// high 32 bits
+func deinterleave64(interleaved uint64) uint64 {
+	b := [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F, 0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF, 0x00000000FFFFFFFF}
+	s := [...]uint{0, 1, 2, 4, 8, 16}
+
+	x := interleaved
+	y := interleaved >> 1
+	for i := 0; i < 6; i++ {
+		x = (x | (x >> s[i])) & b[i]
+		y = (y | (y >> s[i])) & b[i]
+	}
+	return x | (y << 32)
+}
+
+// geohashEncode encodes a coordinate pair with the given precision
+func geohashEncode(longRange, latRange geoHashRange, longitude, latitude float64, step uint) (geoHashBits, bool) {
+	if step > 32 || step == 0 {
+		return geoHashBits{}, false
+	}
+	if longitude > geoLongMax || longitude < geoLongMin || latitude > geoLatMax || latitude < geoLatMin {
+		return geoHashBits{}, false
+	}
+	if latitude < latRange.min || latitude > latRange.max || longitude < longRange.min || longitude > longRange.max {
+		return geoHashBits{}, false
+	}
+
+	latOffset := (latitude - latRange.min) / (latRange.max - latRange.min)
+	longOffset := (longitude - longRange.min) / (longRange.max - longRange.min)
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+	return geoHashBits{bits: interleave64(uint32(latOffset), uint32(longOffset)), step: step}, true
+}
+
+// geohashEncodeWGS84 encodes a coordinate pair at full precision
+func geohashEncodeWGS84(longitude, latitude float64) (geoHashBits, bool) {
+	return geohashEncode(geoLongRange, geoLatRange, longitude, latitude, geoStepMax)
+}
+
+// geohashDecode returns the area a hash stands for
+func geohashDecode(longRange, latRange geoHashRange, hash geoHashBits) geoHashArea {
+	sep := deinterleave64(hash.bits)
+	latScale := latRange.max - latRange.min
+	longScale := longRange.max - longRange.min
+
+	ilato := uint32(sep)
+	ilono := uint32(sep >> 32)
+	scale := float64(uint64(1) << hash.step)
+
+	return geoHashArea{
+		hash: hash,
+		latitude: geoHashRange{
+			min: latRange.min + (float64(ilato)*1.0/scale)*latScale,
+			max: latRange.min + ((float64(ilato)+1)*1.0/scale)*latScale,
+		},
+		longitude: geoHashRange{
+			min: longRange.min + (float64(ilono)*1.0/scale)*longScale,
+			max: longRange.min + ((float64(ilono)+1)*1.0/scale)*longScale,
+		},
+	}
+}
+
+// geohashDecodeAreaToLongLat returns the center of an area
+func geohashDecodeAreaToLongLat(area geoHashArea) (float64, float64) {
+	longitude := (area.longitude.min + area.longitude.max) / 2
+	longitude = math.Min(math.Max(longitude, geoLongMin), geoLongMax)
+	latitude := (area.latitude.min + area.latitude.max) / 2
+	latitude = math.Min(math.Max(latitude, geoLatMin), geoLatMax)
+	return longitude, latitude
+}
+
+// decodeGeohashScore decodes a sorted set score into a coordinate pair
+func decodeGeohashScore(score float64) (float64, float64) {
+	hash := geoHashBits{bits: uint64(score), step: geoStepMax}
+	return geohashDecodeAreaToLongLat(geohashDecode(geoLongRange, geoLatRange, hash))
+}
+
+// geohashMoveX moves the hash d cells along the longitude axis
+func geohashMoveX(hash *geoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - hash.step*2)
+	if d > 0 {
+		x = x + (zz + 1)
+	} else {
+		x = x | zz
+		x = x - (zz + 1)
+	}
+	x &= uint64(0xaaaaaaaaaaaaaaaa) >> (64 - hash.step*2)
+	hash.bits = x | y
+}
+
+// geohashMoveY moves the hash d cells along the latitude axis
+func geohashMoveY(hash *geoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - hash.step*2)
+	if d > 0 {
+		y = y + (zz + 1)
+	} else {
+		y = y | zz
+		y = y - (zz + 1)
+	}
+	y &= uint64(0x5555555555555555) >> (64 - hash.step*2)
+	hash.bits = x | y
+}
+
+// geohashGetNeighbors computes the eight cells around hash
+func geohashGetNeighbors(hash geoHashBits) geoHashNeighbors {
+	move := func(dx, dy int) geoHashBits {
+		h := hash
+		geohashMoveX(&h, dx)
+		geohashMoveY(&h, dy)
+		return h
+	}
+	return geoHashNeighbors{
+		east:      move(1, 0),
+		west:      move(-1, 0),
+		south:     move(0, -1),
+		north:     move(0, 1),
+		northWest: move(-1, 1),
+		southWest: move(-1, -1),
+		northEast: move(1, 1),
+		southEast: move(1, -1),
+	}
+}
+
+// geohashAlign52Bits shifts a hash so it can be compared with full
+// precision scores
+func geohashAlign52Bits(hash geoHashBits) uint64 {
+	return hash.bits << (52 - hash.step*2)
+}
+
+// geohashEstimateStepsByRadius picks the precision whose cells are large
+// enough to cover the radius with the 3x3 neighborhood
+func geohashEstimateStepsByRadius(rangeMeters, lat float64) uint {
+	if rangeMeters == 0 {
+		return geoStepMax
+	}
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	step -= 2 // Make sure range is included in most of the base cases
+
+	// Wider range towards the poles
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+
+	if step < 1 {
+		step = 1
+	}
+	if step > geoStepMax {
+		step = geoStepMax
+	}
+	return uint(step)
+}
+
+// geoShape is the area searched by GEOSEARCH
+type geoShape struct {
+	byBox         bool
+	radius        float64 // in units, for BYRADIUS
+	width, height float64 // in units, for BYBOX
+	conversion    float64 // meters per unit
+	longitude     float64 // center of the search
+	latitude      float64
+}
+
+// geohashBoundingBox returns min long, min lat, max long, max lat of shape
+func geohashBoundingBox(shape *geoShape) [4]float64 {
+	height, width := shape.radius, shape.radius
+	if shape.byBox {
+		height, width = shape.height/2, shape.width/2
+	}
+	height *= shape.conversion
+	width *= shape.conversion
+
+	latDelta := (height / earthRadiusInMeters) / degToRad
+	longDeltaTop := (width / earthRadiusInMeters / math.Cos((shape.latitude+latDelta)*degToRad)) / degToRad
+	longDeltaBottom := (width / earthRadiusInMeters / math.Cos((shape.latitude-latDelta)*degToRad)) / degToRad
+
+	// The directions of the northern and southern hemispheres are opposite,
+	// so choose different points as min/max longitude
+	var bounds [4]float64
+	if shape.latitude < 0 {
+		bounds[0] = shape.longitude - longDeltaBottom
+		bounds[2] = shape.longitude + longDeltaBottom
+	} else {
+		bounds[0] = shape.longitude - longDeltaTop
+		bounds[2] = shape.longitude + longDeltaTop
+	}
+	bounds[1] = shape.latitude - latDelta
+	bounds[3] = shape.latitude + latDelta
+	return bounds
+}
+
+// geohashCalculateAreasByShape computes the center cell and neighbors that
+// need to be scanned to find everything inside shape
+func geohashCalculateAreasByShape(shape *geoShape) geoHashRadius {
+	bounds := geohashBoundingBox(shape)
+	minLon, minLat, maxLon, maxLat := bounds[0], bounds[1], bounds[2], bounds[3]
+
+	radiusMeters := shape.radius
+	if shape.byBox {
+		radiusMeters = math.Sqrt((shape.width/2)*(shape.width/2) + (shape.height/2)*(shape.height/2))
+	}
+	radiusMeters *= shape.conversion
+
+	steps := geohashEstimateStepsByRadius(radiusMeters, shape.latitude)
+
+	hash, _ := geohashEncode(geoLongRange, geoLatRange, shape.longitude, shape.latitude, steps)
+	neighbors := geohashGetNeighbors(hash)
+	area := geohashDecode(geoLongRange, geoLatRange, hash)
+
+	// Sometimes when the search area is near an edge of the cell the
+	// estimated step is not small enough, since one of the neighbors is too
+	// near to the search area to cover everything
+	north := geohashDecode(geoLongRange, geoLatRange, neighbors.north)
+	south := geohashDecode(geoLongRange, geoLatRange, neighbors.south)
+	east := geohashDecode(geoLongRange, geoLatRange, neighbors.east)
+	west := geohashDecode(geoLongRange, geoLatRange, neighbors.west)
+	decreaseStep := north.latitude.max < maxLat || south.latitude.min > minLat ||
+		east.longitude.max < maxLon || west.longitude.min > minLon
+
+	if steps > 1 && decreaseStep {
+		steps--
+		hash, _ = geohashEncode(geoLongRange, geoLatRange, shape.longitude, shape.latitude, steps)
+		neighbors = geohashGetNeighbors(hash)
+		area = geohashDecode(geoLongRange, geoLatRange, hash)
+	}
+
+	// Exclude the search areas that are useless
+	if steps >= 2 {
+		if area.latitude.min < minLat {
+			neighbors.south = geoHashBits{}
+			neighbors.southWest = geoHashBits{}
+			neighbors.southEast = geoHashBits{}
+		}
+		if area.latitude.max > maxLat {
+			neighbors.north = geoHashBits{}
+			neighbors.northEast = geoHashBits{}
+			neighbors.northWest = geoHashBits{}
+		}
+		if area.longitude.min < minLon {
+			neighbors.west = geoHashBits{}
+			neighbors.southWest = geoHashBits{}
+			neighbors.northWest = geoHashBits{}
+		}
+		if area.longitude.max > maxLon {
+			neighbors.east = geoHashBits{}
+			neighbors.southEast = geoHashBits{}
+			neighbors.northEast = geoHashBits{}
+		}
+	}
+	return geoHashRadius{hash: hash, area: area, neighbors: neighbors}
+}
+
+// geohashGetLatDistance returns the distance between two latitudes on the
+// same meridian
+func geohashGetLatDistance(lat1d, lat2d float64) float64 {
+	return earthRadiusInMeters * math.Abs(lat2d*degToRad-lat1d*degToRad)
+}
+
+// geohashGetDistance returns the haversine distance in meters
+func geohashGetDistance(lon1d, lat1d, lon2d, lat2d float64) float64 {
+	lon1r := lon1d * degToRad
+	lon2r := lon2d * degToRad
+	v := math.Sin((lon2r - lon1r) / 2)
+	// Avoid the expensive math when the longitudes are practically the same
+	if v == 0.0 {
+		return geohashGetLatDistance(lat1d, lat2d)
+	}
+	lat1r := lat1d * degToRad
+	lat2r := lat2d * degToRad
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2.0 * earthRadiusInMeters * math.Asin(math.Sqrt(a))
+}
+
+// geoWithinShape reports whether the point is inside shape and its distance
+// from the center in meters
+func geoWithinShape(shape *geoShape, longitude, latitude float64) (float64, bool) {
+	if !shape.byBox {
+		distance := geohashGetDistance(shape.longitude, shape.latitude, longitude, latitude)
+		return distance, distance <= shape.radius*shape.conversion
+	}
+
+	// Latitude distance is cheaper to compute, so check it first
+	if geohashGetLatDistance(latitude, shape.latitude) > shape.height*shape.conversion/2 {
+		return 0, false
+	}
+	if geohashGetDistance(longitude, latitude, shape.longitude, latitude) > shape.width*shape.conversion/2 {
+		return 0, false
+	}
+	return geohashGetDistance(shape.longitude, shape.latitude, longitude, latitude), true
+}
+
+// geohashString encodes a score as the standard 11 character geohash
+func geohashString(score float64) string {
+	const alphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+	// Redis stores hashes with a non-standard latitude range, so re-encode
+	// using the standard [-90, 90] range
+	longitude, latitude := decodeGeohashScore(score)
+	hash, _ := geohashEncode(geoHashRange{-180, 180}, geoHashRange{-90, 90}, longitude, latitude, geoStepMax)
+
+	buf := make([]byte, 11)
+	for i := range buf {
+		idx := 0
+		// Only 52 bits are available; the last character is always zero
+		if i < 10 {
+			idx = int((hash.bits >> (52 - uint(i+1)*5)) & 0x1f)
+		}
+		buf[i] = alphabet[idx]
+	}
+	return string(buf)
+}
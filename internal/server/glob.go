@@ -0,0 +1,121 @@
+package server
+
+// stringMatch reports whether str matches the glob-style pattern, using the
+// same rules as Redis: '*' and '?' wildcards, '[...]' classes with ranges
+// and '^' negation, and '\' to escape the next character.
+func stringMatch(pattern, str string, nocase bool) bool {
+	skipLongerMatches := false
+	return stringMatchImpl(pattern, str, nocase, &skipLongerMatches, 0)
+}
+
+func stringMatchImpl(pattern, str string, nocase bool, skipLongerMatches *bool, nesting int) bool {
+	// Protection against abusive patterns
+	if nesting > 1000 {
+		return false
+	}
+
+	equal := func(a, b byte) bool {
+		if nocase {
+			return toLower(a) == toLower(b)
+		}
+		return a == b
+	}
+
+	for len(pattern) > 0 && len(str) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for len(str) > 0 {
+				if stringMatchImpl(pattern[1:], str, nocase, skipLongerMatches, nesting+1) {
+					return true
+				}
+				if *skipLongerMatches {
+					return false
+				}
+				str = str[1:]
+			}
+			// The rest of the pattern matches nowhere in the rest of the
+			// string, so earlier '*'s can't match longer substrings either
+			*skipLongerMatches = true
+			return false
+		case '?':
+			str = str[1:]
+		case '[':
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for {
+				if len(pattern) == 0 {
+					// Unterminated class, step back so the outer loop
+					// consumes the last character
+					pattern = " "
+					break
+				} else if pattern[0] == '\\' && len(pattern) >= 2 {
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						match = true
+					}
+				} else if pattern[0] == ']' {
+					break
+				} else if len(pattern) >= 3 && pattern[1] == '-' {
+					start, end, c := pattern[0], pattern[2], str[0]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = toLower(start), toLower(end), toLower(c)
+					}
+					pattern = pattern[2:]
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if equal(pattern[0], str[0]) {
+					match = true
+				}
+				pattern = pattern[1:]
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if !equal(pattern[0], str[0]) {
+				return false
+			}
+			str = str[1:]
+		}
+
+		pattern = pattern[1:]
+		if len(str) == 0 {
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			break
+		}
+	}
+
+	return len(pattern) == 0 && len(str) == 0
+}
+
+func toLower(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
@@ -0,0 +1,513 @@
+package server
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// HyperLogLog values use the same byte layout as Redis so they can be moved
+// around as plain strings. A 16 byte header is followed by the registers:
+//
+//	+------+---+-----+----------+
+//	| HYLL | E | N/U | Cardin.  |
+//	+------+---+-----+----------+
+//
+// "HYLL" is the magic, E is the encoding (dense or sparse), N/U are three
+// unused bytes and Cardin. is the cached cardinality as a little endian
+// 64 bit integer. The most significant bit of the cached cardinality is set
+// when the cache is stale.
+//
+// The dense encoding stores 16384 6-bit registers, least significant bits
+// first. The sparse encoding run-length encodes the registers with three
+// opcodes:
+//
+//	ZERO:  00xxxxxx           runs of 1-64 zero registers
+//	XZERO: 01xxxxxx yyyyyyyy  runs of 1-16384 zero registers
+//	VAL:   1vvvvvxx           runs of 1-4 registers set to 1-32
+const (
+	hllP           = 14
+	hllQ           = 64 - hllP
+	hllRegisters   = 1 << hllP
+	hllPMask       = hllRegisters - 1
+	hllBits        = 6
+	hllRegisterMax = 1<<hllBits - 1
+	hllHdrSize     = 16
+	hllDenseSize   = hllHdrSize + (hllRegisters*hllBits+7)/8
+	hllDense       = 0
+	hllSparse      = 1
+	hllAlphaInf    = 0.721347520444481703680 // 0.5/ln(2)
+)
+
+const (
+	hllSparseXZeroBit        = 0x40
+	hllSparseValBit          = 0x80
+	hllSparseValMaxValue     = 32
+	hllSparseValMaxLen       = 4
+	hllSparseZeroMaxLen      = 64
+	hllSparseXZeroMaxLen     = 16384
+	defaultHLLSparseMaxBytes = 3000
+)
+
+func hllSparseIsZero(b byte) bool  { return b&0xc0 == 0 }
+func hllSparseIsXZero(b byte) bool { return b&0xc0 == hllSparseXZeroBit }
+func hllSparseIsVal(b byte) bool   { return b&hllSparseValBit != 0 }
+func hllSparseZeroLen(b byte) int  { return int(b&0x3f) + 1 }
+func hllSparseXZeroLen(b0, b1 byte) int {
+	return (int(b0&0x3f)<<8 | int(b1)) + 1
+}
+func hllSparseValValue(b byte) int { return int(b>>2&0x1f) + 1 }
+func hllSparseValLen(b byte) int   { return int(b&0x3) + 1 }
+
+func hllSparseVal(val, length int) byte {
+	return byte((val-1)<<2|(length-1)) | hllSparseValBit
+}
+
+func hllSparseZero(length int) byte { return byte(length - 1) }
+
+func hllSparseXZero(length int) (byte, byte) {
+	l := length - 1
+	return byte(l>>8) | hllSparseXZeroBit, byte(l & 0xff)
+}
+
+// newHLL returns an empty sparse HyperLogLog: a single XZERO opcode covering
+// every register, with a valid cached cardinality of zero
+func newHLL() []byte {
+	b := make([]byte, hllHdrSize, hllHdrSize+2)
+	copy(b, "HYLL")
+	b[4] = hllSparse
+	x0, x1 := hllSparseXZero(hllRegisters)
+	return append(b, x0, x1)
+}
+
+// isHLL reports whether b looks like a HyperLogLog. Like Redis it only
+// checks the header and the dense size, corrupted sparse payloads are
+// detected while decoding.
+func isHLL(b []byte) bool {
+	if len(b) < hllHdrSize || string(b[:4]) != "HYLL" || b[4] > hllSparse {
+		return false
+	}
+	return b[4] != hllDense || len(b) == hllDenseSize
+}
+
+func hllValidCache(b []byte) bool { return b[15]&(1<<7) == 0 }
+
+func hllInvalidateCache(b []byte) { b[15] |= 1 << 7 }
+
+func hllCachedCard(b []byte) uint64 { return binary.LittleEndian.Uint64(b[8:16]) }
+
+func hllSetCachedCard(b []byte, card uint64) { binary.LittleEndian.PutUint64(b[8:16], card) }
+
+// murmurHash64A is the hash function Redis uses for HyperLogLog elements
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+
+	h := seed ^ (uint64(len(key)) * m)
+	data := key
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * i)
+		}
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// hllPatLen returns the register an element maps to and the length of the
+// 000..1 pattern that follows, which is the value the register would take
+func hllPatLen(ele []byte) (int, uint8) {
+	hash := murmurHash64A(ele, 0xadc83b19)
+	index := int(hash & hllPMask)
+	hash >>= hllP
+	// Make sure the loop terminates
+	hash |= 1 << hllQ
+	bit := uint64(1)
+	count := uint8(1)
+	for hash&bit == 0 {
+		count++
+		bit <<= 1
+	}
+	return index, count
+}
+
+// hllDenseGet returns the value of a register in a dense register array
+func hllDenseGet(regs []byte, regnum int) uint8 {
+	byteIdx := regnum * hllBits / 8
+	fb := uint(regnum * hllBits & 7)
+	b0 := uint(regs[byteIdx])
+	var b1 uint
+	if byteIdx+1 < len(regs) {
+		b1 = uint(regs[byteIdx+1])
+	}
+	return uint8((b0>>fb | b1<<(8-fb)) & hllRegisterMax)
+}
+
+// hllDenseSetRegister stores a value in a dense register array
+func hllDenseSetRegister(regs []byte, regnum int, val uint8) {
+	byteIdx := regnum * hllBits / 8
+	fb := uint(regnum * hllBits & 7)
+	v := uint(val)
+	regs[byteIdx] &^= byte(hllRegisterMax << fb)
+	regs[byteIdx] |= byte(v << fb)
+	if byteIdx+1 < len(regs) {
+		regs[byteIdx+1] &^= byte(hllRegisterMax >> (8 - fb))
+		regs[byteIdx+1] |= byte(v >> (8 - fb))
+	}
+}
+
+// hllDenseSet raises a register to count, returning true if it changed
+func hllDenseSet(regs []byte, index int, count uint8) bool {
+	if count > hllDenseGet(regs, index) {
+		hllDenseSetRegister(regs, index, count)
+		return true
+	}
+	return false
+}
+
+// hllSparseToDense converts a sparse HyperLogLog to the dense encoding. It
+// returns false if the sparse payload is corrupted.
+func hllSparseToDense(b []byte) ([]byte, bool) {
+	if b[4] == hllDense {
+		return b, true
+	}
+
+	dense := make([]byte, hllDenseSize)
+	copy(dense, b[:hllHdrSize])
+	dense[4] = hllDense
+	regs := dense[hllHdrSize:]
+
+	idx := 0
+	p := b[hllHdrSize:]
+	for i := 0; i < len(p); {
+		switch {
+		case hllSparseIsZero(p[i]):
+			idx += hllSparseZeroLen(p[i])
+			i++
+		case hllSparseIsXZero(p[i]):
+			if i+1 >= len(p) {
+				return nil, false
+			}
+			idx += hllSparseXZeroLen(p[i], p[i+1])
+			i += 2
+		default:
+			runlen := hllSparseValLen(p[i])
+			regval := uint8(hllSparseValValue(p[i]))
+			if idx+runlen > hllRegisters {
+				return nil, false
+			}
+			for ; runlen > 0; runlen-- {
+				hllDenseSetRegister(regs, idx, regval)
+				idx++
+			}
+			i++
+		}
+	}
+
+	// The sparse representation must cover exactly every register
+	if idx != hllRegisters {
+		return nil, false
+	}
+	return dense, true
+}
+
+// hllSparseSet raises register index to count in a sparse HyperLogLog,
+// splitting the opcode that covers it. The result is promoted to the dense
+// encoding when the value can't be represented or the payload would grow
+// past maxBytes. It returns the new bytes, and 1 if a register changed, 0 if
+// not, or -1 if the payload is corrupted.
+func hllSparseSet(b []byte, index int, count uint8, maxBytes int) ([]byte, int) {
+	if count > hllSparseValMaxValue {
+		return hllPromote(b, index, count)
+	}
+
+	// Step 1: locate the opcode covering the register
+	sparse := b[hllHdrSize:]
+	p, prev := 0, -1
+	first, span := 0, 0
+	for p < len(sparse) {
+		oplen := 1
+		switch {
+		case hllSparseIsZero(sparse[p]):
+			span = hllSparseZeroLen(sparse[p])
+		case hllSparseIsVal(sparse[p]):
+			span = hllSparseValLen(sparse[p])
+		default:
+			if p+1 >= len(sparse) {
+				return b, -1
+			}
+			span = hllSparseXZeroLen(sparse[p], sparse[p+1])
+			oplen = 2
+		}
+		if index <= first+span-1 {
+			break
+		}
+		prev = p
+		p += oplen
+		first += span
+	}
+	if span == 0 || p >= len(sparse) {
+		return b, -1
+	}
+
+	op := sparse[p]
+	isZero, isXZero := hllSparseIsZero(op), hllSparseIsXZero(op)
+	var runlen int
+	switch {
+	case isZero:
+		runlen = hllSparseZeroLen(op)
+	case isXZero:
+		runlen = hllSparseXZeroLen(op, sparse[p+1])
+	default:
+		runlen = hllSparseValLen(op)
+	}
+
+	// Step 2: trivial in-place updates
+	updated := false
+	if !isZero && !isXZero {
+		if hllSparseValValue(op) >= int(count) {
+			return b, 0
+		}
+		if runlen == 1 {
+			sparse[p] = hllSparseVal(int(count), 1)
+			updated = true
+		}
+	}
+	if isZero && runlen == 1 {
+		sparse[p] = hllSparseVal(int(count), 1)
+		updated = true
+	}
+
+	// Step 3: split the opcode into up to three, e.g. XZERO-VAL-XZERO
+	if !updated {
+		var seq []byte
+		last := first + span - 1
+		zeroRun := func(length int) {
+			if length > hllSparseZeroMaxLen {
+				x0, x1 := hllSparseXZero(length)
+				seq = append(seq, x0, x1)
+			} else {
+				seq = append(seq, hllSparseZero(length))
+			}
+		}
+
+		if isZero || isXZero {
+			if index != first {
+				zeroRun(index - first)
+			}
+			seq = append(seq, hllSparseVal(int(count), 1))
+			if index != last {
+				zeroRun(last - index)
+			}
+		} else {
+			curval := hllSparseValValue(op)
+			if index != first {
+				seq = append(seq, hllSparseVal(curval, index-first))
+			}
+			seq = append(seq, hllSparseVal(int(count), 1))
+			if index != last {
+				seq = append(seq, hllSparseVal(curval, last-index))
+			}
+		}
+
+		oldlen := 1
+		if isXZero {
+			oldlen = 2
+		}
+		if deltalen := len(seq) - oldlen; deltalen > 0 && len(b)+deltalen > maxBytes {
+			return hllPromote(b, index, count)
+		}
+
+		out := make([]byte, 0, len(b)+len(seq)-oldlen)
+		out = append(out, b[:hllHdrSize+p]...)
+		out = append(out, seq...)
+		out = append(out, b[hllHdrSize+p+oldlen:]...)
+		b = out
+		sparse = b[hllHdrSize:]
+	}
+
+	// Step 4: merge adjacent VAL opcodes holding the same value
+	p = 0
+	if prev >= 0 {
+		p = prev
+	}
+	for scan := 5; p < len(sparse) && scan > 0; scan-- {
+		if hllSparseIsXZero(sparse[p]) {
+			p += 2
+			continue
+		} else if hllSparseIsZero(sparse[p]) {
+			p++
+			continue
+		}
+		if p+1 < len(sparse) && hllSparseIsVal(sparse[p+1]) {
+			v1, v2 := hllSparseValValue(sparse[p]), hllSparseValValue(sparse[p+1])
+			if v1 == v2 {
+				if length := hllSparseValLen(sparse[p]) + hllSparseValLen(sparse[p+1]); length <= hllSparseValMaxLen {
+					sparse[p+1] = hllSparseVal(v1, length)
+					copy(sparse[p:], sparse[p+1:])
+					sparse = sparse[:len(sparse)-1]
+					b = b[:len(b)-1]
+					// Try to merge the result with the value on its right
+					continue
+				}
+			}
+		}
+		p++
+	}
+
+	hllInvalidateCache(b)
+	return b, 1
+}
+
+// hllPromote converts to the dense encoding and then sets the register.
+// Promotion only happens when a register needs updating, so the result is
+// always 1 for a valid payload.
+func hllPromote(b []byte, index int, count uint8) ([]byte, int) {
+	dense, ok := hllSparseToDense(b)
+	if !ok {
+		return b, -1
+	}
+	hllDenseSet(dense[hllHdrSize:], index, count)
+	hllInvalidateCache(dense)
+	return dense, 1
+}
+
+// hllSet raises register index to count in either encoding
+func hllSet(b []byte, index int, count uint8, maxBytes int) ([]byte, int) {
+	if b[4] == hllDense {
+		if !hllDenseSet(b[hllHdrSize:], index, count) {
+			return b, 0
+		}
+		hllInvalidateCache(b)
+		return b, 1
+	}
+	return hllSparseSet(b, index, count, maxBytes)
+}
+
+// hllAdd adds an element, see hllSparseSet for the return values
+func hllAdd(b []byte, ele []byte, maxBytes int) ([]byte, int) {
+	index, count := hllPatLen(ele)
+	return hllSet(b, index, count, maxBytes)
+}
+
+// hllMergeRegisters raises every register in max to the matching register
+// of b, returning false if b is corrupted
+func hllMergeRegisters(max []uint8, b []byte) bool {
+	if b[4] == hllDense {
+		regs := b[hllHdrSize:]
+		for i := range max {
+			if val := hllDenseGet(regs, i); val > max[i] {
+				max[i] = val
+			}
+		}
+		return true
+	}
+
+	idx := 0
+	p := b[hllHdrSize:]
+	for i := 0; i < len(p); {
+		switch {
+		case hllSparseIsZero(p[i]):
+			idx += hllSparseZeroLen(p[i])
+			i++
+		case hllSparseIsXZero(p[i]):
+			if i+1 >= len(p) {
+				return false
+			}
+			idx += hllSparseXZeroLen(p[i], p[i+1])
+			i += 2
+		default:
+			runlen := hllSparseValLen(p[i])
+			regval := uint8(hllSparseValValue(p[i]))
+			if idx+runlen > hllRegisters {
+				return false
+			}
+			for ; runlen > 0; runlen-- {
+				if regval > max[idx] {
+					max[idx] = regval
+				}
+				idx++
+			}
+			i++
+		}
+	}
+	return idx == hllRegisters
+}
+
+// hllTau and hllSigma are helpers of the estimator from "New cardinality
+// estimation algorithms for HyperLogLog sketches" by Otmar Ertl
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			break
+		}
+	}
+	return z / 3
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+		if zPrime == z {
+			break
+		}
+	}
+	return z
+}
+
+// hllCountRegisters estimates the cardinality of a raw register array
+func hllCountRegisters(regs []uint8) uint64 {
+	var reghisto [64]int
+	for _, r := range regs {
+		reghisto[r]++
+	}
+
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(reghisto[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(reghisto[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(reghisto[0])/m)
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+// hllCount estimates the cardinality of a HyperLogLog, returning false if it
+// is corrupted
+func hllCount(b []byte) (uint64, bool) {
+	regs := make([]uint8, hllRegisters)
+	if !hllMergeRegisters(regs, b) {
+		return 0, false
+	}
+	return hllCountRegisters(regs), true
+}
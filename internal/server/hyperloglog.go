@@ -0,0 +1,319 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+
+	"redis-learning/pkg/resp"
+)
+
+const (
+	invalidHLLErr   = "WRONGTYPE Key is not a valid HyperLogLog string value."
+	corruptedHLLErr = "INVALIDOBJ Corrupted HLL object detected"
+)
+
+// getHLL returns the HyperLogLog stored at key. The slice is nil if the key
+// is missing.
+func (s *Server) getHLL(key string) ([]byte, resp.Value, bool) {
+	b, exists, errReply, ok := s.getStringBytes(key)
+	if !ok || !exists {
+		return nil, errReply, ok
+	}
+	if !isHLL(b) {
+		return nil, resp.NewError(invalidHLLErr), false
+	}
+	return b, resp.Value{}, true
+}
+
+// handlePFAdd handles the PFADD command
+func (s *Server) handlePFAdd(args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.NewError("ERR wrong number of arguments for 'pfadd' command")
+	}
+
+	key := args[0].Bulk
+	b, errReply, ok := s.getHLL(key)
+	if !ok {
+		return errReply
+	}
+
+	updated := false
+	if b == nil {
+		b = newHLL()
+		updated = true
+	}
+
+	for _, ele := range args[1:] {
+		var result int
+		b, result = hllAdd(b, []byte(ele.Bulk), s.hllSparseMaxBytes)
+		switch result {
+		case 1:
+			updated = true
+		case -1:
+			return resp.NewError(corruptedHLLErr)
+		}
+	}
+
+	if !updated {
+		return resp.NewInteger(0)
+	}
+	hllInvalidateCache(b)
+	s.storeStringBytes(key, b)
+	s.signalModifiedKey(key)
+	s.notifyKeyspaceEvent(notifyString, "pfadd", key)
+	return resp.NewInteger(1)
+}
+
+// handlePFCount handles the PFCOUNT command
+func (s *Server) handlePFCount(args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.NewError("ERR wrong number of arguments for 'pfcount' command")
+	}
+
+	// The union of several keys is computed on the fly and never cached
+	if len(args) > 1 {
+		regs := make([]uint8, hllRegisters)
+		for _, arg := range args {
+			b, errReply, ok := s.getHLL(arg.Bulk)
+			if !ok {
+				return errReply
+			}
+			if b == nil {
+				continue
+			}
+			if !hllMergeRegisters(regs, b) {
+				return resp.NewError(corruptedHLLErr)
+			}
+		}
+		return resp.NewInteger(int(hllCountRegisters(regs)))
+	}
+
+	key := args[0].Bulk
+	b, errReply, ok := s.getHLL(key)
+	if !ok {
+		return errReply
+	}
+	if b == nil {
+		return resp.NewInteger(0)
+	}
+
+	if hllValidCache(b) {
+		return resp.NewInteger(int(hllCachedCard(b)))
+	}
+
+	card, ok := hllCount(b)
+	if !ok {
+		return resp.NewError(corruptedHLLErr)
+	}
+	hllSetCachedCard(b, card)
+	s.storeStringBytes(key, b)
+	s.signalModifiedKey(key)
+	return resp.NewInteger(int(card))
+}
+
+// handlePFMerge handles the PFMERGE command
+func (s *Server) handlePFMerge(args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.NewError("ERR wrong number of arguments for 'pfmerge' command")
+	}
+
+	// The destination takes part in the union as well
+	regs := make([]uint8, hllRegisters)
+	useDense := false
+	for _, arg := range args {
+		b, errReply, ok := s.getHLL(arg.Bulk)
+		if !ok {
+			return errReply
+		}
+		if b == nil {
+			continue
+		}
+		if b[4] == hllDense {
+			useDense = true
+		}
+		if !hllMergeRegisters(regs, b) {
+			return resp.NewError(corruptedHLLErr)
+		}
+	}
+
+	key := args[0].Bulk
+	b, _, _ := s.getHLL(key)
+	if b == nil {
+		b = newHLL()
+	}
+
+	// The destination only goes dense if one of the inputs was dense
+	if useDense {
+		var ok bool
+		if b, ok = hllSparseToDense(b); !ok {
+			return resp.NewError(corruptedHLLErr)
+		}
+	}
+
+	for i, val := range regs {
+		if val == 0 {
+			continue
+		}
+		var result int
+		if b, result = hllSet(b, i, val, s.hllSparseMaxBytes); result == -1 {
+			return resp.NewError(corruptedHLLErr)
+		}
+	}
+
+	hllInvalidateCache(b)
+	s.storeStringBytes(key, b)
+	s.signalModifiedKey(key)
+	s.notifyKeyspaceEvent(notifyString, "pfadd", key)
+	return resp.NewSimpleString("OK")
+}
+
+// handlePFDebug handles the PFDEBUG command
+func (s *Server) handlePFDebug(args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return resp.NewError("ERR wrong number of arguments for 'pfdebug' command")
+	}
+
+	sub := strings.ToUpper(args[0].Bulk)
+	key := args[1].Bulk
+
+	b, errReply, ok := s.getHLL(key)
+	if !ok {
+		return errReply
+	}
+	if b == nil {
+		return resp.NewError("ERR The specified key does not exist")
+	}
+
+	switch sub {
+	case "GETREG":
+		// Reading the registers converts the value to the dense encoding
+		if b[4] == hllSparse {
+			if b, ok = hllSparseToDense(b); !ok {
+				return resp.NewError(corruptedHLLErr)
+			}
+			s.storeStringBytes(key, b)
+		}
+		regs := make([]resp.Value, hllRegisters)
+		for i := range regs {
+			regs[i] = resp.NewInteger(int(hllDenseGet(b[hllHdrSize:], i)))
+		}
+		return resp.NewArray(regs)
+
+	case "DECODE":
+		if b[4] != hllSparse {
+			return resp.NewError("ERR HLL encoding is not sparse")
+		}
+		var ops []string
+		p := b[hllHdrSize:]
+		for i := 0; i < len(p); {
+			switch {
+			case hllSparseIsZero(p[i]):
+				ops = append(ops, fmt.Sprintf("z:%d", hllSparseZeroLen(p[i])))
+				i++
+			case hllSparseIsXZero(p[i]):
+				if i+1 >= len(p) {
+					return resp.NewError(corruptedHLLErr)
+				}
+				ops = append(ops, fmt.Sprintf("Z:%d", hllSparseXZeroLen(p[i], p[i+1])))
+				i += 2
+			default:
+				ops = append(ops, fmt.Sprintf("v:%d,%d", hllSparseValValue(p[i]), hllSparseValLen(p[i])))
+				i++
+			}
+		}
+		return resp.NewSimpleString(strings.Join(ops, " "))
+
+	case "ENCODING":
+		if b[4] == hllSparse {
+			return resp.NewSimpleString("sparse")
+		}
+		return resp.NewSimpleString("dense")
+
+	case "TODENSE":
+		if b[4] == hllDense {
+			return resp.NewInteger(0)
+		}
+		if b, ok = hllSparseToDense(b); !ok {
+			return resp.NewError(corruptedHLLErr)
+		}
+		s.storeStringBytes(key, b)
+		return resp.NewInteger(1)
+
+	default:
+		return resp.NewError(fmt.Sprintf("ERR Unknown PFDEBUG subcommand '%s'", args[0].Bulk))
+	}
+}
+
+// handlePFSelfTest handles the PFSELFTEST command. It checks the dense
+// register accessors and that the estimation error of both encodings stays
+// within a few standard errors up to ten million elements.
+func (s *Server) handlePFSelfTest(args []resp.Value) resp.Value {
+	if len(args) != 0 {
+		return resp.NewError("ERR wrong number of arguments for 'pfselftest' command")
+	}
+
+	// Test 1: set every register to random values and read them back
+	regs := make([]byte, hllDenseSize-hllHdrSize)
+	expected := make([]uint8, hllRegisters)
+	for j := 0; j < 1000; j++ {
+		for i := range expected {
+			expected[i] = uint8(rand.Intn(hllRegisterMax + 1))
+			hllDenseSetRegister(regs, i, expected[i])
+		}
+		for i := range expected {
+			if val := hllDenseGet(regs, i); val != expected[i] {
+				return resp.NewError(fmt.Sprintf("TESTFAILED Register error, counter[%d] = %d, expected %d", i, val, expected[i]))
+			}
+		}
+	}
+
+	// Test 2: feed the same elements to a dense and a sparse HyperLogLog
+	dense := make([]byte, hllDenseSize)
+	copy(dense, "HYLL")
+	sparse := newHLL()
+	relerr := 1.04 / math.Sqrt(hllRegisters)
+	checkpoint := int64(1)
+	seed := rand.Uint64()
+	ele := make([]byte, 8)
+	for j := int64(1); j <= 10000000; j++ {
+		binary.LittleEndian.PutUint64(ele, uint64(j)^seed)
+		index, count := hllPatLen(ele)
+		hllDenseSet(dense[hllHdrSize:], index, count)
+		sparse, _ = hllSet(sparse, index, count, s.hllSparseMaxBytes)
+
+		if j != checkpoint {
+			continue
+		}
+
+		// Small cardinalities must stay sparse
+		if j < int64(s.hllSparseMaxBytes/2) && sparse[4] != hllSparse {
+			return resp.NewError("TESTFAILED sparse encoding not used")
+		}
+
+		denseCard, _ := hllCount(dense)
+		sparseCard, _ := hllCount(sparse)
+		if denseCard != sparseCard {
+			return resp.NewError("TESTFAILED dense/sparse disagree")
+		}
+
+		abserr := checkpoint - int64(denseCard)
+		if abserr < 0 {
+			abserr = -abserr
+		}
+		maxerr := int64(math.Ceil(relerr * 6 * float64(checkpoint)))
+		// Collisions make a larger error at cardinality 10 likely enough
+		// to cause false positives
+		if j == 10 {
+			maxerr = 1
+		}
+		if abserr > maxerr {
+			return resp.NewError(fmt.Sprintf("TESTFAILED Too big error. card:%d abserr:%d", checkpoint, abserr))
+		}
+		checkpoint *= 10
+	}
+
+	return resp.NewSimpleString("OK")
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"redis-learning/pkg/resp"
+)
+
+// infoSection is a section of the INFO reply
+type infoSection struct {
+	name   string
+	fields func(s *Server) []string // "field:value" lines
+}
+
+// infoSections lists the INFO sections in the order they are printed
+var infoSections = []infoSection{
+	{"server", (*Server).infoServer},
+	{"persistence", (*Server).infoPersistence},
+	{"replication", (*Server).infoReplication},
+}
+
+func (s *Server) infoServer() []string {
+	uptime := time.Since(s.startTime)
+	mode := "standalone"
+	if s.sentinel != nil {
+		mode = "sentinel"
+	}
+	return []string{
+		"redis_version:" + redisVersion,
+		"redis_mode:" + mode,
+		"arch_bits:64",
+		fmt.Sprintf("process_id:%d", os.Getpid()),
+		"run_id:" + s.runID,
+		"tcp_port:" + s.port,
+		fmt.Sprintf("uptime_in_seconds:%d", int(uptime.Seconds())),
+		fmt.Sprintf("uptime_in_days:%d", int(uptime.Hours()/24)),
+	}
+}
+
+func (s *Server) infoPersistence() []string {
+	p := &s.persist
+	bgsaveInProgress, currentBgsave := 0, -1
+	if p.bgsave != nil {
+		bgsaveInProgress = 1
+		currentBgsave = int(time.Since(p.bgsave.start).Seconds())
+	}
+	lastBgsaveTime := -1
+	if p.lastBgsaveTime > 0 {
+		lastBgsaveTime = int(p.lastBgsaveTime.Seconds())
+	}
+	a := &s.aof
+	rewriteInProgress, currentRewrite := 0, -1
+	if a.rewrite != nil {
+		rewriteInProgress = 1
+		currentRewrite = int(time.Since(a.rewrite.start).Seconds())
+	}
+	lastRewriteTime := -1
+	if a.lastRewriteTime > 0 {
+		lastRewriteTime = int(a.lastRewriteTime.Seconds())
+	}
+	fields := []string{
+		fmt.Sprintf("loading:%d", boolToInt(p.loading)),
+	}
+	if p.loading {
+		// Estimated from the average loading speed so far
+		elapsed := time.Since(p.loadingStart).Seconds()
+		perc, eta := 0.0, 1
+		if p.loadingTotalBytes > 0 {
+			perc = float64(p.loadingLoadedBytes) * 100 / float64(p.loadingTotalBytes)
+		}
+		if p.loadingLoadedBytes > 0 {
+			eta = int(elapsed * float64(p.loadingTotalBytes-p.loadingLoadedBytes) / float64(p.loadingLoadedBytes))
+		}
+		fields = append(fields,
+			fmt.Sprintf("loading_start_time:%d", p.loadingStart.Unix()),
+			fmt.Sprintf("loading_total_bytes:%d", p.loadingTotalBytes),
+			fmt.Sprintf("loading_loaded_bytes:%d", p.loadingLoadedBytes),
+			fmt.Sprintf("loading_loaded_perc:%.2f", perc),
+			fmt.Sprintf("loading_eta_seconds:%d", eta))
+	}
+	fields = append(fields,
+		fmt.Sprintf("rdb_changes_since_last_save:%d", p.dirty),
+		fmt.Sprintf("rdb_bgsave_in_progress:%d", bgsaveInProgress),
+		fmt.Sprintf("rdb_last_save_time:%d", p.lastSave.Unix()),
+		"rdb_last_bgsave_status:"+okOrErr(p.lastBgsaveOK),
+		fmt.Sprintf("rdb_last_bgsave_time_sec:%d", lastBgsaveTime),
+		fmt.Sprintf("rdb_current_bgsave_time_sec:%d", currentBgsave),
+		fmt.Sprintf("rdb_saves:%d", p.rdbSaves),
+		fmt.Sprintf("rdb_last_cow_size:%d", p.lastCowSize),
+		fmt.Sprintf("rdb_last_load_keys_expired:%d", p.expiredKeys),
+		fmt.Sprintf("rdb_last_load_keys_loaded:%d", p.loadedKeys),
+		fmt.Sprintf("aof_enabled:%d", boolToInt(a.enabled)),
+		fmt.Sprintf("aof_rewrite_in_progress:%d", rewriteInProgress),
+		fmt.Sprintf("aof_rewrite_scheduled:%d", boolToInt(a.rewriteScheduled)),
+		fmt.Sprintf("aof_last_rewrite_time_sec:%d", lastRewriteTime),
+		fmt.Sprintf("aof_current_rewrite_time_sec:%d", currentRewrite),
+		"aof_last_bgrewrite_status:"+okOrErr(a.lastRewriteOK),
+		fmt.Sprintf("aof_rewrites:%d", a.rewrites),
+		"aof_last_write_status:"+okOrErr(a.lastWriteErr == nil),
+		fmt.Sprintf("aof_last_cow_size:%d", a.lastCowSize))
+	if a.enabled {
+		fields = append(fields,
+			fmt.Sprintf("aof_current_size:%d", a.currentSize),
+			fmt.Sprintf("aof_base_size:%d", a.rewriteBaseSize),
+			fmt.Sprintf("aof_buffer_length:%d", len(a.buf)))
+	}
+	return fields
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func okOrErr(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "err"
+}
+
+// handleInfo handles the INFO [section ...] command. Without arguments, or
+// with default, all or everything, every section is included.
+func (s *Server) handleInfo(args []resp.Value) resp.Value {
+	wanted := make(map[string]bool)
+	for _, arg := range args {
+		wanted[strings.ToLower(arg.Bulk)] = true
+	}
+	all := len(args) == 0 || wanted["default"] || wanted["all"] || wanted["everything"]
+
+	sections := infoSections
+	if s.sentinel != nil {
+		sections = sentinelInfoSections
+	}
+	var b strings.Builder
+	for _, section := range sections {
+		if !all && !wanted[section.name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", strings.ToUpper(section.name[:1])+section.name[1:])
+		for _, line := range section.fields(s) {
+			b.WriteString(line)
+			b.WriteString("\r\n")
+		}
+	}
+	return resp.NewBulkString(b.String())
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// Listpacks are the compact encoding Redis uses for small collections and
+// for stream nodes: a 6 byte header (total bytes and element count), the
+// elements, and a 0xFF terminator. Each element is an encoding byte with
+// its data, followed by the element's length encoded backwards so the list
+// can be walked from either end.
+
+const (
+	listpackHeaderSize = 6
+	listpackEOF        = 0xff
+)
+
+var errBadListpack = errors.New("invalid listpack")
+
+// listpackBuilder appends elements to a listpack
+type listpackBuilder struct {
+	buf   []byte
+	count int
+}
+
+func newListpackBuilder() *listpackBuilder {
+	return &listpackBuilder{buf: make([]byte, listpackHeaderSize, 64)}
+}
+
+// appendBacklen appends the length of the element that was just written
+func (lp *listpackBuilder) appendBacklen(l int) {
+	switch {
+	case l <= 127:
+		lp.buf = append(lp.buf, byte(l))
+	case l < 16383:
+		lp.buf = append(lp.buf, byte(l>>7), byte(l&127|128))
+	case l < 2097151:
+		lp.buf = append(lp.buf, byte(l>>14), byte(l>>7&127|128), byte(l&127|128))
+	case l < 268435455:
+		lp.buf = append(lp.buf, byte(l>>21), byte(l>>14&127|128), byte(l>>7&127|128), byte(l&127|128))
+	default:
+		lp.buf = append(lp.buf, byte(l>>28), byte(l>>21&127|128), byte(l>>14&127|128), byte(l>>7&127|128), byte(l&127|128))
+	}
+}
+
+// AppendInt appends an integer in the smallest encoding that fits it
+func (lp *listpackBuilder) AppendInt(v int64) {
+	start := len(lp.buf)
+	switch {
+	case v >= 0 && v <= 127:
+		lp.buf = append(lp.buf, byte(v))
+	case v >= -4096 && v <= 4095:
+		u := uint64(v) & 0x1fff
+		lp.buf = append(lp.buf, byte(0xc0|u>>8), byte(u))
+	case v >= -32768 && v <= 32767:
+		lp.buf = append(lp.buf, 0xf1)
+		lp.buf = binary.LittleEndian.AppendUint16(lp.buf, uint16(v))
+	case v >= -8388608 && v <= 8388607:
+		u := uint32(v)
+		lp.buf = append(lp.buf, 0xf2, byte(u), byte(u>>8), byte(u>>16))
+	case v >= -2147483648 && v <= 2147483647:
+		lp.buf = append(lp.buf, 0xf3)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(v))
+	default:
+		lp.buf = append(lp.buf, 0xf4)
+		lp.buf = binary.LittleEndian.AppendUint64(lp.buf, uint64(v))
+	}
+	lp.appendBacklen(len(lp.buf) - start)
+	lp.count++
+}
+
+// AppendString appends a string, using an integer encoding when it is the
+// canonical representation of one, as Redis does
+func (lp *listpackBuilder) AppendString(s string) {
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(v, 10) == s {
+		lp.AppendInt(v)
+		return
+	}
+
+	start := len(lp.buf)
+	switch n := len(s); {
+	case n < 64:
+		lp.buf = append(lp.buf, byte(0x80|n))
+	case n < 4096:
+		lp.buf = append(lp.buf, byte(0xe0|n>>8), byte(n))
+	default:
+		lp.buf = append(lp.buf, 0xf0)
+		lp.buf = binary.LittleEndian.AppendUint32(lp.buf, uint32(n))
+	}
+	lp.buf = append(lp.buf, s...)
+	lp.appendBacklen(len(lp.buf) - start)
+	lp.count++
+}
+
+// Bytes finishes the listpack
+func (lp *listpackBuilder) Bytes() []byte {
+	buf := append(lp.buf, listpackEOF)
+	binary.LittleEndian.PutUint32(buf, uint32(len(buf)))
+	count := lp.count
+	if count > 65535 {
+		count = 65535 // unknown, has to be counted
+	}
+	binary.LittleEndian.PutUint16(buf[4:], uint16(count))
+	return buf
+}
+
+// listpackEntries decodes every element of a listpack as a string
+func listpackEntries(lp []byte) ([]string, error) {
+	if len(lp) < listpackHeaderSize+1 || int(binary.LittleEndian.Uint32(lp)) != len(lp) || lp[len(lp)-1] != listpackEOF {
+		return nil, errBadListpack
+	}
+
+	var entries []string
+	p := listpackHeaderSize
+	for p < len(lp)-1 {
+		start := p
+		enc := lp[p]
+		var s string
+		switch {
+		case enc&0x80 == 0: // 7 bit uint
+			s = strconv.Itoa(int(enc & 0x7f))
+			p++
+		case enc&0xc0 == 0x80: // 6 bit string length
+			n := int(enc & 0x3f)
+			if p+1+n > len(lp) {
+				return nil, errBadListpack
+			}
+			s = string(lp[p+1 : p+1+n])
+			p += 1 + n
+		case enc&0xe0 == 0xc0: // 13 bit int
+			if p+2 > len(lp) {
+				return nil, errBadListpack
+			}
+			u := uint16(enc&0x1f)<<8 | uint16(lp[p+1])
+			v := int64(u)
+			if u >= 1<<12 {
+				v -= 1 << 13
+			}
+			s = strconv.FormatInt(v, 10)
+			p += 2
+		case enc&0xf0 == 0xe0: // 12 bit string length
+			if p+2 > len(lp) {
+				return nil, errBadListpack
+			}
+			n := int(enc&0x0f)<<8 | int(lp[p+1])
+			if p+2+n > len(lp) {
+				return nil, errBadListpack
+			}
+			s = string(lp[p+2 : p+2+n])
+			p += 2 + n
+		case enc == 0xf0: // 32 bit string length
+			if p+5 > len(lp) {
+				return nil, errBadListpack
+			}
+			n := int(binary.LittleEndian.Uint32(lp[p+1:]))
+			if n < 0 || p+5+n > len(lp) {
+				return nil, errBadListpack
+			}
+			s = string(lp[p+5 : p+5+n])
+			p += 5 + n
+		case enc >= 0xf1 && enc <= 0xf4:
+			size := [...]int{2, 3, 4, 8}[enc-0xf1]
+			if p+1+size > len(lp) {
+				return nil, errBadListpack
+			}
+			var u uint64
+			for i := size - 1; i >= 0; i-- {
+				u = u<<8 | uint64(lp[p+1+i])
+			}
+			// Sign extend
+			shift := 64 - 8*size
+			s = strconv.FormatInt(int64(u<<shift)>>shift, 10)
+			p += 1 + size
+		default:
+			return nil, errBadListpack
+		}
+
+		// Skip the backlen, checking it matches
+		l := p - start
+		backlen := 1
+		for _, limit := range []int{127, 16382, 2097150, 268435454} {
+			if l > limit {
+				backlen++
+			}
+		}
+		if p+backlen > len(lp)-1 {
+			return nil, errBadListpack
+		}
+		p += backlen
+		entries = append(entries, s)
+	}
+	return entries, nil
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"redis-learning/pkg/resp"
+)
+
+const wrongTypeErr = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+// parseListEnd parses a LEFT|RIGHT argument, returning true for LEFT
+func parseListEnd(arg string) (bool, bool) {
+	switch strings.ToUpper(arg) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
+	}
+	return false, false
+}
+
+// listEndName is the inverse of parseListEnd
+func listEndName(left bool) string {
+	if left {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
+
+// listPushEvent and listPopEvent name the keyspace events of list updates
+func listPushEvent(left bool) string {
+	if left {
+		return "lpush"
+	}
+	return "rpush"
+}
+
+func listPopEvent(left bool) string {
+	if left {
+		return "lpop"
+	}
+	return "rpop"
+}
+
+// listPopCount pops up to count elements from the list stored at key. The
+// reply is an error for a wrong type and ok is false if there is no list.
+// Whichever command pops, it is propagated as LPOP or RPOP.
+func (s *Server) listPopCount(key string, left bool, count int) ([]string, resp.Value, bool) {
+	val, exists := s.db.GetValue(key)
+	if !exists {
+		return nil, resp.Value{}, false
+	}
+	if val.Type != "list" {
+		return nil, resp.NewError(wrongTypeErr), true
+	}
+
+	var popped []string
+	for len(popped) < count {
+		value, ok := val.ListPop(left)
+		if !ok {
+			break
+		}
+		popped = append(popped, value)
+	}
+	if len(popped) > 0 {
+		s.signalModifiedKey(key)
+		s.notifyKeyspaceEvent(notifyList, listPopEvent(left), key)
+		s.alsoPropagate(strings.ToUpper(listPopEvent(left)), key, strconv.Itoa(len(popped)))
+	}
+
+	// If list is empty, delete the key
+	if val.ListLength() == 0 {
+		s.db.Del(key)
+		s.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	}
+	return popped, resp.Value{}, true
+}
+
+// listMove pops an element from src and pushes it onto dst, returning the
+// element. ok is false if src holds no list. BLMOVE is propagated as LMOVE.
+func (s *Server) listMove(src, dst string, fromLeft, toLeft bool) (resp.Value, bool) {
+	srcVal, exists := s.db.GetValue(src)
+	if !exists {
+		return resp.Value{}, false
+	}
+	if srcVal.Type != "list" {
+		return resp.NewError(wrongTypeErr), true
+	}
+	dstVal, exists := s.db.GetValue(dst)
+	if exists && dstVal.Type != "list" {
+		return resp.NewError(wrongTypeErr), true
+	}
+
+	value, _ := srcVal.ListPop(fromLeft)
+	if !exists {
+		dstVal = NewListValue()
+		s.db.SetValue(dst, dstVal)
+	}
+	dstVal.ListPush(value, toLeft)
+	s.signalModifiedKey(dst)
+	s.notifyKeyspaceEvent(notifyList, listPushEvent(toLeft), dst)
+	s.signalModifiedKey(src)
+	s.notifyKeyspaceEvent(notifyList, listPopEvent(fromLeft), src)
+
+	// If list is empty, delete the key
+	if srcVal.ListLength() == 0 {
+		s.db.Del(src)
+		s.notifyKeyspaceEvent(notifyGeneric, "del", src)
+	}
+	s.signalKeyAsReady(dst)
+	s.alsoPropagate("LMOVE", src, dst, listEndName(fromLeft), listEndName(toLeft))
+	return resp.NewBulkString(value), true
+}
+
+// listMPop pops up to count elements from the list at key and formats the
+// LMPOP style [key, [elements]] reply
+func (s *Server) listMPop(key string, left bool, count int) (resp.Value, bool) {
+	popped, errReply, ok := s.listPopCount(key, left, count)
+	if !ok || errReply.Type == resp.ERROR {
+		return errReply, ok
+	}
+	elements := make([]resp.Value, len(popped))
+	for i, value := range popped {
+		elements[i] = resp.NewBulkString(value)
+	}
+	return resp.NewArray([]resp.Value{resp.NewBulkString(key), resp.NewArray(elements)}), true
+}
+
+// parseMPopArgs parses the "numkeys key [key ...] LEFT|RIGHT [COUNT count]"
+// tail shared by LMPOP and BLMPOP
+func parseMPopArgs(args []resp.Value) ([]string, bool, int, resp.Value, bool) {
+	numKeys, err := strconv.Atoi(args[0].Bulk)
+	if err != nil || numKeys <= 0 {
+		return nil, false, 0, resp.NewError("ERR numkeys should be greater than 0"), false
+	}
+	// Compared this way round so that a huge numkeys can't overflow
+	if numKeys > len(args)-2 {
+		return nil, false, 0, resp.NewError("ERR syntax error"), false
+	}
+
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = args[1+i].Bulk
+	}
+
+	left, ok := parseListEnd(args[1+numKeys].Bulk)
+	if !ok {
+		return nil, false, 0, resp.NewError("ERR syntax error"), false
+	}
+
+	count := 1
+	rest := args[2+numKeys:]
+	switch {
+	case len(rest) == 0:
+	case len(rest) == 2 && strings.ToUpper(rest[0].Bulk) == "COUNT":
+		count, err = strconv.Atoi(rest[1].Bulk)
+		if err != nil || count <= 0 {
+			return nil, false, 0, resp.NewError("ERR count should be greater than 0"), false
+		}
+	default:
+		return nil, false, 0, resp.NewError("ERR syntax error"), false
+	}
+	return keys, left, count, resp.Value{}, true
+}
+
+// handleLMove handles the LMOVE command
+func (s *Server) handleLMove(args []resp.Value) resp.Value {
+	if len(args) != 4 {
+		return resp.NewError("ERR wrong number of arguments for 'lmove' command")
+	}
+
+	fromLeft, ok1 := parseListEnd(args[2].Bulk)
+	toLeft, ok2 := parseListEnd(args[3].Bulk)
+	if !ok1 || !ok2 {
+		return resp.NewError("ERR syntax error")
+	}
+
+	reply, ok := s.listMove(args[0].Bulk, args[1].Bulk, fromLeft, toLeft)
+	if !ok {
+		return resp.NewNullBulkString()
+	}
+	return reply
+}
+
+// handleLMPop handles the LMPOP command
+func (s *Server) handleLMPop(args []resp.Value) resp.Value {
+	if len(args) < 3 {
+		return resp.NewError("ERR wrong number of arguments for 'lmpop' command")
+	}
+
+	keys, left, count, errReply, ok := parseMPopArgs(args)
+	if !ok {
+		return errReply
+	}
+
+	for _, key := range keys {
+		if reply, ok := s.listMPop(key, left, count); ok {
+			return reply
+		}
+	}
+	return resp.NewNullArray()
+}
+
+// handleBLPop handles the BLPOP command
+func (s *Server) handleBLPop(c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return resp.NewError("ERR wrong number of arguments for 'blpop' command")
+	}
+	return s.blockingPop(c, args, true)
+}
+
+// handleBRPop handles the BRPOP command
+func (s *Server) handleBRPop(c *Client, args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return resp.NewError("ERR wrong number of arguments for 'brpop' command")
+	}
+	return s.blockingPop(c, args, false)
+}
+
+// blockingPop implements BLPOP and BRPOP
+func (s *Server) blockingPop(c *Client, args []resp.Value, left bool) resp.Value {
+	timeout, errReply, ok := parseTimeout(args[len(args)-1].Bulk)
+	if !ok {
+		return errReply
+	}
+
+	keys := make([]string, len(args)-1)
+	for i := range keys {
+		keys[i] = args[i].Bulk
+	}
+
+	serve := func(key string) (resp.Value, bool) {
+		popped, errReply, ok := s.listPopCount(key, left, 1)
+		if !ok || errReply.Type == resp.ERROR {
+			// A key that changed type just doesn't serve us
+			return resp.Value{}, false
+		}
+		return resp.NewArray([]resp.Value{resp.NewBulkString(key), resp.NewBulkString(popped[0])}), true
+	}
+
+	// Serve the first non-empty list right away
+	for _, key := range keys {
+		popped, errReply, ok := s.listPopCount(key, left, 1)
+		if !ok {
+			continue
+		}
+		if errReply.Type == resp.ERROR {
+			return errReply
+		}
+		return resp.NewArray([]resp.Value{resp.NewBulkString(key), resp.NewBulkString(popped[0])})
+	}
+
+	return s.blockClient(c, keys, timeout, resp.NewNullArray(), serve)
+}
+
+// handleBLMove handles the BLMOVE command
+func (s *Server) handleBLMove(c *Client, args []resp.Value) resp.Value {
+	if len(args) != 5 {
+		return resp.NewError("ERR wrong number of arguments for 'blmove' command")
+	}
+
+	src, dst := args[0].Bulk, args[1].Bulk
+	fromLeft, ok1 := parseListEnd(args[2].Bulk)
+	toLeft, ok2 := parseListEnd(args[3].Bulk)
+	if !ok1 || !ok2 {
+		return resp.NewError("ERR syntax error")
+	}
+	timeout, errReply, ok := parseTimeout(args[4].Bulk)
+	if !ok {
+		return errReply
+	}
+
+	if reply, ok := s.listMove(src, dst, fromLeft, toLeft); ok {
+		return reply
+	}
+
+	serve := func(key string) (resp.Value, bool) {
+		if val, exists := s.db.GetValue(key); exists && val.Type != "list" {
+			return resp.Value{}, false
+		}
+		return s.listMove(key, dst, fromLeft, toLeft)
+	}
+	return s.blockClient(c, []string{src}, timeout, resp.NewNullBulkString(), serve)
+}
+
+// handleBLMPop handles the BLMPOP command
+func (s *Server) handleBLMPop(c *Client, args []resp.Value) resp.Value {
+	if len(args) < 4 {
+		return resp.NewError("ERR wrong number of arguments for 'blmpop' command")
+	}
+
+	timeout, errReply, ok := parseTimeout(args[0].Bulk)
+	if !ok {
+		return errReply
+	}
+	keys, left, count, errReply, ok := parseMPopArgs(args[1:])
+	if !ok {
+		return errReply
+	}
+
+	for _, key := range keys {
+		if reply, ok := s.listMPop(key, left, count); ok {
+			return reply
+		}
+	}
+
+	serve := func(key string) (resp.Value, bool) {
+		if val, exists := s.db.GetValue(key); exists && val.Type != "list" {
+			return resp.Value{}, false
+		}
+		return s.listMPop(key, left, count)
+	}
+	return s.blockClient(c, keys, timeout, resp.NewNullArray(), serve)
+}
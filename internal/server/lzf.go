@@ -0,0 +1,61 @@
+package server
+
+import "errors"
+
+var errBadLZF = errors.New("invalid LZF data")
+
+// lzfMaxExpansion is the most LZF data can expand by: a back reference
+// takes 3 bytes for up to 264 bytes of output
+const lzfMaxExpansion = 88
+
+// lzfDecompress expands LZF compressed data, which Redis uses for long
+// strings in RDB files, into a buffer of the known uncompressed size. The
+// size comes with the data, so a size in can't expand to is rejected, and
+// the buffer grows as the data is expanded rather than up front.
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	if outLen > len(in)*lzfMaxExpansion {
+		return nil, errBadLZF
+	}
+	out := make([]byte, 0, min(outLen, 4*len(in)))
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			// Literal run of ctrl+1 bytes
+			n := ctrl + 1
+			if i+n > len(in) || len(out)+n > outLen {
+				return nil, errBadLZF
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+
+		// Back reference
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errBadLZF
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errBadLZF
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		n += 2
+		if ref < 0 || len(out)+n > outLen {
+			return nil, errBadLZF
+		}
+		// Byte by byte, as the reference may overlap what is being written
+		for j := 0; j < n; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != outLen {
+		return nil, errBadLZF
+	}
+	return out, nil
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"log"
+	"strings"
+
+	"redis-learning/pkg/module"
+	"redis-learning/pkg/resp"
+)
+
+// loadModuleCommands adds the commands registered through package module.
+// Built-in commands can't be overridden.
+func (s *Server) loadModuleCommands() {
+	s.moduleCommands = make(map[string]commandInfo)
+	s.moduleClient = newClient(nil)
+	s.moduleClient.denyBlocking = true
+
+	for _, cmd := range module.Commands() {
+		name := strings.ToUpper(cmd.Name)
+		if _, builtin := commandTable[name]; builtin {
+			log.Printf("Module command %s ignored: it clashes with a built-in command", cmd.Name)
+			continue
+		}
+		info := commandInfo{
+			arity:  cmd.Arity,
+			keys:   keySpec{cmd.Keys.FirstKey, cmd.Keys.LastKey, cmd.Keys.Step},
+			module: cmd,
+		}
+		if cmd.Flags&module.Write != 0 {
+			info.flags |= cmdWrite
+		}
+		if cmd.Flags&module.NoMulti != 0 {
+			info.flags |= cmdNoMulti
+		}
+		if cmd.Flags&module.NoScript != 0 {
+			info.flags |= cmdNoScript
+		}
+		s.moduleCommands[name] = info
+	}
+}
+
+// callModuleCommand runs a module command's handler on behalf of c
+func (s *Server) callModuleCommand(c *Client, cmd *module.Command, args []resp.Value) resp.Value {
+	argv := make([]string, len(args))
+	for i, arg := range args {
+		argv[i] = arg.Bulk
+	}
+	return cmd.Handler(&moduleContext{s: s, c: c}, argv)
+}
+
+// moduleContext implements module.Context. c is the client that ran the
+// module command.
+type moduleContext struct {
+	s *Server
+	c *Client
+}
+
+func (ctx *moduleContext) Get(key string) (string, bool, error) {
+	val, exists := ctx.s.db.GetValue(key)
+	if !exists {
+		return "", false, nil
+	}
+	if val.Type != "string" {
+		return "", false, module.ErrWrongType
+	}
+	return val.String, true, nil
+}
+
+func (ctx *moduleContext) Set(key, value string) {
+	ctx.s.db.Set(key, value)
+	ctx.s.signalModifiedKey(key)
+	ctx.s.notifyKeyspaceEvent(notifyString, "set", key)
+}
+
+func (ctx *moduleContext) GetValue(key string, t *module.Type) (any, bool, error) {
+	val, exists := ctx.s.db.GetValue(key)
+	if !exists {
+		return nil, false, nil
+	}
+	if val.ModType != t {
+		return nil, false, module.ErrWrongType
+	}
+	return val.Module, true, nil
+}
+
+func (ctx *moduleContext) SetValue(key string, t *module.Type, value any) {
+	ctx.s.db.SetValue(key, NewModuleValue(t, value))
+	ctx.s.signalModifiedKey(key)
+	ctx.s.notifyKeyspaceEvent(notifyModule, "set", key)
+}
+
+func (ctx *moduleContext) Delete(key string) bool {
+	if !ctx.s.db.Del(key) {
+		return false
+	}
+	ctx.s.signalModifiedKey(key)
+	ctx.s.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	return true
+}
+
+func (ctx *moduleContext) KeyType(key string) string {
+	val, exists := ctx.s.db.GetValue(key)
+	if !exists {
+		return "none"
+	}
+	return val.Type
+}
+
+// Call runs another command as redis.call does for scripts. Commands that
+// depend on the caller's connection, such as MULTI or SUBSCRIBE, are
+// refused.
+func (ctx *moduleContext) Call(name string, args ...string) resp.Value {
+	cmd := strings.ToUpper(name)
+	info, known := ctx.s.lookupCommand(cmd)
+	if !known {
+		return resp.NewError("ERR unknown command '" + name + "'")
+	}
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+	if errReply, ok := checkArity(cmd, info, values); !ok {
+		return errReply
+	}
+	if info.flags&cmdNoScript != 0 {
+		return resp.NewError("ERR This command is not allowed from modules")
+	}
+	if info.flags&cmdWrite != 0 && !ctx.c.mustObey() {
+		if errReply, denied := ctx.s.writeDeniedReply(); denied {
+			return errReply
+		}
+	}
+	return ctx.s.call(ctx.s.moduleClient, cmd, values)
+}
+
+func (ctx *moduleContext) NotifyKeyspaceEvent(event, key string) {
+	ctx.s.notifyKeyspaceEvent(notifyModule, event, key)
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"redis-learning/pkg/resp"
+)
+
+// multiState holds the commands queued by a client between MULTI and EXEC
+type multiState struct {
+	commands []queuedCommand
+
+	// dirty is set when a command failed to queue, e.g. because it doesn't
+	// exist or has the wrong number of arguments. EXEC then refuses to run
+	// any of them.
+	dirty bool
+}
+
+// queuedCommand is a command waiting for EXEC
+type queuedCommand struct {
+	name string // upper case
+	args []resp.Value
+}
+
+// Commands that run right away even inside MULTI
+func runsInMulti(cmd string) bool {
+	switch cmd {
+	case "EXEC", "DISCARD", "MULTI", "WATCH", "QUIT", "RESET":
+		return true
+	}
+	return false
+}
+
+// flagTransaction marks the client's transaction, if any, as failed
+func flagTransaction(c *Client) {
+	if c.mstate != nil {
+		c.mstate.dirty = true
+	}
+}
+
+// queueMultiCommand adds a command to the client's transaction
+func queueMultiCommand(c *Client, cmd string, args []resp.Value) resp.Value {
+	c.mstate.commands = append(c.mstate.commands, queuedCommand{name: cmd, args: args})
+	return resp.NewSimpleString("QUEUED")
+}
+
+// discardTransaction drops the client's transaction, if any, along with
+// its watched keys
+func (s *Server) discardTransaction(c *Client) {
+	c.mstate = nil
+	s.unwatchAllKeys(c)
+}
+
+// watchKey starts tracking key for modifications on behalf of c
+func (s *Server) watchKey(c *Client, key string) {
+	if _, ok := c.watchedKeys[key]; ok {
+		return
+	}
+	clients, ok := s.watchedKeys[key]
+	if !ok {
+		clients = make(map[*Client]struct{})
+		s.watchedKeys[key] = clients
+	}
+	clients[c] = struct{}{}
+
+	// Remember whether the key had already expired, so that its deletion
+	// doesn't count as a change later on
+	val, exists := s.db.peek(key)
+	c.watchedKeys[key] = exists && val.IsExpired()
+}
+
+// unwatchAllKeys stops tracking every key watched by c
+func (s *Server) unwatchAllKeys(c *Client) {
+	for key := range c.watchedKeys {
+		clients := s.watchedKeys[key]
+		delete(clients, c)
+		if len(clients) == 0 {
+			delete(s.watchedKeys, key)
+		}
+	}
+	if len(c.watchedKeys) > 0 {
+		c.watchedKeys = make(map[string]bool)
+	}
+	c.dirtyCAS = false
+}
+
+// isWatchedKeyExpired reports whether one of the keys watched by c has
+// expired since it was watched but hasn't been deleted yet
+func (s *Server) isWatchedKeyExpired(c *Client) bool {
+	for key, expired := range c.watchedKeys {
+		if expired {
+			continue
+		}
+		if val, exists := s.db.peek(key); exists && val.IsExpired() {
+			return true
+		}
+	}
+	return false
+}
+
+// signalModifiedKey must be called whenever a key changes, so that EXEC
+// fails for the clients watching it and snapshots count the change. That
+// includes keys being deleted, expired or flushed.
+func (s *Server) signalModifiedKey(key string) {
+	s.persist.dirty++
+	s.touchWatchedKey(key)
+}
+
+// touchWatchedKey makes EXEC fail for the clients watching key
+func (s *Server) touchWatchedKey(key string) {
+	for c := range s.watchedKeys[key] {
+		if c.watchedKeys[key] {
+			// The key had already expired when it was watched, so it
+			// being deleted now isn't a change
+			if _, exists := s.db.peek(key); !exists {
+				c.watchedKeys[key] = false
+				continue
+			}
+		}
+		c.dirtyCAS = true
+	}
+}
+
+// touchWatchedKeysOnFlush flags the clients watching any of the keys that
+// a flush removed
+func (s *Server) touchWatchedKeysOnFlush(emptied map[string]*RedisValue) {
+	for key := range s.watchedKeys {
+		if _, ok := emptied[key]; ok {
+			s.touchWatchedKey(key)
+		}
+	}
+}
+
+// touchWatchedKeysOnLoad flags the clients watching any of the keys that
+// loading a dataset, e.g. from a full resync with the master, set
+func (s *Server) touchWatchedKeysOnLoad(loaded map[string]*RedisValue) {
+	for key := range s.watchedKeys {
+		if _, ok := loaded[key]; ok {
+			s.touchWatchedKey(key)
+		}
+	}
+}
+
+// handleWatch handles the WATCH command
+func (s *Server) handleWatch(c *Client, args []resp.Value) resp.Value {
+	if c.mstate != nil {
+		return resp.NewError("ERR WATCH inside MULTI is not allowed")
+	}
+	// No point in watching more keys if EXEC is going to fail anyway
+	if c.dirtyCAS {
+		return resp.NewSimpleString("OK")
+	}
+	for _, arg := range args {
+		s.watchKey(c, arg.Bulk)
+	}
+	return resp.NewSimpleString("OK")
+}
+
+// handleUnwatch handles the UNWATCH command
+func (s *Server) handleUnwatch(c *Client, args []resp.Value) resp.Value {
+	s.unwatchAllKeys(c)
+	return resp.NewSimpleString("OK")
+}
+
+// handleMulti handles the MULTI command
+func (s *Server) handleMulti(c *Client, args []resp.Value) resp.Value {
+	if c.mstate != nil {
+		return resp.NewError("ERR MULTI calls can not be nested")
+	}
+	c.mstate = &multiState{}
+	return resp.NewSimpleString("OK")
+}
+
+// handleDiscard handles the DISCARD command
+func (s *Server) handleDiscard(c *Client, args []resp.Value) resp.Value {
+	if c.mstate == nil {
+		return resp.NewError("ERR DISCARD without MULTI")
+	}
+	s.discardTransaction(c)
+	return resp.NewSimpleString("OK")
+}
+
+// handleExec handles the EXEC command. The queued commands run back to back
+// while the server lock is held, so no other client's command can interleave
+// with them. A command failing at runtime doesn't stop the others: its error
+// is just its slot in the reply. If a watched key was modified since WATCH,
+// nothing runs and the reply is a null array. The commands are propagated
+// as a transaction too.
+func (s *Server) handleExec(c *Client, args []resp.Value) resp.Value {
+	if c.mstate == nil {
+		return resp.NewError("ERR EXEC without MULTI")
+	}
+	mstate := c.mstate
+	dirtyCAS := c.dirtyCAS || s.isWatchedKeyExpired(c)
+	s.discardTransaction(c)
+
+	if mstate.dirty {
+		return resp.NewError("EXECABORT Transaction discarded because of previous errors.")
+	}
+	if dirtyCAS {
+		return resp.NewNullArray()
+	}
+
+	// Blocking commands can't wait in the middle of a transaction: they
+	// behave as if they timed out right away
+	c.denyBlocking = true
+	defer func() { c.denyBlocking = false }()
+	s.startPropagateBatch()
+	defer s.endPropagateBatch()
+
+	replies := make([]resp.Value, len(mstate.commands))
+	for i, cmd := range mstate.commands {
+		replies[i] = s.call(c, cmd.name, cmd.args)
+	}
+	return resp.NewArray(replies)
+}
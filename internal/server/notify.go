@@ -0,0 +1,124 @@
+package server
+
+import (
+	"strings"
+)
+
+// Keyspace notification classes, selected with notify-keyspace-events
+const (
+	notifyKeyspace = 1 << iota // K
+	notifyKeyevent             // E
+	notifyGeneric              // g
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZSet                 // z
+	notifyExpired              // x
+	notifyEvicted              // e
+	notifyStream               // t
+	notifyKeyMiss              // m, excluded from A on purpose
+	notifyLoaded               // module only, a key was loaded from disk
+	notifyModule               // d
+	notifyNew                  // n, excluded from A on purpose
+
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash |
+		notifyZSet | notifyExpired | notifyEvicted | notifyStream | notifyModule
+)
+
+const invalidKeyspaceEventsErr = "Invalid event class character. Use 'Ag$lshzxeKEtmdn'."
+
+// keyspaceEventsStringToFlags parses a notify-keyspace-events value,
+// returning false if it has an unknown class character
+func keyspaceEventsStringToFlags(classes string) (int, bool) {
+	flags := 0
+	for _, c := range classes {
+		switch c {
+		case 'A':
+			flags |= notifyAll
+		case 'g':
+			flags |= notifyGeneric
+		case '$':
+			flags |= notifyString
+		case 'l':
+			flags |= notifyList
+		case 's':
+			flags |= notifySet
+		case 'h':
+			flags |= notifyHash
+		case 'z':
+			flags |= notifyZSet
+		case 'x':
+			flags |= notifyExpired
+		case 'e':
+			flags |= notifyEvicted
+		case 'K':
+			flags |= notifyKeyspace
+		case 'E':
+			flags |= notifyKeyevent
+		case 't':
+			flags |= notifyStream
+		case 'm':
+			flags |= notifyKeyMiss
+		case 'd':
+			flags |= notifyModule
+		case 'n':
+			flags |= notifyNew
+		default:
+			return 0, false
+		}
+	}
+	return flags, true
+}
+
+// keyspaceEventsFlagsToString is the inverse of keyspaceEventsStringToFlags,
+// using A when every class it covers is set
+func keyspaceEventsFlagsToString(flags int) string {
+	var b strings.Builder
+	if flags&notifyAll == notifyAll {
+		b.WriteByte('A')
+	} else {
+		classes := []struct {
+			flag int
+			c    byte
+		}{
+			{notifyGeneric, 'g'}, {notifyString, '$'}, {notifyList, 'l'},
+			{notifySet, 's'}, {notifyHash, 'h'}, {notifyZSet, 'z'},
+			{notifyExpired, 'x'}, {notifyEvicted, 'e'}, {notifyStream, 't'},
+			{notifyModule, 'd'}, {notifyNew, 'n'},
+		}
+		for _, class := range classes {
+			if flags&class.flag != 0 {
+				b.WriteByte(class.c)
+			}
+		}
+	}
+	if flags&notifyKeyspace != 0 {
+		b.WriteByte('K')
+	}
+	if flags&notifyKeyevent != 0 {
+		b.WriteByte('E')
+	}
+	if flags&notifyKeyMiss != 0 {
+		b.WriteByte('m')
+	}
+	return b.String()
+}
+
+// notifyKeyspaceEvent publishes an event of the given class about key, as
+// "__keyspace@0__:<key> <event>" and/or "__keyevent@0__:<event> <key>"
+// depending on the configured flags. There is only one database, so the
+// database index is always 0.
+func (s *Server) notifyKeyspaceEvent(class int, event, key string) {
+	flags := s.notifyKeyspaceEvents
+	if flags&class == 0 {
+		return
+	}
+
+	if flags&notifyKeyspace != 0 {
+		s.pubsubPublishMessage("__keyspace@0__:"+key, event, pubsubClassic)
+	}
+	if flags&notifyKeyevent != 0 {
+		s.pubsubPublishMessage("__keyevent@0__:"+event, key, pubsubClassic)
+	}
+}
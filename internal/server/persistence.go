@@ -0,0 +1,645 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"redis-learning/pkg/resp"
+)
+
+// Persistence defaults
+const (
+	defaultDBFilename = "dump.rdb"
+	defaultSaveParams = "3600 1 300 100 60 10000"
+
+	// After a failed BGSAVE, save points are only retried after this long
+	bgsaveRetryDelay = 5 * time.Second
+
+	defaultLoadingProcessEventsInterval = 2 * 1024 * 1024
+)
+
+// saveParam triggers a background save once changes writes happened in
+// the last seconds
+type saveParam struct {
+	seconds int
+	changes int
+}
+
+// parseSaveParams parses the "save" setting: pairs of seconds and changes,
+// or an empty string to disable automatic snapshots
+func parseSaveParams(value string) ([]saveParam, error) {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("Invalid save parameters")
+	}
+	params := make([]saveParam, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.Atoi(fields[i])
+		changes, err2 := strconv.Atoi(fields[i+1])
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, errors.New("Invalid save parameters")
+		}
+		params = append(params, saveParam{seconds, changes})
+	}
+	return params, nil
+}
+
+func formatSaveParams(params []saveParam) string {
+	parts := make([]string, 0, 2*len(params))
+	for _, p := range params {
+		parts = append(parts, strconv.Itoa(p.seconds), strconv.Itoa(p.changes))
+	}
+	return strings.Join(parts, " ")
+}
+
+// persistenceState is what the server tracks about snapshots
+type persistenceState struct {
+	dir        string
+	dbFilename string
+	saveParams []saveParam
+
+	dirty           int64 // changes since the last successful save
+	dirtyBeforeSave int64 // dirty when the running BGSAVE started
+	lastSave        time.Time
+	lastBgsaveTry   time.Time
+	lastBgsaveOK    bool
+	lastBgsaveTime  time.Duration
+	lastCowSize     int64 // bytes the last BGSAVE preserved for writes
+	rdbSaves        int
+
+	// The running BGSAVE, if any, and whether one waits for the running
+	// AOF rewrite to finish
+	bgsave          *bgsaveJob
+	bgsaveScheduled bool
+
+	// Outcome of loading the dataset at startup
+	loadedKeys  int
+	expiredKeys int
+
+	// Set while the dataset is loaded at startup. Clients are let in every
+	// loadingEventsInterval bytes, and get LOADING errors for data
+	// commands meanwhile.
+	loading               bool
+	loadingStart          time.Time
+	loadingTotalBytes     int64
+	loadingLoadedBytes    int64
+	loadingDoneBytes      int64 // in the files already loaded
+	loadingLastYield      int64
+	loadingEventsInterval int64
+	keyLoadDelay          time.Duration // debugging aid, slowing down loading
+	keySaveDelay          time.Duration // debugging aid, slowing down saving
+}
+
+// errLoadingAborted is returned by loaders when the server stops midway
+var errLoadingAborted = errors.New("loading aborted by shutdown")
+
+// bgsaveJob is a snapshot being written in the background
+type bgsaveJob struct {
+	start    time.Time
+	snapshot *snapshot
+	diskless bool        // streamed to replicas instead of written to disk
+	canceled atomic.Bool // e.g. by SHUTDOWN
+}
+
+// rdbPath returns where snapshots are written and loaded from
+func (s *Server) rdbPath() string {
+	return filepath.Join(s.persist.dir, s.persist.dbFilename)
+}
+
+// rdbWriter writes RDB data while computing its checksum
+type rdbWriter struct {
+	w   io.Writer
+	crc uint64
+}
+
+func (w *rdbWriter) write(p []byte) error {
+	w.crc = crc64(w.crc, p)
+	_, err := w.w.Write(p)
+	return err
+}
+
+// rdbWrite serializes the dataset and function libraries as an RDB file.
+// The caller must hold the server lock.
+func (s *Server) rdbWrite(out io.Writer) error {
+	return s.newSnapshot(snapshotRDB).write(out)
+}
+
+// rdbAppendKeyValue appends a key with its expiry, type and value
+func rdbAppendKeyValue(buf []byte, key string, val *RedisValue) []byte {
+	if val.ExpiresAt != nil {
+		buf = append(buf, rdbOpcodeExpireTimeMs)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(val.ExpiresAt.UnixMilli()))
+	}
+	buf = append(buf, rdbObjectType(val))
+	buf = rdbAppendString(buf, key)
+	return rdbAppendObject(buf, val)
+}
+
+// writeFileAtomically writes a file through a temporary file in the same
+// directory, renamed over path once fully written and synced, so a crash
+// never leaves a partial file behind
+func writeFileAtomically(path string, write func(io.Writer) error) error {
+	dir := filepath.Dir(path)
+	tmp := filepath.Join(dir, fmt.Sprintf("temp-%d-%d.rdb", os.Getpid(), time.Now().UnixNano()))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, 64*1024)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Make the rename itself durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// rdbSave writes a snapshot synchronously. The caller must hold the server
+// lock.
+func (s *Server) rdbSave() error {
+	if err := writeFileAtomically(s.rdbPath(), s.rdbWrite); err != nil {
+		log.Printf("Failed saving the DB: %v", err)
+		return err
+	}
+	log.Printf("DB saved on disk")
+	s.persist.dirty = 0
+	s.persist.lastSave = time.Now()
+	s.persist.lastBgsaveOK = true
+	s.persist.rdbSaves++
+	return nil
+}
+
+// rdbSaveBackground starts a BGSAVE. The dataset is captured right away,
+// under the server lock, and serialized and written to disk by another
+// goroutine while commands keep running.
+func (s *Server) rdbSaveBackground() error {
+	if s.persist.bgsave != nil {
+		return errors.New("Background save already in progress")
+	}
+	if s.hasActiveChild() {
+		return errors.New("Another child process is active (AOF?): can't BGSAVE right now")
+	}
+
+	snap := s.newSnapshot(snapshotRDB)
+	s.db.snapshot = snap
+	job := &bgsaveJob{start: time.Now(), snapshot: snap}
+	s.persist.bgsave = job
+	s.persist.bgsaveScheduled = false
+	s.persist.dirtyBeforeSave = s.persist.dirty
+	s.persist.lastBgsaveTry = job.start
+	path := s.rdbPath()
+	log.Printf("Background saving started")
+
+	go func() {
+		err := writeFileAtomically(path, func(w io.Writer) error {
+			if err := snap.write(w); err != nil {
+				return err
+			}
+			if job.canceled.Load() {
+				return errors.New("canceled")
+			}
+			return nil
+		})
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.backgroundSaveDone(job, err)
+	}()
+	return nil
+}
+
+// backgroundSaveDone records the outcome of a BGSAVE. The caller must hold
+// the server lock.
+func (s *Server) backgroundSaveDone(job *bgsaveJob, err error) {
+	if s.db.snapshot == job.snapshot {
+		s.db.snapshot = nil
+	}
+	if job.canceled.Load() {
+		return
+	}
+	// Replicas waiting for this snapshot get it, or are dropped on error
+	defer s.updateReplicasWaitingBgsave(err)
+	s.persist.bgsave = nil
+	if job.diskless {
+		// Nothing was saved
+		if err != nil {
+			log.Printf("Background transfer error: %v", err)
+		} else {
+			log.Printf("Background RDB transfer terminated with success")
+		}
+		return
+	}
+	s.persist.lastBgsaveTime = time.Since(job.start)
+	s.persist.lastCowSize = job.snapshot.cowBytes()
+	if s.persist.lastCowSize > 0 {
+		log.Printf("RDB: %d bytes of memory used by copy-on-write", s.persist.lastCowSize)
+	}
+	if err != nil {
+		log.Printf("Background saving error: %v", err)
+		s.persist.lastBgsaveOK = false
+		return
+	}
+	log.Printf("Background saving terminated with success")
+	s.persist.dirty -= s.persist.dirtyBeforeSave
+	s.persist.lastSave = job.start
+	s.persist.lastBgsaveOK = true
+	s.persist.rdbSaves++
+}
+
+// persistenceCron starts a BGSAVE when one was scheduled or a save point is
+// reached
+func (s *Server) persistenceCron() {
+	if s.hasActiveChild() {
+		return
+	}
+	now := time.Now()
+	if s.persist.bgsaveScheduled &&
+		(s.persist.lastBgsaveOK || now.Sub(s.persist.lastBgsaveTry) > bgsaveRetryDelay) {
+		if err := s.rdbSaveBackground(); err != nil {
+			log.Printf("Can't save in background: %v", err)
+		}
+		return
+	}
+	for _, sp := range s.persist.saveParams {
+		// After an error, wait a bit before trying again
+		if s.persist.dirty >= int64(sp.changes) &&
+			now.Sub(s.persist.lastSave) > time.Duration(sp.seconds)*time.Second &&
+			(s.persist.lastBgsaveOK || now.Sub(s.persist.lastBgsaveTry) > bgsaveRetryDelay) {
+			log.Printf("%d changes in %d seconds. Saving...", sp.changes, sp.seconds)
+			if err := s.rdbSaveBackground(); err != nil {
+				log.Printf("Can't save in background: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// cron runs periodic tasks until the server stops
+func (s *Server) cron() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			if s.sentinel != nil {
+				s.mu.Lock()
+				s.sentinelReleaseAll()
+				s.mu.Unlock()
+			}
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.sentinel != nil {
+				s.sentinelTimer()
+			} else {
+				s.aofRewriteCron()
+				s.persistenceCron()
+				s.replicationCron()
+				s.flushAppendOnlyFile()
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// loadingProgress records how far loading got, in bytes of the file being
+// loaded, and lets waiting clients run every loading-process-events-
+// interval-bytes. It returns errLoadingAborted once the server is stopping.
+// The caller must hold the server lock, which is released meanwhile.
+func (s *Server) loadingProgress(pos int64) error {
+	p := &s.persist
+	if !p.loading {
+		return nil
+	}
+	p.loadingLoadedBytes = p.loadingDoneBytes + pos
+	if p.keyLoadDelay > 0 {
+		s.mu.Unlock()
+		time.Sleep(p.keyLoadDelay)
+		s.mu.Lock()
+	} else if p.loadingLoadedBytes-p.loadingLastYield >= p.loadingEventsInterval {
+		p.loadingLastYield = p.loadingLoadedBytes
+		s.mu.Unlock()
+		runtime.Gosched()
+		s.mu.Lock()
+	}
+	select {
+	case <-s.quit:
+		return errLoadingAborted
+	default:
+		return nil
+	}
+}
+
+// loadDataFromDisk loads the append only file if enabled, since it is the
+// most up to date, and the snapshot otherwise
+func (s *Server) loadDataFromDisk() error {
+	if s.aof.enabled {
+		return s.loadAppendOnlyFiles()
+	}
+
+	start := time.Now()
+	data, err := os.ReadFile(s.rdbPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fatal error loading the DB: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.persist.loadingTotalBytes = int64(len(data))
+	if err := s.rdbLoad(data); err == errLoadingAborted {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("fatal error loading the DB %s: %v", s.rdbPath(), err)
+	}
+	s.persist.lastSave = time.Now()
+	log.Printf("DB loaded from disk: %.3f seconds", time.Since(start).Seconds())
+	return nil
+}
+
+// rdbLoad replaces the dataset and function libraries with the content of
+// an RDB file. The caller must hold the server lock.
+func (s *Server) rdbLoad(data []byte) error {
+	if len(data) < 9 || string(data[:5]) != "REDIS" {
+		return errors.New("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(data[5:9]))
+	if err != nil || version < 1 || version > rdbVersion {
+		return fmt.Errorf("can't handle RDB format version %s", data[5:9])
+	}
+
+	libCtx := newFunctionsLibCtx()
+	loaded := make(map[string]*RedisValue)
+	dbid := uint64(0)
+	s.persist.loadedKeys, s.persist.expiredKeys = 0, 0
+	r := &rdbReader{buf: data, pos: 9}
+	now := time.Now()
+	var expiresAt *time.Time
+	for {
+		opcode, err := r.readByte()
+		if err != nil {
+			return err
+		}
+
+		switch opcode {
+		case rdbOpcodeEOF:
+			if version >= 5 {
+				sum, err := r.readBytes(8)
+				if err != nil {
+					return err
+				}
+				expected := binary.LittleEndian.Uint64(sum)
+				if expected != 0 && expected != crc64(0, data[:r.pos-8]) {
+					return errors.New("wrong RDB checksum")
+				}
+			}
+			s.touchWatchedKeysOnFlush(s.db.Replace(loaded))
+			s.touchWatchedKeysOnLoad(loaded)
+			s.functionsLib = libCtx
+			return nil
+
+		case rdbOpcodeAux:
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+			continue
+
+		case rdbOpcodeSelectDB:
+			if dbid, _, err = r.readLen(); err != nil {
+				return err
+			}
+			if dbid != 0 {
+				log.Printf("Keys of database %d skipped: only database 0 is supported", dbid)
+			}
+			continue
+
+		case rdbOpcodeResizeDB:
+			if _, _, err := r.readLen(); err != nil {
+				return err
+			}
+			if _, _, err := r.readLen(); err != nil {
+				return err
+			}
+			continue
+
+		case rdbOpcodeExpireTimeMs:
+			p, err := r.readBytes(8)
+			if err != nil {
+				return err
+			}
+			t := time.UnixMilli(int64(binary.LittleEndian.Uint64(p)))
+			expiresAt = &t
+			continue
+
+		case rdbOpcodeExpireTime:
+			p, err := r.readBytes(4)
+			if err != nil {
+				return err
+			}
+			t := time.Unix(int64(int32(binary.LittleEndian.Uint32(p))), 0)
+			expiresAt = &t
+			continue
+
+		case rdbOpcodeIdle:
+			if _, _, err := r.readLen(); err != nil {
+				return err
+			}
+			continue
+
+		case rdbOpcodeFreq:
+			if _, err := r.readByte(); err != nil {
+				return err
+			}
+			continue
+
+		case rdbOpcodeFunction2:
+			code, err := r.readString()
+			if err != nil {
+				return err
+			}
+			if _, err := s.functionsCreate(code, false, libCtx); err != nil {
+				return fmt.Errorf("failed loading library: %v", err)
+			}
+			continue
+
+		case rdbOpcodeFunctionPreGA:
+			return errors.New("pre-release function format not supported")
+
+		case rdbOpcodeModuleAux:
+			return errors.New("module auxiliary data is not supported")
+		}
+
+		// Anything else is a key of that type
+		key, err := r.readString()
+		if err != nil {
+			return err
+		}
+		val, err := rdbLoadObject(r, opcode)
+		if err != nil {
+			return fmt.Errorf("loading key %q: %v", key, err)
+		}
+		val.ExpiresAt, expiresAt = expiresAt, nil
+		if dbid != 0 {
+			continue
+		}
+		if val.ExpiresAt != nil && val.ExpiresAt.Before(now) {
+			s.persist.expiredKeys++
+			continue
+		}
+		loaded[key] = val
+		s.persist.loadedKeys++
+		if err := s.loadingProgress(int64(r.pos)); err != nil {
+			return err
+		}
+	}
+}
+
+// handleSave handles the SAVE command
+func (s *Server) handleSave(args []resp.Value) resp.Value {
+	if s.persist.bgsave != nil {
+		return resp.NewError("ERR Background save already in progress")
+	}
+	if err := s.rdbSave(); err != nil {
+		return resp.NewError("ERR " + errorSafe(err.Error()))
+	}
+	return resp.NewSimpleString("OK")
+}
+
+// handleBgsave handles the BGSAVE [SCHEDULE] command. With SCHEDULE, a
+// save requested while an AOF rewrite runs starts once it is done.
+func (s *Server) handleBgsave(args []resp.Value) resp.Value {
+	schedule := false
+	if len(args) == 1 {
+		if strings.ToUpper(args[0].Bulk) != "SCHEDULE" {
+			return resp.NewError("ERR syntax error")
+		}
+		schedule = true
+	}
+	if s.persist.bgsave != nil {
+		return resp.NewError("ERR Background save already in progress")
+	}
+	if s.hasActiveChild() {
+		if !schedule {
+			return resp.NewError("ERR Another child process is active (AOF?): can't BGSAVE right now. Use BGSAVE SCHEDULE in order to schedule a BGSAVE whenever possible.")
+		}
+		s.persist.bgsaveScheduled = true
+		return resp.NewSimpleString("Background saving scheduled")
+	}
+	if err := s.rdbSaveBackground(); err != nil {
+		return resp.NewError("ERR " + errorSafe(err.Error()))
+	}
+	return resp.NewSimpleString("Background saving started")
+}
+
+// handleLastSave handles the LASTSAVE command
+func (s *Server) handleLastSave(args []resp.Value) resp.Value {
+	return resp.NewInteger(int(s.persist.lastSave.Unix()))
+}
+
+// prepareForShutdown saves the dataset if asked to, or by default if save
+// points are configured. The caller must hold the server lock.
+func (s *Server) prepareForShutdown(save, nosave, force bool) error {
+	if s.persist.loading {
+		// Saving would overwrite the files with a partial dataset
+		save, nosave = false, true
+	}
+	if job := s.persist.bgsave; job != nil {
+		// Its snapshot is stale by now
+		log.Printf("There is a child saving an .rdb. Killing it!")
+		job.canceled.Store(true)
+		s.persist.bgsave = nil
+		s.db.snapshot = nil
+	}
+	if s.aof.rewrite != nil {
+		log.Printf("There is a child rewriting the AOF. Killing it!")
+		s.cancelAOFRewrite()
+	}
+	if !nosave && (save || len(s.persist.saveParams) > 0) {
+		log.Printf("Saving the final RDB snapshot before exiting.")
+		if err := s.rdbSave(); err != nil && !force {
+			log.Printf("Error trying to save the DB, can't exit.")
+			return err
+		}
+	}
+	s.closeAppendOnlyFile()
+	log.Printf("Redis is now ready to exit, bye bye...")
+	return nil
+}
+
+// Shutdown saves the dataset as SHUTDOWN does by default and stops the
+// server
+func (s *Server) Shutdown() error {
+	s.mu.Lock()
+	err := s.prepareForShutdown(false, false, false)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.Stop()
+}
+
+// handleShutdown handles SHUTDOWN [NOSAVE|SAVE] [NOW] [FORCE] [ABORT]. On
+// success nothing is replied: the server goes away.
+func (s *Server) handleShutdown(args []resp.Value) resp.Value {
+	var save, nosave, force, abort bool
+	for _, arg := range args {
+		switch strings.ToUpper(arg.Bulk) {
+		case "SAVE":
+			save = true
+		case "NOSAVE":
+			nosave = true
+		case "NOW":
+			// Replicas aren't waited for to catch up anyway
+		case "FORCE":
+			force = true
+		case "ABORT":
+			abort = true
+		default:
+			return resp.NewError("ERR syntax error")
+		}
+	}
+	if save && nosave || abort && (save || nosave || force) {
+		return resp.NewError("ERR syntax error")
+	}
+	if abort {
+		return resp.NewError("ERR No shutdown in progress.")
+	}
+
+	if err := s.prepareForShutdown(save, nosave, force); err != nil {
+		return resp.NewError("ERR Errors trying to SHUTDOWN. Check logs.")
+	}
+	s.Stop()
+	return resp.Value{}
+}
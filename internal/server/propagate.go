@@ -0,0 +1,144 @@
+package server
+
+import (
+	"redis-learning/pkg/resp"
+)
+
+// propagationState tracks how the effects of commands are written to the
+// append only file and streamed to replicas.
+//
+// A write command that changed the dataset is propagated as it was called,
+// unless it registered other commands through alsoPropagate: commands whose
+// effect depends on time or on the state of blocked clients are replaced by
+// deterministic ones, e.g. the ID XADD generated or the pops a blocking
+// command did. Transactions and scripts propagate the commands they ran,
+// wrapped in MULTI and EXEC. Commands that change nothing but must reach
+// replicas, such as PUBLISH, are streamed to them and kept out of the
+// append only file.
+type propagationState struct {
+	// also collects the commands replacing the running write command
+	also       [][]string
+	collecting bool
+	// replOnly is set when the running command forced its replication
+	replOnly bool
+
+	// batch collects the commands of a transaction or script
+	batch      []propagatedCommand
+	batchDepth int
+}
+
+// propagatedCommand is a command waiting to be propagated
+type propagatedCommand struct {
+	argv []string
+	// replOnly commands are not written to the append only file
+	replOnly bool
+}
+
+// commandArgv converts a command to the argument vector it is propagated as
+func commandArgv(cmd string, args []resp.Value) []string {
+	argv := make([]string, 0, len(args)+1)
+	argv = append(argv, cmd)
+	for _, arg := range args {
+		argv = append(argv, arg.Bulk)
+	}
+	return argv
+}
+
+// propagate writes a command to the append only file and the replicas, or
+// adds it to the running transaction or script
+func (s *Server) propagate(argv []string) {
+	s.propagateCommand(propagatedCommand{argv: argv})
+}
+
+func (s *Server) propagateCommand(cmd propagatedCommand) {
+	if s.prop.batchDepth > 0 {
+		s.prop.batch = append(s.prop.batch, cmd)
+		return
+	}
+	s.propagateNow(cmd)
+}
+
+// propagateNow writes a command to the append only file and the replicas.
+// Replicas stream the writes of their master to their own replicas
+// instead, as they receive them.
+func (s *Server) propagateNow(cmd propagatedCommand) {
+	if !cmd.replOnly {
+		s.feedAppendOnlyFile(cmd.argv)
+	}
+	if s.repl.masterHost == "" {
+		s.replicationFeedReplicas(cmd.argv)
+	}
+}
+
+// alsoPropagate registers a command the running write command is
+// propagated as instead of itself. Outside of commands, e.g. when serving
+// blocked clients, the command is propagated right away.
+func (s *Server) alsoPropagate(argv ...string) {
+	if s.prop.collecting {
+		s.prop.also = append(s.prop.also, argv)
+		return
+	}
+	s.propagate(argv)
+}
+
+// startPropagateBatch starts grouping propagated commands so that they are
+// replayed atomically. Batches nest, e.g. for scripts run by EXEC.
+func (s *Server) startPropagateBatch() {
+	s.prop.batchDepth++
+}
+
+// endPropagateBatch ends a batch, propagating its commands wrapped in MULTI
+// and EXEC if there are several
+func (s *Server) endPropagateBatch() {
+	s.prop.batchDepth--
+	if s.prop.batchDepth > 0 {
+		return
+	}
+	batch := s.prop.batch
+	s.prop.batch = nil
+	if len(batch) > 1 {
+		s.propagateNow(propagatedCommand{argv: []string{"MULTI"}})
+	}
+	for _, cmd := range batch {
+		s.propagateNow(cmd)
+	}
+	if len(batch) > 1 {
+		s.propagateNow(propagatedCommand{argv: []string{"EXEC"}})
+	}
+}
+
+// forceReplication streams the running command to replicas even though it
+// changed nothing
+func (s *Server) forceReplication() {
+	if s.prop.collecting {
+		s.prop.replOnly = true
+	}
+}
+
+// callPropagating runs a write command called outside of another one, then
+// propagates it if the dataset changed or it forced its replication
+func (s *Server) callPropagating(c *Client, info commandInfo, cmd string, args []resp.Value) resp.Value {
+	s.db.writing = true
+	s.prop.collecting = true
+	s.prop.replOnly = false
+	s.prop.also = s.prop.also[:0]
+	dirty := s.persist.dirty
+
+	reply := s.dispatch(c, cmd, args)
+
+	s.db.writing = false
+	s.prop.collecting = false
+	switch {
+	case len(s.prop.also) > 0 && info.module == nil:
+		for _, argv := range s.prop.also {
+			s.propagate(argv)
+		}
+	case s.persist.dirty != dirty:
+		// Module commands are always propagated verbatim, whatever the
+		// commands they Call did
+		s.propagate(commandArgv(cmd, args))
+	case s.prop.replOnly:
+		s.propagateCommand(propagatedCommand{argv: commandArgv(cmd, args), replOnly: true})
+	}
+	return reply
+}
@@ -0,0 +1,384 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"redis-learning/pkg/resp"
+)
+
+// pubsubType describes a channel namespace. Classic and sharded Pub/Sub
+// share the subscription logic but keep separate channels, replies and
+// subscription counts.
+type pubsubType struct {
+	serverChannels    func(s *Server) map[string]map[*Client]struct{}
+	clientChannels    func(c *Client) map[string]struct{}
+	subscriptionCount func(c *Client) int
+	sharded           bool // channels are tracked by hash slot
+
+	subscribeMsg   string
+	unsubscribeMsg string
+	messageBulk    string
+}
+
+var pubsubClassic = &pubsubType{
+	serverChannels:    func(s *Server) map[string]map[*Client]struct{} { return s.pubsubChannels },
+	clientChannels:    func(c *Client) map[string]struct{} { return c.channels },
+	subscriptionCount: (*Client).subscriptionCount,
+	subscribeMsg:      "subscribe",
+	unsubscribeMsg:    "unsubscribe",
+	messageBulk:       "message",
+}
+
+var pubsubShard = &pubsubType{
+	serverChannels:    func(s *Server) map[string]map[*Client]struct{} { return s.pubsubShardChannels },
+	clientChannels:    func(c *Client) map[string]struct{} { return c.shardChannels },
+	subscriptionCount: (*Client).shardSubscriptionCount,
+	sharded:           true,
+	subscribeMsg:      "ssubscribe",
+	unsubscribeMsg:    "sunsubscribe",
+	messageBulk:       "smessage",
+}
+
+// subscriptionCount returns the number of channels and patterns the client
+// is subscribed to
+func (c *Client) subscriptionCount() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+// shardSubscriptionCount returns the number of shard channels the client is
+// subscribed to
+func (c *Client) shardSubscriptionCount() int {
+	return len(c.shardChannels)
+}
+
+// inSubscribedMode reports whether the client may only run Pub/Sub
+// commands. RESP3 clients receive messages as push frames, so they can keep
+// running any command.
+func (c *Client) inSubscribedMode() bool {
+	return c.proto == 2 && c.subscriptionCount()+c.shardSubscriptionCount() > 0
+}
+
+// pubsubAllowedCommand reports whether cmd may run in subscribed mode
+func pubsubAllowedCommand(cmd string) bool {
+	switch cmd {
+	case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "SUNSUBSCRIBE", "PING", "QUIT", "RESET":
+		return true
+	}
+	return false
+}
+
+// pubsubReply builds a subscribe/unsubscribe confirmation
+func pubsubReply(kind string, channel resp.Value, count int) resp.Value {
+	return resp.NewPush([]resp.Value{
+		resp.NewBulkString(kind),
+		channel,
+		resp.NewInteger(count),
+	})
+}
+
+// sortedKeys returns the keys of a map, such as a subscription set, in order
+func sortedKeys[V any](set map[string]V) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// pubsubSubscribeChannel subscribes the client to a channel, returning
+// false if it already was
+func (s *Server) pubsubSubscribeChannel(c *Client, channel string, t *pubsubType) bool {
+	clientChannels := t.clientChannels(c)
+	if _, ok := clientChannels[channel]; ok {
+		return false
+	}
+	clientChannels[channel] = struct{}{}
+
+	serverChannels := t.serverChannels(s)
+	subs, ok := serverChannels[channel]
+	if !ok {
+		subs = make(map[*Client]struct{})
+		serverChannels[channel] = subs
+		if t.sharded {
+			s.shardSlotAddChannel(channel)
+		}
+	}
+	subs[c] = struct{}{}
+	return true
+}
+
+// pubsubUnsubscribeChannel removes a channel subscription, optionally
+// confirming it to the client
+func (s *Server) pubsubUnsubscribeChannel(c *Client, channel string, notify bool, t *pubsubType) {
+	clientChannels := t.clientChannels(c)
+	if _, ok := clientChannels[channel]; ok {
+		delete(clientChannels, channel)
+		serverChannels := t.serverChannels(s)
+		if subs := serverChannels[channel]; subs != nil {
+			delete(subs, c)
+			if len(subs) == 0 {
+				delete(serverChannels, channel)
+				if t.sharded {
+					s.shardSlotRemoveChannel(channel)
+				}
+			}
+		}
+	}
+	if notify {
+		c.addReply(pubsubReply(t.unsubscribeMsg, resp.NewBulkString(channel), t.subscriptionCount(c)))
+	}
+}
+
+// pubsubUnsubscribeAllChannels removes every channel subscription. When
+// notifying a client that had none, a single reply with a nil channel is
+// sent.
+func (s *Server) pubsubUnsubscribeAllChannels(c *Client, notify bool, t *pubsubType) {
+	channels := sortedKeys(t.clientChannels(c))
+	for _, channel := range channels {
+		s.pubsubUnsubscribeChannel(c, channel, notify, t)
+	}
+	if notify && len(channels) == 0 {
+		c.addReply(pubsubReply(t.unsubscribeMsg, resp.NewNullBulkString(), t.subscriptionCount(c)))
+	}
+}
+
+// pubsubUnsubscribeAll drops every subscription of the client in all
+// namespaces without notifying it
+func (s *Server) pubsubUnsubscribeAll(c *Client) {
+	s.pubsubUnsubscribeAllChannels(c, false, pubsubClassic)
+	s.pubsubUnsubscribeAllChannels(c, false, pubsubShard)
+	s.pubsubUnsubscribeAllPatterns(c, false)
+}
+
+// pubsubSubscribePattern subscribes the client to a pattern, returning
+// false if it already was
+func (s *Server) pubsubSubscribePattern(c *Client, pattern string) bool {
+	if _, ok := c.patterns[pattern]; ok {
+		return false
+	}
+	c.patterns[pattern] = struct{}{}
+	subs, ok := s.pubsubPatterns[pattern]
+	if !ok {
+		subs = make(map[*Client]struct{})
+		s.pubsubPatterns[pattern] = subs
+	}
+	subs[c] = struct{}{}
+	return true
+}
+
+// pubsubUnsubscribePattern removes a pattern subscription, optionally
+// confirming it to the client
+func (s *Server) pubsubUnsubscribePattern(c *Client, pattern string, notify bool) {
+	if _, ok := c.patterns[pattern]; ok {
+		delete(c.patterns, pattern)
+		if subs := s.pubsubPatterns[pattern]; subs != nil {
+			delete(subs, c)
+			if len(subs) == 0 {
+				delete(s.pubsubPatterns, pattern)
+			}
+		}
+	}
+	if notify {
+		c.addReply(pubsubReply("punsubscribe", resp.NewBulkString(pattern), c.subscriptionCount()))
+	}
+}
+
+// pubsubUnsubscribeAllPatterns removes every pattern subscription
+func (s *Server) pubsubUnsubscribeAllPatterns(c *Client, notify bool) {
+	patterns := sortedKeys(c.patterns)
+	for _, pattern := range patterns {
+		s.pubsubUnsubscribePattern(c, pattern, notify)
+	}
+	if notify && len(patterns) == 0 {
+		c.addReply(pubsubReply("punsubscribe", resp.NewNullBulkString(), c.subscriptionCount()))
+	}
+}
+
+// pubsubDeliver queues a message for a subscriber, disconnecting it if it
+// has fallen too far behind
+func (s *Server) pubsubDeliver(c *Client, msg resp.Value) {
+	c.addReply(msg)
+	c.checkOutputBufferLimit(s.clientOutputBufferLimits[clientClassPubSub])
+}
+
+// pubsubPublishMessage delivers a message to the subscribers of channel
+// and, for classic Pub/Sub, of every matching pattern. It returns the
+// number of receivers.
+func (s *Server) pubsubPublishMessage(channel, message string, t *pubsubType) int {
+	receivers := 0
+
+	for sub := range t.serverChannels(s)[channel] {
+		s.pubsubDeliver(sub, resp.NewPush([]resp.Value{
+			resp.NewBulkString(t.messageBulk),
+			resp.NewBulkString(channel),
+			resp.NewBulkString(message),
+		}))
+		receivers++
+	}
+
+	// Patterns only apply to the classic namespace
+	if t.sharded {
+		return receivers
+	}
+
+	for pattern, subs := range s.pubsubPatterns {
+		if !stringMatch(pattern, channel, false) {
+			continue
+		}
+		for sub := range subs {
+			s.pubsubDeliver(sub, resp.NewPush([]resp.Value{
+				resp.NewBulkString("pmessage"),
+				resp.NewBulkString(pattern),
+				resp.NewBulkString(channel),
+				resp.NewBulkString(message),
+			}))
+			receivers++
+		}
+	}
+
+	return receivers
+}
+
+// handleSubscribe handles the SUBSCRIBE command
+func (s *Server) handleSubscribe(c *Client, args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.NewError("ERR wrong number of arguments for 'subscribe' command")
+	}
+	s.pubsubSubscribe(c, args, pubsubClassic)
+	return resp.Value{}
+}
+
+// handleUnsubscribe handles the UNSUBSCRIBE command
+func (s *Server) handleUnsubscribe(c *Client, args []resp.Value) resp.Value {
+	s.pubsubUnsubscribe(c, args, pubsubClassic)
+	return resp.Value{}
+}
+
+// pubsubSubscribe subscribes the client to every channel in args,
+// confirming each one
+func (s *Server) pubsubSubscribe(c *Client, args []resp.Value, t *pubsubType) {
+	for _, arg := range args {
+		s.pubsubSubscribeChannel(c, arg.Bulk, t)
+		c.addReply(pubsubReply(t.subscribeMsg, resp.NewBulkString(arg.Bulk), t.subscriptionCount(c)))
+	}
+}
+
+// pubsubUnsubscribe unsubscribes the client from the channels in args, or
+// from all of them if there are none
+func (s *Server) pubsubUnsubscribe(c *Client, args []resp.Value, t *pubsubType) {
+	if len(args) == 0 {
+		s.pubsubUnsubscribeAllChannels(c, true, t)
+		return
+	}
+	for _, arg := range args {
+		s.pubsubUnsubscribeChannel(c, arg.Bulk, true, t)
+	}
+}
+
+// handlePSubscribe handles the PSUBSCRIBE command
+func (s *Server) handlePSubscribe(c *Client, args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.NewError("ERR wrong number of arguments for 'psubscribe' command")
+	}
+	for _, arg := range args {
+		s.pubsubSubscribePattern(c, arg.Bulk)
+		c.addReply(pubsubReply("psubscribe", resp.NewBulkString(arg.Bulk), c.subscriptionCount()))
+	}
+	return resp.Value{}
+}
+
+// handlePUnsubscribe handles the PUNSUBSCRIBE command
+func (s *Server) handlePUnsubscribe(c *Client, args []resp.Value) resp.Value {
+	if len(args) == 0 {
+		s.pubsubUnsubscribeAllPatterns(c, true)
+		return resp.Value{}
+	}
+	for _, arg := range args {
+		s.pubsubUnsubscribePattern(c, arg.Bulk, true)
+	}
+	return resp.Value{}
+}
+
+// handlePublish handles the PUBLISH command
+func (s *Server) handlePublish(args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return resp.NewError("ERR wrong number of arguments for 'publish' command")
+	}
+	// Subscribers of replicas get the messages published on their master
+	s.forceReplication()
+	return resp.NewInteger(s.pubsubPublishMessage(args[0].Bulk, args[1].Bulk, pubsubClassic))
+}
+
+// handlePubSub handles the PUBSUB introspection command
+func (s *Server) handlePubSub(args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.NewError("ERR wrong number of arguments for 'pubsub' command")
+	}
+
+	sub := strings.ToUpper(args[0].Bulk)
+	switch {
+	case sub == "CHANNELS" && len(args) <= 2:
+		return pubsubChannelList(s.pubsubChannels, args[1:])
+
+	case sub == "NUMSUB":
+		return pubsubNumSub(s.pubsubChannels, args[1:])
+
+	case sub == "NUMPAT" && len(args) == 1:
+		return resp.NewInteger(len(s.pubsubPatterns))
+
+	case sub == "SHARDCHANNELS" && len(args) <= 2:
+		return pubsubChannelList(s.pubsubShardChannels, args[1:])
+
+	case sub == "SHARDNUMSUB":
+		return pubsubNumSub(s.pubsubShardChannels, args[1:])
+
+	case sub == "CHANNELS" || sub == "NUMPAT" || sub == "SHARDCHANNELS":
+		return resp.NewError(fmt.Sprintf("ERR wrong number of arguments for 'pubsub|%s' command", strings.ToLower(sub)))
+
+	default:
+		return resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try PUBSUB HELP.", args[0].Bulk))
+	}
+}
+
+// pubsubChannelList lists the active channels of a namespace, optionally
+// filtered by a glob pattern
+func pubsubChannelList(channels map[string]map[*Client]struct{}, args []resp.Value) resp.Value {
+	names := make([]string, 0, len(channels))
+	for channel := range channels {
+		if len(args) == 0 || stringMatch(args[0].Bulk, channel, false) {
+			names = append(names, channel)
+		}
+	}
+	sort.Strings(names)
+
+	values := make([]resp.Value, len(names))
+	for i, name := range names {
+		values[i] = resp.NewBulkString(name)
+	}
+	return resp.NewArray(values)
+}
+
+// pubsubNumSub replies with channel and subscriber count pairs
+func pubsubNumSub(channels map[string]map[*Client]struct{}, args []resp.Value) resp.Value {
+	values := make([]resp.Value, 0, 2*len(args))
+	for _, arg := range args {
+		values = append(values, resp.NewBulkString(arg.Bulk), resp.NewInteger(len(channels[arg.Bulk])))
+	}
+	return resp.NewArray(values)
+}
+
+// pubsubPing answers PING in RESP2 subscribed mode, where replies must
+// look like messages
+func pubsubPing(args []resp.Value) resp.Value {
+	if len(args) > 1 {
+		return resp.NewError("ERR wrong number of arguments for 'ping' command")
+	}
+	msg := ""
+	if len(args) == 1 {
+		msg = args[0].Bulk
+	}
+	return resp.NewArray([]resp.Value{resp.NewBulkString("pong"), resp.NewBulkString(msg)})
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"redis-learning/pkg/resp"
+)
+
+// shardSlotAddChannel records a newly active shard channel under its slot
+func (s *Server) shardSlotAddChannel(channel string) {
+	slot := keyHashSlot(channel)
+	channels, ok := s.shardSlotChannels[slot]
+	if !ok {
+		channels = make(map[string]struct{})
+		s.shardSlotChannels[slot] = channels
+	}
+	channels[channel] = struct{}{}
+}
+
+// shardSlotRemoveChannel forgets a shard channel with no subscribers left
+func (s *Server) shardSlotRemoveChannel(channel string) {
+	slot := keyHashSlot(channel)
+	if channels, ok := s.shardSlotChannels[slot]; ok {
+		delete(channels, channel)
+		if len(channels) == 0 {
+			delete(s.shardSlotChannels, slot)
+		}
+	}
+}
+
+// pubsubShardUnsubscribeSlot unsubscribes every client from the shard
+// channels of a slot, as happens when the slot moves to another node. Each
+// subscriber is told with a sunsubscribe message.
+func (s *Server) pubsubShardUnsubscribeSlot(slot int) {
+	for _, channel := range sortedKeys(s.shardSlotChannels[slot]) {
+		for sub := range s.pubsubShardChannels[channel] {
+			s.pubsubUnsubscribeChannel(sub, channel, true, pubsubShard)
+		}
+	}
+}
+
+// handleSSubscribe handles the SSUBSCRIBE command. Without cluster mode
+// every slot is served here, so channels of different slots can be
+// combined, as in Redis.
+func (s *Server) handleSSubscribe(c *Client, args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.NewError("ERR wrong number of arguments for 'ssubscribe' command")
+	}
+	s.pubsubSubscribe(c, args, pubsubShard)
+	return resp.Value{}
+}
+
+// handleSUnsubscribe handles the SUNSUBSCRIBE command
+func (s *Server) handleSUnsubscribe(c *Client, args []resp.Value) resp.Value {
+	s.pubsubUnsubscribe(c, args, pubsubShard)
+	return resp.Value{}
+}
+
+// handleSPublish handles the SPUBLISH command
+func (s *Server) handleSPublish(args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return resp.NewError("ERR wrong number of arguments for 'spublish' command")
+	}
+	s.forceReplication()
+	return resp.NewInteger(s.pubsubPublishMessage(args[0].Bulk, args[1].Bulk, pubsubShard))
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// rdbVersion is the version of the RDB serialization format we write
+const rdbVersion = 11
+
+// RDB opcodes, which precede keys and other records in RDB files
+const (
+	rdbOpcodeFunction2     = 245 // function library code
+	rdbOpcodeFunctionPreGA = 246
+	rdbOpcodeModuleAux     = 247
+	rdbOpcodeIdle          = 248
+	rdbOpcodeFreq          = 249
+	rdbOpcodeAux           = 250
+	rdbOpcodeResizeDB      = 251
+	rdbOpcodeExpireTimeMs  = 252
+	rdbOpcodeExpireTime    = 253
+	rdbOpcodeSelectDB      = 254
+	rdbOpcodeEOF           = 255
+)
+
+// RDB length encodings, selected by the two most significant bits of the
+// first byte
+const (
+	rdb6BitLen  = 0
+	rdb14BitLen = 1
+	rdb32BitLen = 0x80
+	rdb64BitLen = 0x81
+	rdbEncVal   = 3 // the other 6 bits select a special string encoding
+)
+
+// Special string encodings
+const (
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+var errRDBShort = errors.New("unexpected end of RDB data")
+
+// rdbAppendLen appends n in the RDB length encoding
+func rdbAppendLen(buf []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(buf, byte(n))
+	case n < 1<<14:
+		return append(buf, byte(rdb14BitLen<<6|n>>8), byte(n))
+	case n <= 1<<32-1:
+		buf = append(buf, rdb32BitLen)
+		return binary.BigEndian.AppendUint32(buf, uint32(n))
+	default:
+		buf = append(buf, rdb64BitLen)
+		return binary.BigEndian.AppendUint64(buf, n)
+	}
+}
+
+// rdbAppendString appends a length prefixed string
+func rdbAppendString(buf []byte, s string) []byte {
+	buf = rdbAppendLen(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// rdbReader decodes RDB encoded data held in memory
+type rdbReader struct {
+	buf []byte
+	pos int
+}
+
+// readByte reads a single byte
+func (r *rdbReader) readByte() (byte, error) {
+	if r.pos >= len(r.buf) {
+		return 0, errRDBShort
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b, nil
+}
+
+// readBytes reads the next n bytes
+func (r *rdbReader) readBytes(n int) ([]byte, error) {
+	if n < 0 || n > len(r.buf)-r.pos {
+		return nil, errRDBShort
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// readLen reads a length. encoded is set when the length is actually a
+// special string encoding.
+func (r *rdbReader) readLen() (n uint64, encoded bool, err error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case rdb6BitLen:
+		return uint64(b & 0x3f), false, nil
+	case rdb14BitLen:
+		next, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3f)<<8 | uint64(next), false, nil
+	case rdbEncVal:
+		return uint64(b & 0x3f), true, nil
+	}
+	switch b {
+	case rdb32BitLen:
+		p, err := r.readBytes(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(p)), false, nil
+	case rdb64BitLen:
+		p, err := r.readBytes(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(p), false, nil
+	}
+	return 0, false, errors.New("unknown RDB length encoding")
+}
+
+// readString reads a string in any of the encodings Redis writes
+func (r *rdbReader) readString() (string, error) {
+	n, encoded, err := r.readLen()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		if n > uint64(len(r.buf)-r.pos) {
+			return "", errRDBShort
+		}
+		p, _ := r.readBytes(int(n))
+		return string(p), nil
+	}
+
+	switch n {
+	case rdbEncInt8:
+		p, err := r.readBytes(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(p[0]))), nil
+	case rdbEncInt16:
+		p, err := r.readBytes(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(p)))), nil
+	case rdbEncInt32:
+		p, err := r.readBytes(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(p)))), nil
+	case rdbEncLZF:
+		clen, _, err := r.readLen()
+		if err != nil {
+			return "", err
+		}
+		ulen, _, err := r.readLen()
+		if err != nil {
+			return "", err
+		}
+		if clen > uint64(len(r.buf)-r.pos) {
+			return "", errRDBShort
+		}
+		if ulen > maxStringLen {
+			return "", errors.New("RDB string too long")
+		}
+		p, _ := r.readBytes(int(clen))
+		out, err := lzfDecompress(p, int(ulen))
+		if err != nil {
+			return "", err
+		}
+		return string(out), nil
+	default:
+		return "", errors.New("unknown RDB string encoding")
+	}
+}
+
+// createDumpPayload appends the footer DUMP payloads end with: the RDB
+// version and a CRC64 of everything before it, both little endian
+func createDumpPayload(body []byte) []byte {
+	body = binary.LittleEndian.AppendUint16(body, rdbVersion)
+	return binary.LittleEndian.AppendUint64(body, crc64(0, body))
+}
+
+// verifyDumpPayload checks the footer of a DUMP payload, returning the
+// serialized data in front of it
+func verifyDumpPayload(payload []byte) ([]byte, bool) {
+	if len(payload) < 10 {
+		return nil, false
+	}
+	footer := payload[len(payload)-10:]
+	if binary.LittleEndian.Uint16(footer) > rdbVersion {
+		return nil, false
+	}
+	if binary.LittleEndian.Uint64(footer[2:]) != crc64(0, payload[:len(payload)-8]) {
+		return nil, false
+	}
+	return payload[:len(payload)-10], true
+}
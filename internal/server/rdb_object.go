@@ -0,0 +1,803 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-learning/pkg/module"
+)
+
+// RDB value types. We write the simplest encoding of each type that Redis
+// itself still loads, and read the compact encodings too.
+const (
+	rdbTypeString           = 0
+	rdbTypeList             = 1
+	rdbTypeSet              = 2
+	rdbTypeZSet             = 3
+	rdbTypeHash             = 4
+	rdbTypeZSet2            = 5
+	rdbTypeModule2          = 7
+	rdbTypeSetIntset        = 11
+	rdbTypeHashListpack     = 16
+	rdbTypeZSetListpack     = 17
+	rdbTypeListQuicklist2   = 18
+	rdbTypeStreamListpacks  = 15
+	rdbTypeStreamListpacks2 = 19
+	rdbTypeSetListpack      = 20
+	rdbTypeStreamListpacks3 = 21
+)
+
+// Module values are written as a sequence of typed fields, ours being a
+// single string
+const (
+	rdbModuleOpcodeEOF    = 0
+	rdbModuleOpcodeString = 5
+)
+
+// Quicklist node containers
+const (
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+// Stream listpack entry flags
+const (
+	streamItemFlagDeleted    = 1
+	streamItemFlagSameFields = 2
+)
+
+// moduleTypeID packs a module type name and encoding version into the
+// 64-bit ID RDB files identify module types by
+func moduleTypeID(t *module.Type) uint64 {
+	var id uint64
+	for i := 0; i < len(t.Name); i++ {
+		id = id<<6 | uint64(strings.IndexByte(module.TypeNameCharset, t.Name[i]))
+	}
+	return id<<10 | uint64(t.EncodingVersion)
+}
+
+// moduleTypeByID finds the registered type an RDB module ID refers to,
+// returning the encoding version the value was written with
+func moduleTypeByID(id uint64) (*module.Type, int, bool) {
+	for _, t := range module.Types() {
+		if moduleTypeID(t)>>10 == id>>10 {
+			return t, int(id & 1023), true
+		}
+	}
+	return nil, 0, false
+}
+
+// moduleTypeNameFromID unpacks the type name of an RDB module ID, for
+// error messages
+func moduleTypeNameFromID(id uint64) string {
+	name := make([]byte, 9)
+	id >>= 10
+	for i := 8; i >= 0; i-- {
+		name[i] = module.TypeNameCharset[id&63]
+		id >>= 6
+	}
+	return string(name)
+}
+
+// rdbAppendStreamID appends the 128-bit big endian form of id used for
+// stream node keys and pending entries
+func rdbAppendStreamID(buf []byte, id StreamID) []byte {
+	buf = binary.BigEndian.AppendUint64(buf, id.Ms)
+	return binary.BigEndian.AppendUint64(buf, id.Seq)
+}
+
+// rdbAppendMillis appends a timestamp as 8 little endian bytes of
+// milliseconds
+func rdbAppendMillis(buf []byte, t time.Time) []byte {
+	return binary.LittleEndian.AppendUint64(buf, uint64(t.UnixMilli()))
+}
+
+// rdbObjectType returns the RDB type val is written as
+func rdbObjectType(val *RedisValue) byte {
+	switch val.Type {
+	case "string":
+		return rdbTypeString
+	case "list":
+		return rdbTypeList
+	case "set":
+		return rdbTypeSet
+	case "zset":
+		return rdbTypeZSet2
+	case "hash":
+		return rdbTypeHash
+	case "stream":
+		return rdbTypeStreamListpacks3
+	default:
+		return rdbTypeModule2
+	}
+}
+
+// rdbAppendObject appends the serialized form of val, without its type
+func rdbAppendObject(buf []byte, val *RedisValue) []byte {
+	switch val.Type {
+	case "string":
+		return rdbAppendString(buf, val.String)
+
+	case "list":
+		buf = rdbAppendLen(buf, uint64(len(val.List)))
+		for _, elem := range val.List {
+			buf = rdbAppendString(buf, elem)
+		}
+		return buf
+
+	case "set":
+		buf = rdbAppendLen(buf, uint64(len(val.Set)))
+		for _, member := range sortedKeys(val.Set) {
+			buf = rdbAppendString(buf, member)
+		}
+		return buf
+
+	case "zset":
+		members := make([]string, 0, len(val.ZSet))
+		for member := range val.ZSet {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		buf = rdbAppendLen(buf, uint64(len(members)))
+		for _, member := range members {
+			buf = rdbAppendString(buf, member)
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(val.ZSet[member]))
+		}
+		return buf
+
+	case "hash":
+		buf = rdbAppendLen(buf, uint64(len(val.Hash)))
+		for _, field := range sortedKeys(val.Hash) {
+			buf = rdbAppendString(buf, field)
+			buf = rdbAppendString(buf, val.Hash[field])
+		}
+		return buf
+
+	case "stream":
+		return rdbAppendStream(buf, val.Stream)
+
+	default:
+		buf = rdbAppendLen(buf, moduleTypeID(val.ModType))
+		buf = rdbAppendLen(buf, rdbModuleOpcodeString)
+		buf = rdbAppendString(buf, string(val.ModType.Save(val.Module)))
+		return rdbAppendLen(buf, rdbModuleOpcodeEOF)
+	}
+}
+
+// rdbAppendStream writes a stream as RDB_TYPE_STREAM_LISTPACKS_3: one
+// listpack per node, the stream metadata, then its consumer groups
+func rdbAppendStream(buf []byte, st *Stream) []byte {
+	buf = rdbAppendLen(buf, uint64(len(st.nodes)))
+	for _, node := range st.nodes {
+		master := node.entries[0]
+		buf = rdbAppendString(buf, string(rdbAppendStreamID(nil, master.ID)))
+		buf = rdbAppendString(buf, string(streamNodeListpack(node, master)))
+	}
+
+	buf = rdbAppendLen(buf, uint64(st.length))
+	buf = rdbAppendLen(buf, st.LastID.Ms)
+	buf = rdbAppendLen(buf, st.LastID.Seq)
+	first, _ := st.FirstEntry()
+	buf = rdbAppendLen(buf, first.ID.Ms)
+	buf = rdbAppendLen(buf, first.ID.Seq)
+	buf = rdbAppendLen(buf, st.MaxDeletedID.Ms)
+	buf = rdbAppendLen(buf, st.MaxDeletedID.Seq)
+	buf = rdbAppendLen(buf, st.EntriesAdded)
+
+	buf = rdbAppendLen(buf, uint64(len(st.Groups)))
+	for _, name := range st.GroupNames() {
+		group := st.Groups[name]
+		buf = rdbAppendString(buf, name)
+		buf = rdbAppendLen(buf, group.LastID.Ms)
+		buf = rdbAppendLen(buf, group.LastID.Seq)
+		buf = rdbAppendLen(buf, uint64(group.EntriesRead))
+
+		pending := sortedPending(group.Pending)
+		buf = rdbAppendLen(buf, uint64(len(pending)))
+		for _, pe := range pending {
+			buf = rdbAppendStreamID(buf, pe.ID)
+			buf = rdbAppendMillis(buf, pe.DeliveryTime)
+			buf = rdbAppendLen(buf, uint64(pe.DeliveryCount))
+		}
+
+		buf = rdbAppendLen(buf, uint64(len(group.Consumers)))
+		for _, cname := range sortedKeys(group.Consumers) {
+			consumer := group.Consumers[cname]
+			buf = rdbAppendString(buf, cname)
+			buf = rdbAppendMillis(buf, consumer.SeenTime)
+			buf = rdbAppendMillis(buf, consumer.ActiveTime)
+			cpending := sortedPending(consumer.Pending)
+			buf = rdbAppendLen(buf, uint64(len(cpending)))
+			for _, pe := range cpending {
+				buf = rdbAppendStreamID(buf, pe.ID)
+			}
+		}
+	}
+	return buf
+}
+
+// streamNodeListpack encodes a stream node the way Redis lays out stream
+// listpacks: a master entry holding the field names of master, then every
+// entry with its ID relative to master's, omitting the field names when
+// they match the master ones
+func streamNodeListpack(node *streamNode, master StreamEntry) []byte {
+	lp := newListpackBuilder()
+	numFields := len(master.Fields) / 2
+	lp.AppendInt(int64(len(node.entries)))
+	lp.AppendInt(0) // deleted entries
+	lp.AppendInt(int64(numFields))
+	for i := 0; i < len(master.Fields); i += 2 {
+		lp.AppendString(master.Fields[i])
+	}
+	lp.AppendInt(0) // master entry terminator
+
+	for _, entry := range node.entries {
+		flags := 0
+		if sameStreamFields(entry.Fields, master.Fields) {
+			flags = streamItemFlagSameFields
+		}
+		lp.AppendInt(int64(flags))
+		lp.AppendInt(int64(entry.ID.Ms - master.ID.Ms))
+		lp.AppendInt(int64(entry.ID.Seq - master.ID.Seq))
+
+		n := len(entry.Fields) / 2
+		if flags&streamItemFlagSameFields != 0 {
+			for i := 1; i < len(entry.Fields); i += 2 {
+				lp.AppendString(entry.Fields[i])
+			}
+			lp.AppendInt(int64(n + 3))
+		} else {
+			lp.AppendInt(int64(n))
+			for _, field := range entry.Fields {
+				lp.AppendString(field)
+			}
+			lp.AppendInt(int64(2*n + 4))
+		}
+	}
+	return lp.Bytes()
+}
+
+// sameStreamFields reports whether two entries have the same field names
+func sameStreamFields(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i += 2 {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+var errRDBBadObject = errors.New("invalid RDB object")
+
+// rdbLoadObject reads a value of the given RDB type
+func rdbLoadObject(r *rdbReader, rdbType byte) (*RedisValue, error) {
+	switch rdbType {
+	case rdbTypeString:
+		s, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		return NewStringValue(s), nil
+
+	case rdbTypeList, rdbTypeSet:
+		n, _, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		elems, err := r.readStrings(n)
+		if err != nil {
+			return nil, err
+		}
+		if rdbType == rdbTypeList {
+			val := NewListValue()
+			val.List = elems
+			return val, nil
+		}
+		return newSetFromMembers(elems), nil
+
+	case rdbTypeZSet, rdbTypeZSet2:
+		n, _, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		val := NewZSetValue()
+		for i := uint64(0); i < n; i++ {
+			member, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if rdbType == rdbTypeZSet2 {
+				p, err := r.readBytes(8)
+				if err != nil {
+					return nil, err
+				}
+				score = math.Float64frombits(binary.LittleEndian.Uint64(p))
+			} else if score, err = r.readStringDouble(); err != nil {
+				return nil, err
+			}
+			val.ZSet[member] = score
+		}
+		return val, nil
+
+	case rdbTypeHash:
+		n, _, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		elems, err := r.readStrings(2 * n)
+		if err != nil {
+			return nil, err
+		}
+		return newHashFromPairs(elems), nil
+
+	case rdbTypeSetIntset:
+		s, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		members, err := intsetMembers([]byte(s))
+		if err != nil {
+			return nil, err
+		}
+		return newSetFromMembers(members), nil
+
+	case rdbTypeSetListpack, rdbTypeHashListpack, rdbTypeZSetListpack:
+		s, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		elems, err := listpackEntries([]byte(s))
+		if err != nil {
+			return nil, err
+		}
+		switch rdbType {
+		case rdbTypeSetListpack:
+			return newSetFromMembers(elems), nil
+		case rdbTypeHashListpack:
+			if len(elems)%2 != 0 {
+				return nil, errRDBBadObject
+			}
+			return newHashFromPairs(elems), nil
+		}
+		if len(elems)%2 != 0 {
+			return nil, errRDBBadObject
+		}
+		val := NewZSetValue()
+		for i := 0; i < len(elems); i += 2 {
+			score, err := strconv.ParseFloat(elems[i+1], 64)
+			if err != nil {
+				return nil, errRDBBadObject
+			}
+			val.ZSet[elems[i]] = score
+		}
+		return val, nil
+
+	case rdbTypeListQuicklist2:
+		n, _, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		val := NewListValue()
+		for i := uint64(0); i < n; i++ {
+			container, _, err := r.readLen()
+			if err != nil {
+				return nil, err
+			}
+			s, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			switch container {
+			case quicklistNodePlain:
+				val.List = append(val.List, s)
+			case quicklistNodePacked:
+				elems, err := listpackEntries([]byte(s))
+				if err != nil {
+					return nil, err
+				}
+				val.List = append(val.List, elems...)
+			default:
+				return nil, errRDBBadObject
+			}
+		}
+		return val, nil
+
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		st, err := rdbLoadStream(r, rdbType)
+		if err != nil {
+			return nil, err
+		}
+		return &RedisValue{Type: "stream", Stream: st}, nil
+
+	case rdbTypeModule2:
+		id, _, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		t, encver, ok := moduleTypeByID(id)
+		if !ok {
+			return nil, fmt.Errorf("the RDB file contains module data for the module type '%s', that the responsible module is not able to load", moduleTypeNameFromID(id))
+		}
+		if opcode, _, err := r.readLen(); err != nil || opcode != rdbModuleOpcodeString {
+			return nil, errRDBBadObject
+		}
+		data, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		if opcode, _, err := r.readLen(); err != nil || opcode != rdbModuleOpcodeEOF {
+			return nil, errRDBBadObject
+		}
+		value, err := t.Load([]byte(data), encver)
+		if err != nil {
+			return nil, fmt.Errorf("module type %s failed to load a value: %v", t.Name, err)
+		}
+		return NewModuleValue(t, value), nil
+
+	default:
+		return nil, fmt.Errorf("unknown or unsupported RDB object type %d", rdbType)
+	}
+}
+
+// readStrings reads n strings
+func (r *rdbReader) readStrings(n uint64) ([]string, error) {
+	if n > uint64(len(r.buf)-r.pos) {
+		// Every string takes at least a byte
+		return nil, errRDBShort
+	}
+	elems := make([]string, n)
+	for i := range elems {
+		s, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		elems[i] = s
+	}
+	return elems, nil
+}
+
+// readStringDouble reads a score of the old zset encoding: a length byte
+// followed by the number as text, with special lengths for NaN and
+// infinities
+func (r *rdbReader) readStringDouble() (float64, error) {
+	n, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	p, err := r.readBytes(int(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(p), 64)
+}
+
+// readStreamID reads a 128-bit big endian stream ID
+func (r *rdbReader) readStreamID() (StreamID, error) {
+	p, err := r.readBytes(16)
+	if err != nil {
+		return StreamID{}, err
+	}
+	return StreamID{binary.BigEndian.Uint64(p), binary.BigEndian.Uint64(p[8:])}, nil
+}
+
+// readMillis reads an 8 byte little endian millisecond timestamp
+func (r *rdbReader) readMillis() (time.Time, error) {
+	p, err := r.readBytes(8)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(int64(binary.LittleEndian.Uint64(p))), nil
+}
+
+// readLenID reads a stream ID written as two lengths
+func (r *rdbReader) readLenID() (StreamID, error) {
+	ms, _, err := r.readLen()
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, _, err := r.readLen()
+	if err != nil {
+		return StreamID{}, err
+	}
+	return StreamID{ms, seq}, nil
+}
+
+func newSetFromMembers(members []string) *RedisValue {
+	val := NewSetValue()
+	for _, member := range members {
+		val.Set[member] = true
+	}
+	return val
+}
+
+func newHashFromPairs(pairs []string) *RedisValue {
+	val := NewHashValue()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		val.Hash[pairs[i]] = pairs[i+1]
+	}
+	return val
+}
+
+// intsetMembers decodes an intset: a 4 byte integer width, a 4 byte count
+// and the sorted integers, all little endian
+func intsetMembers(b []byte) ([]string, error) {
+	if len(b) < 8 {
+		return nil, errRDBBadObject
+	}
+	width := int(binary.LittleEndian.Uint32(b))
+	count := int(binary.LittleEndian.Uint32(b[4:]))
+	if width != 2 && width != 4 && width != 8 || len(b) != 8+width*count {
+		return nil, errRDBBadObject
+	}
+	members := make([]string, count)
+	for i := range members {
+		p := b[8+i*width:]
+		var v int64
+		switch width {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(p)))
+		default:
+			v = int64(binary.LittleEndian.Uint64(p))
+		}
+		members[i] = strconv.FormatInt(v, 10)
+	}
+	return members, nil
+}
+
+// rdbLoadStream reads any of the stream encodings; older ones lack some of
+// the metadata
+func rdbLoadStream(r *rdbReader, rdbType byte) (*Stream, error) {
+	st := NewStream()
+	nodes, _, err := r.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < nodes; i++ {
+		key, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 16 {
+			return nil, errRDBBadObject
+		}
+		master := StreamID{binary.BigEndian.Uint64([]byte(key)), binary.BigEndian.Uint64([]byte(key[8:]))}
+		lp, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		entries, err := listpackEntries([]byte(lp))
+		if err != nil {
+			return nil, err
+		}
+		if err := streamLoadNode(st, master, entries); err != nil {
+			return nil, err
+		}
+	}
+
+	length, _, err := r.readLen()
+	if err != nil {
+		return nil, err
+	}
+	if length != uint64(st.length) {
+		return nil, errRDBBadObject
+	}
+	if st.LastID, err = r.readLenID(); err != nil {
+		return nil, err
+	}
+	st.EntriesAdded = uint64(st.length)
+	if rdbType != rdbTypeStreamListpacks {
+		if _, err := r.readLenID(); err != nil { // first ID, implied by the entries
+			return nil, err
+		}
+		if st.MaxDeletedID, err = r.readLenID(); err != nil {
+			return nil, err
+		}
+		if st.EntriesAdded, _, err = r.readLen(); err != nil {
+			return nil, err
+		}
+	}
+
+	groups, _, err := r.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < groups; i++ {
+		name, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		lastID, err := r.readLenID()
+		if err != nil {
+			return nil, err
+		}
+		entriesRead := int64(-1)
+		if rdbType != rdbTypeStreamListpacks {
+			n, _, err := r.readLen()
+			if err != nil {
+				return nil, err
+			}
+			entriesRead = int64(n)
+		} else {
+			entriesRead = st.EstimateEntriesRead(lastID)
+		}
+		group, ok := st.CreateGroup(name, lastID, entriesRead)
+		if !ok {
+			return nil, errRDBBadObject
+		}
+
+		pending, _, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < pending; j++ {
+			id, err := r.readStreamID()
+			if err != nil {
+				return nil, err
+			}
+			deliveryTime, err := r.readMillis()
+			if err != nil {
+				return nil, err
+			}
+			count, _, err := r.readLen()
+			if err != nil {
+				return nil, err
+			}
+			group.Pending[id] = &StreamPendingEntry{ID: id, DeliveryTime: deliveryTime, DeliveryCount: int64(count)}
+		}
+
+		consumers, _, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < consumers; j++ {
+			cname, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			consumer, created := group.Consumer(cname, true)
+			if !created {
+				return nil, errRDBBadObject
+			}
+			if consumer.SeenTime, err = r.readMillis(); err != nil {
+				return nil, err
+			}
+			consumer.ActiveTime = consumer.SeenTime
+			if rdbType == rdbTypeStreamListpacks3 {
+				if consumer.ActiveTime, err = r.readMillis(); err != nil {
+					return nil, err
+				}
+			}
+			n, _, err := r.readLen()
+			if err != nil {
+				return nil, err
+			}
+			for k := uint64(0); k < n; k++ {
+				id, err := r.readStreamID()
+				if err != nil {
+					return nil, err
+				}
+				pe, ok := group.Pending[id]
+				if !ok || pe.Consumer != nil {
+					return nil, errRDBBadObject
+				}
+				pe.Consumer = consumer
+				consumer.Pending[id] = pe
+			}
+		}
+		for _, pe := range group.Pending {
+			if pe.Consumer == nil {
+				return nil, errRDBBadObject
+			}
+		}
+	}
+	return st, nil
+}
+
+// streamLoadNode appends the live entries of a stream listpack
+func streamLoadNode(st *Stream, master StreamID, lp []string) error {
+	p := 0
+	next := func() (int64, error) {
+		if p >= len(lp) {
+			return 0, errRDBBadObject
+		}
+		v, err := strconv.ParseInt(lp[p], 10, 64)
+		p++
+		if err != nil {
+			return 0, errRDBBadObject
+		}
+		return v, nil
+	}
+
+	count, err := next()
+	if err != nil {
+		return err
+	}
+	deleted, err := next()
+	if err != nil {
+		return err
+	}
+	numFields, err := next()
+	if err != nil {
+		return err
+	}
+	if numFields < 0 || int(numFields) > len(lp)-p {
+		return errRDBBadObject
+	}
+	masterFields := lp[p : p+int(numFields)]
+	p += int(numFields)
+	if terminator, err := next(); err != nil || terminator != 0 {
+		return errRDBBadObject
+	}
+
+	for i := int64(0); i < count+deleted; i++ {
+		flags, err := next()
+		if err != nil {
+			return err
+		}
+		msDiff, err := next()
+		if err != nil {
+			return err
+		}
+		seqDiff, err := next()
+		if err != nil {
+			return err
+		}
+		id := StreamID{master.Ms + uint64(msDiff), master.Seq + uint64(seqDiff)}
+
+		var fields []string
+		if flags&streamItemFlagSameFields != 0 {
+			if len(masterFields) > len(lp)-p {
+				return errRDBBadObject
+			}
+			for _, field := range masterFields {
+				fields = append(fields, field, lp[p])
+				p++
+			}
+		} else {
+			n, err := next()
+			if err != nil {
+				return err
+			}
+			if n < 0 || 2*int(n) > len(lp)-p {
+				return errRDBBadObject
+			}
+			fields = append(fields, lp[p:p+2*int(n)]...)
+			p += 2 * int(n)
+		}
+		if _, err := next(); err != nil { // lp-count
+			return err
+		}
+
+		if flags&streamItemFlagDeleted != 0 {
+			continue
+		}
+		if st.length > 0 && !st.LastID.Less(id) {
+			return errRDBBadObject
+		}
+		st.Append(id, fields)
+	}
+	if p != len(lp) {
+		return errRDBBadObject
+	}
+	return nil
+}
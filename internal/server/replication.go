@@ -0,0 +1,1391 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"redis-learning/pkg/resp"
+)
+
+const (
+	defaultReplBacklogSize = 1024 * 1024
+	defaultReplTimeout     = 60 * time.Second
+	defaultReplPingPeriod  = 10 * time.Second
+
+	defaultReplDisklessSyncDelay = 5 * time.Second
+	defaultMinReplicasMaxLag     = 10
+	defaultReplicaPriority       = 100
+
+	// A replica that lost its master tries to reconnect this often
+	replConnectRetryDelay = time.Second
+
+	// Snapshots streamed by diskless masters end with a random mark of
+	// this size, announced before them
+	replEOFMarkSize = 40
+)
+
+// How replicas load the snapshot of a full sync
+const (
+	replDisklessLoadDisabled  = iota // saved as the RDB file, then loaded
+	replDisklessLoadOnEmptyDB        // loaded from memory if the dataset is empty
+	replDisklessLoadSwapdb           // loaded from memory, keeping the old dataset until done
+)
+
+var replDisklessLoadNames = []string{"disabled", "on-empty-db", "swapdb"}
+
+// parseReplDisklessLoad parses a repl-diskless-load mode name
+func parseReplDisklessLoad(value string) (int, error) {
+	for mode, name := range replDisklessLoadNames {
+		if strings.EqualFold(value, name) {
+			return mode, nil
+		}
+	}
+	return 0, errors.New("argument(s) must be one of the following: disabled, on-empty-db, swapdb")
+}
+
+// replicationState holds both sides of replication: the replicas a master
+// streams its writes to, and the link of a replica to its master.
+//
+// The replication stream is the sequence of write commands a master
+// propagates. Its history is identified by replid, and offset counts the
+// bytes of it the dataset reflects. After a replica is promoted, the
+// history it followed remains valid as replid2 up to secondOffset, so that
+// the other replicas can still resync partially.
+type replicationState struct {
+	replid       string
+	replid2      string
+	offset       int64
+	secondOffset int64
+
+	// backlog keeps the end of the stream for partial resyncs. It is
+	// created once the first replica connects.
+	backlog     *replBacklog
+	backlogSize int64
+
+	replicas   []*Client
+	pingPeriod time.Duration
+	timeout    time.Duration
+	lastPing   time.Time
+	lastCron   time.Time
+
+	// Full syncs may stream the snapshot to the replicas instead of writing
+	// it to disk first. They start disklessSyncDelay after a replica asked,
+	// so that others can share the same snapshot, or as soon as
+	// disklessSyncMaxReplicas wait.
+	disklessSync            bool
+	disklessSyncDelay       time.Duration
+	disklessSyncMaxReplicas int
+	disklessLoad            int
+
+	// Writes are refused unless minReplicasToWrite replicas acknowledged
+	// the stream within the last minReplicasMaxLag seconds. Zero for
+	// either turns the check off.
+	minReplicasToWrite int
+	minReplicasMaxLag  int
+
+	// Clients blocked in WAIT or WAITAOF. getAck asks the replicas for an
+	// acknowledgement once the running command is done.
+	waiting []*Client
+	getAck  bool
+
+	// Set on replicas: the master, and the link to it while connected
+	masterHost     string
+	masterPort     string
+	readOnly       bool
+	priority       int // the lower, the better candidate for promotion
+	link           *masterLink
+	linkState      int
+	lastConnectTry time.Time
+	linkDownSince  time.Time
+	lastAck        time.Time
+	lastFsyncAck   int64 // the AOF offset sent with the last ACK
+}
+
+// Replica link states
+const (
+	replLinkNone       = iota // not a replica
+	replLinkConnect           // must connect to its master
+	replLinkConnecting        // handshake in progress
+	replLinkTransfer          // receiving the snapshot of a full sync
+	replLinkConnected         // receiving the stream
+)
+
+var replLinkStateNames = []string{"none", "connect", "connecting", "sync", "connected"}
+
+// masterLink is the connection of a replica to its master
+type masterLink struct {
+	conn   net.Conn
+	client *Client // runs the commands of the stream
+	lastIO time.Time
+
+	// Progress of the snapshot transfer
+	syncStart time.Time
+	syncTotal int64
+	syncRead  atomic.Int64
+}
+
+// Replica states, as seen by its master
+const (
+	replicaWaitBgsaveStart = iota // full sync pending until a BGSAVE can start
+	replicaWaitBgsaveEnd          // waiting for the snapshot to be written
+	replicaOnline                 // receiving the stream
+)
+
+// replicaState is kept by a master for each replica connection
+type replicaState struct {
+	state         int
+	listeningPort int
+	ip            string // as announced, if it was
+	capaEOF       bool
+	capaPsync2    bool
+
+	// The stream written while the snapshot of a full sync is, sent
+	// after it. disklessTransfer is set while the snapshot is streamed to
+	// the replica as it is written.
+	waitStart        time.Time
+	pending          []byte
+	initialOffset    int64
+	disklessTransfer bool
+
+	ackOffset    int64
+	aofAckOffset int64 // synced to the AOF of the replica
+	ackTime      time.Time
+}
+
+// replBacklog is a circular buffer holding the end of the replication
+// stream
+type replBacklog struct {
+	buf     []byte
+	idx     int   // where the next byte goes
+	histlen int64 // bytes held
+	offset  int64 // replication offset of the first byte held
+}
+
+func newReplBacklog(size, offset int64) *replBacklog {
+	return &replBacklog{buf: make([]byte, size), offset: offset}
+}
+
+// write appends p, which ends the stream at replication offset end
+func (b *replBacklog) write(p []byte, end int64) {
+	size := int64(len(b.buf))
+	if int64(len(p)) > size {
+		p = p[int64(len(p))-size:]
+	}
+	for len(p) > 0 {
+		n := copy(b.buf[b.idx:], p)
+		b.idx = (b.idx + n) % len(b.buf)
+		p = p[n:]
+		b.histlen += int64(n)
+	}
+	b.histlen = min(b.histlen, size)
+	b.offset = end - b.histlen + 1
+}
+
+// readFrom returns the stream held from replication offset from on, which
+// must be within the backlog
+func (b *replBacklog) readFrom(from int64) []byte {
+	size := int64(len(b.buf))
+	n := b.histlen - (from - b.offset)
+	start := ((int64(b.idx)-n)%size + size) % size
+	out := make([]byte, 0, n)
+	if start+n <= size {
+		return append(out, b.buf[start:start+n]...)
+	}
+	out = append(out, b.buf[start:]...)
+	return append(out, b.buf[:start+n-size]...)
+}
+
+// randomReplID returns a new replication ID: 40 random hex characters
+func randomReplID() string {
+	var id [20]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// noReplID is the replication ID of no history
+const noReplID = "0000000000000000000000000000000000000000"
+
+// shiftReplicationID starts a new history, remembering the current one as
+// valid up to the current offset, e.g. when a replica becomes a master
+func (s *Server) shiftReplicationID() {
+	r := &s.repl
+	r.replid2 = r.replid
+	r.secondOffset = r.offset + 1
+	r.replid = randomReplID()
+	log.Printf("Setting secondary replication ID to %s, valid up to offset: %d. New replication ID is %s", r.replid2, r.secondOffset, r.replid)
+}
+
+// replicationFeedReplicas propagates a command of the stream this server
+// originates. The caller must hold the server lock.
+func (s *Server) replicationFeedReplicas(argv []string) {
+	if s.repl.backlog == nil {
+		return
+	}
+	s.replicationFeedStream(aofAppendCommand(nil, argv))
+}
+
+// replicationFeedStream appends bytes to the replication stream: to the
+// backlog and to every replica. The caller must hold the server lock.
+func (s *Server) replicationFeedStream(p []byte) {
+	r := &s.repl
+	if r.backlog == nil {
+		return
+	}
+	r.offset += int64(len(p))
+	r.backlog.write(p, r.offset)
+	for _, c := range r.replicas {
+		switch c.replica.state {
+		case replicaWaitBgsaveStart:
+			// The snapshot it will get includes this
+		case replicaWaitBgsaveEnd:
+			c.replica.pending = append(c.replica.pending, p...)
+		case replicaOnline:
+			c.addReplyRaw(p)
+			c.checkOutputBufferLimit(s.clientOutputBufferLimits[clientClassReplica])
+		}
+	}
+}
+
+// createReplicationBacklog starts keeping the stream for partial resyncs.
+// A master that had no replicas yet starts a new history, since nobody
+// could follow the previous one.
+func (s *Server) createReplicationBacklog() {
+	r := &s.repl
+	if r.masterHost == "" {
+		r.replid = randomReplID()
+		r.replid2 = noReplID
+		r.secondOffset = -1
+	}
+	r.backlog = newReplBacklog(r.backlogSize, r.offset+1)
+}
+
+// addReplica registers a connection as a replica
+func (s *Server) addReplica(c *Client) {
+	for _, replica := range s.repl.replicas {
+		if replica == c {
+			return
+		}
+	}
+	s.repl.replicas = append(s.repl.replicas, c)
+}
+
+// removeReplica forgets a replica whose connection went away
+func (s *Server) removeReplica(c *Client) {
+	for i, replica := range s.repl.replicas {
+		if replica == c {
+			s.repl.replicas = append(s.repl.replicas[:i], s.repl.replicas[i+1:]...)
+			log.Printf("Connection with replica %s lost.", replicaName(c))
+			return
+		}
+	}
+}
+
+// disconnectReplicas closes the connections of every replica, making them
+// resync, e.g. after the history of this server changed
+func (s *Server) disconnectReplicas() {
+	for _, c := range s.repl.replicas {
+		c.conn.Close()
+	}
+}
+
+// replicaAddr returns the address a replica listens on, as announced
+func replicaAddr(c *Client) (string, int) {
+	ip := c.replica.ip
+	if ip == "" {
+		ip, _, _ = net.SplitHostPort(c.conn.RemoteAddr().String())
+	}
+	return ip, c.replica.listeningPort
+}
+
+// replicaName describes a replica for logs
+func replicaName(c *Client) string {
+	ip, port := replicaAddr(c)
+	return net.JoinHostPort(ip, strconv.Itoa(port))
+}
+
+// handleReplconf handles REPLCONF, which replicas use to configure their
+// link and acknowledge the stream they processed
+func (s *Server) handleReplconf(c *Client, args []resp.Value) resp.Value {
+	if len(args)%2 != 0 {
+		return resp.NewError("ERR syntax error")
+	}
+	if c.master {
+		// The master asks for an acknowledgement
+		if len(args) > 0 && strings.ToUpper(args[0].Bulk) == "GETACK" {
+			s.replicationSendAck()
+		}
+		return resp.Value{}
+	}
+	if c.replica == nil {
+		c.replica = &replicaState{ackTime: time.Now()}
+	}
+	acked := false
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1].Bulk
+		switch strings.ToLower(args[i].Bulk) {
+		case "listening-port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 0 || port > 65535 {
+				return resp.NewError("ERR value is not an integer or out of range")
+			}
+			c.replica.listeningPort = port
+		case "ip-address":
+			c.replica.ip = value
+		case "capa":
+			switch strings.ToLower(value) {
+			case "eof":
+				c.replica.capaEOF = true
+			case "psync2":
+				c.replica.capaPsync2 = true
+			}
+		case "ack", "fack":
+			// Acknowledgements are not replied to
+			offset, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || c.replica.state != replicaOnline {
+				return resp.Value{}
+			}
+			if strings.EqualFold(args[i].Bulk, "fack") {
+				c.replica.aofAckOffset = max(c.replica.aofAckOffset, offset)
+			} else {
+				c.replica.ackOffset = max(c.replica.ackOffset, offset)
+				c.replica.ackTime = time.Now()
+			}
+			acked = true
+		case "getack":
+			return resp.Value{}
+		default:
+			return resp.NewError(fmt.Sprintf("ERR Unrecognized REPLCONF option: %s", args[i].Bulk))
+		}
+	}
+	if acked {
+		s.processClientsWaitingAcks()
+		return resp.Value{}
+	}
+	return resp.NewSimpleString("OK")
+}
+
+// handlePsync handles PSYNC replid offset. The replica continues from the
+// backlog if it follows our history and what it misses is still there, and
+// gets a full sync otherwise.
+func (s *Server) handlePsync(c *Client, args []resp.Value) resp.Value {
+	if c.replica != nil && s.isReplica(c) {
+		// Already syncing
+		return resp.Value{}
+	}
+	if s.repl.masterHost != "" && s.repl.linkState != replLinkConnected {
+		return resp.NewError("NOMASTERLINK Can't SYNC while not connected with my master")
+	}
+	offset, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+	if err != nil {
+		return resp.NewError("ERR value is not an integer or out of range")
+	}
+	if c.replica == nil {
+		c.replica = &replicaState{ackTime: time.Now()}
+	}
+	if s.tryPartialResync(c, args[0].Bulk, offset) {
+		return resp.Value{}
+	}
+
+	log.Printf("Replica %s asks for synchronization", replicaName(c))
+	if s.repl.backlog == nil {
+		s.createReplicationBacklog()
+	}
+	c.replica.state = replicaWaitBgsaveStart
+	c.replica.waitStart = time.Now()
+	s.addReplica(c)
+
+	// Share the snapshot being written to disk for another replica, if
+	// any: the stream it buffered since is what this one needs too
+	if job := s.persist.bgsave; job != nil && !job.diskless {
+		for _, other := range s.repl.replicas {
+			if other != c && other.replica.state == replicaWaitBgsaveEnd {
+				c.replica.pending = append([]byte(nil), other.replica.pending...)
+				s.replicationSetupFullResync(c, other.replica.initialOffset)
+				log.Printf("Waiting for end of BGSAVE for SYNC")
+				return resp.Value{}
+			}
+		}
+	}
+	switch {
+	case s.repl.disklessSync && c.replica.capaEOF:
+		log.Printf("Delay next BGSAVE for diskless SYNC")
+	case !s.hasActiveChild():
+		s.startBgsaveForReplication(false)
+	default:
+		log.Printf("Current BGSAVE has a different purpose, waiting for the next one")
+	}
+	return resp.Value{}
+}
+
+// isReplica reports whether c is registered as a replica
+func (s *Server) isReplica(c *Client) bool {
+	for _, replica := range s.repl.replicas {
+		if replica == c {
+			return true
+		}
+	}
+	return false
+}
+
+// tryPartialResync continues the stream of a replica from offset if
+// possible, replying +CONTINUE followed by what it misses
+func (s *Server) tryPartialResync(c *Client, replid string, offset int64) bool {
+	r := &s.repl
+	if replid != r.replid && (replid != r.replid2 || offset > r.secondOffset) {
+		if replid != "?" {
+			log.Printf("Partial resynchronization not accepted: Replication ID mismatch (Replica asked for '%s', my replication IDs are '%s' and '%s')", replid, r.replid, r.replid2)
+		}
+		return false
+	}
+	b := r.backlog
+	if b == nil || offset < b.offset || offset > b.offset+b.histlen {
+		log.Printf("Unable to partial resync with replica %s for lack of backlog (Replica request was: %d).", replicaName(c), offset)
+		return false
+	}
+
+	c.replica.state = replicaOnline
+	c.replica.ackTime = time.Now()
+	s.addReplica(c)
+	if c.replica.capaPsync2 {
+		c.addReplyRaw([]byte("+CONTINUE " + r.replid + "\r\n"))
+	} else {
+		c.addReplyRaw([]byte("+CONTINUE\r\n"))
+	}
+	missing := b.readFrom(offset)
+	c.addReplyRaw(missing)
+	log.Printf("Partial resynchronization request from %s accepted. Sending %d bytes of backlog starting from offset %d.", replicaName(c), len(missing), offset)
+	return true
+}
+
+// replicationStartPendingFork starts the full sync of the replicas waiting
+// for one. Diskless syncs are delayed for more replicas to join, and only
+// done if every waiting replica can read a snapshot of unknown size.
+func (s *Server) replicationStartPendingFork() {
+	if s.hasActiveChild() {
+		return
+	}
+	waiting, maxIdle, capaEOF := 0, time.Duration(0), true
+	for _, c := range s.repl.replicas {
+		if c.replica.state == replicaWaitBgsaveStart {
+			waiting++
+			maxIdle = max(maxIdle, time.Since(c.replica.waitStart))
+			capaEOF = capaEOF && c.replica.capaEOF
+		}
+	}
+	if waiting == 0 {
+		return
+	}
+	diskless := s.repl.disklessSync && capaEOF
+	if diskless && maxIdle < s.repl.disklessSyncDelay &&
+		(s.repl.disklessSyncMaxReplicas == 0 || waiting < s.repl.disklessSyncMaxReplicas) {
+		return
+	}
+	s.startBgsaveForReplication(diskless)
+}
+
+// startBgsaveForReplication starts the BGSAVE the replicas waiting for a
+// full sync will get, written to disk or streamed to them
+func (s *Server) startBgsaveForReplication(diskless bool) {
+	if diskless {
+		log.Printf("Starting BGSAVE for SYNC with target: replicas sockets")
+		s.rdbSaveToReplicasSockets()
+		return
+	}
+	log.Printf("Starting BGSAVE for SYNC with target: disk")
+	if err := s.rdbSaveBackground(); err != nil {
+		log.Printf("BGSAVE for replication failed: %v", err)
+		for _, c := range s.repl.replicas {
+			if c.replica.state == replicaWaitBgsaveStart {
+				c.addReplyRaw([]byte("-ERR BGSAVE failed, maybe there is another child process?\r\n"))
+				c.conn.Close()
+			}
+		}
+		return
+	}
+	for _, c := range s.repl.replicas {
+		if c.replica.state == replicaWaitBgsaveStart {
+			s.replicationSetupFullResync(c, s.repl.offset)
+		}
+	}
+}
+
+// rdbSaveToReplicasSockets streams a snapshot to the replicas waiting for a
+// full sync, the way BGSAVE writes it to disk. Each replica gets it as an
+// EOF marked payload. The caller must hold the server lock, and make sure
+// no other snapshot is being written.
+func (s *Server) rdbSaveToReplicasSockets() {
+	snap := s.newSnapshot(snapshotRDB)
+	s.db.snapshot = snap
+	job := &bgsaveJob{start: time.Now(), snapshot: snap, diskless: true}
+	s.persist.bgsave = job
+
+	mark := []byte(randomReplID())
+	var targets replicaSocketsWriter
+	for _, c := range s.repl.replicas {
+		if c.replica.state == replicaWaitBgsaveStart {
+			s.replicationSetupFullResync(c, s.repl.offset)
+			c.replica.disklessTransfer = true
+			c.addReplyRaw([]byte("$EOF:" + string(mark) + "\r\n"))
+			targets = append(targets, c)
+		}
+	}
+
+	go func() {
+		err := snap.write(targets)
+		if err == nil && job.canceled.Load() {
+			err = errors.New("canceled")
+		}
+		if err == nil {
+			_, err = targets.Write(mark)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.backgroundSaveDone(job, err)
+	}()
+}
+
+// replicaSocketsWriter writes a snapshot to the replicas it is streamed
+// to. It fails once they all disconnected, since nobody needs the rest.
+type replicaSocketsWriter []*Client
+
+func (w replicaSocketsWriter) Write(p []byte) (int, error) {
+	alive := false
+	for _, c := range w {
+		if !c.isClosed() {
+			c.addReplyRaw(p)
+			alive = true
+		}
+	}
+	if !alive {
+		return 0, errors.New("all the replicas disconnected")
+	}
+	return len(p), nil
+}
+
+// replicationSetupFullResync tells a replica the snapshot it will get is
+// at offset of our history
+func (s *Server) replicationSetupFullResync(c *Client, offset int64) {
+	c.replica.state = replicaWaitBgsaveEnd
+	c.replica.initialOffset = offset
+	c.addReplyRaw([]byte(fmt.Sprintf("+FULLRESYNC %s %d\r\n", s.repl.replid, offset)))
+}
+
+// updateReplicasWaitingBgsave sends the snapshot a BGSAVE wrote to the
+// replicas waiting for it, unless it was streamed to them, followed by the
+// stream written meanwhile
+func (s *Server) updateReplicasWaitingBgsave(bgsaveErr error) {
+	var data []byte
+	err := bgsaveErr
+	for _, c := range s.repl.replicas {
+		if c.replica.state != replicaWaitBgsaveEnd {
+			continue
+		}
+		if data == nil && err == nil && !c.replica.disklessTransfer {
+			data, err = os.ReadFile(s.rdbPath())
+		}
+		if err != nil {
+			log.Printf("SYNC failed. BGSAVE child returned an error: %v", err)
+			c.conn.Close()
+			continue
+		}
+		if !c.replica.disklessTransfer {
+			c.addReplyRaw([]byte(fmt.Sprintf("$%d\r\n", len(data))))
+			c.addReplyRaw(data)
+		}
+		c.addReplyRaw(c.replica.pending)
+		c.replica.pending = nil
+		c.replica.disklessTransfer = false
+		c.replica.state = replicaOnline
+		c.replica.ackTime = time.Now()
+		log.Printf("Synchronization with replica %s succeeded", replicaName(c))
+	}
+}
+
+// replicationCron keeps the links with the master and the replicas alive,
+// and starts the full syncs that are due. The caller must hold the server
+// lock.
+func (s *Server) replicationCron() {
+	r := &s.repl
+	now := time.Now()
+	if r.masterHost != "" && r.link == nil && now.Sub(r.lastConnectTry) >= replConnectRetryDelay {
+		s.connectWithMaster()
+	}
+	// Replicas also tell their master as soon as their AOF got synced,
+	// for WAITAOF
+	if r.linkState == replLinkConnected && (now.Sub(r.lastAck) >= time.Second || s.aof.fsyncedOffset.Load() != r.lastFsyncAck) {
+		s.replicationSendAck()
+	}
+	s.processClientsWaitingAcks()
+
+	s.replicationStartPendingFork()
+
+	if r.masterHost == "" && len(r.replicas) > 0 && now.Sub(r.lastPing) >= r.pingPeriod {
+		s.replicationFeedReplicas([]string{"PING"})
+		r.lastPing = now
+	}
+	if now.Sub(r.lastCron) < time.Second {
+		return
+	}
+	r.lastCron = now
+	for _, c := range r.replicas {
+		switch c.replica.state {
+		case replicaWaitBgsaveStart, replicaWaitBgsaveEnd:
+			// Newlines keep the link alive until the snapshot is sent,
+			// unless it is already being streamed
+			if !c.replica.disklessTransfer {
+				c.addReplyRaw([]byte("\n"))
+			}
+		case replicaOnline:
+			if now.Sub(c.replica.ackTime) > r.timeout {
+				log.Printf("Disconnecting timedout replica (streaming sync): %s", replicaName(c))
+				c.conn.Close()
+			}
+		}
+	}
+}
+
+// replicationSendAck tells the master how much of the stream was processed
+func (s *Server) replicationSendAck() {
+	link := s.repl.link
+	if link == nil || s.repl.linkState != replLinkConnected {
+		return
+	}
+	s.repl.lastAck = time.Now()
+	s.repl.lastFsyncAck = s.aof.fsyncedOffset.Load()
+	argv := []string{"REPLCONF", "ACK", strconv.FormatInt(s.repl.offset, 10),
+		"FACK", strconv.FormatInt(s.repl.lastFsyncAck, 10)}
+	link.conn.SetWriteDeadline(time.Now().Add(s.repl.timeout))
+	link.conn.Write(aofAppendCommand(nil, argv))
+}
+
+// waitRequest is what a client blocked in WAIT or WAITAOF waits for: the
+// stream up to offset acknowledged by numreplicas replicas, and for WAITAOF
+// synced to the AOF of those replicas and, if numlocal is 1, to ours
+type waitRequest struct {
+	offset      int64
+	numlocal    int
+	numreplicas int
+	aof         bool
+}
+
+// parseWaitArgs parses the counts and the timeout in milliseconds of WAIT
+// and WAITAOF
+func parseWaitArgs(args []resp.Value) ([]int, time.Duration, resp.Value, bool) {
+	counts := make([]int, len(args)-1)
+	for i := range counts {
+		n, err := strconv.Atoi(args[i].Bulk)
+		if err != nil {
+			return nil, 0, resp.NewError("ERR value is not an integer or out of range"), false
+		}
+		counts[i] = n
+	}
+	ms, err := strconv.ParseInt(args[len(args)-1].Bulk, 10, 64)
+	if err != nil || ms > int64(time.Duration(math.MaxInt64)/time.Millisecond) {
+		return nil, 0, resp.NewError("ERR timeout is not an integer or out of range"), false
+	}
+	if ms < 0 {
+		return nil, 0, resp.NewError("ERR timeout is negative"), false
+	}
+	return counts, time.Duration(ms) * time.Millisecond, resp.Value{}, true
+}
+
+// handleWait handles WAIT numreplicas timeout, which blocks until the
+// writes of the client were acknowledged by numreplicas replicas and
+// replies with how many did
+func (s *Server) handleWait(c *Client, args []resp.Value) resp.Value {
+	if s.repl.masterHost != "" {
+		return resp.NewError("ERR WAIT cannot be used with replica instances. Please also note that since Redis 4.0 if a replica is configured to be writable (which is not the default) writes to replicas are just local and are not propagated.")
+	}
+	counts, timeout, errReply, ok := parseWaitArgs(args)
+	if !ok {
+		return errReply
+	}
+	return s.waitForAcks(c, &waitRequest{offset: c.woff, numreplicas: counts[0]}, timeout)
+}
+
+// handleWaitaof handles WAITAOF numlocal numreplicas timeout, which blocks
+// until the writes of the client were synced to the local AOF if numlocal
+// is set, and to the AOF of numreplicas replicas. It replies with both
+// counts.
+func (s *Server) handleWaitaof(c *Client, args []resp.Value) resp.Value {
+	if s.repl.masterHost != "" {
+		return resp.NewError("ERR WAITAOF cannot be used with replica instances. Please also note that writes to replicas are just local and are not propagated.")
+	}
+	counts, timeout, errReply, ok := parseWaitArgs(args)
+	if !ok {
+		return errReply
+	}
+	if counts[0] > 0 && !s.aof.enabled {
+		return resp.NewError("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.")
+	}
+	return s.waitForAcks(c, &waitRequest{offset: c.woff, numlocal: counts[0], numreplicas: counts[1], aof: true}, timeout)
+}
+
+// waitForAcks replies right away if the acknowledgements w waits for are
+// already there, and blocks the client otherwise
+func (s *Server) waitForAcks(c *Client, w *waitRequest, timeout time.Duration) resp.Value {
+	reply, done := s.waitReply(w)
+	if done {
+		return reply
+	}
+	reply = s.blockClient(c, nil, timeout, reply, nil)
+	if c.bstate == nil {
+		// Not allowed to block, e.g. inside a transaction
+		return reply
+	}
+	c.bstate.wait = w
+	s.repl.waiting = append(s.repl.waiting, c)
+	s.repl.getAck = true
+	return reply
+}
+
+// waitReply returns the reply of a WAIT or WAITAOF with the
+// acknowledgements received so far, and whether they are enough
+func (s *Server) waitReply(w *waitRequest) (resp.Value, bool) {
+	replicas := 0
+	for _, c := range s.repl.replicas {
+		offset := c.replica.ackOffset
+		if w.aof {
+			offset = c.replica.aofAckOffset
+		}
+		if c.replica.state == replicaOnline && offset >= w.offset {
+			replicas++
+		}
+	}
+	if !w.aof {
+		return resp.NewInteger(replicas), replicas >= w.numreplicas
+	}
+	local := 0
+	if s.aof.enabled && s.aof.fsyncedOffset.Load() >= w.offset {
+		local = 1
+	}
+	reply := resp.NewArray([]resp.Value{resp.NewInteger(local), resp.NewInteger(replicas)})
+	return reply, local >= w.numlocal && replicas >= w.numreplicas
+}
+
+// processClientsWaitingAcks serves the clients blocked in WAIT or WAITAOF
+// that got enough acknowledgements. The caller must hold the server lock.
+func (s *Server) processClientsWaitingAcks() {
+	for _, c := range append([]*Client(nil), s.repl.waiting...) {
+		reply, done := s.waitReply(c.bstate.wait)
+		if !done {
+			continue
+		}
+		bstate := c.bstate
+		s.unblockClient(c)
+		c.bstate = nil
+		bstate.reply <- reply
+	}
+}
+
+// removeWaitingClient forgets a client blocked in WAIT or WAITAOF
+func (s *Server) removeWaitingClient(c *Client) {
+	for i, w := range s.repl.waiting {
+		if w == c {
+			s.repl.waiting = append(s.repl.waiting[:i], s.repl.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// replicationRequestAcks asks the replicas for an acknowledgement if a
+// client started waiting for one. It is sent once the running command is
+// done, so that it isn't counted as a write of the client. The caller must
+// hold the server lock.
+func (s *Server) replicationRequestAcks() {
+	if !s.repl.getAck {
+		return
+	}
+	s.repl.getAck = false
+	s.replicationFeedReplicas([]string{"REPLCONF", "GETACK", "*"})
+}
+
+// checkGoodReplicas reports whether enough replicas acknowledged the
+// stream recently for a master to accept writes, as min-replicas-to-write
+// and min-replicas-max-lag require
+func (s *Server) checkGoodReplicas() bool {
+	r := &s.repl
+	if r.masterHost != "" || r.minReplicasToWrite == 0 || r.minReplicasMaxLag == 0 {
+		return true
+	}
+	return s.goodReplicasCount() >= r.minReplicasToWrite
+}
+
+// goodReplicasCount counts the online replicas whose last acknowledgement
+// is no older than min-replicas-max-lag
+func (s *Server) goodReplicasCount() int {
+	n := 0
+	for _, c := range s.repl.replicas {
+		lag := int(time.Since(c.replica.ackTime).Seconds())
+		if c.replica.state == replicaOnline && lag <= s.repl.minReplicasMaxLag {
+			n++
+		}
+	}
+	return n
+}
+
+// connectWithMaster starts connecting to the master in the background
+func (s *Server) connectWithMaster() {
+	r := &s.repl
+	link := &masterLink{}
+	r.link = link
+	r.linkState = replLinkConnecting
+	r.lastConnectTry = time.Now()
+	addr := net.JoinHostPort(r.masterHost, r.masterPort)
+	log.Printf("Connecting to MASTER %s", addr)
+	go func() {
+		err := s.syncWithMaster(link, addr)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.repl.link != link {
+			return
+		}
+		log.Printf("Connection with master lost: %v", err)
+		s.replicationDropLink()
+	}()
+}
+
+// replicationDropLink closes the link to the master, if any. A replica
+// reconnects to its master afterwards.
+func (s *Server) replicationDropLink() {
+	r := &s.repl
+	if link := r.link; link != nil {
+		if link.conn != nil {
+			link.conn.Close()
+		}
+		if r.linkState == replLinkConnected {
+			r.linkDownSince = time.Now()
+		}
+	}
+	r.link = nil
+	if r.masterHost != "" {
+		r.linkState = replLinkConnect
+	} else {
+		r.linkState = replLinkNone
+	}
+}
+
+// errLinkDropped is returned by syncWithMaster once its link was replaced
+var errLinkDropped = errors.New("link dropped")
+
+// syncWithMaster runs a link to the master: the handshake, the full sync
+// if needed, and then the stream, until the link goes away
+func (s *Server) syncWithMaster(link *masterLink, addr string) error {
+	s.mu.Lock()
+	timeout := s.repl.timeout
+	s.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.repl.link != link {
+		s.mu.Unlock()
+		conn.Close()
+		return errLinkDropped
+	}
+	link.conn = conn
+	// Without a backlog, this server never followed a history that could
+	// be continued
+	psyncID, psyncOffset := "?", "-1"
+	if s.repl.backlog != nil {
+		psyncID, psyncOffset = s.repl.replid, strconv.FormatInt(s.repl.offset+1, 10)
+	}
+	port := s.port
+	s.mu.Unlock()
+
+	// Nothing else closes the connection when the server stops
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.quit:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	br := bufio.NewReaderSize(conn, 64*1024)
+	readLine := func() (string, error) {
+		for {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return "", err
+			}
+			// Masters send newlines to keep the link alive
+			if line = strings.TrimRight(line, "\r\n"); line != "" {
+				return line, nil
+			}
+		}
+	}
+	command := func(argv ...string) (string, error) {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		if _, err := conn.Write(aofAppendCommand(nil, argv)); err != nil {
+			return "", err
+		}
+		return readLine()
+	}
+
+	log.Printf("MASTER <-> REPLICA sync started")
+	if reply, err := command("PING"); err != nil {
+		return err
+	} else if reply[0] == '-' {
+		return fmt.Errorf("error reply to PING from master: '%s'", reply[1:])
+	}
+	if reply, err := command("REPLCONF", "listening-port", port); err != nil {
+		return err
+	} else if reply[0] == '-' {
+		log.Printf("(Non critical) Master does not understand REPLCONF listening-port: %s", reply[1:])
+	}
+	if reply, err := command("REPLCONF", "capa", "eof", "capa", "psync2"); err != nil {
+		return err
+	} else if reply[0] == '-' {
+		log.Printf("(Non critical) Master does not understand REPLCONF capa: %s", reply[1:])
+	}
+
+	if psyncID == "?" {
+		log.Printf("Partial resynchronization not possible (no cached master)")
+	} else {
+		log.Printf("Trying a partial resynchronization (request %s:%s).", psyncID, psyncOffset)
+	}
+	reply, err := command("PSYNC", psyncID, psyncOffset)
+	if err != nil {
+		return err
+	}
+	switch {
+	case strings.HasPrefix(reply, "+FULLRESYNC"):
+		fields := strings.Fields(reply)
+		if len(fields) != 3 {
+			return fmt.Errorf("bad reply to PSYNC from master: %s", reply)
+		}
+		newOffset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad reply to PSYNC from master: %s", reply)
+		}
+		log.Printf("Full resync from master: %s:%d", fields[1], newOffset)
+		if err := s.readSyncPayload(link, br, readLine, fields[1], newOffset); err != nil {
+			return err
+		}
+
+	case strings.HasPrefix(reply, "+CONTINUE"):
+		log.Printf("Successful partial resynchronization with master.")
+		s.mu.Lock()
+		if s.repl.link != link {
+			s.mu.Unlock()
+			return errLinkDropped
+		}
+		if newID := strings.TrimSpace(strings.TrimPrefix(reply, "+CONTINUE")); newID != "" && newID != s.repl.replid {
+			// The master was promoted since: follow its new history
+			s.repl.replid2 = s.repl.replid
+			s.repl.secondOffset = s.repl.offset + 1
+			s.repl.replid = newID
+			log.Printf("Master replication ID changed to %s", newID)
+			s.disconnectReplicas()
+		}
+		s.replicationLinkEstablished(link)
+		s.mu.Unlock()
+
+	default:
+		return fmt.Errorf("unexpected reply to PSYNC from master: %s", reply)
+	}
+
+	// From now on the master streams its writes
+	r := &aofReader{r: br}
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		argv, err := r.readCommand()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		if s.repl.link != link {
+			s.mu.Unlock()
+			return errLinkDropped
+		}
+		link.lastIO = time.Now()
+		s.db.masterCommand = true
+		s.processCommand(link.client, commandValue(argv))
+		s.db.masterCommand = false
+		s.handleClientsBlockedOnKeys()
+		// Sub-replicas get the stream exactly as we did
+		s.replicationFeedStream(aofAppendCommand(nil, argv))
+		s.flushAppendOnlyFile()
+		s.mu.Unlock()
+	}
+}
+
+// readSyncPayload receives the snapshot of a full sync and loads it in
+// place of the dataset. Depending on repl-diskless-load, the snapshot is
+// first saved as our own RDB file, or loaded straight from memory.
+func (s *Server) readSyncPayload(link *masterLink, br *bufio.Reader, readLine func() (string, error), replid string, offset int64) error {
+	s.mu.Lock()
+	if s.repl.link != link {
+		s.mu.Unlock()
+		return errLinkDropped
+	}
+	s.repl.linkState = replLinkTransfer
+	link.syncStart = time.Now()
+	timeout := s.repl.timeout
+	swapdb := s.repl.disklessLoad == replDisklessLoadSwapdb
+	toDisk := s.repl.disklessLoad == replDisklessLoadDisabled ||
+		s.repl.disklessLoad == replDisklessLoadOnEmptyDB && len(s.db.data) > 0
+	path := s.rdbPath()
+	s.mu.Unlock()
+
+	header, err := readLine()
+	if err != nil {
+		return err
+	}
+	if header[0] == '-' {
+		return fmt.Errorf("master aborted replication with an error: %s", header[1:])
+	}
+	if header[0] != '$' {
+		return fmt.Errorf("bad protocol from master, the first byte is not '$' (we received '%s')", header)
+	}
+	// The size of snapshots streamed by diskless masters isn't known in
+	// advance: they end with the mark announced instead
+	size := int64(-1)
+	var mark []byte
+	if eof, ok := strings.CutPrefix(header, "$EOF:"); ok {
+		if len(eof) != replEOFMarkSize {
+			return fmt.Errorf("bad EOF mark from master: '%s'", eof)
+		}
+		mark = []byte(eof)
+	} else if size, err = strconv.ParseInt(header[1:], 10, 64); err != nil || size < 0 {
+		return fmt.Errorf("bad size of the payload from master: '%s'", header)
+	}
+	s.mu.Lock()
+	link.syncTotal = size
+	s.mu.Unlock()
+
+	var data []byte
+	if toDisk {
+		if size >= 0 {
+			log.Printf("MASTER <-> REPLICA sync: receiving %d bytes from master to disk", size)
+		} else {
+			log.Printf("MASTER <-> REPLICA sync: receiving streamed RDB from master with EOF to disk")
+		}
+		// The snapshot becomes our RDB file
+		err = writeFileAtomically(path, func(w io.Writer) error {
+			return readSyncBulk(link, br, w, size, mark, timeout)
+		})
+		if err == nil {
+			data, err = os.ReadFile(path)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		log.Printf("MASTER <-> REPLICA sync: receiving the RDB from master to memory")
+		var buf bytes.Buffer
+		if err := readSyncBulk(link, br, &buf, size, mark, timeout); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.repl.link != link {
+		return errLinkDropped
+	}
+	if swapdb {
+		// The dataset is only replaced once the new one loaded fine
+		log.Printf("MASTER <-> REPLICA sync: Loading DB in memory, keeping the old dataset until done")
+	} else {
+		log.Printf("MASTER <-> REPLICA sync: Flushing old data")
+		s.touchWatchedKeysOnFlush(s.db.Flush())
+		log.Printf("MASTER <-> REPLICA sync: Loading DB in memory")
+	}
+	p := &s.persist
+	p.loading = true
+	p.loadingStart = time.Now()
+	p.loadingTotalBytes = int64(len(data))
+	p.loadingDoneBytes = 0
+	p.loadingLastYield = 0
+	err = s.rdbLoad(data)
+	p.loading = false
+	if err != nil {
+		if swapdb {
+			log.Printf("Failed trying to load the MASTER synchronization DB, keeping the old dataset: %v", err)
+		} else {
+			log.Printf("Failed trying to load the MASTER synchronization DB: %v", err)
+		}
+		return err
+	}
+	if toDisk {
+		p.lastSave = time.Now()
+	}
+	// Loading let other clients in, which may have changed the master
+	if s.repl.link != link {
+		return errLinkDropped
+	}
+
+	// The dataset now follows the history of the master
+	s.repl.replid = replid
+	s.repl.replid2 = noReplID
+	s.repl.secondOffset = -1
+	s.repl.offset = offset
+	s.repl.backlog = newReplBacklog(s.repl.backlogSize, offset+1)
+	s.disconnectReplicas()
+	if s.aof.enabled {
+		log.Printf("MASTER <-> REPLICA sync: Restarting AOF")
+		s.stopAppendOnly()
+		if err := s.startAppendOnly(); err != nil {
+			log.Printf("Failed enabling the AOF after successful master synchronization! Trying it again in one second.")
+			s.aof.enabled = true
+			s.aof.waitRewrite = true
+			s.aof.rewriteScheduled = true
+		}
+	}
+	s.replicationLinkEstablished(link)
+	log.Printf("MASTER <-> REPLICA sync: Finished with success")
+	return nil
+}
+
+// readSyncBulk copies the snapshot of a full sync to w: size bytes, or
+// everything up to the EOF mark if size is unknown. The stream that follows
+// is left unread.
+func readSyncBulk(link *masterLink, br *bufio.Reader, w io.Writer, size int64, mark []byte, timeout time.Duration) error {
+	var read int64
+	if mark == nil {
+		buf := make([]byte, 64*1024)
+		for read < size {
+			link.conn.SetReadDeadline(time.Now().Add(timeout))
+			n, err := br.Read(buf[:min(int64(len(buf)), size-read)])
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			read += int64(n)
+			link.syncRead.Store(read)
+			if err != nil && read < size {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+		}
+		return nil
+	}
+
+	// What may be the start of the mark is held back until more is read
+	var held []byte
+	for {
+		link.conn.SetReadDeadline(time.Now().Add(timeout))
+		if _, err := br.Peek(1); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		chunk, _ := br.Peek(br.Buffered())
+		data := append(held, chunk...)
+		if i := bytes.Index(data, mark); i >= 0 {
+			if _, err := w.Write(data[:i]); err != nil {
+				return err
+			}
+			br.Discard(i + len(mark) - len(held))
+			link.syncRead.Store(read + int64(i+len(mark)-len(held)))
+			return nil
+		}
+		keep := min(len(data), len(mark)-1)
+		if _, err := w.Write(data[:len(data)-keep]); err != nil {
+			return err
+		}
+		held = append([]byte(nil), data[len(data)-keep:]...)
+		br.Discard(len(chunk))
+		read += int64(len(chunk))
+		link.syncRead.Store(read)
+	}
+}
+
+// replicationLinkEstablished starts processing the stream of the master.
+// The caller must hold the server lock.
+func (s *Server) replicationLinkEstablished(link *masterLink) {
+	if s.repl.backlog == nil {
+		s.repl.backlog = newReplBacklog(s.repl.backlogSize, s.repl.offset+1)
+	}
+	c := newClient(nil)
+	c.master = true
+	c.denyBlocking = true
+	link.client = c
+	link.lastIO = time.Now()
+	s.repl.linkState = replLinkConnected
+	s.repl.lastAck = time.Time{}
+}
+
+// replicationSetMaster makes this server a replica of host:port. Its own
+// replicas stay connected: they only have to resync if a full sync with
+// the new master replaces the dataset.
+func (s *Server) replicationSetMaster(host, port string) {
+	r := &s.repl
+	r.masterHost, r.masterPort = host, port
+	s.db.keepExpired = true
+	s.replicationDropLink()
+	r.linkState = replLinkConnect
+	r.lastConnectTry = time.Time{}
+	r.linkDownSince = time.Now()
+}
+
+// replicationUnsetMaster promotes this replica to a master
+func (s *Server) replicationUnsetMaster() {
+	r := &s.repl
+	r.masterHost, r.masterPort = "", ""
+	s.db.keepExpired = false
+	s.replicationDropLink()
+	s.shiftReplicationID()
+	// Replicas learn about the new replication ID as they reconnect
+	s.disconnectReplicas()
+}
+
+// handleReplicaof handles REPLICAOF host port and REPLICAOF NO ONE
+func (s *Server) handleReplicaof(args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return resp.NewError("ERR wrong number of arguments for 'replicaof' command")
+	}
+	if strings.EqualFold(args[0].Bulk, "no") && strings.EqualFold(args[1].Bulk, "one") {
+		if s.repl.masterHost != "" {
+			s.replicationUnsetMaster()
+			log.Printf("MASTER MODE enabled (user request)")
+		}
+		return resp.NewSimpleString("OK")
+	}
+
+	port, err := strconv.Atoi(args[1].Bulk)
+	if err != nil || port < 0 || port > 65535 {
+		return resp.NewError("ERR Invalid master port")
+	}
+	host := args[0].Bulk
+	if s.repl.masterHost == host && s.repl.masterPort == strconv.Itoa(port) {
+		log.Printf("REPLICAOF would result into synchronization with the master we are already connected with. No operation performed.")
+		return resp.NewSimpleString("OK Already connected to specified master")
+	}
+	s.replicationSetMaster(host, strconv.Itoa(port))
+	log.Printf("REPLICAOF %s:%d enabled (user request)", host, port)
+	return resp.NewSimpleString("OK")
+}
+
+// handleRole handles the ROLE command
+func (s *Server) handleRole(args []resp.Value) resp.Value {
+	if len(args) != 0 {
+		return resp.NewError("ERR wrong number of arguments for 'role' command")
+	}
+	r := &s.repl
+	if r.masterHost != "" {
+		offset := int64(-1)
+		if r.linkState == replLinkConnected {
+			offset = r.offset
+		}
+		port, _ := strconv.Atoi(r.masterPort)
+		return resp.NewArray([]resp.Value{
+			resp.NewBulkString("slave"),
+			resp.NewBulkString(r.masterHost),
+			resp.NewInteger(port),
+			resp.NewBulkString(replLinkStateNames[r.linkState]),
+			resp.NewInteger(int(offset)),
+		})
+	}
+
+	replicas := make([]resp.Value, 0, len(r.replicas))
+	for _, c := range r.replicas {
+		ip, port := replicaAddr(c)
+		replicas = append(replicas, resp.NewArray([]resp.Value{
+			resp.NewBulkString(ip),
+			resp.NewBulkString(strconv.Itoa(port)),
+			resp.NewBulkString(strconv.FormatInt(c.replica.ackOffset, 10)),
+		}))
+	}
+	return resp.NewArray([]resp.Value{
+		resp.NewBulkString("master"),
+		resp.NewInteger(int(r.offset)),
+		resp.NewArray(replicas),
+	})
+}
+
+func (s *Server) infoReplication() []string {
+	r := &s.repl
+	var fields []string
+	if r.masterHost == "" {
+		fields = append(fields, "role:master")
+	} else {
+		link := r.link
+		status, lastIO := "down", -1
+		if r.linkState == replLinkConnected {
+			status, lastIO = "up", int(time.Since(link.lastIO).Seconds())
+		}
+		fields = append(fields,
+			"role:slave",
+			"master_host:"+r.masterHost,
+			"master_port:"+r.masterPort,
+			"master_link_status:"+status,
+			fmt.Sprintf("master_last_io_seconds_ago:%d", lastIO),
+			fmt.Sprintf("master_sync_in_progress:%d", boolToInt(r.linkState == replLinkTransfer)),
+			fmt.Sprintf("slave_read_repl_offset:%d", r.offset),
+			fmt.Sprintf("slave_repl_offset:%d", r.offset))
+		if r.linkState == replLinkTransfer {
+			read := link.syncRead.Load()
+			perc := 0.0
+			if link.syncTotal > 0 {
+				perc = float64(read) * 100 / float64(link.syncTotal)
+			}
+			fields = append(fields,
+				fmt.Sprintf("master_sync_total_bytes:%d", link.syncTotal),
+				fmt.Sprintf("master_sync_read_bytes:%d", read),
+				fmt.Sprintf("master_sync_left_bytes:%d", link.syncTotal-read),
+				fmt.Sprintf("master_sync_perc:%.2f", perc),
+				fmt.Sprintf("master_sync_last_io_seconds_ago:%d", int(time.Since(link.syncStart).Seconds())))
+		}
+		if r.linkState != replLinkConnected {
+			fields = append(fields, fmt.Sprintf("master_link_down_since_seconds:%d", int(time.Since(r.linkDownSince).Seconds())))
+		}
+		fields = append(fields,
+			fmt.Sprintf("slave_priority:%d", r.priority),
+			fmt.Sprintf("slave_read_only:%d", boolToInt(r.readOnly)),
+			"replica_announced:1")
+	}
+
+	if r.minReplicasToWrite > 0 && r.minReplicasMaxLag > 0 {
+		fields = append(fields, fmt.Sprintf("min_slaves_good_slaves:%d", s.goodReplicasCount()))
+	}
+	fields = append(fields, fmt.Sprintf("connected_slaves:%d", len(r.replicas)))
+	for i, c := range r.replicas {
+		ip, port := replicaAddr(c)
+		state := "online"
+		if c.replica.state != replicaOnline {
+			state = "wait_bgsave"
+		}
+		lag := int(time.Since(c.replica.ackTime).Seconds())
+		fields = append(fields, fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d",
+			i, ip, port, state, c.replica.ackOffset, lag))
+	}
+
+	firstByte, histlen := int64(0), int64(0)
+	if r.backlog != nil {
+		firstByte, histlen = r.backlog.offset, r.backlog.histlen
+	}
+	return append(fields,
+		"master_failover_state:no-failover",
+		"master_replid:"+r.replid,
+		"master_replid2:"+r.replid2,
+		fmt.Sprintf("master_repl_offset:%d", r.offset),
+		fmt.Sprintf("second_repl_offset:%d", r.secondOffset),
+		fmt.Sprintf("repl_backlog_active:%d", boolToInt(r.backlog != nil)),
+		fmt.Sprintf("repl_backlog_size:%d", r.backlogSize),
+		fmt.Sprintf("repl_backlog_first_byte_offset:%d", firstByte),
+		fmt.Sprintf("repl_backlog_histlen:%d", histlen))
+}
@@ -0,0 +1,443 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"redis-learning/pkg/resp"
+)
+
+// Script flags, declared in a "#!lua flags=..." shebang
+const (
+	scriptFlagNoWrites = 1 << iota
+	scriptFlagAllowOOM
+	scriptFlagAllowStale
+	scriptFlagNoCluster
+	scriptFlagAllowCrossSlotKeys
+
+	// Set on scripts without a shebang, which predate flags: they may write
+	// without saying so, and are only checked as they call commands
+	scriptFlagEvalCompatMode
+)
+
+var scriptFlagNames = []struct {
+	name string
+	flag int
+}{
+	{"no-writes", scriptFlagNoWrites},
+	{"allow-oom", scriptFlagAllowOOM},
+	{"allow-stale", scriptFlagAllowStale},
+	{"no-cluster", scriptFlagNoCluster},
+	{"allow-cross-slot-keys", scriptFlagAllowCrossSlotKeys},
+}
+
+// scriptFlagByName returns the flag with the given name, or 0
+func scriptFlagByName(name string) int {
+	for _, f := range scriptFlagNames {
+		if f.name == name {
+			return f.flag
+		}
+	}
+	return 0
+}
+
+// defaultBusyReplyThreshold is how long a script can run before other
+// clients are told the server is busy
+const defaultBusyReplyThreshold = 5 * time.Second
+
+// luaScript is a compiled EVAL script
+type luaScript struct {
+	fn    *lua.LFunction
+	flags int
+}
+
+// scriptRunCtx describes the script being executed
+type scriptRunCtx struct {
+	name     string // SHA1 of an EVAL script, or function name
+	chunk    string // chunk name errors refer to
+	function bool
+	readOnly bool // run with EVAL_RO or FCALL_RO, or flagged no-writes
+	busyAt   time.Time
+	cancel   context.CancelFunc
+
+	// Where the last error raised by redis.call came from
+	errWhere string
+
+	// Read by clients checking whether the server is busy, protected by
+	// Server.scriptMu
+	wrote  bool
+	killed bool
+}
+
+// parseShebang splits a "#!<engine> [flags=a,b]" first line off body,
+// keeping the newline so that line numbers don't change. Scripts without a
+// shebang are flagged as such.
+func parseShebang(body string) (flags int, code string, errReply resp.Value, ok bool) {
+	if !strings.HasPrefix(body, "#!") {
+		return scriptFlagEvalCompatMode, body, resp.Value{}, true
+	}
+	line, rest := body, ""
+	if i := strings.IndexByte(body, '\n'); i >= 0 {
+		line, rest = body[:i], body[i:]
+	}
+
+	parts := strings.Fields(line[2:])
+	if len(parts) == 0 || parts[0] != "lua" {
+		engine := ""
+		if len(parts) > 0 {
+			engine = parts[0]
+		}
+		return 0, "", resp.NewError(fmt.Sprintf("ERR Could not find scripting engine '%s'", engine)), false
+	}
+	for _, part := range parts[1:] {
+		value, found := strings.CutPrefix(part, "flags=")
+		if !found {
+			return 0, "", resp.NewError(fmt.Sprintf("ERR Unknown lua shebang option: %s", part)), false
+		}
+		for _, name := range strings.Split(value, ",") {
+			if name == "" {
+				continue
+			}
+			flag := scriptFlagByName(name)
+			if flag == 0 {
+				return 0, "", resp.NewError(fmt.Sprintf("ERR Unexpected flag in script shebang: %s", name)), false
+			}
+			flags |= flag
+		}
+	}
+	return flags, rest, resp.Value{}, true
+}
+
+// scriptCreate compiles body, caching it under its SHA1
+func (s *Server) scriptCreate(body string) (string, *luaScript, resp.Value, bool) {
+	sha := sha1Hex(body)
+	if script, ok := s.scripts[sha]; ok {
+		return sha, script, resp.Value{}, true
+	}
+
+	flags, code, errReply, ok := parseShebang(body)
+	if !ok {
+		return "", nil, errReply, false
+	}
+	fn, err := s.lua.Load(strings.NewReader(code), "user_script")
+	if err != nil {
+		msg, _ := luaErrorMessage(err)
+		return "", nil, resp.NewError(errorSafe("ERR Error compiling script (new function): " + msg)), false
+	}
+
+	script := &luaScript{fn: fn, flags: flags}
+	s.scripts[sha] = script
+	return sha, script, resp.Value{}, true
+}
+
+// parseNumKeys splits the arguments following the script or function name
+// into keys and arguments
+func parseNumKeys(args []resp.Value) (keys, argv []resp.Value, errReply resp.Value, ok bool) {
+	numkeys, err := strconv.Atoi(args[0].Bulk)
+	if err != nil {
+		return nil, nil, resp.NewError("ERR value is not an integer or out of range"), false
+	}
+	if numkeys > len(args)-1 {
+		return nil, nil, resp.NewError("ERR Number of keys can't be greater than number of args"), false
+	}
+	if numkeys < 0 {
+		return nil, nil, resp.NewError("ERR Number of keys can't be negative"), false
+	}
+	return args[1 : 1+numkeys], args[1+numkeys:], resp.Value{}, true
+}
+
+// luaStringTable converts arguments to a Lua array of strings
+func luaStringTable(L *lua.LState, args []resp.Value) *lua.LTable {
+	t := L.CreateTable(len(args), 0)
+	for _, arg := range args {
+		t.Append(lua.LString(arg.Bulk))
+	}
+	return t
+}
+
+// evalGeneric implements EVAL, EVALSHA, EVAL_RO and EVALSHA_RO
+func (s *Server) evalGeneric(args []resp.Value, evalsha, readOnly bool) resp.Value {
+	keys, argv, errReply, ok := parseNumKeys(args[1:])
+	if !ok {
+		return errReply
+	}
+
+	var sha string
+	var script *luaScript
+	if evalsha {
+		sha = strings.ToLower(args[0].Bulk)
+		if script, ok = s.scripts[sha]; !ok {
+			return resp.NewError("NOSCRIPT No matching script. Please use EVAL.")
+		}
+	} else if sha, script, errReply, ok = s.scriptCreate(args[0].Bulk); !ok {
+		return errReply
+	}
+
+	if errReply, ok := s.scriptPrepareForRun(script.flags, readOnly); !ok {
+		return errReply
+	}
+
+	s.lua.G.Global.RawSetString("KEYS", luaStringTable(s.lua, keys))
+	s.lua.G.Global.RawSetString("ARGV", luaStringTable(s.lua, argv))
+
+	run := &scriptRunCtx{
+		name:     sha,
+		chunk:    "user_script",
+		readOnly: readOnly || script.flags&scriptFlagNoWrites != 0,
+	}
+	return s.runScript(s.lua, run, script.fn)
+}
+
+// scriptPrepareForRun rejects a script that may write, going by its flags,
+// wherever writes would be rejected, so that it fails before having any
+// effect. Scripts without a shebang are let through.
+func (s *Server) scriptPrepareForRun(flags int, readOnly bool) (resp.Value, bool) {
+	if flags&(scriptFlagEvalCompatMode|scriptFlagNoWrites) != 0 {
+		return resp.Value{}, true
+	}
+	if readOnly {
+		return resp.NewError("ERR Can not execute a script with write flag using *_ro command."), false
+	}
+	if errReply, denied := s.writeDeniedReply(); denied {
+		return errReply, false
+	}
+	return resp.Value{}, true
+}
+
+// runScript calls fn, which takes no arguments, and converts what it
+// returns into a reply. The script runs while the server lock is held, so
+// it's atomic, but other clients can still see whether it has become busy
+// and kill it.
+func (s *Server) runScript(L *lua.LState, run *scriptRunCtx, fn *lua.LFunction, args ...lua.LValue) resp.Value {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	run.busyAt = time.Now().Add(s.busyReplyThreshold)
+	run.cancel = cancel
+
+	s.scriptMu.Lock()
+	s.scriptRun = run
+	s.scriptMu.Unlock()
+	s.scriptClient.proto = 2
+
+	// The commands the script runs are propagated as a transaction
+	s.startPropagateBatch()
+	defer s.endPropagateBatch()
+
+	L.SetContext(ctx)
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	err := L.PCall(len(args), 1, nil)
+	L.RemoveContext()
+
+	s.scriptMu.Lock()
+	killed := run.killed
+	s.scriptRun = nil
+	s.scriptMu.Unlock()
+
+	if err != nil {
+		if killed {
+			if run.function {
+				return resp.NewError("ERR Script killed by user with FUNCTION KILL...")
+			}
+			return resp.NewError("ERR Script killed by user with SCRIPT KILL...")
+		}
+		return scriptErrorReply(run, err)
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	return luaToResp(ret)
+}
+
+// scriptErrorReply formats an error raised by a script the way Redis does,
+// appending which script failed and where
+func scriptErrorReply(run *scriptRunCtx, err error) resp.Value {
+	msg, isTable := luaErrorMessage(err)
+	where := run.errWhere
+	if !isTable {
+		// Errors raised by Lua itself start with their position
+		where = ""
+		if rest, found := strings.CutPrefix(msg, run.chunk+":"); found {
+			if i := strings.IndexByte(rest, ':'); i > 0 {
+				where = run.chunk + ":" + rest[:i]
+			}
+		}
+		msg = "ERR " + msg
+	}
+
+	msg += " script: " + run.name
+	if where = strings.TrimSuffix(where, ":"); where != "" {
+		msg += ", on @" + where + "."
+	}
+	return resp.NewError(errorSafe(msg))
+}
+
+// scriptCall runs a command on behalf of redis.call, with the checks a
+// script is subject to
+func (s *Server) scriptCall(argv []string) resp.Value {
+	cmd := strings.ToUpper(argv[0])
+	info, known := s.lookupCommand(cmd)
+	if !known {
+		return resp.NewError("ERR Unknown Redis command called from script")
+	}
+
+	args := make([]resp.Value, len(argv)-1)
+	for i, arg := range argv[1:] {
+		args[i] = resp.NewBulkString(arg)
+	}
+	if _, ok := checkArity(cmd, info, args); !ok {
+		return resp.NewError("ERR Wrong number of args calling Redis command from script")
+	}
+	if info.flags&cmdNoScript != 0 {
+		return resp.NewError("ERR This Redis command is not allowed from script")
+	}
+	if info.flags&cmdWrite != 0 {
+		if s.scriptRun.readOnly {
+			return resp.NewError("ERR Write commands are not allowed from read-only scripts.")
+		}
+		if errReply, denied := s.writeDeniedReply(); denied {
+			return errReply
+		}
+		s.scriptMu.Lock()
+		s.scriptRun.wrote = true
+		s.scriptMu.Unlock()
+	}
+	return s.call(s.scriptClient, cmd, args)
+}
+
+// busyScriptReply is checked before a command takes the server lock. Once
+// a script has run for longer than busy-reply-threshold, other clients get
+// a BUSY error straight away, except for the commands that can stop it.
+func (s *Server) busyScriptReply(value resp.Value) (resp.Value, bool) {
+	s.scriptMu.Lock()
+	defer s.scriptMu.Unlock()
+
+	run := s.scriptRun
+	if run == nil || time.Now().Before(run.busyAt) {
+		return resp.Value{}, false
+	}
+
+	var cmd, sub string
+	if value.Type == resp.ARRAY && len(value.Array) > 0 {
+		cmd = strings.ToUpper(value.Array[0].Bulk)
+	}
+	if len(value.Array) > 1 {
+		sub = strings.ToUpper(value.Array[1].Bulk)
+	}
+	switch {
+	case cmd == "SHUTDOWN" && sub == "NOSAVE":
+		// Stopping abandons the script along with the whole server
+		s.Stop()
+		return resp.Value{}, true
+	case cmd == "SCRIPT" && sub == "KILL":
+		return s.scriptKill(run, false), true
+	case cmd == "FUNCTION" && sub == "KILL":
+		return s.scriptKill(run, true), true
+	case run.function:
+		return resp.NewError("BUSY Redis is busy running a script. You can only call FUNCTION KILL or SHUTDOWN NOSAVE."), true
+	default:
+		return resp.NewError("BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE."), true
+	}
+}
+
+// scriptKill stops the running script unless it has already written to the
+// dataset, which would break atomicity. The caller must hold scriptMu.
+func (s *Server) scriptKill(run *scriptRunCtx, function bool) resp.Value {
+	if run == nil {
+		return resp.NewError("NOTBUSY No scripts in execution right now.")
+	}
+	if run.function != function {
+		if run.function {
+			return resp.NewError("BUSY Redis is busy running a function. You can only call FUNCTION KILL command.")
+		}
+		return resp.NewError("BUSY Redis is busy running a script. You can only call SCRIPT KILL command.")
+	}
+	if run.wrote {
+		return resp.NewError("UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.")
+	}
+	run.killed = true
+	run.cancel()
+	return resp.NewSimpleString("OK")
+}
+
+// handleEval handles the EVAL command
+func (s *Server) handleEval(args []resp.Value) resp.Value {
+	return s.evalGeneric(args, false, false)
+}
+
+// handleEvalSha handles the EVALSHA command
+func (s *Server) handleEvalSha(args []resp.Value) resp.Value {
+	return s.evalGeneric(args, true, false)
+}
+
+// handleEvalRO handles the EVAL_RO command
+func (s *Server) handleEvalRO(args []resp.Value) resp.Value {
+	return s.evalGeneric(args, false, true)
+}
+
+// handleEvalShaRO handles the EVALSHA_RO command
+func (s *Server) handleEvalShaRO(args []resp.Value) resp.Value {
+	return s.evalGeneric(args, true, true)
+}
+
+// handleScript handles the SCRIPT command
+func (s *Server) handleScript(args []resp.Value) resp.Value {
+	sub := strings.ToUpper(args[0].Bulk)
+	switch sub {
+	case "LOAD":
+		if len(args) != 2 {
+			return resp.NewError("ERR wrong number of arguments for 'script|load' command")
+		}
+		sha, _, errReply, ok := s.scriptCreate(args[1].Bulk)
+		if !ok {
+			return errReply
+		}
+		return resp.NewBulkString(sha)
+
+	case "EXISTS":
+		if len(args) < 2 {
+			return resp.NewError("ERR wrong number of arguments for 'script|exists' command")
+		}
+		values := make([]resp.Value, len(args)-1)
+		for i, arg := range args[1:] {
+			exists := 0
+			if _, ok := s.scripts[strings.ToLower(arg.Bulk)]; ok {
+				exists = 1
+			}
+			values[i] = resp.NewInteger(exists)
+		}
+		return resp.NewArray(values)
+
+	case "FLUSH":
+		if len(args) > 2 {
+			return resp.NewError("ERR wrong number of arguments for 'script|flush' command")
+		}
+		if len(args) == 2 {
+			switch strings.ToUpper(args[1].Bulk) {
+			case "ASYNC", "SYNC":
+			default:
+				return resp.NewError("ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+			}
+		}
+		s.lua.Close()
+		s.lua = s.newLuaState()
+		s.scripts = make(map[string]*luaScript)
+		return resp.NewSimpleString("OK")
+
+	case "KILL":
+		if len(args) != 1 {
+			return resp.NewError("ERR wrong number of arguments for 'script|kill' command")
+		}
+		// Scripts run under the server lock, so none can be running now
+		return resp.NewError("NOTBUSY No scripts in execution right now.")
+
+	default:
+		return resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'. Try SCRIPT HELP.", args[0].Bulk))
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"math"
+	"math/bits"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaOpenBit builds the bit table of LuaBitOp, the bitwise operations on
+// 32 bit integers Redis bundles with its interpreter
+func luaOpenBit(L *lua.LState) *lua.LTable {
+	unary := func(op func(x uint32) uint32) lua.LGFunction {
+		return func(L *lua.LState) int {
+			L.Push(luaBitResult(op(luaBitArg(L, 1))))
+			return 1
+		}
+	}
+	fold := func(op func(x, y uint32) uint32) lua.LGFunction {
+		return func(L *lua.LState) int {
+			x := luaBitArg(L, 1)
+			for i := 2; i <= L.GetTop(); i++ {
+				x = op(x, luaBitArg(L, i))
+			}
+			L.Push(luaBitResult(x))
+			return 1
+		}
+	}
+	shift := func(op func(x uint32, n int) uint32) lua.LGFunction {
+		return func(L *lua.LState) int {
+			x, n := luaBitArg(L, 1), int(luaBitArg(L, 2)&31)
+			L.Push(luaBitResult(op(x, n)))
+			return 1
+		}
+	}
+
+	return L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"tobit":  unary(func(x uint32) uint32 { return x }),
+		"bnot":   unary(func(x uint32) uint32 { return ^x }),
+		"bswap":  unary(bits.ReverseBytes32),
+		"band":   fold(func(x, y uint32) uint32 { return x & y }),
+		"bor":    fold(func(x, y uint32) uint32 { return x | y }),
+		"bxor":   fold(func(x, y uint32) uint32 { return x ^ y }),
+		"lshift": shift(func(x uint32, n int) uint32 { return x << n }),
+		"rshift": shift(func(x uint32, n int) uint32 { return x >> n }),
+		"arshift": shift(func(x uint32, n int) uint32 {
+			return uint32(int32(x) >> n)
+		}),
+		"rol":   shift(func(x uint32, n int) uint32 { return bits.RotateLeft32(x, n) }),
+		"ror":   shift(func(x uint32, n int) uint32 { return bits.RotateLeft32(x, -n) }),
+		"tohex": luaBitToHex,
+	})
+}
+
+// luaBitArg reads a number argument as LuaBitOp does: rounded to the
+// nearest integer and reduced modulo 2^32
+func luaBitArg(L *lua.LState, n int) uint32 {
+	f := math.RoundToEven(float64(L.CheckNumber(n)))
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	return uint32(int64(math.Mod(f, 1<<32)))
+}
+
+// luaBitResult returns the bits of x as the signed number LuaBitOp
+// results are
+func luaBitResult(x uint32) lua.LNumber {
+	return lua.LNumber(int32(x))
+}
+
+// luaBitToHex implements bit.tohex(x [,n]): the n least significant hex
+// digits of x, 8 by default, upper case when n is negative
+func luaBitToHex(L *lua.LState) int {
+	x := luaBitArg(L, 1)
+	n := 8
+	if L.GetTop() >= 2 {
+		n = int(int32(luaBitArg(L, 2)))
+	}
+	digits := "0123456789abcdef"
+	if n < 0 {
+		n = -n
+		digits = "0123456789ABCDEF"
+	}
+	n = min(n, 8)
+	buf := make([]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		buf[i] = digits[x&15]
+		x >>= 4
+	}
+	L.Push(lua.LString(buf))
+	return 1
+}
@@ -0,0 +1,476 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Limits and defaults lua-cjson applies
+const (
+	jsonMaxDepth        = 1000
+	jsonNumberPrecision = 14
+	jsonSparseRatio     = 2
+	jsonSparseSafe      = 10
+)
+
+// luaOpenCjson builds the cjson table of lua-cjson, with encode, decode
+// and the null sentinel. The functions configuring lua-cjson (such as
+// encode_max_depth or encode_sparse_array) aren't provided: its default
+// settings always apply.
+func luaOpenCjson(L *lua.LState) *lua.LTable {
+	null := L.NewUserData()
+	cjson := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"encode": func(L *lua.LState) int {
+			L.CheckAny(1)
+			e := &jsonEncoder{L: L, null: null}
+			e.encode(L.Get(1), 0)
+			L.Push(lua.LString(e.buf.String()))
+			return 1
+		},
+		"decode": func(L *lua.LState) int {
+			d := &jsonDecoder{L: L, data: L.CheckString(1), null: null}
+			L.Push(d.decode())
+			return 1
+		},
+	})
+	cjson.RawSetString("null", null)
+	cjson.RawSetString("_NAME", lua.LString("cjson"))
+	cjson.RawSetString("_VERSION", lua.LString("2.1.0"))
+	return cjson
+}
+
+// jsonEncoder serialises Lua values the way cjson.encode does
+type jsonEncoder struct {
+	L    *lua.LState
+	null lua.LValue
+	buf  strings.Builder
+}
+
+func (e *jsonEncoder) fail(v lua.LValue, reason string) {
+	e.L.RaiseError("Cannot serialise %s: %s", v.Type().String(), reason)
+}
+
+func (e *jsonEncoder) encode(v lua.LValue, depth int) {
+	switch v := v.(type) {
+	case *lua.LNilType:
+		e.buf.WriteString("null")
+	case lua.LBool:
+		e.buf.WriteString(strconv.FormatBool(bool(v)))
+	case lua.LNumber:
+		e.encodeNumber(v)
+	case lua.LString:
+		e.encodeString(string(v))
+	case *lua.LTable:
+		depth++
+		if depth > jsonMaxDepth {
+			e.L.RaiseError("Cannot serialise, excessive nesting (%d)", depth)
+		}
+		if n := e.arrayLength(v); n > 0 {
+			e.encodeArray(v, n, depth)
+		} else {
+			e.encodeObject(v, depth)
+		}
+	default:
+		if v == e.null {
+			e.buf.WriteString("null")
+			return
+		}
+		e.fail(v, "type not supported")
+	}
+}
+
+func (e *jsonEncoder) encodeNumber(n lua.LNumber) {
+	f := float64(n)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		e.fail(n, "must not be NaN or Inf")
+	}
+	e.buf.WriteString(strconv.FormatFloat(f, 'g', jsonNumberPrecision, 64))
+}
+
+func (e *jsonEncoder) encodeString(s string) {
+	e.buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\', '/':
+			e.buf.WriteByte('\\')
+			e.buf.WriteByte(c)
+		case '\b':
+			e.buf.WriteString(`\b`)
+		case '\f':
+			e.buf.WriteString(`\f`)
+		case '\n':
+			e.buf.WriteString(`\n`)
+		case '\r':
+			e.buf.WriteString(`\r`)
+		case '\t':
+			e.buf.WriteString(`\t`)
+		default:
+			if c < 0x20 {
+				e.buf.WriteString(`\u00`)
+				e.buf.WriteByte("0123456789abcdef"[c>>4])
+				e.buf.WriteByte("0123456789abcdef"[c&15])
+			} else {
+				e.buf.WriteByte(c)
+			}
+		}
+	}
+	e.buf.WriteByte('"')
+}
+
+// arrayLength returns the length of t when it is an array, that is when
+// all its keys are positive integers and it isn't excessively sparse, or
+// 0 when it must be encoded as an object. Empty tables are objects.
+func (e *jsonEncoder) arrayLength(t *lua.LTable) int {
+	max, items := 0, 0
+	isArray := true
+	t.ForEach(func(key, _ lua.LValue) {
+		n, ok := key.(lua.LNumber)
+		if !ok || n < 1 || float64(n) != math.Trunc(float64(n)) {
+			isArray = false
+			return
+		}
+		if int(n) > max {
+			max = int(n)
+		}
+		items++
+	})
+	if !isArray {
+		return 0
+	}
+	if max > items*jsonSparseRatio && max > jsonSparseSafe {
+		e.fail(t, "excessively sparse array")
+	}
+	return max
+}
+
+func (e *jsonEncoder) encodeArray(t *lua.LTable, n int, depth int) {
+	e.buf.WriteByte('[')
+	for i := 1; i <= n; i++ {
+		if i > 1 {
+			e.buf.WriteByte(',')
+		}
+		e.encode(t.RawGetInt(i), depth)
+	}
+	e.buf.WriteByte(']')
+}
+
+func (e *jsonEncoder) encodeObject(t *lua.LTable, depth int) {
+	e.buf.WriteByte('{')
+	first := true
+	t.ForEach(func(key, value lua.LValue) {
+		if !first {
+			e.buf.WriteByte(',')
+		}
+		first = false
+		switch key := key.(type) {
+		case lua.LString:
+			e.encodeString(string(key))
+		case lua.LNumber:
+			e.buf.WriteByte('"')
+			e.encodeNumber(key)
+			e.buf.WriteByte('"')
+		default:
+			e.fail(t, "table key must be a number or string")
+		}
+		e.buf.WriteByte(':')
+		e.encode(value, depth)
+	})
+	e.buf.WriteByte('}')
+}
+
+// Token types of the JSON decoder, named in its errors as lua-cjson does
+const (
+	jsonObjBegin = iota
+	jsonObjEnd
+	jsonArrBegin
+	jsonArrEnd
+	jsonString
+	jsonNumber
+	jsonBoolean
+	jsonNull
+	jsonColon
+	jsonComma
+	jsonEnd
+	jsonError
+)
+
+var jsonTokenNames = []string{
+	"T_OBJ_BEGIN", "T_OBJ_END", "T_ARR_BEGIN", "T_ARR_END", "T_STRING",
+	"T_NUMBER", "T_BOOLEAN", "T_NULL", "T_COLON", "T_COMMA", "T_END", "T_ERROR",
+}
+
+var jsonPunctuation = map[byte]int{
+	'{': jsonObjBegin, '}': jsonObjEnd, '[': jsonArrBegin, ']': jsonArrEnd,
+	':': jsonColon, ',': jsonComma,
+}
+
+type jsonToken struct {
+	kind  int
+	index int
+	value lua.LValue
+	err   string
+}
+
+// jsonDecoder parses JSON into Lua values the way cjson.decode does
+type jsonDecoder struct {
+	L     *lua.LState
+	data  string
+	pos   int
+	depth int
+	null  lua.LValue
+}
+
+func (d *jsonDecoder) decode() lua.LValue {
+	value := d.parseValue(d.next())
+	if token := d.next(); token.kind != jsonEnd {
+		d.fail("the end", token)
+	}
+	return value
+}
+
+func (d *jsonDecoder) fail(expected string, token jsonToken) {
+	found := token.err
+	if token.kind != jsonError {
+		found = jsonTokenNames[token.kind]
+	}
+	d.L.RaiseError("Expected %s but found %s at character %d", expected, found, token.index+1)
+}
+
+func (d *jsonDecoder) descend() {
+	d.depth++
+	if d.depth > jsonMaxDepth {
+		d.L.RaiseError("Found too many nested data structures (%d) at character %d", d.depth, d.pos)
+	}
+}
+
+func (d *jsonDecoder) parseValue(token jsonToken) lua.LValue {
+	switch token.kind {
+	case jsonString, jsonNumber, jsonBoolean:
+		return token.value
+	case jsonNull:
+		return d.null
+	case jsonObjBegin:
+		return d.parseObject()
+	case jsonArrBegin:
+		return d.parseArray()
+	}
+	d.fail("value", token)
+	return lua.LNil
+}
+
+func (d *jsonDecoder) parseObject() lua.LValue {
+	d.descend()
+	t := d.L.NewTable()
+	token := d.next()
+	if token.kind == jsonObjEnd {
+		d.depth--
+		return t
+	}
+	for {
+		if token.kind != jsonString {
+			d.fail("object key string", token)
+		}
+		key := token.value
+		if token = d.next(); token.kind != jsonColon {
+			d.fail("colon", token)
+		}
+		t.RawSet(key, d.parseValue(d.next()))
+		token = d.next()
+		if token.kind == jsonObjEnd {
+			break
+		}
+		if token.kind != jsonComma {
+			d.fail("comma or object end", token)
+		}
+		token = d.next()
+	}
+	d.depth--
+	return t
+}
+
+func (d *jsonDecoder) parseArray() lua.LValue {
+	d.descend()
+	t := d.L.NewTable()
+	token := d.next()
+	if token.kind == jsonArrEnd {
+		d.depth--
+		return t
+	}
+	for i := 1; ; i++ {
+		t.RawSetInt(i, d.parseValue(token))
+		token = d.next()
+		if token.kind == jsonArrEnd {
+			break
+		}
+		if token.kind != jsonComma {
+			d.fail("comma or array end", token)
+		}
+		token = d.next()
+	}
+	d.depth--
+	return t
+}
+
+// next scans the token at the current position
+func (d *jsonDecoder) next() jsonToken {
+	for d.pos < len(d.data) && strings.IndexByte(" \t\n\r", d.data[d.pos]) >= 0 {
+		d.pos++
+	}
+	token := jsonToken{index: d.pos}
+	if d.pos == len(d.data) {
+		token.kind = jsonEnd
+		return token
+	}
+
+	c := d.data[d.pos]
+	if kind, ok := jsonPunctuation[c]; ok {
+		d.pos++
+		token.kind = kind
+		return token
+	}
+	switch {
+	case c == '"':
+		return d.scanString(token)
+	case c == '-' || c >= '0' && c <= '9':
+		return d.scanNumber(token)
+	}
+	for _, word := range []struct {
+		text  string
+		kind  int
+		value lua.LValue
+	}{
+		{"true", jsonBoolean, lua.LTrue},
+		{"false", jsonBoolean, lua.LFalse},
+		{"null", jsonNull, lua.LNil},
+	} {
+		if strings.HasPrefix(d.data[d.pos:], word.text) {
+			d.pos += len(word.text)
+			token.kind, token.value = word.kind, word.value
+			return token
+		}
+	}
+	token.kind, token.err = jsonError, "invalid token"
+	return token
+}
+
+func (d *jsonDecoder) scanNumber(token jsonToken) jsonToken {
+	end := d.pos
+	digits := func() bool {
+		start := end
+		for end < len(d.data) && d.data[end] >= '0' && d.data[end] <= '9' {
+			end++
+		}
+		return end > start
+	}
+	if d.data[end] == '-' {
+		end++
+	}
+	ok := digits()
+	if ok && end < len(d.data) && d.data[end] == '.' {
+		end++
+		ok = digits()
+	}
+	if ok && end < len(d.data) && (d.data[end] == 'e' || d.data[end] == 'E') {
+		end++
+		if end < len(d.data) && (d.data[end] == '+' || d.data[end] == '-') {
+			end++
+		}
+		ok = digits()
+	}
+	f, err := strconv.ParseFloat(d.data[d.pos:end], 64)
+	if !ok || err != nil && !errors.Is(err, strconv.ErrRange) {
+		token.kind, token.err = jsonError, "invalid number"
+		return token
+	}
+	d.pos = end
+	token.kind, token.value = jsonNumber, lua.LNumber(f)
+	return token
+}
+
+func (d *jsonDecoder) scanString(token jsonToken) jsonToken {
+	var buf strings.Builder
+	i := d.pos + 1
+	for {
+		if i >= len(d.data) {
+			token.kind, token.err = jsonError, "unexpected end of string"
+			return token
+		}
+		c := d.data[i]
+		if c == '"' {
+			break
+		}
+		if c != '\\' {
+			buf.WriteByte(c)
+			i++
+			continue
+		}
+		if i+1 >= len(d.data) {
+			token.kind, token.err = jsonError, "unexpected end of string"
+			return token
+		}
+		switch esc := d.data[i+1]; esc {
+		case '"', '\\', '/':
+			buf.WriteByte(esc)
+		case 'b':
+			buf.WriteByte('\b')
+		case 'f':
+			buf.WriteByte('\f')
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		case 'u':
+			r, n := d.scanUnicodeEscape(i)
+			if n == 0 {
+				token.kind, token.err = jsonError, "invalid unicode escape code"
+				return token
+			}
+			buf.WriteRune(r)
+			i += n
+			continue
+		default:
+			token.kind, token.err = jsonError, "invalid escape code"
+			return token
+		}
+		i += 2
+	}
+	d.pos = i + 1
+	token.kind, token.value = jsonString, lua.LString(buf.String())
+	return token
+}
+
+// scanUnicodeEscape decodes the \uXXXX escape at i, combining surrogate
+// pairs, and returns the rune and the length of the escape, 0 when it is
+// invalid
+func (d *jsonDecoder) scanUnicodeEscape(i int) (rune, int) {
+	hex := func(at int) (rune, bool) {
+		if at+6 > len(d.data) || d.data[at:at+2] != `\u` {
+			return 0, false
+		}
+		n, err := strconv.ParseUint(d.data[at+2:at+6], 16, 16)
+		return rune(n), err == nil
+	}
+	r, ok := hex(i)
+	switch {
+	case !ok || r >= 0xdc00 && r <= 0xdfff:
+		return 0, 0
+	case r < 0xd800 || r > 0xdbff:
+		return r, 6
+	}
+	low, ok := hex(i + 6)
+	if !ok || low < 0xdc00 || low > 0xdfff {
+		return 0, 0
+	}
+	r = 0x10000 + (r-0xd800)<<10 + (low - 0xdc00)
+	if !utf8.ValidRune(r) {
+		return 0, 0
+	}
+	return r, 12
+}
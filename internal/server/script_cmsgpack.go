@@ -0,0 +1,303 @@
+package server
+
+import (
+	"encoding/binary"
+	"math"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Tables nested deeper than this are packed as nil, as lua-cmsgpack does.
+// Unpacking stops at msgpackMaxDepth, which lua-cmsgpack only bounds by
+// the Lua stack.
+const (
+	msgpackMaxNesting = 16
+	msgpackMaxDepth   = 1000
+)
+
+// luaOpenCmsgpack builds the cmsgpack table of lua-cmsgpack, which
+// converts Lua values to and from MessagePack
+func luaOpenCmsgpack(L *lua.LState) *lua.LTable {
+	cmsgpack := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"pack": luaMsgpackPack,
+		"unpack": func(L *lua.LState) int {
+			return luaMsgpackUnpack(L, 0, 0)
+		},
+		"unpack_one": func(L *lua.LState) int {
+			offset := L.OptInt(2, 0)
+			return luaMsgpackUnpack(L, 1, offset)
+		},
+		"unpack_limit": func(L *lua.LState) int {
+			limit := L.CheckInt(2)
+			offset := L.OptInt(3, 0)
+			return luaMsgpackUnpack(L, limit, offset)
+		},
+	})
+	cmsgpack.RawSetString("_NAME", lua.LString("cmsgpack"))
+	cmsgpack.RawSetString("_VERSION", lua.LString("lua-cmsgpack 0.4.0"))
+	return cmsgpack
+}
+
+// luaMsgpackPack implements cmsgpack.pack(...), the concatenation of the
+// encodings of its arguments
+func luaMsgpackPack(L *lua.LState) int {
+	if L.GetTop() == 0 {
+		L.ArgError(0, "MessagePack pack needs input.")
+	}
+	var buf []byte
+	for i := 1; i <= L.GetTop(); i++ {
+		buf = msgpackEncode(buf, L.Get(i), 0)
+	}
+	L.Push(lua.LString(buf))
+	return 1
+}
+
+func msgpackEncode(buf []byte, v lua.LValue, level int) []byte {
+	switch v := v.(type) {
+	case lua.LBool:
+		if v {
+			return append(buf, 0xc3)
+		}
+		return append(buf, 0xc2)
+	case lua.LNumber:
+		f := float64(v)
+		if f >= math.MinInt64 && f < math.MaxInt64 && f == math.Trunc(f) {
+			return msgpackEncodeInt(buf, int64(f))
+		}
+		if float64(float32(f)) == f {
+			buf = append(buf, 0xca)
+			return binary.BigEndian.AppendUint32(buf, math.Float32bits(float32(f)))
+		}
+		buf = append(buf, 0xcb)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(f))
+	case lua.LString:
+		return msgpackEncodeString(buf, string(v))
+	case *lua.LTable:
+		if level == msgpackMaxNesting {
+			break
+		}
+		if n, ok := msgpackArrayLength(v); ok {
+			buf = msgpackEncodeHeader(buf, n, 0x90, 0xdc)
+			for i := 1; i <= n; i++ {
+				buf = msgpackEncode(buf, v.RawGetInt(i), level+1)
+			}
+			return buf
+		}
+		n := 0
+		v.ForEach(func(_, _ lua.LValue) { n++ })
+		buf = msgpackEncodeHeader(buf, n, 0x80, 0xde)
+		v.ForEach(func(key, value lua.LValue) {
+			buf = msgpackEncode(buf, key, level+1)
+			buf = msgpackEncode(buf, value, level+1)
+		})
+		return buf
+	}
+	// nil and the types MessagePack has no encoding for
+	return append(buf, 0xc0)
+}
+
+func msgpackEncodeInt(buf []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 127, n < 0 && n >= -32:
+		return append(buf, byte(n))
+	case n >= 0 && n <= math.MaxUint8:
+		return append(buf, 0xcc, byte(n))
+	case n >= 0 && n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(n))
+	case n >= 0 && n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(n))
+	case n >= 0:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcf), uint64(n))
+	case n >= math.MinInt8:
+		return append(buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(n))
+}
+
+func msgpackEncodeString(buf []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xda), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xdb), uint32(n))
+	}
+	return append(buf, s...)
+}
+
+// msgpackEncodeHeader writes the header of an array or map of n
+// elements, fix being the type byte of the short form and wide the one of
+// the 16 bit form
+func msgpackEncodeHeader(buf []byte, n int, fix, wide byte) []byte {
+	switch {
+	case n < 16:
+		return append(buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, wide), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(buf, wide+1), uint32(n))
+}
+
+// msgpackArrayLength reports whether t is packed as an array, that is
+// whether its keys are exactly 1..n, and returns n
+func msgpackArrayLength(t *lua.LTable) (int, bool) {
+	max, count := 0, 0
+	isArray := true
+	t.ForEach(func(key, _ lua.LValue) {
+		n, ok := key.(lua.LNumber)
+		if !ok || n < 1 || float64(n) != math.Trunc(float64(n)) {
+			isArray = false
+			return
+		}
+		max = int(math.Max(float64(max), float64(n)))
+		count++
+	})
+	return count, isArray && max == count
+}
+
+// luaMsgpackUnpack decodes values from the string argument starting at
+// offset, at most limit of them. Without limit and offset it returns all
+// the values, otherwise the offset of the next value (-1 at the end of the
+// string) comes first.
+func luaMsgpackUnpack(L *lua.LState, limit, offset int) int {
+	data := L.CheckString(1)
+	decodeAll := limit == 0 && offset == 0
+	if offset < 0 || limit < 0 {
+		L.RaiseError("Invalid request to unpack with offset of %d and limit of %d.", offset, limit)
+	}
+	if offset > len(data) {
+		L.RaiseError("Start offset %d greater than input length %d.", offset, len(data))
+	}
+
+	d := &msgpackDecoder{L: L, data: data, pos: offset}
+	var values []lua.LValue
+	for d.pos < len(data) && (decodeAll || len(values) < limit) {
+		values = append(values, d.decode())
+	}
+	if !decodeAll {
+		next := d.pos
+		if next == len(data) {
+			next = -1
+		}
+		L.Push(lua.LNumber(next))
+	}
+	for _, v := range values {
+		L.Push(v)
+	}
+	if decodeAll {
+		return len(values)
+	}
+	return len(values) + 1
+}
+
+// msgpackDecoder reads MessagePack values into Lua values. Integers and
+// floats become numbers, binary data strings, and arrays and maps tables.
+type msgpackDecoder struct {
+	L     *lua.LState
+	data  string
+	pos   int
+	depth int
+}
+
+func (d *msgpackDecoder) take(n int) string {
+	if n < 0 || n > len(d.data)-d.pos {
+		d.L.RaiseError("Missing bytes in input.")
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
+
+func (d *msgpackDecoder) uint(n int) uint64 {
+	var v uint64
+	for _, c := range []byte(d.take(n)) {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func (d *msgpackDecoder) decode() lua.LValue {
+	c := d.take(1)[0]
+	switch {
+	case c <= 0x7f:
+		return lua.LNumber(c)
+	case c >= 0xe0:
+		return lua.LNumber(int8(c))
+	case c&0xe0 == 0xa0:
+		return lua.LString(d.take(int(c & 0x1f)))
+	case c&0xf0 == 0x90:
+		return d.decodeArray(int(c & 0x0f))
+	case c&0xf0 == 0x80:
+		return d.decodeMap(int(c & 0x0f))
+	}
+
+	switch c {
+	case 0xc0:
+		return lua.LNil
+	case 0xc2:
+		return lua.LFalse
+	case 0xc3:
+		return lua.LTrue
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return lua.LNumber(d.uint(1 << (c - 0xcc)))
+	case 0xd0:
+		return lua.LNumber(int8(d.uint(1)))
+	case 0xd1:
+		return lua.LNumber(int16(d.uint(2)))
+	case 0xd2:
+		return lua.LNumber(int32(d.uint(4)))
+	case 0xd3:
+		return lua.LNumber(int64(d.uint(8)))
+	case 0xca:
+		return lua.LNumber(math.Float32frombits(uint32(d.uint(4))))
+	case 0xcb:
+		return lua.LNumber(math.Float64frombits(d.uint(8)))
+	case 0xc4, 0xc5, 0xc6:
+		return lua.LString(d.take(int(d.uint(1 << (c - 0xc4)))))
+	case 0xd9, 0xda, 0xdb:
+		return lua.LString(d.take(int(d.uint(1 << (c - 0xd9)))))
+	case 0xdc, 0xdd:
+		return d.decodeArray(int(d.uint(2 << (c - 0xdc))))
+	case 0xde, 0xdf:
+		return d.decodeMap(int(d.uint(2 << (c - 0xde))))
+	}
+	d.L.RaiseError("Bad data format in input.")
+	return lua.LNil
+}
+
+func (d *msgpackDecoder) descend() {
+	d.depth++
+	if d.depth > msgpackMaxDepth {
+		d.L.RaiseError("Too many nested data structures in input.")
+	}
+}
+
+func (d *msgpackDecoder) decodeArray(n int) lua.LValue {
+	d.descend()
+	t := d.L.NewTable()
+	for i := 1; i <= n; i++ {
+		t.RawSetInt(i, d.decode())
+	}
+	d.depth--
+	return t
+}
+
+func (d *msgpackDecoder) decodeMap(n int) lua.LValue {
+	d.descend()
+	t := d.L.NewTable()
+	for i := 0; i < n; i++ {
+		key, value := d.decode(), d.decode()
+		if key != lua.LNil {
+			t.RawSet(key, value)
+		}
+	}
+	d.depth--
+	return t
+}
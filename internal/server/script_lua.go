@@ -0,0 +1,336 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"redis-learning/pkg/resp"
+)
+
+// Log levels of redis.log
+const (
+	luaLogDebug = iota
+	luaLogVerbose
+	luaLogNotice
+	luaLogWarning
+)
+
+// newLuaState creates the interpreter scripts run in: the subset of the
+// standard library Redis exposes, the cjson, cmsgpack, struct and bit
+// libraries it bundles, the redis table, and globals protected against
+// accidental creation
+func (s *Server) newLuaState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	// Scripts must not touch the file system
+	L.SetGlobal("dofile", lua.LNil)
+	L.SetGlobal("loadfile", lua.LNil)
+
+	L.SetGlobal("cjson", luaOpenCjson(L))
+	L.SetGlobal("cmsgpack", luaOpenCmsgpack(L))
+	L.SetGlobal("struct", luaOpenStruct(L))
+	L.SetGlobal("bit", luaOpenBit(L))
+
+	redis := L.NewTable()
+	L.SetFuncs(redis, map[string]lua.LGFunction{
+		"call":               func(L *lua.LState) int { return s.luaRedisCall(L, true) },
+		"pcall":              func(L *lua.LState) int { return s.luaRedisCall(L, false) },
+		"error_reply":        luaErrorReply,
+		"status_reply":       luaStatusReply,
+		"sha1hex":            luaSha1Hex,
+		"log":                luaLog,
+		"setresp":            s.luaSetResp,
+		"replicate_commands": func(L *lua.LState) int { L.Push(lua.LTrue); return 1 },
+		"set_repl":           func(L *lua.LState) int { L.CheckInt(1); return 0 },
+	})
+	for name, value := range map[string]int{
+		"LOG_DEBUG":    luaLogDebug,
+		"LOG_VERBOSE":  luaLogVerbose,
+		"LOG_NOTICE":   luaLogNotice,
+		"LOG_WARNING":  luaLogWarning,
+		"REPL_NONE":    0,
+		"REPL_AOF":     1,
+		"REPL_SLAVE":   2,
+		"REPL_REPLICA": 2,
+		"REPL_ALL":     3,
+	} {
+		redis.RawSetString(name, lua.LNumber(value))
+	}
+	redis.RawSetString("REDIS_VERSION", lua.LString(redisVersion))
+	redis.RawSetString("REDIS_VERSION_NUM", lua.LNumber(redisVersionNum()))
+	L.SetGlobal("redis", redis)
+
+	// From now on scripts can only read existing globals. KEYS and ARGV
+	// are set with RawSet, which bypasses the metatable.
+	mt := L.NewTable()
+	mt.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("Script attempted to create global variable '%s'", L.ToString(2))
+		return 0
+	}))
+	mt.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("Script attempted to access nonexistent global variable '%s'", L.ToString(2))
+		return 0
+	}))
+	L.SetMetatable(L.G.Global, mt)
+	return L
+}
+
+// redisVersionNum encodes redisVersion as 0x00MMmmpp
+func redisVersionNum() int {
+	num := 0
+	for _, part := range strings.SplitN(redisVersion, ".", 3) {
+		n, _ := strconv.Atoi(part)
+		num = num<<8 | n
+	}
+	return num
+}
+
+// sha1Hex returns the hex SHA1 digest scripts are cached under
+func sha1Hex(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// luaErrorTable builds the {err=...} table Redis errors are represented
+// with in Lua
+func luaErrorTable(L *lua.LState, msg string) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("err", lua.LString(msg))
+	return t
+}
+
+// luaRedisCall implements redis.call, which raises errors, and redis.pcall,
+// which returns them as error tables
+func (s *Server) luaRedisCall(L *lua.LState, raise bool) int {
+	if s.scriptRun == nil {
+		// Library code registering its functions
+		L.RaiseError("redis.call and redis.pcall can only be called inside a script invocation")
+	}
+	reply := s.luaRunCommand(L)
+	if reply.Type == resp.ERROR && raise {
+		s.scriptRun.errWhere = L.Where(1)
+		L.Error(luaErrorTable(L, reply.Str), 0)
+		return 0
+	}
+	L.Push(s.respToLua(L, reply))
+	return 1
+}
+
+// luaRunCommand runs the command given as the arguments of redis.call
+func (s *Server) luaRunCommand(L *lua.LState) resp.Value {
+	n := L.GetTop()
+	if n == 0 {
+		return resp.NewError("ERR Please specify at least one argument for this redis lib call")
+	}
+
+	argv := make([]string, n)
+	for i := 1; i <= n; i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString:
+			argv[i-1] = string(v)
+		case lua.LNumber:
+			argv[i-1] = v.String()
+		default:
+			return resp.NewError("ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+	return s.scriptCall(argv)
+}
+
+// luaErrorReply implements redis.error_reply
+func luaErrorReply(L *lua.LState) int {
+	msg := L.CheckString(1)
+	L.Push(luaErrorTable(L, msg))
+	return 1
+}
+
+// luaStatusReply implements redis.status_reply
+func luaStatusReply(L *lua.LState) int {
+	t := L.NewTable()
+	t.RawSetString("ok", lua.LString(L.CheckString(1)))
+	L.Push(t)
+	return 1
+}
+
+// luaSha1Hex implements redis.sha1hex
+func luaSha1Hex(L *lua.LState) int {
+	if L.GetTop() != 1 {
+		L.RaiseError("wrong number of arguments")
+	}
+	L.Push(lua.LString(sha1Hex(L.ToString(1))))
+	return 1
+}
+
+// luaLog implements redis.log
+func luaLog(L *lua.LState) int {
+	if L.GetTop() < 2 {
+		L.RaiseError("redis.log() requires two arguments or more.")
+	}
+	level := L.CheckInt(1)
+	if level < luaLogDebug || level > luaLogWarning {
+		L.RaiseError("Invalid debug level.")
+	}
+	parts := make([]string, 0, L.GetTop()-1)
+	for i := 2; i <= L.GetTop(); i++ {
+		parts = append(parts, L.ToString(i))
+	}
+	log.Printf("Script log: %s", strings.Join(parts, " "))
+	return 0
+}
+
+// luaSetResp implements redis.setresp, which selects the protocol replies
+// of redis.call are converted from
+func (s *Server) luaSetResp(L *lua.LState) int {
+	if L.GetTop() != 1 {
+		L.RaiseError("redis.setresp() requires one argument.")
+	}
+	proto := L.CheckInt(1)
+	if proto != 2 && proto != 3 {
+		L.RaiseError("RESP version must be 2 or 3.")
+	}
+	s.scriptClient.proto = proto
+	return 0
+}
+
+// respToLua converts a command reply to Lua following Redis's rules:
+// integers become numbers, bulk strings strings, arrays tables, nulls false,
+// status replies {ok=...} tables and errors {err=...} tables. With RESP3
+// maps become {map={...}} tables, otherwise flat arrays.
+func (s *Server) respToLua(L *lua.LState, v resp.Value) lua.LValue {
+	switch v.Type {
+	case resp.INTEGER:
+		return lua.LNumber(v.Num)
+	case resp.BULK:
+		if v.Null {
+			return lua.LFalse
+		}
+		return lua.LString(v.Bulk)
+	case resp.STRING:
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(v.Str))
+		return t
+	case resp.ERROR:
+		return luaErrorTable(L, v.Str)
+	case resp.MAP:
+		if s.scriptClient.proto == 3 {
+			m := L.NewTable()
+			for i := 0; i+1 < len(v.Array); i += 2 {
+				m.RawSet(s.respToLua(L, v.Array[i]), s.respToLua(L, v.Array[i+1]))
+			}
+			t := L.NewTable()
+			t.RawSetString("map", m)
+			return t
+		}
+		fallthrough
+	default: // arrays and pushes
+		if v.Null {
+			return lua.LFalse
+		}
+		t := L.NewTable()
+		for _, elem := range v.Array {
+			t.Append(s.respToLua(L, elem))
+		}
+		return t
+	}
+}
+
+// luaToResp converts the value returned by a script to a reply. Numbers are
+// truncated to integers, true becomes 1 and false or nil a null bulk string.
+// Tables with an err or ok field become errors and status replies, and
+// other tables arrays made of their elements up to the first nil.
+func luaToResp(v lua.LValue) resp.Value {
+	switch v := v.(type) {
+	case lua.LString:
+		return resp.NewBulkString(string(v))
+	case lua.LNumber:
+		return resp.NewInteger(luaNumberToInt(v))
+	case lua.LBool:
+		if v {
+			return resp.NewInteger(1)
+		}
+		return resp.NewNullBulkString()
+	case *lua.LTable:
+		if err, ok := v.RawGetString("err").(lua.LString); ok {
+			return resp.NewError(errorSafe(strings.TrimPrefix(string(err), "-")))
+		}
+		if status, ok := v.RawGetString("ok").(lua.LString); ok {
+			return resp.NewSimpleString(string(status))
+		}
+		if m, ok := v.RawGetString("map").(*lua.LTable); ok {
+			var values []resp.Value
+			m.ForEach(func(key, value lua.LValue) {
+				values = append(values, luaToResp(key), luaToResp(value))
+			})
+			return resp.NewMap(values)
+		}
+		if d, ok := v.RawGetString("double").(lua.LNumber); ok {
+			return resp.NewBulkString(strconv.FormatFloat(float64(d), 'g', 17, 64))
+		}
+		values := []resp.Value{}
+		for i := 1; ; i++ {
+			elem := v.RawGetInt(i)
+			if elem == lua.LNil {
+				break
+			}
+			values = append(values, luaToResp(elem))
+		}
+		return resp.NewArray(values)
+	default:
+		return resp.NewNullBulkString()
+	}
+}
+
+// errorSafe replaces newlines, which can't appear in error replies, with
+// spaces
+func errorSafe(msg string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+}
+
+// luaNumberToInt truncates a Lua number the way the C cast Redis uses does
+// on x86-64: NaN and values out of range become math.MinInt64, so 1e20
+// replies -9223372036854775808 rather than a clamped value
+func luaNumberToInt(n lua.LNumber) int {
+	f := float64(n)
+	if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return math.MinInt64
+	}
+	return int(f)
+}
+
+// luaErrorMessage extracts the message of an error raised by a script,
+// which may be a plain string or an {err=...} table
+func luaErrorMessage(err error) (msg string, isTable bool) {
+	apiErr, ok := err.(*lua.ApiError)
+	if !ok {
+		return err.Error(), false
+	}
+	if t, ok := apiErr.Object.(*lua.LTable); ok {
+		if e, ok := t.RawGetString("err").(lua.LString); ok {
+			return strings.TrimPrefix(string(e), "-"), true
+		}
+	}
+	if apiErr.Object != nil {
+		return apiErr.Object.String(), false
+	}
+	return fmt.Sprint(apiErr.Cause), false
+}
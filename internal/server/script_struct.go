@@ -0,0 +1,277 @@
+package server
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Limits of the struct library: the largest integer size and the default
+// alignment of "!"
+const (
+	structMaxIntSize = 32
+	structMaxAlign   = 8
+)
+
+// luaOpenStruct builds the struct table of Roberto Ierusalimschy's struct
+// library, which converts between Lua values and C structs. Sizes are
+// those of a 64 bit platform, and the native byte order little endian.
+func luaOpenStruct(L *lua.LState) *lua.LTable {
+	return L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"pack":   luaStructPack,
+		"unpack": luaStructUnpack,
+		"size":   luaStructSize,
+	})
+}
+
+// structFormat walks a format string, tracking the byte order and the
+// alignment its options set
+type structFormat struct {
+	L     *lua.LState
+	fmt   string
+	pos   int
+	big   bool
+	align int
+}
+
+func newStructFormat(L *lua.LState) *structFormat {
+	return &structFormat{L: L, fmt: L.CheckString(1), align: 1}
+}
+
+// next returns the next option and the size of the data it describes
+func (f *structFormat) next() (byte, int) {
+	opt := f.fmt[f.pos]
+	f.pos++
+	switch opt {
+	case 'b', 'B', 'x':
+		return opt, 1
+	case 'h', 'H':
+		return opt, 2
+	case 'f':
+		return opt, 4
+	case 'i', 'I':
+		size := f.number(4)
+		if size > structMaxIntSize {
+			f.L.RaiseError("integral size %d is larger than limit of %d", size, structMaxIntSize)
+		}
+		return opt, size
+	case 'l', 'L', 'T', 'd':
+		return opt, 8
+	case 'c':
+		return opt, f.number(1)
+	}
+	return opt, 0
+}
+
+// number reads the optional number following an option
+func (f *structFormat) number(def int) int {
+	if f.pos == len(f.fmt) || f.fmt[f.pos] < '0' || f.fmt[f.pos] > '9' {
+		return def
+	}
+	n := 0
+	for ; f.pos < len(f.fmt) && f.fmt[f.pos] >= '0' && f.fmt[f.pos] <= '9'; f.pos++ {
+		digit := int(f.fmt[f.pos] - '0')
+		if n > (math.MaxInt32-digit)/10 {
+			f.L.RaiseError("integral size overflow")
+		}
+		n = n*10 + digit
+	}
+	return n
+}
+
+// padding returns the bytes needed to align data of size at offset
+func (f *structFormat) padding(offset int, opt byte, size int) int {
+	if size == 0 || opt == 'c' {
+		return 0
+	}
+	size = min(size, f.align)
+	return (size - offset&(size-1)) & (size - 1)
+}
+
+// control applies an option that describes no data
+func (f *structFormat) control(opt byte) {
+	switch opt {
+	case ' ':
+	case '>':
+		f.big = true
+	case '<':
+		f.big = false
+	case '!':
+		a := f.number(structMaxAlign)
+		if a&(a-1) != 0 {
+			f.L.RaiseError("alignment %d is not a power of 2", a)
+		}
+		f.align = a
+	default:
+		f.L.ArgError(1, "invalid format option '"+string(opt)+"'")
+	}
+}
+
+// order returns the byte order set by the format
+func (f *structFormat) order() interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+} {
+	if f.big {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// luaStructPack implements struct.pack(fmt, ...)
+func luaStructPack(L *lua.LState) int {
+	f := newStructFormat(L)
+	arg := 2
+	var buf []byte
+	for f.pos < len(f.fmt) {
+		opt, size := f.next()
+		buf = append(buf, make([]byte, f.padding(len(buf), opt, size))...)
+		switch opt {
+		case 'b', 'B', 'h', 'H', 'l', 'L', 'T', 'i', 'I':
+			n := float64(L.CheckNumber(arg))
+			arg++
+			var value uint64
+			if n < 0 {
+				value = uint64(int64(n))
+			} else {
+				value = uint64(n)
+			}
+			b := make([]byte, size)
+			for i := range b {
+				b[i] = byte(value)
+				value >>= 8
+			}
+			if f.big {
+				for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+					b[i], b[j] = b[j], b[i]
+				}
+			}
+			buf = append(buf, b...)
+		case 'x':
+			buf = append(buf, 0)
+		case 'f':
+			buf = f.order().AppendUint32(buf, math.Float32bits(float32(L.CheckNumber(arg))))
+			arg++
+		case 'd':
+			buf = f.order().AppendUint64(buf, math.Float64bits(float64(L.CheckNumber(arg))))
+			arg++
+		case 'c', 's':
+			s := L.CheckString(arg)
+			arg++
+			if size == 0 {
+				size = len(s)
+			}
+			if len(s) < size {
+				L.ArgError(arg, "string too short")
+			}
+			buf = append(buf, s[:size]...)
+			if opt == 's' {
+				buf = append(buf, 0)
+			}
+		default:
+			f.control(opt)
+		}
+	}
+	L.Push(lua.LString(buf))
+	return 1
+}
+
+// luaStructUnpack implements struct.unpack(fmt, data [, pos]), returning
+// the values followed by the position after them
+func luaStructUnpack(L *lua.LState) int {
+	f := newStructFormat(L)
+	data := L.CheckString(2)
+	pos := L.OptInt(3, 1)
+	if pos <= 0 {
+		L.ArgError(3, "offset must be 1 or greater")
+	}
+	pos--
+	n := 0
+	for f.pos < len(f.fmt) {
+		opt, size := f.next()
+		pos += f.padding(pos, opt, size)
+		if size > len(data) || pos > len(data)-size {
+			L.ArgError(2, "data string too short")
+		}
+		switch opt {
+		case 'b', 'B', 'h', 'H', 'l', 'L', 'T', 'i', 'I':
+			var value uint64
+			for i := 0; i < size; i++ {
+				c := data[pos+size-1-i]
+				if f.big {
+					c = data[pos+i]
+				}
+				value = value<<8 | uint64(c)
+			}
+			if opt >= 'a' && opt <= 'z' {
+				// Extend the sign of integers narrower than 64 bits
+				if mask := ^uint64(0) << (size*8 - 1); size < 8 && value&mask != 0 {
+					value |= mask
+				}
+				L.Push(lua.LNumber(int64(value)))
+			} else {
+				L.Push(lua.LNumber(value))
+			}
+			n++
+		case 'x':
+		case 'f':
+			L.Push(lua.LNumber(math.Float32frombits(f.order().Uint32([]byte(data[pos : pos+4])))))
+			n++
+		case 'd':
+			L.Push(lua.LNumber(math.Float64frombits(f.order().Uint64([]byte(data[pos : pos+8])))))
+			n++
+		case 'c':
+			if size == 0 {
+				prev, ok := L.Get(-1).(lua.LNumber)
+				if n == 0 || !ok {
+					L.RaiseError("format 'c0' needs a previous size")
+				}
+				L.Pop(1)
+				n--
+				size = int(prev)
+				if size < 0 || size > len(data) || pos > len(data)-size {
+					L.ArgError(2, "data string too short")
+				}
+			}
+			L.Push(lua.LString(data[pos : pos+size]))
+			n++
+		case 's':
+			end := strings.IndexByte(data[pos:], 0)
+			if end < 0 {
+				L.RaiseError("unfinished string in data")
+			}
+			L.Push(lua.LString(data[pos : pos+end]))
+			n++
+			size = end + 1
+		default:
+			f.control(opt)
+		}
+		pos += size
+	}
+	L.Push(lua.LNumber(pos + 1))
+	return n + 1
+}
+
+// luaStructSize implements struct.size(fmt), the size of the data a
+// format describes
+func luaStructSize(L *lua.LState) int {
+	f := newStructFormat(L)
+	pos := 0
+	for f.pos < len(f.fmt) {
+		opt, size := f.next()
+		pos += f.padding(pos, opt, size)
+		switch {
+		case opt == 's':
+			L.ArgError(1, "options 's' has no fixed size")
+		case opt == 'c' && size == 0:
+			L.ArgError(1, "option 'c0' has no fixed size")
+		case !(opt >= 'a' && opt <= 'z' || opt >= 'A' && opt <= 'Z' || opt >= '0' && opt <= '9'):
+			f.control(opt)
+		}
+		pos += size
+	}
+	L.Push(lua.LNumber(pos))
+	return 1
+}
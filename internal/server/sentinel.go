@@ -0,0 +1,1662 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-learning/pkg/resp"
+)
+
+// Sentinel timing, as in Redis
+const (
+	defaultSentinelDownAfter       = 30 * time.Second
+	defaultSentinelFailoverTimeout = 3 * time.Minute
+	defaultSentinelParallelSyncs   = 1
+
+	sentinelHelloChannel = "__sentinel__:hello"
+
+	sentinelInfoPeriod    = 10 * time.Second
+	sentinelPingPeriod    = time.Second
+	sentinelAskPeriod     = time.Second
+	sentinelPublishPeriod = 2 * time.Second
+
+	// Sentinels start their failover attempts up to this much apart, so
+	// that one of them usually gets elected
+	sentinelMaxDesync = time.Second
+
+	sentinelElectionTimeout      = 10 * time.Second
+	sentinelReplicaReconfTimeout = 10 * time.Second
+
+	// A link is only dropped for not replying once it has been connected
+	// for this long
+	sentinelMinLinkReconnectPeriod = 15 * time.Second
+	sentinelMaxPendingCommands     = 100
+)
+
+// Flags of a monitored instance
+const (
+	sriMaster = 1 << iota
+	sriReplica
+	sriSentinel
+	sriSDown              // subjectively down: not replying to us
+	sriODown              // objectively down: enough sentinels agree
+	sriMasterDown         // a sentinel that said the master is down
+	sriFailoverInProgress // a master being failed over
+	sriPromoted           // the replica chosen for promotion
+	sriReconfSent         // replicas being pointed to the promoted replica
+	sriReconfInprog
+	sriReconfDone
+	sriForceFailover // requested with SENTINEL FAILOVER
+)
+
+// sentinelFlagNames lists the flags in the order SENTINEL MASTER shows them.
+// disconnected isn't a flag but is shown among them.
+var sentinelFlagNames = []struct {
+	flag int
+	name string
+}{
+	{sriSDown, "s_down"},
+	{sriODown, "o_down"},
+	{sriMaster, "master"},
+	{sriReplica, "slave"},
+	{sriSentinel, "sentinel"},
+	{0, "disconnected"},
+	{sriMasterDown, "master_down"},
+	{sriFailoverInProgress, "failover_in_progress"},
+	{sriPromoted, "promoted"},
+	{sriReconfSent, "reconf_sent"},
+	{sriReconfInprog, "reconf_inprog"},
+	{sriReconfDone, "reconf_done"},
+	{sriForceFailover, "force_failover"},
+}
+
+// Failover states of a master
+const (
+	failoverNone = iota
+	failoverWaitStart
+	failoverSelectReplica
+	failoverSendReplicaofNoOne
+	failoverWaitPromotion
+	failoverReconfReplicas
+	failoverUpdateConfig
+)
+
+// sentinelState is what a server in Sentinel mode keeps.
+//
+// Sentinels monitor masters, discovering their replicas through INFO and
+// the other sentinels monitoring them through hello messages published on
+// the masters and replicas. A master that doesn't reply for
+// down-after-milliseconds is subjectively down; once a quorum of sentinels
+// agree, it is objectively down and the sentinels elect one of them, for
+// a new configuration epoch, to fail it over: the leader promotes the best
+// replica and points the others to it. Its hello messages then spread the
+// new configuration to the other sentinels, which switch to the new master
+// as it has a greater epoch.
+type sentinelState struct {
+	myid         string
+	currentEpoch int64
+	masters      map[string]*sentinelInstance
+}
+
+// sentinelInstance is a master, replica or other sentinel, as seen by this
+// sentinel
+type sentinelInstance struct {
+	flags       int
+	name        string // of the master, or the address of others
+	runid       string
+	configEpoch int64
+	host        string
+	port        int
+	link        *sentinelLink
+
+	master *sentinelInstance // of replicas and sentinels
+
+	lastPubTime             time.Time // last hello we sent
+	lastHelloTime           time.Time // sentinels: last hello we got
+	lastMasterDownReplyTime time.Time // sentinels: last reply to our ask
+	sdownSince              time.Time
+	odownSince              time.Time
+	downAfter               time.Duration
+
+	// From INFO
+	infoRefresh           time.Time
+	roleReported          int // sriMaster or sriReplica
+	roleReportedTime      time.Time
+	replicaConfChangeTime time.Time // when its master last changed
+	masterLinkDownTime    time.Duration
+	replMasterHost        string
+	replMasterPort        int
+	replMasterLinkUp      bool
+	replicaPriority       int
+	replOffset            int64
+
+	// Masters only
+	sentinels     map[string]*sentinelInstance
+	replicas      map[string]*sentinelInstance
+	quorum        int
+	parallelSyncs int
+
+	// The leader we voted for in leaderEpoch, or for sentinels the one
+	// they replied they voted for
+	leader      string
+	leaderEpoch int64
+
+	failoverEpoch           int64
+	failoverState           int
+	failoverStateChangeTime time.Time
+	failoverStartTime       time.Time
+	failoverTimeout         time.Duration
+	failoverDelayLogged     time.Time
+	promoted                *sentinelInstance
+	replicaReconfSentTime   time.Time
+}
+
+// sentinelLink is the connection of a sentinel to an instance: a command
+// connection, and for masters and replicas a connection subscribed to the
+// hello channel. Replies are matched to the commands in the order they
+// were sent.
+type sentinelLink struct {
+	conn       net.Conn
+	pubsub     net.Conn
+	connecting bool
+	released   bool // the instance is gone
+	connTime   time.Time
+	pending    []func(reply resp.Value)
+
+	lastReconnect  time.Time
+	pcLastActivity time.Time // last message on the pubsub connection
+
+	// actPingTime is when the oldest unanswered PING was sent, zero when
+	// there is none. lastAvailTime is the last valid reply to a PING,
+	// lastPongTime the last reply of any kind.
+	actPingTime   time.Time
+	lastPingTime  time.Time
+	lastPongTime  time.Time
+	lastAvailTime time.Time
+}
+
+// sentinelCommandTable lists the commands a sentinel runs
+var sentinelCommandTable = map[string]commandInfo{
+	"PING":         commandTable["PING"],
+	"SENTINEL":     {arity: -2, flags: cmdNoScript | cmdLoading},
+	"SUBSCRIBE":    commandTable["SUBSCRIBE"],
+	"UNSUBSCRIBE":  commandTable["UNSUBSCRIBE"],
+	"PSUBSCRIBE":   commandTable["PSUBSCRIBE"],
+	"PUNSUBSCRIBE": commandTable["PUNSUBSCRIBE"],
+	"PUBLISH":      commandTable["PUBLISH"],
+	"INFO":         commandTable["INFO"],
+	"ROLE":         commandTable["ROLE"],
+	"SHUTDOWN":     commandTable["SHUTDOWN"],
+	"HELLO":        commandTable["HELLO"],
+	"RESET":        commandTable["RESET"],
+	"QUIT":         commandTable["QUIT"],
+}
+
+// sentinelInfoSections lists the INFO sections of a sentinel
+var sentinelInfoSections = []infoSection{
+	{"server", (*Server).infoServer},
+	{"sentinel", (*Server).infoSentinel},
+}
+
+// NewSentinel creates a server running in Sentinel mode. Masters to
+// monitor are added with SENTINEL MONITOR.
+func NewSentinel(host, port string) *Server {
+	s := NewServer(host, port)
+	s.sentinel = &sentinelState{
+		myid:    randomReplID(),
+		masters: make(map[string]*sentinelInstance),
+	}
+	s.persist.saveParams = nil
+	return s
+}
+
+// SentinelConfig runs a SENTINEL subcommand, such as MONITOR or SET, to
+// configure a sentinel before it starts
+func (s *Server) SentinelConfig(args ...string) error {
+	if s.sentinel == nil {
+		return errors.New("not running in Sentinel mode")
+	}
+	values := make([]resp.Value, len(args))
+	for i, arg := range args {
+		values[i] = resp.NewBulkString(arg)
+	}
+	if len(values) == 0 {
+		return errors.New("missing SENTINEL subcommand")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reply := s.handleSentinel(values); reply.Type == resp.ERROR {
+		return errors.New(reply.Str)
+	}
+	return nil
+}
+
+// sentinelDispatch runs the commands that behave differently in Sentinel
+// mode. It returns false for the others.
+func (s *Server) sentinelDispatch(c *Client, cmd string, args []resp.Value) (resp.Value, bool) {
+	switch cmd {
+	case "SENTINEL":
+		return s.handleSentinel(args), true
+	case "PUBLISH":
+		// Other sentinels send their hello messages straight to us
+		if len(args) != 2 || args[0].Bulk != sentinelHelloChannel {
+			return resp.NewError("ERR Only HELLO messages are accepted by Sentinel instances."), true
+		}
+		s.sentinelProcessHelloMessage(args[1].Bulk)
+		return resp.NewInteger(1), true
+	case "ROLE":
+		names := sortedKeys(s.sentinel.masters)
+		masters := make([]resp.Value, len(names))
+		for i, name := range names {
+			masters[i] = resp.NewBulkString(name)
+		}
+		return resp.NewArray([]resp.Value{resp.NewBulkString("sentinel"), resp.NewArray(masters)}), true
+	}
+	return resp.Value{}, false
+}
+
+// sentinelEvent logs an event and publishes it on the channel named after
+// its type. A format starting with %@ is prefixed with the instance: its
+// type, name and address, followed by its master's for replicas and
+// sentinels.
+func (s *Server) sentinelEvent(typ string, ri *sentinelInstance, format string, args ...any) {
+	msg := fmt.Sprintf(strings.TrimPrefix(format, "%@"), args...)
+	if strings.HasPrefix(format, "%@") {
+		desc := fmt.Sprintf("%s %s %s %d", sentinelInstanceType(ri), ri.name, ri.host, ri.port)
+		if ri.master != nil {
+			desc += fmt.Sprintf(" @ %s %s %d", ri.master.name, ri.master.host, ri.master.port)
+		}
+		msg = desc + msg
+	}
+	log.Printf("%s %s", typ, msg)
+	s.pubsubPublishMessage(typ, msg, pubsubClassic)
+}
+
+func sentinelInstanceType(ri *sentinelInstance) string {
+	switch {
+	case ri.flags&sriMaster != 0:
+		return "master"
+	case ri.flags&sriReplica != 0:
+		return "slave"
+	}
+	return "sentinel"
+}
+
+// createSentinelInstance creates a monitored master, or a replica or
+// sentinel of master. Replicas and sentinels are named after their address.
+func (s *Server) createSentinelInstance(name string, flags int, host string, port int, master *sentinelInstance) *sentinelInstance {
+	now := time.Now()
+	ri := &sentinelInstance{
+		flags: flags,
+		name:  name,
+		host:  host,
+		port:  port,
+		// An instance never reached is considered down after downAfter
+		link: &sentinelLink{
+			actPingTime:   now,
+			lastPongTime:  now,
+			lastAvailTime: now,
+		},
+		master:                master,
+		downAfter:             defaultSentinelDownAfter,
+		roleReported:          flags & (sriMaster | sriReplica),
+		roleReportedTime:      now,
+		replicaConfChangeTime: now,
+		replicaPriority:       defaultReplicaPriority,
+		quorum:                1,
+		parallelSyncs:         defaultSentinelParallelSyncs,
+		failoverTimeout:       defaultSentinelFailoverTimeout,
+	}
+	switch {
+	case master == nil:
+		ri.sentinels = make(map[string]*sentinelInstance)
+		ri.replicas = make(map[string]*sentinelInstance)
+	case flags&sriReplica != 0:
+		ri.downAfter = master.downAfter
+		master.replicas[name] = ri
+	default:
+		ri.downAfter = master.downAfter
+		master.sentinels[name] = ri
+	}
+	return ri
+}
+
+// releaseSentinelInstance closes the link of an instance that is forgotten,
+// with its replicas and sentinels for a master
+func (s *Server) releaseSentinelInstance(ri *sentinelInstance) {
+	for _, r := range ri.replicas {
+		s.releaseSentinelInstance(r)
+	}
+	for _, si := range ri.sentinels {
+		s.releaseSentinelInstance(si)
+	}
+	s.sentinelCloseLinkConnection(ri.link)
+	ri.link.released = true
+}
+
+// sentinelReleaseAll closes the links of every instance, once the sentinel
+// stops
+func (s *Server) sentinelReleaseAll() {
+	for _, ri := range s.sentinel.masters {
+		s.releaseSentinelInstance(ri)
+	}
+}
+
+// sentinelReplicaByAddr finds a replica of master by address
+func sentinelReplicaByAddr(master *sentinelInstance, host string, port int) *sentinelInstance {
+	return master.replicas[net.JoinHostPort(host, strconv.Itoa(port))]
+}
+
+// sentinelMasterAddr returns where a master is: the promoted replica once
+// a failover reached that point
+func sentinelMasterAddr(master *sentinelInstance) (string, int) {
+	if master.flags&sriFailoverInProgress != 0 && master.promoted != nil && master.failoverState >= failoverReconfReplicas {
+		return master.promoted.host, master.promoted.port
+	}
+	return master.host, master.port
+}
+
+// sortedInstances returns instances by name, so that they are handled in a
+// stable order
+func sortedInstances(set map[string]*sentinelInstance) []*sentinelInstance {
+	names := sortedKeys(set)
+	instances := make([]*sentinelInstance, len(names))
+	for i, name := range names {
+		instances[i] = set[name]
+	}
+	return instances
+}
+
+// sentinelResetMaster forgets what was learnt about a master: its replicas
+// and, unless keepSentinels, the other sentinels, its failover state and
+// its link
+func (s *Server) sentinelResetMaster(ri *sentinelInstance, keepSentinels bool) {
+	for _, r := range ri.replicas {
+		s.releaseSentinelInstance(r)
+	}
+	ri.replicas = make(map[string]*sentinelInstance)
+	if !keepSentinels {
+		for _, si := range ri.sentinels {
+			s.releaseSentinelInstance(si)
+		}
+		ri.sentinels = make(map[string]*sentinelInstance)
+	}
+	s.sentinelCloseLinkConnection(ri.link)
+	ri.link.released = true
+	now := time.Now()
+	ri.link = &sentinelLink{actPingTime: now, lastPongTime: now, lastAvailTime: now}
+
+	ri.flags &= sriMaster
+	ri.leader = ""
+	ri.failoverState = failoverNone
+	ri.failoverStateChangeTime = time.Time{}
+	ri.failoverStartTime = time.Time{}
+	ri.promoted = nil
+	ri.runid = ""
+	ri.infoRefresh = time.Time{}
+	ri.roleReported = sriMaster
+	ri.roleReportedTime = now
+	ri.lastPubTime = time.Time{}
+}
+
+// sentinelResetMasterAndChangeAddress points a master to a new address,
+// e.g. after a failover. The replicas are kept, except the new master,
+// and the old master is added as one of them.
+func (s *Server) sentinelResetMasterAndChangeAddress(master *sentinelInstance, host string, port int) {
+	type addr struct {
+		host string
+		port int
+	}
+	var replicas []addr
+	for _, r := range sortedInstances(master.replicas) {
+		if r.host != host || r.port != port {
+			replicas = append(replicas, addr{r.host, r.port})
+		}
+	}
+	if master.host != host || master.port != port {
+		replicas = append(replicas, addr{master.host, master.port})
+	}
+
+	s.sentinelResetMaster(master, true)
+	master.host, master.port = host, port
+	for _, r := range replicas {
+		s.createSentinelInstance(net.JoinHostPort(r.host, strconv.Itoa(r.port)), sriReplica, r.host, r.port, master)
+	}
+}
+
+// sentinelTimer runs from the cron of a sentinel, handling every instance
+// and the failovers in progress. The caller must hold the server lock.
+func (s *Server) sentinelTimer() {
+	for _, master := range sortedInstances(s.sentinel.masters) {
+		s.sentinelHandleInstance(master)
+		for _, r := range sortedInstances(master.replicas) {
+			s.sentinelHandleInstance(r)
+		}
+		for _, si := range sortedInstances(master.sentinels) {
+			s.sentinelHandleInstance(si)
+		}
+		if master.failoverState == failoverUpdateConfig {
+			s.sentinelFailoverSwitchToPromotedReplica(master)
+		}
+	}
+}
+
+// sentinelHandleInstance monitors an instance, and for masters decides
+// whether they are down and drives their failover
+func (s *Server) sentinelHandleInstance(ri *sentinelInstance) {
+	s.sentinelReconnectInstance(ri)
+	s.sentinelSendPeriodicCommands(ri)
+	s.sentinelCheckSubjectivelyDown(ri)
+	if ri.flags&sriMaster != 0 {
+		s.sentinelCheckObjectivelyDown(ri)
+		if s.sentinelStartFailoverIfNeeded(ri) {
+			s.sentinelAskMasterStateToOtherSentinels(ri, true)
+		}
+		s.sentinelFailoverStateMachine(ri)
+		s.sentinelAskMasterStateToOtherSentinels(ri, false)
+	}
+}
+
+// sentinelReconnectInstance connects the link of an instance in the
+// background if it is down, at most once per ping period
+func (s *Server) sentinelReconnectInstance(ri *sentinelInstance) {
+	link := ri.link
+	if link.conn != nil || link.connecting || time.Since(link.lastReconnect) < sentinelPingPeriod {
+		return
+	}
+	link.lastReconnect = time.Now()
+	link.connecting = true
+	addr := net.JoinHostPort(ri.host, strconv.Itoa(ri.port))
+	withPubsub := ri.flags&sriSentinel == 0
+	go func() {
+		conn, err := net.DialTimeout("tcp", addr, sentinelPingPeriod)
+		var pubsub net.Conn
+		if err == nil && withPubsub {
+			if pubsub, err = net.DialTimeout("tcp", addr, sentinelPingPeriod); err != nil {
+				conn.Close()
+			}
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		link.connecting = false
+		if err != nil {
+			return
+		}
+		if link.released {
+			conn.Close()
+			if pubsub != nil {
+				pubsub.Close()
+			}
+			return
+		}
+		link.conn, link.pubsub = conn, pubsub
+		link.connTime = time.Now()
+		link.pcLastActivity = link.connTime
+		link.pending = nil
+		go s.sentinelReadReplies(link, conn)
+		if pubsub != nil {
+			pubsub.SetWriteDeadline(time.Now().Add(sentinelPingPeriod))
+			pubsub.Write(aofAppendCommand(nil, []string{"SUBSCRIBE", sentinelHelloChannel}))
+			go s.sentinelReadHellos(link, pubsub)
+		}
+		s.sentinelSendPing(ri)
+	}()
+}
+
+// sentinelCloseLinkConnection drops the connections of a link, which is
+// reconnected later unless released
+func (s *Server) sentinelCloseLinkConnection(link *sentinelLink) {
+	if link.conn != nil {
+		link.conn.Close()
+		link.conn = nil
+	}
+	if link.pubsub != nil {
+		link.pubsub.Close()
+		link.pubsub = nil
+	}
+	link.pending = nil
+}
+
+// sentinelReadReplies hands the replies read on the command connection of
+// a link to the callbacks of the commands, in order
+func (s *Server) sentinelReadReplies(link *sentinelLink, conn net.Conn) {
+	parser := resp.NewParser(conn)
+	for {
+		reply, err := parser.Read()
+		s.mu.Lock()
+		if link.conn != conn {
+			s.mu.Unlock()
+			return
+		}
+		if err != nil {
+			s.sentinelCloseLinkConnection(link)
+			s.mu.Unlock()
+			return
+		}
+		if len(link.pending) > 0 {
+			callback := link.pending[0]
+			link.pending = link.pending[1:]
+			callback(reply)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// sentinelReadHellos processes the hello messages received on the pubsub
+// connection of a link
+func (s *Server) sentinelReadHellos(link *sentinelLink, conn net.Conn) {
+	parser := resp.NewParser(conn)
+	for {
+		msg, err := parser.Read()
+		s.mu.Lock()
+		if link.pubsub != conn {
+			s.mu.Unlock()
+			return
+		}
+		if err != nil {
+			s.sentinelCloseLinkConnection(link)
+			s.mu.Unlock()
+			return
+		}
+		link.pcLastActivity = time.Now()
+		if len(msg.Array) == 3 && msg.Array[0].Bulk == "message" && msg.Array[1].Bulk == sentinelHelloChannel {
+			s.sentinelProcessHelloMessage(msg.Array[2].Bulk)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// sentinelSendCommand sends a command on the link of an instance, calling
+// callback with its reply. It returns false if the link is down.
+func (s *Server) sentinelSendCommand(ri *sentinelInstance, argv []string, callback func(reply resp.Value)) bool {
+	link := ri.link
+	if link.conn == nil {
+		return false
+	}
+	link.conn.SetWriteDeadline(time.Now().Add(sentinelPingPeriod))
+	if _, err := link.conn.Write(aofAppendCommand(nil, argv)); err != nil {
+		s.sentinelCloseLinkConnection(link)
+		return false
+	}
+	if callback == nil {
+		callback = func(resp.Value) {}
+	}
+	link.pending = append(link.pending, callback)
+	return true
+}
+
+// sentinelSendPing pings an instance. Only PONG and the errors of an
+// instance that is busy loading or without its master count as the
+// instance being available.
+func (s *Server) sentinelSendPing(ri *sentinelInstance) bool {
+	link := ri.link
+	ok := s.sentinelSendCommand(ri, []string{"PING"}, func(reply resp.Value) {
+		now := time.Now()
+		switch {
+		case reply.Type == resp.STRING && reply.Str == "PONG",
+			reply.Type == resp.ERROR && (strings.HasPrefix(reply.Str, "LOADING") || strings.HasPrefix(reply.Str, "MASTERDOWN")):
+			link.lastAvailTime = now
+			link.actPingTime = time.Time{}
+		}
+		link.lastPongTime = now
+	})
+	if ok {
+		link.lastPingTime = time.Now()
+		if link.actPingTime.IsZero() {
+			link.actPingTime = link.lastPingTime
+		}
+	}
+	return ok
+}
+
+// sentinelSendHello publishes our hello message for the master of ri on ri:
+// our address, ID and epoch, and the master's name, address and
+// configuration epoch
+func (s *Server) sentinelSendHello(ri *sentinelInstance) bool {
+	link := ri.link
+	if link.conn == nil {
+		return false
+	}
+	master := ri
+	if ri.flags&sriMaster == 0 {
+		master = ri.master
+	}
+	host, _, _ := net.SplitHostPort(link.conn.LocalAddr().String())
+	masterHost, masterPort := sentinelMasterAddr(master)
+	hello := fmt.Sprintf("%s,%s,%s,%d,%s,%s,%d,%d", host, s.port, s.sentinel.myid, s.sentinel.currentEpoch,
+		master.name, masterHost, masterPort, master.configEpoch)
+	return s.sentinelSendCommand(ri, []string{"PUBLISH", sentinelHelloChannel, hello}, func(reply resp.Value) {
+		if reply.Type != resp.ERROR {
+			ri.lastPubTime = time.Now()
+		}
+	})
+}
+
+// sentinelForceHelloUpdateForMaster makes the hello messages of a master
+// and its replicas go out on the next run of the timer, e.g. to spread a
+// new configuration quickly
+func (s *Server) sentinelForceHelloUpdateForMaster(master *sentinelInstance) {
+	master.lastPubTime = time.Time{}
+	for _, r := range master.replicas {
+		r.lastPubTime = time.Time{}
+	}
+}
+
+// sentinelSendPeriodicCommands sends INFO to masters and replicas, PING to
+// every instance, and our hello messages, as often as each is due
+func (s *Server) sentinelSendPeriodicCommands(ri *sentinelInstance) {
+	link := ri.link
+	if link.conn == nil || len(link.pending) >= sentinelMaxPendingCommands {
+		return
+	}
+	now := time.Now()
+
+	// Replicas are watched closely while their master is failing
+	infoPeriod := sentinelInfoPeriod
+	if ri.flags&sriReplica != 0 && (ri.master.flags&(sriODown|sriFailoverInProgress) != 0 || ri.masterLinkDownTime > 0) {
+		infoPeriod = time.Second
+	}
+	pingPeriod := min(ri.downAfter, sentinelPingPeriod)
+
+	if ri.flags&sriSentinel == 0 && (ri.infoRefresh.IsZero() || now.Sub(ri.infoRefresh) > infoPeriod) {
+		s.sentinelSendCommand(ri, []string{"INFO"}, func(reply resp.Value) {
+			if reply.Type == resp.BULK && !reply.Null {
+				s.sentinelRefreshInstanceInfo(ri, reply.Bulk)
+			}
+		})
+	}
+	if now.Sub(link.lastPongTime) > pingPeriod && now.Sub(link.lastPingTime) > pingPeriod/2 {
+		s.sentinelSendPing(ri)
+	}
+	if now.Sub(ri.lastPubTime) > sentinelPublishPeriod {
+		s.sentinelSendHello(ri)
+	}
+}
+
+// sentinelRefreshInstanceInfo updates what we know of an instance from its
+// INFO, and acts on it: replicas are discovered, promotions and replicas
+// being reconfigured are followed, and instances that don't have the role
+// they should have are reconfigured
+func (s *Server) sentinelRefreshInstanceInfo(ri *sentinelInstance, info string) {
+	now := time.Now()
+	ri.infoRefresh = now
+	ri.masterLinkDownTime = 0
+	role := 0
+	for _, line := range strings.Split(info, "\r\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch {
+		case key == "run_id" && len(value) == 40:
+			if ri.runid != "" && ri.runid != value {
+				s.sentinelEvent("+reboot", ri, "%@")
+			}
+			ri.runid = value
+		case key == "role":
+			switch value {
+			case "master":
+				role = sriMaster
+			case "slave":
+				role = sriReplica
+			}
+		case key == "master_host":
+			if ri.replMasterHost != value {
+				ri.replMasterHost = value
+				ri.replicaConfChangeTime = now
+			}
+		case key == "master_port":
+			port, _ := strconv.Atoi(value)
+			if ri.replMasterPort != port {
+				ri.replMasterPort = port
+				ri.replicaConfChangeTime = now
+			}
+		case key == "master_link_status":
+			ri.replMasterLinkUp = value == "up"
+		case key == "master_link_down_since_seconds":
+			secs, _ := strconv.Atoi(value)
+			ri.masterLinkDownTime = time.Duration(secs) * time.Second
+		case key == "slave_priority":
+			ri.replicaPriority, _ = strconv.Atoi(value)
+		case key == "slave_repl_offset":
+			ri.replOffset, _ = strconv.ParseInt(value, 10, 64)
+		case strings.HasPrefix(key, "slave") && ri.flags&sriMaster != 0:
+			// slave0:ip=...,port=...,state=...,offset=...,lag=...
+			var host string
+			var port int
+			for _, field := range strings.Split(value, ",") {
+				name, v, _ := strings.Cut(field, "=")
+				switch name {
+				case "ip":
+					host = v
+				case "port":
+					port, _ = strconv.Atoi(v)
+				}
+			}
+			if host != "" && port > 0 && sentinelReplicaByAddr(ri, host, port) == nil {
+				r := s.createSentinelInstance(net.JoinHostPort(host, strconv.Itoa(port)), sriReplica, host, port, ri)
+				s.sentinelEvent("+slave", r, "%@")
+			}
+		}
+	}
+
+	if role != 0 && role != ri.roleReported {
+		ri.roleReported = role
+		ri.roleReportedTime = now
+		if role == sriReplica {
+			ri.replicaConfChangeTime = now
+		}
+		event := "-role-change"
+		if ri.flags&(sriMaster|sriReplica) == role {
+			event = "+role-change"
+		}
+		roleName := "master"
+		if role == sriReplica {
+			roleName = "slave"
+		}
+		s.sentinelEvent(event, ri, "%@ new reported role is %s", roleName)
+	}
+	if ri.flags&sriReplica == 0 {
+		return
+	}
+	master := ri.master
+
+	if role == sriMaster {
+		if ri.flags&sriPromoted != 0 && master.flags&sriFailoverInProgress != 0 && master.failoverState == failoverWaitPromotion {
+			// The replica we promoted is a master now: the new
+			// configuration gets the epoch we were elected for
+			master.configEpoch = master.failoverEpoch
+			master.failoverState = failoverReconfReplicas
+			master.failoverStateChangeTime = now
+			s.sentinelEvent("+promoted-slave", ri, "%@")
+			s.sentinelEvent("+failover-state-reconf-slaves", master, "%@")
+			s.sentinelForceHelloUpdateForMaster(master)
+		} else {
+			// A replica that says it's a master, e.g. an old master
+			// that restarted, is turned back into a replica once it
+			// has kept saying so for a while
+			waitTime := sentinelPublishPeriod * 4
+			if ri.flags&sriPromoted == 0 && sentinelMasterLooksSane(master) &&
+				sentinelInstanceNoDownFor(ri, waitTime) && now.Sub(ri.roleReportedTime) > waitTime {
+				if s.sentinelSendReplicaof(ri, master.host, master.port) {
+					s.sentinelEvent("+convert-to-slave", ri, "%@")
+				}
+			}
+		}
+	}
+
+	// Replicas of another master are pointed to the right one, once the
+	// master looks healthy and they have been wrong for a while
+	if role == sriReplica && (ri.replMasterPort != master.port || ri.replMasterHost != master.host) {
+		waitTime := master.failoverTimeout
+		if ri.flags&(sriReconfSent|sriReconfInprog) == 0 && sentinelMasterLooksSane(master) &&
+			sentinelInstanceNoDownFor(ri, waitTime) && now.Sub(ri.replicaConfChangeTime) > waitTime {
+			if s.sentinelSendReplicaof(ri, master.host, master.port) {
+				s.sentinelEvent("+fix-slave-config", ri, "%@")
+			}
+		}
+	}
+
+	// Replicas being pointed to the promoted replica
+	if role == sriReplica && ri.flags&(sriReconfSent|sriReconfInprog) != 0 && master.promoted != nil {
+		promoted := master.promoted
+		if ri.flags&sriReconfSent != 0 && ri.replMasterHost == promoted.host && ri.replMasterPort == promoted.port {
+			ri.flags = ri.flags&^sriReconfSent | sriReconfInprog
+			s.sentinelEvent("+slave-reconf-inprog", ri, "%@")
+		}
+		if ri.flags&sriReconfInprog != 0 && ri.replMasterLinkUp {
+			ri.flags = ri.flags&^sriReconfInprog | sriReconfDone
+			s.sentinelEvent("+slave-reconf-done", ri, "%@")
+		}
+	}
+}
+
+// sentinelMasterLooksSane reports whether a master is up and says it's a
+// master, so that replicas can safely be pointed to it
+func sentinelMasterLooksSane(master *sentinelInstance) bool {
+	return master.flags&sriMaster != 0 && master.roleReported == sriMaster &&
+		master.flags&(sriSDown|sriODown) == 0 &&
+		time.Since(master.infoRefresh) < sentinelInfoPeriod*2
+}
+
+// sentinelInstanceNoDownFor reports whether an instance wasn't down in the
+// last d
+func sentinelInstanceNoDownFor(ri *sentinelInstance, d time.Duration) bool {
+	mostRecent := ri.sdownSince
+	if ri.odownSince.After(mostRecent) {
+		mostRecent = ri.odownSince
+	}
+	return mostRecent.IsZero() || time.Since(mostRecent) > d
+}
+
+// sentinelSendReplicaof points an instance to a master, or makes it a
+// master if host is empty
+func (s *Server) sentinelSendReplicaof(ri *sentinelInstance, host string, port int) bool {
+	argv := []string{"REPLICAOF", "NO", "ONE"}
+	if host != "" {
+		argv = []string{"REPLICAOF", host, strconv.Itoa(port)}
+	}
+	return s.sentinelSendCommand(ri, argv, nil)
+}
+
+// sentinelProcessHelloMessage handles a hello message of another sentinel,
+// discovering it, and adopting the configuration it announces for the
+// master if it is newer than ours
+func (s *Server) sentinelProcessHelloMessage(hello string) {
+	st := s.sentinel
+	token := strings.Split(hello, ",")
+	if len(token) != 8 {
+		return
+	}
+	host, runid, masterName, masterHost := token[0], token[2], token[4], token[5]
+	port, err1 := strconv.Atoi(token[1])
+	currentEpoch, err2 := strconv.ParseInt(token[3], 10, 64)
+	masterPort, err3 := strconv.Atoi(token[6])
+	masterConfigEpoch, err4 := strconv.ParseInt(token[7], 10, 64)
+	if err := errors.Join(err1, err2, err3, err4); err != nil || runid == st.myid {
+		return
+	}
+	master := st.masters[masterName]
+	if master == nil {
+		return
+	}
+
+	name := net.JoinHostPort(host, strconv.Itoa(port))
+	si := master.sentinels[name]
+	if si == nil || si.runid != runid {
+		// A sentinel that restarted with another ID, or moved to another
+		// address, replaces what we knew of it for every master
+		for _, m := range sortedInstances(st.masters) {
+			for _, other := range sortedInstances(m.sentinels) {
+				if (other.runid == runid) != (other.name == name) {
+					s.sentinelEvent("-dup-sentinel", other, "%@ #duplicate of %s:%d or %s", host, port, runid)
+					s.releaseSentinelInstance(other)
+					delete(m.sentinels, other.name)
+				}
+			}
+		}
+		si = s.createSentinelInstance(name, sriSentinel, host, port, master)
+		si.runid = runid
+		s.sentinelEvent("+sentinel", si, "%@")
+	}
+
+	if currentEpoch > st.currentEpoch {
+		st.currentEpoch = currentEpoch
+		s.sentinelEvent("+new-epoch", master, "%d", st.currentEpoch)
+	}
+	if master.configEpoch < masterConfigEpoch {
+		master.configEpoch = masterConfigEpoch
+		if masterHost != master.host || masterPort != master.port {
+			s.sentinelEvent("+config-update-from", si, "%@")
+			s.sentinelEvent("+switch-master", master, "%s %s %d %s %d",
+				master.name, master.host, master.port, masterHost, masterPort)
+			s.sentinelResetMasterAndChangeAddress(master, masterHost, masterPort)
+		}
+	}
+	si.lastHelloTime = time.Now()
+}
+
+// sentinelCheckSubjectivelyDown flags an instance that didn't reply to our
+// pings for down-after-milliseconds, or a master that reported being a
+// replica for too long, as subjectively down
+func (s *Server) sentinelCheckSubjectivelyDown(ri *sentinelInstance) {
+	link := ri.link
+	now := time.Now()
+	var elapsed time.Duration
+	switch {
+	case !link.actPingTime.IsZero():
+		elapsed = now.Sub(link.actPingTime)
+	case link.conn == nil:
+		elapsed = now.Sub(link.lastAvailTime)
+	}
+
+	// Links that look stuck are reconnected
+	if link.conn != nil && now.Sub(link.connTime) > sentinelMinLinkReconnectPeriod {
+		if !link.actPingTime.IsZero() && now.Sub(link.actPingTime) > ri.downAfter/2 && now.Sub(link.lastPongTime) > ri.downAfter/2 {
+			s.sentinelCloseLinkConnection(link)
+		} else if link.pubsub != nil && now.Sub(link.pcLastActivity) > sentinelPublishPeriod*3 {
+			s.sentinelCloseLinkConnection(link)
+		}
+	}
+
+	if elapsed > ri.downAfter ||
+		ri.flags&sriMaster != 0 && ri.roleReported == sriReplica && now.Sub(ri.roleReportedTime) > ri.downAfter+sentinelInfoPeriod*2 {
+		if ri.flags&sriSDown == 0 {
+			s.sentinelEvent("+sdown", ri, "%@")
+			ri.sdownSince = now
+			ri.flags |= sriSDown
+		}
+	} else if ri.flags&sriSDown != 0 {
+		s.sentinelEvent("-sdown", ri, "%@")
+		ri.flags &^= sriSDown
+	}
+}
+
+// sentinelCheckObjectivelyDown flags a master as objectively down once,
+// counting us, a quorum of sentinels say it is down
+func (s *Server) sentinelCheckObjectivelyDown(master *sentinelInstance) {
+	quorum, odown := 0, false
+	if master.flags&sriSDown != 0 {
+		quorum = 1
+		for _, si := range master.sentinels {
+			if si.flags&sriMasterDown != 0 {
+				quorum++
+			}
+		}
+		odown = quorum >= master.quorum
+	}
+	if odown {
+		if master.flags&sriODown == 0 {
+			s.sentinelEvent("+odown", master, "%@ #quorum %d/%d", quorum, master.quorum)
+			master.flags |= sriODown
+			master.odownSince = time.Now()
+		}
+	} else if master.flags&sriODown != 0 {
+		s.sentinelEvent("-odown", master, "%@")
+		master.flags &^= sriODown
+	}
+}
+
+// sentinelAskMasterStateToOtherSentinels asks the other sentinels whether
+// they see a master we see down as down too, and for their vote once we
+// try to fail it over. Replies older than a few ask periods are forgotten.
+func (s *Server) sentinelAskMasterStateToOtherSentinels(master *sentinelInstance, force bool) {
+	st := s.sentinel
+	now := time.Now()
+	for _, si := range sortedInstances(master.sentinels) {
+		elapsed := now.Sub(si.lastMasterDownReplyTime)
+		if elapsed > sentinelAskPeriod*5 {
+			si.flags &^= sriMasterDown
+			si.leader = ""
+		}
+		if master.flags&sriSDown == 0 || si.link.conn == nil {
+			continue
+		}
+		if !force && elapsed < sentinelAskPeriod {
+			continue
+		}
+		runid := "*"
+		if master.failoverState > failoverNone {
+			runid = st.myid
+		}
+		argv := []string{"SENTINEL", "is-master-down-by-addr", master.host, strconv.Itoa(master.port),
+			strconv.FormatInt(st.currentEpoch, 10), runid}
+		s.sentinelSendCommand(si, argv, func(reply resp.Value) {
+			if len(reply.Array) != 3 || reply.Array[0].Type != resp.INTEGER || reply.Array[1].Type != resp.BULK || reply.Array[2].Type != resp.INTEGER {
+				return
+			}
+			si.lastMasterDownReplyTime = time.Now()
+			if reply.Array[0].Num == 1 {
+				si.flags |= sriMasterDown
+			} else {
+				si.flags &^= sriMasterDown
+			}
+			if leader := reply.Array[1].Bulk; leader != "*" {
+				si.leader = leader
+				si.leaderEpoch = int64(reply.Array[2].Num)
+			}
+		})
+	}
+}
+
+// sentinelVoteLeader votes for the sentinel runid to fail a master over in
+// epoch, unless we already voted in that epoch, and returns our vote. A
+// sentinel voting for another one doesn't try to fail the master over
+// itself for a while.
+func (s *Server) sentinelVoteLeader(master *sentinelInstance, epoch int64, runid string) (string, int64) {
+	st := s.sentinel
+	if epoch > st.currentEpoch {
+		st.currentEpoch = epoch
+		s.sentinelEvent("+new-epoch", master, "%d", st.currentEpoch)
+	}
+	if master.leaderEpoch < epoch && st.currentEpoch <= epoch {
+		master.leader = runid
+		master.leaderEpoch = st.currentEpoch
+		s.sentinelEvent("+vote-for-leader", master, "%s %d", master.leader, master.leaderEpoch)
+		if runid != st.myid {
+			master.failoverStartTime = time.Now().Add(time.Duration(rand.Int63n(int64(sentinelMaxDesync))))
+		}
+	}
+	return master.leader, master.leaderEpoch
+}
+
+// sentinelGetLeader counts the votes for the failover of a master in epoch.
+// We vote for the sentinel with the most votes, or for ourselves. The
+// winner needs the votes of a majority of the sentinels, and at least
+// quorum of them.
+func (s *Server) sentinelGetLeader(master *sentinelInstance, epoch int64) string {
+	st := s.sentinel
+	votes := make(map[string]int)
+	for _, si := range master.sentinels {
+		if si.leader != "" && si.leaderEpoch == st.currentEpoch {
+			votes[si.leader]++
+		}
+	}
+	winner := sentinelMostVoted(votes)
+
+	candidate := st.myid
+	if winner != "" {
+		candidate = winner
+	}
+	if vote, voteEpoch := s.sentinelVoteLeader(master, epoch, candidate); vote != "" && voteEpoch == epoch {
+		votes[vote]++
+		winner = sentinelMostVoted(votes)
+	}
+
+	voters := len(master.sentinels) + 1
+	if winner != "" && (votes[winner] < voters/2+1 || votes[winner] < master.quorum) {
+		return ""
+	}
+	return winner
+}
+
+// sentinelMostVoted returns the candidate with the most votes, the smallest
+// ID winning ties
+func sentinelMostVoted(votes map[string]int) string {
+	winner := ""
+	for _, candidate := range sortedKeys(votes) {
+		if winner == "" || votes[candidate] > votes[winner] {
+			winner = candidate
+		}
+	}
+	return winner
+}
+
+// sentinelStartFailoverIfNeeded starts failing over an objectively down
+// master, unless a failover is in progress or one was tried recently
+func (s *Server) sentinelStartFailoverIfNeeded(master *sentinelInstance) bool {
+	if master.flags&sriODown == 0 || master.flags&sriFailoverInProgress != 0 {
+		return false
+	}
+	if time.Since(master.failoverStartTime) < master.failoverTimeout*2 {
+		if !master.failoverDelayLogged.Equal(master.failoverStartTime) {
+			master.failoverDelayLogged = master.failoverStartTime
+			next := master.failoverStartTime.Add(master.failoverTimeout * 2)
+			log.Printf("Next failover delay: I will not start a failover before %s", next.Format(time.TimeOnly))
+		}
+		return false
+	}
+	s.sentinelStartFailover(master)
+	return true
+}
+
+// sentinelStartFailover starts a failover for a new epoch
+func (s *Server) sentinelStartFailover(master *sentinelInstance) {
+	st := s.sentinel
+	master.failoverState = failoverWaitStart
+	master.failoverStateChangeTime = time.Now()
+	master.flags |= sriFailoverInProgress
+	st.currentEpoch++
+	master.failoverEpoch = st.currentEpoch
+	s.sentinelEvent("+new-epoch", master, "%d", st.currentEpoch)
+	s.sentinelEvent("+try-failover", master, "%@")
+	master.failoverStartTime = time.Now().Add(time.Duration(rand.Int63n(int64(sentinelMaxDesync))))
+}
+
+// sentinelAbortFailover gives a failover up, e.g. when we weren't elected
+func (s *Server) sentinelAbortFailover(master *sentinelInstance) {
+	master.flags &^= sriFailoverInProgress | sriForceFailover
+	master.failoverState = failoverNone
+	master.failoverStateChangeTime = time.Now()
+	if master.promoted != nil {
+		master.promoted.flags &^= sriPromoted
+		master.promoted = nil
+	}
+}
+
+// sentinelFailoverStateMachine moves the failover of a master forward
+func (s *Server) sentinelFailoverStateMachine(master *sentinelInstance) {
+	if master.flags&sriFailoverInProgress == 0 {
+		return
+	}
+	switch master.failoverState {
+	case failoverWaitStart:
+		s.sentinelFailoverWaitStart(master)
+	case failoverSelectReplica:
+		s.sentinelFailoverSelectReplica(master)
+	case failoverSendReplicaofNoOne:
+		s.sentinelFailoverSendReplicaofNoOne(master)
+	case failoverWaitPromotion:
+		if time.Since(master.failoverStateChangeTime) > master.failoverTimeout {
+			s.sentinelEvent("-failover-abort-slave-timeout", master, "%@")
+			s.sentinelAbortFailover(master)
+		}
+	case failoverReconfReplicas:
+		s.sentinelFailoverReconfNextReplica(master)
+	}
+}
+
+// sentinelFailoverWaitStart goes on with the failover once we are elected,
+// or right away when it was forced
+func (s *Server) sentinelFailoverWaitStart(master *sentinelInstance) {
+	leader := s.sentinelGetLeader(master, master.failoverEpoch)
+	if leader != s.sentinel.myid && master.flags&sriForceFailover == 0 {
+		electionTimeout := min(sentinelElectionTimeout, master.failoverTimeout)
+		if time.Since(master.failoverStartTime) > electionTimeout {
+			s.sentinelEvent("-failover-abort-not-elected", master, "%@")
+			s.sentinelAbortFailover(master)
+		}
+		return
+	}
+	s.sentinelEvent("+elected-leader", master, "%@")
+	master.failoverState = failoverSelectReplica
+	master.failoverStateChangeTime = time.Now()
+	s.sentinelEvent("+failover-state-select-slave", master, "%@")
+}
+
+// sentinelSelectReplica picks the replica to promote among those that are
+// up and have recent information: the one with the lowest priority, then
+// the most data, then the smallest run ID. Replicas with priority 0 are
+// never promoted.
+func (s *Server) sentinelSelectReplica(master *sentinelInstance) *sentinelInstance {
+	now := time.Now()
+	maxMasterDownTime := master.downAfter * 10
+	if master.flags&sriSDown != 0 {
+		maxMasterDownTime += now.Sub(master.sdownSince)
+	}
+	infoValidity := sentinelInfoPeriod * 3
+	if master.flags&sriSDown != 0 {
+		infoValidity = sentinelPingPeriod * 5
+	}
+
+	var candidates []*sentinelInstance
+	for _, r := range master.replicas {
+		if r.flags&(sriSDown|sriODown) != 0 || r.link.conn == nil ||
+			now.Sub(r.link.lastAvailTime) > sentinelPingPeriod*5 ||
+			r.replicaPriority == 0 || now.Sub(r.infoRefresh) > infoValidity ||
+			r.masterLinkDownTime > maxMasterDownTime {
+			continue
+		}
+		candidates = append(candidates, r)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.replicaPriority != b.replicaPriority {
+			return a.replicaPriority < b.replicaPriority
+		}
+		if a.replOffset != b.replOffset {
+			return a.replOffset > b.replOffset
+		}
+		if (a.runid == "") != (b.runid == "") {
+			return a.runid != ""
+		}
+		return a.runid < b.runid
+	})
+	return candidates[0]
+}
+
+func (s *Server) sentinelFailoverSelectReplica(master *sentinelInstance) {
+	replica := s.sentinelSelectReplica(master)
+	if replica == nil {
+		s.sentinelEvent("-failover-abort-no-good-slave", master, "%@")
+		s.sentinelAbortFailover(master)
+		return
+	}
+	s.sentinelEvent("+selected-slave", replica, "%@")
+	replica.flags |= sriPromoted
+	master.promoted = replica
+	master.failoverState = failoverSendReplicaofNoOne
+	master.failoverStateChangeTime = time.Now()
+	s.sentinelEvent("+failover-state-send-slaveof-noone", replica, "%@")
+}
+
+func (s *Server) sentinelFailoverSendReplicaofNoOne(master *sentinelInstance) {
+	promoted := master.promoted
+	if promoted.link.conn == nil {
+		if time.Since(master.failoverStateChangeTime) > master.failoverTimeout {
+			s.sentinelEvent("-failover-abort-slave-timeout", master, "%@")
+			s.sentinelAbortFailover(master)
+		}
+		return
+	}
+	if !s.sentinelSendReplicaof(promoted, "", 0) {
+		return
+	}
+	s.sentinelEvent("+failover-state-wait-promotion", promoted, "%@")
+	master.failoverState = failoverWaitPromotion
+	master.failoverStateChangeTime = time.Now()
+}
+
+// sentinelFailoverReconfNextReplica points the other replicas to the
+// promoted one, parallel-syncs at a time, then checks whether the failover
+// is done
+func (s *Server) sentinelFailoverReconfNextReplica(master *sentinelInstance) {
+	inProgress := 0
+	for _, r := range master.replicas {
+		if r.flags&(sriReconfSent|sriReconfInprog) != 0 {
+			inProgress++
+		}
+	}
+	now := time.Now()
+	for _, r := range sortedInstances(master.replicas) {
+		if inProgress >= master.parallelSyncs {
+			break
+		}
+		if r.flags&(sriPromoted|sriReconfDone) != 0 {
+			continue
+		}
+		// Replicas that don't make progress are considered done
+		if r.flags&sriReconfSent != 0 && now.Sub(r.replicaReconfSentTime) > sentinelReplicaReconfTimeout {
+			s.sentinelEvent("-slave-reconf-sent-timeout", r, "%@")
+			r.flags = r.flags&^sriReconfSent | sriReconfDone
+		}
+		if r.flags&(sriReconfSent|sriReconfInprog) != 0 || r.link.conn == nil {
+			continue
+		}
+		if s.sentinelSendReplicaof(r, master.promoted.host, master.promoted.port) {
+			r.flags |= sriReconfSent
+			r.replicaReconfSentTime = now
+			s.sentinelEvent("+slave-reconf-sent", r, "%@")
+			inProgress++
+		}
+	}
+	s.sentinelFailoverDetectEnd(master)
+}
+
+// sentinelFailoverDetectEnd ends a failover once every replica that is up
+// was reconfigured, or once it timed out, then pointing the remaining
+// replicas to the promoted one anyway
+func (s *Server) sentinelFailoverDetectEnd(master *sentinelInstance) {
+	promoted := master.promoted
+	if promoted == nil || promoted.flags&sriSDown != 0 {
+		return
+	}
+	notReconfigured := 0
+	for _, r := range master.replicas {
+		if r.flags&(sriPromoted|sriReconfDone) == 0 && r.flags&sriSDown == 0 {
+			notReconfigured++
+		}
+	}
+	timeout := time.Since(master.failoverStateChangeTime) > master.failoverTimeout
+	if timeout {
+		notReconfigured = 0
+		s.sentinelEvent("-failover-end-for-timeout", master, "%@")
+	}
+	if notReconfigured == 0 {
+		s.sentinelEvent("+failover-end", master, "%@")
+		master.failoverState = failoverUpdateConfig
+		master.failoverStateChangeTime = time.Now()
+	}
+	if timeout {
+		for _, r := range sortedInstances(master.replicas) {
+			if r.flags&(sriPromoted|sriReconfDone|sriReconfSent) != 0 || r.link.conn == nil {
+				continue
+			}
+			if s.sentinelSendReplicaof(r, promoted.host, promoted.port) {
+				s.sentinelEvent("+slave-reconf-sent-be", r, "%@")
+				r.flags |= sriReconfSent
+			}
+		}
+	}
+}
+
+// sentinelFailoverSwitchToPromotedReplica makes the promoted replica the
+// master we monitor, once the failover is over
+func (s *Server) sentinelFailoverSwitchToPromotedReplica(master *sentinelInstance) {
+	promoted := master.promoted
+	s.sentinelEvent("+switch-master", master, "%s %s %d %s %d",
+		master.name, master.host, master.port, promoted.host, promoted.port)
+	s.sentinelResetMasterAndChangeAddress(master, promoted.host, promoted.port)
+}
+
+// sentinelIsQuorumReachable reports how many sentinels, counting us, are
+// usable for a master, and what is missing if they aren't enough to reach
+// the quorum and the majority a failover needs
+func sentinelIsQuorumReachable(master *sentinelInstance) (int, string) {
+	usable := 1
+	for _, si := range master.sentinels {
+		if si.flags&(sriSDown|sriODown) == 0 {
+			usable++
+		}
+	}
+	voters := len(master.sentinels) + 1
+	switch {
+	case usable < master.quorum:
+		return usable, "Not enough available Sentinels to reach the specified quorum for this master"
+	case usable < voters/2+1:
+		return usable, "Not enough available Sentinels to reach the majority and authorize a failover"
+	}
+	return usable, ""
+}
+
+// handleSentinel handles the SENTINEL command
+func (s *Server) handleSentinel(args []resp.Value) resp.Value {
+	st := s.sentinel
+	sub := strings.ToUpper(args[0].Bulk)
+	lookup := func(name string) (*sentinelInstance, resp.Value, bool) {
+		ri := st.masters[name]
+		if ri == nil {
+			return nil, resp.NewError("ERR No such master with that name"), false
+		}
+		return ri, resp.Value{}, true
+	}
+
+	switch {
+	case sub == "MASTERS" && len(args) == 1:
+		masters := sortedInstances(st.masters)
+		replies := make([]resp.Value, len(masters))
+		for i, ri := range masters {
+			replies[i] = sentinelInstanceReply(ri)
+		}
+		return resp.NewArray(replies)
+
+	case sub == "MASTER" && len(args) == 2:
+		ri, errReply, ok := lookup(args[1].Bulk)
+		if !ok {
+			return errReply
+		}
+		return sentinelInstanceReply(ri)
+
+	case (sub == "REPLICAS" || sub == "SLAVES" || sub == "SENTINELS") && len(args) == 2:
+		ri, errReply, ok := lookup(args[1].Bulk)
+		if !ok {
+			return errReply
+		}
+		instances := ri.replicas
+		if sub == "SENTINELS" {
+			instances = ri.sentinels
+		}
+		var replies []resp.Value
+		for _, r := range sortedInstances(instances) {
+			replies = append(replies, sentinelInstanceReply(r))
+		}
+		return resp.NewArray(replies)
+
+	case sub == "MYID" && len(args) == 1:
+		return resp.NewBulkString(st.myid)
+
+	case sub == "GET-MASTER-ADDR-BY-NAME" && len(args) == 2:
+		ri := st.masters[args[1].Bulk]
+		if ri == nil {
+			return resp.NewNullArray()
+		}
+		host, port := sentinelMasterAddr(ri)
+		return resp.NewArray([]resp.Value{resp.NewBulkString(host), resp.NewBulkString(strconv.Itoa(port))})
+
+	case sub == "IS-MASTER-DOWN-BY-ADDR" && len(args) == 5:
+		// Asked by other sentinels: whether we see the master at an
+		// address down, and our vote if they want to fail it over
+		port, err1 := strconv.Atoi(args[2].Bulk)
+		epoch, err2 := strconv.ParseInt(args[3].Bulk, 10, 64)
+		if err1 != nil || err2 != nil {
+			return resp.NewError("ERR value is not an integer or out of range")
+		}
+		var ri *sentinelInstance
+		for _, m := range st.masters {
+			if m.host == args[1].Bulk && m.port == port {
+				ri = m
+			}
+		}
+		isDown := ri != nil && ri.flags&sriSDown != 0
+		leader, leaderEpoch := "", int64(0)
+		if ri != nil && args[4].Bulk != "*" {
+			leader, leaderEpoch = s.sentinelVoteLeader(ri, epoch, args[4].Bulk)
+		}
+		if leader == "" {
+			leader = "*"
+		}
+		return resp.NewArray([]resp.Value{
+			resp.NewInteger(boolToInt(isDown)),
+			resp.NewBulkString(leader),
+			resp.NewInteger(int(leaderEpoch)),
+		})
+
+	case sub == "MONITOR" && len(args) == 5:
+		return s.sentinelMonitor(args[1].Bulk, args[2].Bulk, args[3].Bulk, args[4].Bulk)
+
+	case sub == "REMOVE" && len(args) == 2:
+		ri, errReply, ok := lookup(args[1].Bulk)
+		if !ok {
+			return errReply
+		}
+		s.sentinelEvent("-monitor", ri, "%@")
+		s.releaseSentinelInstance(ri)
+		delete(st.masters, ri.name)
+		return resp.NewSimpleString("OK")
+
+	case sub == "SET" && len(args) >= 4 && len(args)%2 == 0:
+		ri, errReply, ok := lookup(args[1].Bulk)
+		if !ok {
+			return errReply
+		}
+		return s.sentinelSet(ri, args[2:])
+
+	case sub == "FAILOVER" && len(args) == 2:
+		ri, errReply, ok := lookup(args[1].Bulk)
+		if !ok {
+			return errReply
+		}
+		if ri.flags&sriFailoverInProgress != 0 {
+			return resp.NewError("INPROG Failover already in progress")
+		}
+		if s.sentinelSelectReplica(ri) == nil {
+			return resp.NewError("NOGOODSLAVE No suitable replica to promote")
+		}
+		log.Printf("Executing user requested FAILOVER of '%s'", ri.name)
+		s.sentinelStartFailover(ri)
+		ri.flags |= sriForceFailover
+		return resp.NewSimpleString("OK")
+
+	case sub == "RESET" && len(args) == 2:
+		reset := 0
+		for _, ri := range sortedInstances(st.masters) {
+			if stringMatch(args[1].Bulk, ri.name, false) {
+				s.sentinelResetMaster(ri, false)
+				s.sentinelEvent("+reset-master", ri, "%@")
+				reset++
+			}
+		}
+		return resp.NewInteger(reset)
+
+	case sub == "CKQUORUM" && len(args) == 2:
+		ri, errReply, ok := lookup(args[1].Bulk)
+		if !ok {
+			return errReply
+		}
+		usable, problem := sentinelIsQuorumReachable(ri)
+		if problem != "" {
+			return resp.NewError(fmt.Sprintf("NOQUORUM %d usable Sentinels. %s", usable, problem))
+		}
+		return resp.NewSimpleString(fmt.Sprintf("OK %d usable Sentinels. Quorum and failover authorization can be reached", usable))
+	}
+	return resp.NewError(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'. Try SENTINEL HELP.", args[0].Bulk))
+}
+
+// sentinelMonitor starts monitoring a master
+func (s *Server) sentinelMonitor(name, host, portArg, quorumArg string) resp.Value {
+	st := s.sentinel
+	quorum, err := strconv.Atoi(quorumArg)
+	if err != nil {
+		return resp.NewError("ERR value is not an integer or out of range")
+	}
+	if quorum <= 0 {
+		return resp.NewError("ERR Quorum must be 1 or greater.")
+	}
+	port, err := strconv.Atoi(portArg)
+	if err != nil {
+		return resp.NewError("ERR value is not an integer or out of range")
+	}
+	if port <= 0 || port > 65535 {
+		return resp.NewError("ERR Invalid port number")
+	}
+	// Instances are known by IP, as replicas and other sentinels report them
+	addrs, err := net.LookupHost(host)
+	if err != nil || len(addrs) == 0 {
+		return resp.NewError("ERR Invalid IP address or hostname specified")
+	}
+	if _, exists := st.masters[name]; exists {
+		return resp.NewError("ERR Duplicated master name")
+	}
+	ri := s.createSentinelInstance(name, sriMaster, addrs[0], port, nil)
+	ri.quorum = quorum
+	st.masters[name] = ri
+	s.sentinelEvent("+monitor", ri, "%@ quorum %d", quorum)
+	return resp.NewSimpleString("OK")
+}
+
+// sentinelSet changes settings of a monitored master
+func (s *Server) sentinelSet(ri *sentinelInstance, args []resp.Value) resp.Value {
+	// Validate everything before changing anything
+	values := make([]int, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		option, value := strings.ToLower(args[i].Bulk), args[i+1].Bulk
+		switch option {
+		case "down-after-milliseconds", "failover-timeout", "parallel-syncs", "quorum":
+		default:
+			return resp.NewError(fmt.Sprintf("ERR Unknown option or number of arguments for SENTINEL SET '%s'", args[i].Bulk))
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return resp.NewError(fmt.Sprintf("ERR Invalid argument '%s' for SENTINEL SET '%s'", value, args[i].Bulk))
+		}
+		values[i/2] = n
+	}
+	for i := 0; i < len(args); i += 2 {
+		n := values[i/2]
+		switch strings.ToLower(args[i].Bulk) {
+		case "down-after-milliseconds":
+			ri.downAfter = time.Duration(n) * time.Millisecond
+			for _, r := range ri.replicas {
+				r.downAfter = ri.downAfter
+			}
+			for _, si := range ri.sentinels {
+				si.downAfter = ri.downAfter
+			}
+		case "failover-timeout":
+			ri.failoverTimeout = time.Duration(n) * time.Millisecond
+		case "parallel-syncs":
+			ri.parallelSyncs = n
+		case "quorum":
+			ri.quorum = n
+		}
+		s.sentinelEvent("+set", ri, "%@ %s %s", args[i].Bulk, args[i+1].Bulk)
+	}
+	return resp.NewSimpleString("OK")
+}
+
+// sentinelInstanceReply describes an instance for SENTINEL MASTER, REPLICAS
+// and SENTINELS, with durations in milliseconds
+func sentinelInstanceReply(ri *sentinelInstance) resp.Value {
+	now := time.Now()
+	link := ri.link
+	since := func(t time.Time) string {
+		if t.IsZero() {
+			return "0"
+		}
+		return strconv.FormatInt(now.Sub(t).Milliseconds(), 10)
+	}
+	var flags []string
+	for _, f := range sentinelFlagNames {
+		if f.flag == 0 && link.conn == nil || f.flag != 0 && ri.flags&f.flag != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+
+	fields := []string{
+		"name", ri.name,
+		"ip", ri.host,
+		"port", strconv.Itoa(ri.port),
+		"runid", ri.runid,
+		"flags", strings.Join(flags, ","),
+		"link-pending-commands", strconv.Itoa(len(link.pending)),
+		"link-refcount", "1",
+		"last-ping-sent", since(link.actPingTime),
+		"last-ok-ping-reply", since(link.lastAvailTime),
+		"last-ping-reply", since(link.lastPongTime),
+	}
+	if ri.flags&sriSDown != 0 {
+		fields = append(fields, "s-down-time", since(ri.sdownSince))
+	}
+	if ri.flags&sriODown != 0 {
+		fields = append(fields, "o-down-time", since(ri.odownSince))
+	}
+	fields = append(fields, "down-after-milliseconds", strconv.FormatInt(ri.downAfter.Milliseconds(), 10))
+
+	if ri.flags&(sriMaster|sriReplica) != 0 {
+		role := "master"
+		if ri.roleReported == sriReplica {
+			role = "slave"
+		}
+		fields = append(fields,
+			"info-refresh", since(ri.infoRefresh),
+			"role-reported", role,
+			"role-reported-time", since(ri.roleReportedTime))
+	}
+	switch {
+	case ri.flags&sriMaster != 0:
+		fields = append(fields,
+			"config-epoch", strconv.FormatInt(ri.configEpoch, 10),
+			"num-slaves", strconv.Itoa(len(ri.replicas)),
+			"num-other-sentinels", strconv.Itoa(len(ri.sentinels)),
+			"quorum", strconv.Itoa(ri.quorum),
+			"failover-timeout", strconv.FormatInt(ri.failoverTimeout.Milliseconds(), 10),
+			"parallel-syncs", strconv.Itoa(ri.parallelSyncs))
+	case ri.flags&sriReplica != 0:
+		masterHost, linkStatus := ri.replMasterHost, "err"
+		if masterHost == "" {
+			masterHost = "?"
+		}
+		if ri.replMasterLinkUp {
+			linkStatus = "ok"
+		}
+		fields = append(fields,
+			"master-link-down-time", strconv.FormatInt(ri.masterLinkDownTime.Milliseconds(), 10),
+			"master-link-status", linkStatus,
+			"master-host", masterHost,
+			"master-port", strconv.Itoa(ri.replMasterPort),
+			"slave-priority", strconv.Itoa(ri.replicaPriority),
+			"slave-repl-offset", strconv.FormatInt(ri.replOffset, 10),
+			"replica-announced", "1")
+	default:
+		leader := ri.leader
+		if leader == "" {
+			leader = "?"
+		}
+		fields = append(fields,
+			"last-hello-message", since(ri.lastHelloTime),
+			"voted-leader", leader,
+			"voted-leader-epoch", strconv.FormatInt(ri.leaderEpoch, 10))
+	}
+
+	values := make([]resp.Value, len(fields))
+	for i, field := range fields {
+		values[i] = resp.NewBulkString(field)
+	}
+	return resp.NewMap(values)
+}
+
+func (s *Server) infoSentinel() []string {
+	st := s.sentinel
+	fields := []string{
+		fmt.Sprintf("sentinel_masters:%d", len(st.masters)),
+		"sentinel_tilt:0",
+		"sentinel_tilt_since_seconds:-1",
+		"sentinel_running_scripts:0",
+		"sentinel_scripts_queue_length:0",
+		"sentinel_simulate_failure_flags:0",
+	}
+	for i, ri := range sortedInstances(st.masters) {
+		status := "ok"
+		switch {
+		case ri.flags&sriODown != 0:
+			status = "odown"
+		case ri.flags&sriSDown != 0:
+			status = "sdown"
+		}
+		host, port := sentinelMasterAddr(ri)
+		fields = append(fields, fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d",
+			i, ri.name, status, net.JoinHostPort(host, strconv.Itoa(port)), len(ri.replicas), len(ri.sentinels)+1))
+	}
+	return fields
+}
@@ -4,23 +4,116 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
 
 	"redis-learning/pkg/resp"
 )
 
+// redisVersion is the Redis version this server reports to clients
+const redisVersion = "7.2.0"
+
 // Server represents our Redis server
 type Server struct {
 	host     string
 	port     string
 	listener net.Listener
 	db       *Database
+
+	// quit is closed when the server stops
+	quit      chan struct{}
+	quitOnce  sync.Once
+	startTime time.Time
+	runID     string // random, identifies this run of the server
+
+	// loaded is set once the dataset is loaded: from then on, settings
+	// such as appendonly take effect right away
+	loaded bool
+
+	// mu serializes command execution, mirroring Redis's single-threaded
+	// event loop. Blocked clients wait without holding it.
+	mu sync.Mutex
+
+	// Clients blocked on each key, in arrival order, and keys that may now
+	// serve some of them
+	blockingKeys map[string][]*Client
+	readyKeys    []string
+	readySet     map[string]bool
+
+	// Clients WATCHing each key
+	watchedKeys map[string]map[*Client]struct{}
+
+	// Sparse HyperLogLogs are converted to dense past this size
+	hllSparseMaxBytes int
+
+	// Pub/Sub subscribers by channel and by pattern, and sharded Pub/Sub
+	// subscribers with the active shard channels of each slot
+	pubsubChannels      map[string]map[*Client]struct{}
+	pubsubPatterns      map[string]map[*Client]struct{}
+	pubsubShardChannels map[string]map[*Client]struct{}
+	shardSlotChannels   map[int]map[string]struct{}
+
+	// Lua scripting: the interpreter, the EVAL script cache and the client
+	// redis.call runs commands as. scriptRun is the script being executed,
+	// also read by other clients under scriptMu.
+	lua          *lua.LState
+	scripts      map[string]*luaScript
+	scriptClient *Client
+	scriptRun    *scriptRunCtx
+	scriptMu     sync.Mutex
+
+	// Redis Functions: libraries live in their own interpreter.
+	// functionsLoading is the library FUNCTION LOAD is registering.
+	functionsLua     *lua.LState
+	functionsLib     *functionsLibCtx
+	functionsLoading *functionLibrary
+
+	// Commands registered through package module, and the client the
+	// commands they Call run as
+	moduleCommands map[string]commandInfo
+	moduleClient   *Client
+
+	// RDB snapshots, the append only file and what is written to it, and
+	// replication of the writes to replicas
+	persist persistenceState
+	aof     aofState
+	prop    propagationState
+	repl    replicationState
+
+	// Set in Sentinel mode, where the server monitors masters instead of
+	// holding a dataset
+	sentinel *sentinelState
+
+	// Settings exposed through CONFIG
+	notifyKeyspaceEvents     int
+	clientOutputBufferLimits [clientClassCount]outputBufferLimit
+	busyReplyThreshold       time.Duration
 }
 
 // Database represents our in-memory data store
 type Database struct {
 	data map[string]*RedisValue
 	mu   sync.RWMutex
+
+	// notify receives keyspace events raised by the database itself: keys
+	// being created or lazily expired
+	notify func(class int, event, key string)
+
+	// snapshot is the view a background save is writing, if any. writing
+	// is set while a command that may modify values runs, and then values
+	// are handed to the snapshot before being returned.
+	snapshot *snapshot
+	writing  bool
+
+	// Replicas leave expiring keys to their master, which sends a DEL:
+	// with keepExpired set, expired keys read as missing but stay, except
+	// for the commands of the master, run with masterCommand set.
+	keepExpired   bool
+	masterCommand bool
 }
 
 // NewDatabase creates a new database instance
@@ -30,11 +123,16 @@ func NewDatabase() *Database {
 	}
 }
 
+// fireEvent raises a keyspace event if anyone is listening
+func (db *Database) fireEvent(class int, event, key string) {
+	if db.notify != nil {
+		db.notify(class, event, key)
+	}
+}
+
 // Set stores a key-value pair
 func (db *Database) Set(key, value string) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	db.data[key] = NewStringValue(value)
+	db.SetValue(key, NewStringValue(value))
 }
 
 // Get retrieves a value by key
@@ -42,15 +140,7 @@ func (db *Database) Get(key string) (string, bool) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 	val, exists := db.data[key]
-	if !exists || val.IsExpired() {
-		if exists && val.IsExpired() {
-			// Clean up expired key
-			db.mu.RUnlock()
-			db.mu.Lock()
-			delete(db.data, key)
-			db.mu.Unlock()
-			db.mu.RLock()
-		}
+	if !exists || db.expireIfNeeded(key, val) {
 		return "", false
 	}
 	if val.Type != "string" {
@@ -64,25 +154,67 @@ func (db *Database) GetValue(key string) (*RedisValue, bool) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 	val, exists := db.data[key]
-	if !exists || val.IsExpired() {
-		if exists && val.IsExpired() {
-			// Clean up expired key
-			db.mu.RUnlock()
-			db.mu.Lock()
-			delete(db.data, key)
-			db.mu.Unlock()
-			db.mu.RLock()
-		}
+	if !exists || db.expireIfNeeded(key, val) {
 		return nil, false
 	}
+	if db.writing && db.snapshot != nil {
+		db.snapshot.preserve(val)
+	}
 	return val, true
 }
 
+// expireIfNeeded deletes key if its value has expired, and reports whether
+// it has. The caller must hold db.mu for reading.
+func (db *Database) expireIfNeeded(key string, val *RedisValue) bool {
+	if !val.IsExpired() {
+		return false
+	}
+	if db.keepExpired {
+		return !db.masterCommand
+	}
+	db.mu.RUnlock()
+	db.mu.Lock()
+	delete(db.data, key)
+	db.mu.Unlock()
+	db.fireEvent(notifyExpired, "expired", key)
+	db.mu.RLock()
+	return true
+}
+
 // SetValue stores a RedisValue
 func (db *Database) SetValue(key string, value *RedisValue) {
 	db.mu.Lock()
-	defer db.mu.Unlock()
+	_, exists := db.data[key]
 	db.data[key] = value
+	db.mu.Unlock()
+	if !exists {
+		db.fireEvent(notifyNew, "new", key)
+	}
+}
+
+// peek returns the value stored at key without expiring it, so expired
+// values that haven't been lazily deleted yet are returned too
+func (db *Database) peek(key string) (*RedisValue, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	val, exists := db.data[key]
+	return val, exists
+}
+
+// Flush deletes every key, returning the data that was removed
+func (db *Database) Flush() map[string]*RedisValue {
+	return db.Replace(make(map[string]*RedisValue))
+}
+
+// Replace swaps the whole dataset for data, e.g. one loaded from a
+// snapshot, returning the data that was removed. The keys set don't raise
+// keyspace events.
+func (db *Database) Replace(data map[string]*RedisValue) map[string]*RedisValue {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	emptied := db.data
+	db.data = data
+	return emptied
 }
 
 // Del deletes a key
@@ -98,15 +230,88 @@ func (db *Database) Del(key string) bool {
 
 // NewServer creates a new Redis server
 func NewServer(host, port string) *Server {
-	return &Server{
-		host: host,
-		port: port,
-		db:   NewDatabase(),
+	s := &Server{
+		host:         host,
+		port:         port,
+		db:           NewDatabase(),
+		blockingKeys: make(map[string][]*Client),
+		readySet:     make(map[string]bool),
+		watchedKeys:  make(map[string]map[*Client]struct{}),
+		hllSparseMaxBytes: defaultHLLSparseMaxBytes,
+		pubsubChannels:    make(map[string]map[*Client]struct{}),
+		pubsubPatterns:    make(map[string]map[*Client]struct{}),
+		pubsubShardChannels: make(map[string]map[*Client]struct{}),
+		shardSlotChannels:   make(map[int]map[string]struct{}),
+		clientOutputBufferLimits: defaultOutputBufferLimits,
+		scripts:            make(map[string]*luaScript),
+		scriptClient:       newClient(nil),
+		busyReplyThreshold: defaultBusyReplyThreshold,
+		functionsLib:       newFunctionsLibCtx(),
+		quit:               make(chan struct{}),
+		startTime:          time.Now(),
+		runID:              randomReplID(),
+	}
+	s.persist = persistenceState{
+		dir:          ".",
+		dbFilename:   defaultDBFilename,
+		lastSave:     s.startTime,
+		lastBgsaveOK: true,
+
+		loadingEventsInterval: defaultLoadingProcessEventsInterval,
+	}
+	s.persist.saveParams, _ = parseSaveParams(defaultSaveParams)
+	s.repl = replicationState{
+		replid:       randomReplID(),
+		replid2:      noReplID,
+		secondOffset: -1,
+		backlogSize:  defaultReplBacklogSize,
+		timeout:      defaultReplTimeout,
+		pingPeriod:   defaultReplPingPeriod,
+		readOnly:     true,
+		priority:     defaultReplicaPriority,
+
+		disklessSync:      true,
+		disklessSyncDelay: defaultReplDisklessSyncDelay,
+
+		minReplicasMaxLag: defaultMinReplicasMaxLag,
 	}
+	s.aof = aofState{
+		dirname:           defaultAppendDirname,
+		filename:          defaultAppendFilename,
+		fsync:             aofFsyncEverysec,
+		loadTruncated:     true,
+		useRDBPreamble:    true,
+		rewritePercentage: defaultAutoAOFRewritePercentage,
+		rewriteMinSize:    defaultAutoAOFRewriteMinSize,
+		lastRewriteOK:     true,
+	}
+	s.aof.fsyncedOffset.Store(-1)
+	s.lua = s.newLuaState()
+	s.functionsLua = s.newFunctionsLuaState()
+	s.scriptClient.denyBlocking = true
+	s.loadModuleCommands()
+	s.db.notify = s.databaseEvent
+	return s
 }
 
-// Start starts the server and listens for connections
+// databaseEvent handles the events raised by the database itself
+func (s *Server) databaseEvent(class int, event, key string) {
+	if class == notifyExpired {
+		s.signalModifiedKey(key)
+		s.propagate([]string{"DEL", key})
+	}
+	s.notifyKeyspaceEvent(class, event, key)
+}
+
+// Start listens for connections and loads the dataset saved on disk in the
+// background, returning once the server is stopped. A failure to load
+// stops the server and is returned.
 func (s *Server) Start() error {
+	s.mu.Lock()
+	s.persist.loading = true
+	s.persist.loadingStart = time.Now()
+	s.mu.Unlock()
+
 	addr := fmt.Sprintf("%s:%s", s.host, s.port)
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -115,10 +320,46 @@ func (s *Server) Start() error {
 	
 	s.listener = listener
 	log.Printf("Redis server listening on %s", addr)
+
+	// Clients are served while the dataset loads, getting LOADING errors
+	// for commands that need it
+	loadErr := make(chan error, 1)
+	go func() {
+		var err error
+		if s.sentinel == nil {
+			err = s.loadDataFromDisk()
+		}
+		if err == nil {
+			err = s.openAppendOnlyFile()
+		}
+		if err != nil {
+			loadErr <- err
+			s.Stop()
+			return
+		}
+		s.mu.Lock()
+		s.loaded = true
+		s.persist.loading = false
+		s.mu.Unlock()
+		log.Printf("Ready to accept connections")
+		go s.cron()
+	}()
 	
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-s.quit:
+				select {
+				case err := <-loadErr:
+					if err != errLoadingAborted {
+						return err
+					}
+				default:
+				}
+				return nil
+			default:
+			}
 			log.Printf("Error accepting connection: %v", err)
 			continue
 		}
@@ -130,6 +371,7 @@ func (s *Server) Start() error {
 
 // Stop stops the server
 func (s *Server) Stop() error {
+	s.quitOnce.Do(func() { close(s.quit) })
 	if s.listener != nil {
 		return s.listener.Close()
 	}
@@ -142,30 +384,135 @@ func (s *Server) handleClient(conn net.Conn) {
 	
 	log.Printf("Client connected: %s", conn.RemoteAddr())
 	
+	c := newClient(conn)
+	defer s.freeClient(c)
+	// A command that panics only costs its client the connection
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("Panic serving client %s: %v\n%s", conn.RemoteAddr(), err, debug.Stack())
+		}
+	}()
 	parser := resp.NewParser(conn)
-	writer := resp.NewWriter(conn)
+
+	// done stops the reader and the writer once no more commands run. The
+	// connection is only closed after the writer flushed the replies.
+	done := make(chan struct{})
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		c.writeLoop(done)
+	}()
+	defer func() {
+		close(done)
+		<-written
+	}()
+	
+	// Read commands in a separate goroutine so that a client blocked on a
+	// key still notices when its connection goes away
+	commands := make(chan resp.Value)
+	go func() {
+		defer close(c.closed)
+		for {
+			value, err := parser.Read()
+			if err != nil {
+				log.Printf("Error reading from client %s: %v", conn.RemoteAddr(), err)
+				return
+			}
+			select {
+			case commands <- value:
+			case <-done:
+				return
+			}
+		}
+	}()
 	
 	for {
-		// Read command from client
-		value, err := parser.Read()
-		if err != nil {
-			log.Printf("Error reading from client %s: %v", conn.RemoteAddr(), err)
+		var value resp.Value
+		select {
+		case value = <-commands:
+		case <-c.closed:
+			return
+		case <-s.quit:
 			return
 		}
 		
-		// Process the command
-		response := s.processCommand(value)
-		
-		// Send response back to client
-		if err := writer.Write(response); err != nil {
-			log.Printf("Error writing to client %s: %v", conn.RemoteAddr(), err)
+		// Process the command, unless a script has been running for too
+		// long
+		if reply, busy := s.busyScriptReply(value); busy {
+			if reply.Type != "" {
+				c.addReply(reply)
+			}
+			continue
+		}
+		response, bstate, ok := s.execCommand(c, value)
+		if !ok {
 			return
 		}
+		
+		if bstate != nil {
+			var ok bool
+			if response, ok = s.waitForUnblock(c, bstate); !ok {
+				return
+			}
+		}
+		
+		// Queue the response, unless the handler already sent its replies
+		if response.Type != "" {
+			c.addReply(response)
+		}
 	}
 }
 
+// execCommand runs a command under the server lock, followed by what every
+// command is followed by. It returns the state of the client if the command
+// blocked it, and false if the server stopped meanwhile. The lock is
+// released even if the command panics, so that other clients go on.
+func (s *Server) execCommand(c *Client, value resp.Value) (resp.Value, *blockedState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func() {
+		if err := recover(); err != nil {
+			s.resetCommandState()
+			panic(err)
+		}
+	}()
+	select {
+	case <-s.quit:
+		// Stopped while waiting for the lock, e.g. by SHUTDOWN
+		return resp.Value{}, nil, false
+	default:
+	}
+	offset := s.repl.offset
+	response := s.processCommand(c, value)
+	if s.repl.offset != offset {
+		// WAIT waits for the replicas to get the last write
+		c.woff = s.repl.offset
+	}
+	s.handleClientsBlockedOnKeys()
+	s.replicationRequestAcks()
+	s.flushAppendOnlyFile()
+	return response, c.bstate, true
+}
+
+// resetCommandState clears what a command leaves set while it runs, after
+// it panicked halfway through. Writes collected for propagation are dropped,
+// as they may not match what the command did.
+func (s *Server) resetCommandState() {
+	s.db.writing = false
+	s.prop.collecting = false
+	s.prop.replOnly = false
+	s.prop.also = nil
+	s.prop.batch = nil
+	s.prop.batchDepth = 0
+	s.functionsLoading = nil
+
+	s.scriptMu.Lock()
+	s.scriptRun = nil
+	s.scriptMu.Unlock()
+}
+
 // processCommand processes a Redis command and returns a response
-func (s *Server) processCommand(value resp.Value) resp.Value {
+func (s *Server) processCommand(c *Client, value resp.Value) resp.Value {
 	if value.Type != "array" || len(value.Array) == 0 {
 		return resp.NewError("ERR invalid command format")
 	}
@@ -175,8 +522,84 @@ func (s *Server) processCommand(value resp.Value) resp.Value {
 	args := value.Array[1:]
 	
 	// Convert command to uppercase for case-insensitive matching
-	switch command {
+	cmd := strings.ToUpper(command)
+
+	// Errors caught before running the command also abort the transaction
+	// the client may be building
+	info, known := s.lookupCommand(cmd)
+	if !known {
+		flagTransaction(c)
+		return resp.NewError(fmt.Sprintf("ERR unknown command '%s'", command))
+	}
+	if errReply, ok := checkArity(cmd, info, args); !ok {
+		flagTransaction(c)
+		return errReply
+	}
+	if s.persist.loading && info.flags&cmdLoading == 0 && !c.aofLoader {
+		flagTransaction(c)
+		return resp.NewError("LOADING Redis is loading the dataset in memory")
+	}
+	if c.inSubscribedMode() && !pubsubAllowedCommand(cmd) {
+		flagTransaction(c)
+		return resp.NewError(fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(command)))
+	}
+
+	if info.flags&cmdWrite != 0 && !c.mustObey() {
+		if errReply, denied := s.writeDeniedReply(); denied {
+			flagTransaction(c)
+			return errReply
+		}
+	}
+
+	if c.mstate != nil && !runsInMulti(cmd) {
+		if info.flags&cmdNoMulti != 0 {
+			flagTransaction(c)
+			return resp.NewError("ERR Command not allowed inside a transaction")
+		}
+		return queueMultiCommand(c, cmd, args)
+	}
+	return s.call(c, cmd, args)
+}
+
+// writeDeniedReply returns the error write commands get while writes are
+// refused: on a read-only replica, after a failed AOF write, or without
+// enough good replicas. Scripts and modules calling write commands are
+// subject to the same checks.
+func (s *Server) writeDeniedReply() (resp.Value, bool) {
+	if s.repl.masterHost != "" && s.repl.readOnly {
+		return resp.NewError("READONLY You can't write against a read only replica."), true
+	}
+	if s.aof.lastWriteErr != nil {
+		return resp.NewError("MISCONF Errors writing to the AOF file: " + errorSafe(s.aof.lastWriteErr.Error())), true
+	}
+	if !s.checkGoodReplicas() {
+		return resp.NewError("NOREPLICAS Not enough good replicas to write."), true
+	}
+	return resp.Value{}, false
+}
+
+// call runs a command that has already been validated by processCommand
+func (s *Server) call(c *Client, cmd string, args []resp.Value) resp.Value {
+	if !s.db.writing {
+		if info, _ := s.lookupCommand(cmd); info.flags&(cmdWrite|cmdMayReplicate) != 0 {
+			return s.callPropagating(c, info, cmd, args)
+		}
+	}
+	return s.dispatch(c, cmd, args)
+}
+
+// dispatch runs the handler of a command
+func (s *Server) dispatch(c *Client, cmd string, args []resp.Value) resp.Value {
+	if s.sentinel != nil {
+		if reply, ok := s.sentinelDispatch(c, cmd, args); ok {
+			return reply
+		}
+	}
+	switch cmd {
 	case "PING":
+		if c.inSubscribedMode() {
+			return pubsubPing(args)
+		}
 		return s.handlePing(args)
 	case "SET":
 		return s.handleSet(args)
@@ -194,12 +617,177 @@ func (s *Server) processCommand(value resp.Value) resp.Value {
 		return s.handleRPop(args)
 	case "LLEN":
 		return s.handleLLen(args)
+	case "LMOVE":
+		return s.handleLMove(args)
+	case "LMPOP":
+		return s.handleLMPop(args)
+	case "BLPOP":
+		return s.handleBLPop(c, args)
+	case "BRPOP":
+		return s.handleBRPop(c, args)
+	case "BLMOVE":
+		return s.handleBLMove(c, args)
+	case "BLMPOP":
+		return s.handleBLMPop(c, args)
+	case "XADD":
+		return s.handleXAdd(args)
+	case "XRANGE":
+		return s.handleXRange(args)
+	case "XREVRANGE":
+		return s.handleXRevRange(args)
+	case "XLEN":
+		return s.handleXLen(args)
+	case "XDEL":
+		return s.handleXDel(args)
+	case "XTRIM":
+		return s.handleXTrim(args)
+	case "XSETID":
+		return s.handleXSetID(args)
+	case "XINFO":
+		return s.handleXInfo(args)
+	case "XREAD":
+		return s.handleXRead(c, args)
+	case "XGROUP":
+		return s.handleXGroup(args)
+	case "XREADGROUP":
+		return s.handleXReadGroup(c, args)
+	case "XACK":
+		return s.handleXAck(args)
+	case "XPENDING":
+		return s.handleXPending(args)
+	case "XCLAIM":
+		return s.handleXClaim(args)
+	case "XAUTOCLAIM":
+		return s.handleXAutoClaim(args)
+	case "GEOADD":
+		return s.handleGeoAdd(args)
+	case "GEOPOS":
+		return s.handleGeoPos(args)
+	case "GEODIST":
+		return s.handleGeoDist(args)
+	case "GEOHASH":
+		return s.handleGeoHash(args)
+	case "GEOSEARCH":
+		return s.handleGeoSearch(args)
+	case "GEOSEARCHSTORE":
+		return s.handleGeoSearchStore(args)
+	case "SETBIT":
+		return s.handleSetBit(args)
+	case "GETBIT":
+		return s.handleGetBit(args)
+	case "BITCOUNT":
+		return s.handleBitCount(args)
+	case "BITPOS":
+		return s.handleBitPos(args)
+	case "BITOP":
+		return s.handleBitOp(args)
+	case "BITFIELD":
+		return s.handleBitField(args)
+	case "BITFIELD_RO":
+		return s.handleBitFieldRO(args)
+	case "PFADD":
+		return s.handlePFAdd(args)
+	case "PFCOUNT":
+		return s.handlePFCount(args)
+	case "PFMERGE":
+		return s.handlePFMerge(args)
+	case "PFDEBUG":
+		return s.handlePFDebug(args)
+	case "PFSELFTEST":
+		return s.handlePFSelfTest(args)
+	case "SUBSCRIBE":
+		return s.handleSubscribe(c, args)
+	case "UNSUBSCRIBE":
+		return s.handleUnsubscribe(c, args)
+	case "PSUBSCRIBE":
+		return s.handlePSubscribe(c, args)
+	case "PUNSUBSCRIBE":
+		return s.handlePUnsubscribe(c, args)
+	case "PUBLISH":
+		return s.handlePublish(args)
+	case "SSUBSCRIBE":
+		return s.handleSSubscribe(c, args)
+	case "SUNSUBSCRIBE":
+		return s.handleSUnsubscribe(c, args)
+	case "SPUBLISH":
+		return s.handleSPublish(args)
+	case "PUBSUB":
+		return s.handlePubSub(args)
+	case "HELLO":
+		return s.handleHello(c, args)
+	case "RESET":
+		return s.handleReset(c, args)
+	case "MULTI":
+		return s.handleMulti(c, args)
+	case "EXEC":
+		return s.handleExec(c, args)
+	case "DISCARD":
+		return s.handleDiscard(c, args)
+	case "WATCH":
+		return s.handleWatch(c, args)
+	case "UNWATCH":
+		return s.handleUnwatch(c, args)
+	case "FLUSHDB":
+		return s.handleFlush(args)
+	case "FLUSHALL":
+		return s.handleFlush(args)
+	case "EVAL":
+		return s.handleEval(args)
+	case "EVALSHA":
+		return s.handleEvalSha(args)
+	case "EVAL_RO":
+		return s.handleEvalRO(args)
+	case "EVALSHA_RO":
+		return s.handleEvalShaRO(args)
+	case "SCRIPT":
+		return s.handleScript(args)
+	case "FCALL":
+		return s.handleFCall(args)
+	case "FCALL_RO":
+		return s.handleFCallRO(args)
+	case "FUNCTION":
+		return s.handleFunction(args)
+	case "SAVE":
+		return s.handleSave(args)
+	case "BGSAVE":
+		return s.handleBgsave(args)
+	case "BGREWRITEAOF":
+		return s.handleBgrewriteaof(args)
+	case "LASTSAVE":
+		return s.handleLastSave(args)
+	case "SHUTDOWN":
+		return s.handleShutdown(args)
+	case "INFO":
+		return s.handleInfo(args)
+	case "CONFIG":
+		return s.handleConfig(args)
 	case "TYPE":
 		return s.handleType(args)
+	case "DUMP":
+		return s.handleDump(args)
+	case "RESTORE":
+		return s.handleRestore(args)
+	case "PSYNC":
+		return s.handlePsync(c, args)
+	case "REPLCONF":
+		return s.handleReplconf(c, args)
+	case "REPLICAOF", "SLAVEOF":
+		return s.handleReplicaof(args)
+	case "ROLE":
+		return s.handleRole(args)
+	case "WAIT":
+		return s.handleWait(c, args)
+	case "WAITAOF":
+		return s.handleWaitaof(c, args)
+	case "COMMAND":
+		return s.handleCommand(args)
 	case "QUIT":
 		return resp.NewSimpleString("OK")
 	default:
-		return resp.NewError(fmt.Sprintf("ERR unknown command '%s'", command))
+		if info, ok := s.moduleCommands[cmd]; ok {
+			return s.callModuleCommand(c, info.module, args)
+		}
+		return resp.NewError(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(cmd)))
 	}
 }
 
@@ -224,6 +812,8 @@ func (s *Server) handleSet(args []resp.Value) resp.Value {
 	value := args[1].Bulk
 	
 	s.db.Set(key, value)
+	s.signalModifiedKey(key)
+	s.notifyKeyspaceEvent(notifyString, "set", key)
 	return resp.NewSimpleString("OK")
 }
 
@@ -237,6 +827,7 @@ func (s *Server) handleGet(args []resp.Value) resp.Value {
 	value, exists := s.db.Get(key)
 	
 	if !exists {
+		s.notifyKeyspaceEvent(notifyKeyMiss, "keymiss", key)
 		return resp.NewNullBulkString()
 	}
 	
@@ -253,6 +844,8 @@ func (s *Server) handleDel(args []resp.Value) resp.Value {
 	deleted := s.db.Del(key)
 	
 	if deleted {
+		s.signalModifiedKey(key)
+		s.notifyKeyspaceEvent(notifyGeneric, "del", key)
 		return resp.NewInteger(1)
 	}
 	return resp.NewInteger(0)
@@ -279,6 +872,9 @@ func (s *Server) handleLPush(args []resp.Value) resp.Value {
 	for i := 1; i < len(args); i++ {
 		val.ListPush(args[i].Bulk, true) // true for left push
 	}
+	s.signalModifiedKey(key)
+	s.notifyKeyspaceEvent(notifyList, "lpush", key)
+	s.signalKeyAsReady(key)
 	
 	return resp.NewInteger(val.ListLength())
 }
@@ -304,6 +900,9 @@ func (s *Server) handleRPush(args []resp.Value) resp.Value {
 	for i := 1; i < len(args); i++ {
 		val.ListPush(args[i].Bulk, false) // false for right push
 	}
+	s.signalModifiedKey(key)
+	s.notifyKeyspaceEvent(notifyList, "rpush", key)
+	s.signalKeyAsReady(key)
 	
 	return resp.NewInteger(val.ListLength())
 }
@@ -329,10 +928,13 @@ func (s *Server) handleLPop(args []resp.Value) resp.Value {
 	if !popped {
 		return resp.NewNullBulkString()
 	}
+	s.signalModifiedKey(key)
+	s.notifyKeyspaceEvent(notifyList, "lpop", key)
 	
 	// If list is empty, delete the key
 	if val.ListLength() == 0 {
 		s.db.Del(key)
+		s.notifyKeyspaceEvent(notifyGeneric, "del", key)
 	}
 	
 	return resp.NewBulkString(value)
@@ -359,10 +961,13 @@ func (s *Server) handleRPop(args []resp.Value) resp.Value {
 	if !popped {
 		return resp.NewNullBulkString()
 	}
+	s.signalModifiedKey(key)
+	s.notifyKeyspaceEvent(notifyList, "rpop", key)
 	
 	// If list is empty, delete the key
 	if val.ListLength() == 0 {
 		s.db.Del(key)
+		s.notifyKeyspaceEvent(notifyGeneric, "del", key)
 	}
 	
 	return resp.NewBulkString(value)
@@ -378,6 +983,7 @@ func (s *Server) handleLLen(args []resp.Value) resp.Value {
 	val, exists := s.db.GetValue(key)
 	
 	if !exists {
+		s.notifyKeyspaceEvent(notifyKeyMiss, "keymiss", key)
 		return resp.NewInteger(0)
 	}
 	
@@ -398,8 +1004,30 @@ func (s *Server) handleType(args []resp.Value) resp.Value {
 	val, exists := s.db.GetValue(key)
 	
 	if !exists {
+		s.notifyKeyspaceEvent(notifyKeyMiss, "keymiss", key)
 		return resp.NewSimpleString("none")
 	}
 	
 	return resp.NewSimpleString(val.Type)
 }
+
+// handleFlush handles FLUSHDB and FLUSHALL, which are the same thing with a
+// single database. Flushing always happens synchronously.
+func (s *Server) handleFlush(args []resp.Value) resp.Value {
+	if len(args) > 1 {
+		return resp.NewError("ERR syntax error")
+	}
+	if len(args) == 1 {
+		switch strings.ToUpper(args[0].Bulk) {
+		case "ASYNC", "SYNC":
+		default:
+			return resp.NewError("ERR syntax error")
+		}
+	}
+
+	emptied := s.db.Flush()
+	s.touchWatchedKeysOnFlush(emptied)
+	// Propagated even if there was nothing to delete
+	s.persist.dirty += int64(len(emptied)) + 1
+	return resp.NewSimpleString("OK")
+}
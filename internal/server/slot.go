@@ -0,0 +1,53 @@
+package server
+
+// clusterSlots is the number of hash slots the keyspace is split into
+const clusterSlots = 16384
+
+// crc16Table is the lookup table of the CRC16 variant Redis Cluster uses
+// (XMODEM: polynomial 0x1021, initial value 0)
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc16 computes the CRC16 of buf
+func crc16(buf string) uint16 {
+	var crc uint16
+	for i := 0; i < len(buf); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^buf[i]]
+	}
+	return crc
+}
+
+// keyHashSlot maps a key or shard channel to its hash slot. If the key
+// contains a non-empty {hash tag}, only the tag is hashed, so related keys
+// can be forced into the same slot.
+func keyHashSlot(key string) int {
+	s := 0
+	for s < len(key) && key[s] != '{' {
+		s++
+	}
+	if s == len(key) {
+		return int(crc16(key) & (clusterSlots - 1))
+	}
+
+	e := s + 1
+	for e < len(key) && key[e] != '}' {
+		e++
+	}
+	if e == len(key) || e == s+1 {
+		return int(crc16(key) & (clusterSlots - 1))
+	}
+	return int(crc16(key[s+1:e]) & (clusterSlots - 1))
+}
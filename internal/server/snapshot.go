@@ -0,0 +1,159 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// snapshot is a point-in-time view of the dataset being written as an RDB
+// file, or as the commands of an AOF base file.
+//
+// Go can't fork the way Redis does, so the copy-on-write happens at the
+// level of values instead of memory pages: creating a snapshot only copies
+// the key to value pointers. While the snapshot is attached to the database,
+// commands that may modify a value first hand it to preserve, which
+// serializes it as it was. Values that are replaced or deleted don't need
+// that, since the snapshot still points to the old ones. The extra memory
+// is bounded by the pointers plus the values preserved but not written yet,
+// which the writer drains as it goes.
+type snapshot struct {
+	format  int
+	header  []byte // RDB header, function libraries and database selector
+	entries []snapshotEntry
+
+	mu      sync.Mutex
+	pending map[*RedisValue]string // values not serialized yet, by key
+	cow     []byte                 // values preserved and not written yet
+	cowSize int64                  // bytes preserved over the snapshot's life
+
+	keyDelay time.Duration // rdb-key-save-delay, slowing down write
+}
+
+// Formats a snapshot can be written in
+const (
+	snapshotRDB = iota
+	snapshotAOF // commands rebuilding the dataset
+)
+
+type snapshotEntry struct {
+	key string
+	val *RedisValue
+}
+
+// newSnapshot captures the dataset and function libraries. The caller must
+// hold the server lock.
+func (s *Server) newSnapshot(format int) *snapshot {
+	data := s.db.data
+	snap := &snapshot{
+		format:   format,
+		entries:  make([]snapshotEntry, 0, len(data)),
+		pending:  make(map[*RedisValue]string, len(data)),
+		keyDelay: s.persist.keySaveDelay,
+	}
+	expires := 0
+	for key, val := range data {
+		snap.entries = append(snap.entries, snapshotEntry{key, val})
+		snap.pending[val] = key
+		if val.ExpiresAt != nil {
+			expires++
+		}
+	}
+	if format == snapshotAOF {
+		snap.header = s.functionsRewrite(nil)
+		return snap
+	}
+
+	buf := []byte(fmt.Sprintf("REDIS%04d", rdbVersion))
+	for _, aux := range [][2]string{
+		{"redis-ver", redisVersion},
+		{"redis-bits", "64"},
+		{"ctime", strconv.FormatInt(time.Now().Unix(), 10)},
+		{"used-mem", "0"},
+		{"aof-base", "0"},
+	} {
+		buf = append(buf, rdbOpcodeAux)
+		buf = rdbAppendString(buf, aux[0])
+		buf = rdbAppendString(buf, aux[1])
+	}
+	buf = s.functionsDump(buf)
+	if len(data) > 0 {
+		buf = append(buf, rdbOpcodeSelectDB, 0, rdbOpcodeResizeDB)
+		buf = rdbAppendLen(buf, uint64(len(data)))
+		buf = rdbAppendLen(buf, uint64(expires))
+	}
+	snap.header = buf
+	return snap
+}
+
+// preserve serializes val if the snapshot still needs it, so that it can be
+// modified
+func (snap *snapshot) preserve(val *RedisValue) {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	key, ok := snap.pending[val]
+	if !ok {
+		return
+	}
+	delete(snap.pending, val)
+	n := len(snap.cow)
+	snap.cow = snap.appendKeyValue(snap.cow, key, val)
+	snap.cowSize += int64(len(snap.cow) - n)
+}
+
+// appendKeyValue serializes a key in the format of the snapshot. The caller
+// must hold snap.mu.
+func (snap *snapshot) appendKeyValue(buf []byte, key string, val *RedisValue) []byte {
+	if snap.format == snapshotRDB {
+		return rdbAppendKeyValue(buf, key, val)
+	}
+	return aofAppendKeyValue(buf, key, val)
+}
+
+// cowBytes returns how much had to be serialized on behalf of writes
+func (snap *snapshot) cowBytes() int64 {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	return snap.cowSize
+}
+
+// write writes the snapshot in its format. Unless nothing can modify the
+// dataset meanwhile, the snapshot must be attached to the database, and
+// write must not be called with the server lock held.
+func (snap *snapshot) write(out io.Writer) error {
+	w := &rdbWriter{w: out}
+	if err := w.write(snap.header); err != nil {
+		return err
+	}
+
+	var buf []byte
+	for _, e := range snap.entries {
+		snap.mu.Lock()
+		buf = buf[:0]
+		if _, ok := snap.pending[e.val]; ok {
+			delete(snap.pending, e.val)
+			buf = snap.appendKeyValue(buf, e.key, e.val)
+		}
+		buf = append(buf, snap.cow...)
+		snap.cow = snap.cow[:0]
+		snap.mu.Unlock()
+		if err := w.write(buf); err != nil {
+			return err
+		}
+		if snap.keyDelay > 0 {
+			time.Sleep(snap.keyDelay)
+		}
+	}
+	if snap.format == snapshotAOF {
+		return nil
+	}
+
+	buf = append(buf[:0], rdbOpcodeEOF)
+	w.crc = crc64(w.crc, buf)
+	buf = binary.LittleEndian.AppendUint64(buf, w.crc)
+	_, err := w.w.Write(buf)
+	return err
+}
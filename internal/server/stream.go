@@ -0,0 +1,475 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// streamNodeMaxEntries caps the entries kept per stream node, like Redis's
+// stream-node-max-entries
+const streamNodeMaxEntries = 100
+
+// StreamID identifies a stream entry as <milliseconds>-<sequence>
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+// String formats the ID the way Redis prints it
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+// Compare returns -1, 0 or 1 depending on how id orders against other
+func (id StreamID) Compare(other StreamID) int {
+	switch {
+	case id.Ms < other.Ms:
+		return -1
+	case id.Ms > other.Ms:
+		return 1
+	case id.Seq < other.Seq:
+		return -1
+	case id.Seq > other.Seq:
+		return 1
+	}
+	return 0
+}
+
+// Less reports whether id sorts before other
+func (id StreamID) Less(other StreamID) bool {
+	return id.Compare(other) < 0
+}
+
+// IsZero reports whether id is 0-0
+func (id StreamID) IsZero() bool {
+	return id.Ms == 0 && id.Seq == 0
+}
+
+// Incr returns the smallest ID greater than id. ok is false on overflow.
+func (id StreamID) Incr() (StreamID, bool) {
+	switch {
+	case id.Seq < math.MaxUint64:
+		return StreamID{id.Ms, id.Seq + 1}, true
+	case id.Ms < math.MaxUint64:
+		return StreamID{id.Ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// Decr returns the largest ID smaller than id. ok is false on underflow.
+func (id StreamID) Decr() (StreamID, bool) {
+	switch {
+	case id.Seq > 0:
+		return StreamID{id.Ms, id.Seq - 1}, true
+	case id.Ms > 0:
+		return StreamID{id.Ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// Stream ID bounds
+var (
+	minStreamID = StreamID{0, 0}
+	maxStreamID = StreamID{math.MaxUint64, math.MaxUint64}
+)
+
+// StreamEntry is a single stream record with its field/value pairs flattened
+// as f1, v1, f2, v2, ...
+type StreamEntry struct {
+	ID     StreamID
+	Fields []string
+}
+
+// streamNode holds a run of consecutive entries. Keeping entries in small
+// ordered nodes (the role listpacks play in Redis's radix tree) makes
+// appends cheap and lets trimming drop whole nodes at once.
+type streamNode struct {
+	entries []StreamEntry
+}
+
+// Stream is an append-only log of entries ordered by ID
+type Stream struct {
+	nodes  []*streamNode
+	length int
+
+	LastID       StreamID // last ID ever generated, even if since deleted
+	MaxDeletedID StreamID // largest ID removed by XDEL
+	EntriesAdded uint64   // entries ever appended
+
+	Groups map[string]*StreamGroup
+}
+
+// NewStream creates an empty stream
+func NewStream() *Stream {
+	return &Stream{}
+}
+
+// Len returns the number of entries in the stream
+func (st *Stream) Len() int {
+	return st.length
+}
+
+// NodeCount returns the number of storage nodes
+func (st *Stream) NodeCount() int {
+	return len(st.nodes)
+}
+
+// Append adds an entry. The caller must make sure id is greater than LastID.
+func (st *Stream) Append(id StreamID, fields []string) {
+	var node *streamNode
+	if n := len(st.nodes); n > 0 && len(st.nodes[n-1].entries) < streamNodeMaxEntries {
+		node = st.nodes[n-1]
+	} else {
+		node = &streamNode{}
+		st.nodes = append(st.nodes, node)
+	}
+	node.entries = append(node.entries, StreamEntry{ID: id, Fields: fields})
+	st.length++
+	st.LastID = id
+	st.EntriesAdded++
+}
+
+// FirstEntry returns the entry with the smallest ID
+func (st *Stream) FirstEntry() (StreamEntry, bool) {
+	if st.length == 0 {
+		return StreamEntry{}, false
+	}
+	return st.nodes[0].entries[0], true
+}
+
+// LastEntry returns the entry with the largest ID
+func (st *Stream) LastEntry() (StreamEntry, bool) {
+	if st.length == 0 {
+		return StreamEntry{}, false
+	}
+	node := st.nodes[len(st.nodes)-1]
+	return node.entries[len(node.entries)-1], true
+}
+
+// seek returns the position of the first entry whose ID is >= id. The node
+// index equals len(st.nodes) if there is no such entry.
+func (st *Stream) seek(id StreamID) (int, int) {
+	// Last node whose first entry is <= id
+	ni := sort.Search(len(st.nodes), func(i int) bool {
+		return id.Less(st.nodes[i].entries[0].ID)
+	}) - 1
+	if ni < 0 {
+		return 0, 0
+	}
+	entries := st.nodes[ni].entries
+	ei := sort.Search(len(entries), func(i int) bool {
+		return !entries[i].ID.Less(id)
+	})
+	if ei == len(entries) {
+		return ni + 1, 0
+	}
+	return ni, ei
+}
+
+// Lookup returns the entry with the given ID
+func (st *Stream) Lookup(id StreamID) (StreamEntry, bool) {
+	ni, ei := st.seek(id)
+	if ni == len(st.nodes) || st.nodes[ni].entries[ei].ID != id {
+		return StreamEntry{}, false
+	}
+	return st.nodes[ni].entries[ei], true
+}
+
+// Range returns up to count entries (0 means no limit) with IDs between
+// start and end inclusive, in reverse order if rev is set
+func (st *Stream) Range(start, end StreamID, count int, rev bool) []StreamEntry {
+	var result []StreamEntry
+	if end.Less(start) {
+		return result
+	}
+
+	if !rev {
+		for ni, ei := st.seek(start); ni < len(st.nodes); ni, ei = ni+1, 0 {
+			for _, entry := range st.nodes[ni].entries[ei:] {
+				if end.Less(entry.ID) || (count > 0 && len(result) == count) {
+					return result
+				}
+				result = append(result, entry)
+			}
+		}
+		return result
+	}
+
+	// Start from the last entry <= end and walk backwards
+	ni, ei := len(st.nodes), 0
+	if next, ok := end.Incr(); ok {
+		ni, ei = st.seek(next)
+	}
+	for {
+		if ei == 0 {
+			if ni == 0 {
+				return result
+			}
+			ni--
+			ei = len(st.nodes[ni].entries)
+		}
+		ei--
+		entry := st.nodes[ni].entries[ei]
+		if entry.ID.Less(start) || (count > 0 && len(result) == count) {
+			return result
+		}
+		result = append(result, entry)
+	}
+}
+
+// Entries returns every entry in ID order
+func (st *Stream) Entries() []StreamEntry {
+	return st.Range(minStreamID, maxStreamID, 0, false)
+}
+
+// Delete removes the entry with the given ID
+func (st *Stream) Delete(id StreamID) bool {
+	ni, ei := st.seek(id)
+	if ni == len(st.nodes) || st.nodes[ni].entries[ei].ID != id {
+		return false
+	}
+	st.removeAt(ni, ei)
+	if st.MaxDeletedID.Less(id) {
+		st.MaxDeletedID = id
+	}
+	return true
+}
+
+// removeAt drops a single entry, and its node if that becomes empty
+func (st *Stream) removeAt(ni, ei int) {
+	node := st.nodes[ni]
+	node.entries = append(node.entries[:ei], node.entries[ei+1:]...)
+	if len(node.entries) == 0 {
+		st.nodes = append(st.nodes[:ni], st.nodes[ni+1:]...)
+	}
+	st.length--
+}
+
+// TrimMaxLen evicts the oldest entries until at most maxLen remain. With
+// approx set only whole nodes are evicted, and limit (if non-zero) caps the
+// number of evicted entries. It returns the number of evicted entries.
+func (st *Stream) TrimMaxLen(maxLen int, approx bool, limit int) int {
+	return st.trim(func(entry StreamEntry, remaining int) bool {
+		return remaining > maxLen
+	}, func(node *streamNode, remaining int) bool {
+		return remaining-len(node.entries) >= maxLen
+	}, approx, limit)
+}
+
+// TrimMinID evicts entries with IDs lower than minID. approx and limit work
+// as in TrimMaxLen.
+func (st *Stream) TrimMinID(minID StreamID, approx bool, limit int) int {
+	return st.trim(func(entry StreamEntry, remaining int) bool {
+		return entry.ID.Less(minID)
+	}, func(node *streamNode, remaining int) bool {
+		return node.entries[len(node.entries)-1].ID.Less(minID)
+	}, approx, limit)
+}
+
+// trim evicts from the head of the stream while the predicates allow it
+func (st *Stream) trim(evictEntry func(StreamEntry, int) bool, evictNode func(*streamNode, int) bool, approx bool, limit int) int {
+	removed := 0
+	for len(st.nodes) > 0 {
+		node := st.nodes[0]
+		if evictNode(node, st.length) {
+			if limit > 0 && removed+len(node.entries) > limit {
+				break
+			}
+			st.nodes = st.nodes[1:]
+			st.length -= len(node.entries)
+			removed += len(node.entries)
+			continue
+		}
+		if approx {
+			break
+		}
+
+		// Exact trimming evicts individual entries from the first node
+		for st.length > 0 && evictEntry(st.nodes[0].entries[0], st.length) {
+			st.removeAt(0, 0)
+			removed++
+		}
+		break
+	}
+	return removed
+}
+
+// StreamPendingEntry tracks a message delivered to a consumer but not yet
+// acknowledged
+type StreamPendingEntry struct {
+	ID            StreamID
+	Consumer      *StreamConsumer
+	DeliveryTime  time.Time
+	DeliveryCount int64
+}
+
+// StreamConsumer is a named member of a consumer group
+type StreamConsumer struct {
+	Name       string
+	SeenTime   time.Time // last time the consumer attempted an interaction
+	ActiveTime time.Time // last time the consumer read or claimed an entry
+	Pending    map[StreamID]*StreamPendingEntry
+}
+
+// StreamGroup is a consumer group reading from a stream
+type StreamGroup struct {
+	Name        string
+	LastID      StreamID
+	EntriesRead int64 // -1 when it cannot be known
+	Pending     map[StreamID]*StreamPendingEntry
+	Consumers   map[string]*StreamConsumer
+}
+
+// CreateGroup adds a consumer group positioned at lastID. It returns false if
+// the group already exists.
+func (st *Stream) CreateGroup(name string, lastID StreamID, entriesRead int64) (*StreamGroup, bool) {
+	if st.Groups == nil {
+		st.Groups = make(map[string]*StreamGroup)
+	}
+	if _, exists := st.Groups[name]; exists {
+		return nil, false
+	}
+	group := &StreamGroup{
+		Name:        name,
+		LastID:      lastID,
+		EntriesRead: entriesRead,
+		Pending:     make(map[StreamID]*StreamPendingEntry),
+		Consumers:   make(map[string]*StreamConsumer),
+	}
+	st.Groups[name] = group
+	return group, true
+}
+
+// GroupNames returns the consumer group names in sorted order
+func (st *Stream) GroupNames() []string {
+	names := make([]string, 0, len(st.Groups))
+	for name := range st.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hasTombstonesAfter reports whether entries with IDs greater than id may
+// have been deleted, which makes entries-read counters unreliable
+func (st *Stream) hasTombstonesAfter(id StreamID) bool {
+	if st.length == 0 || st.MaxDeletedID.IsZero() {
+		return false
+	}
+	if first, ok := st.FirstEntry(); ok && st.MaxDeletedID.Less(first.ID) {
+		return false
+	}
+	return !st.MaxDeletedID.Less(id)
+}
+
+// EstimateEntriesRead returns the logical number of entries read once a
+// group has consumed everything up to id, or -1 if it cannot be known
+func (st *Stream) EstimateEntriesRead(id StreamID) int64 {
+	if st.EntriesAdded == 0 {
+		return 0
+	}
+	if !id.Less(st.LastID) {
+		return int64(st.EntriesAdded)
+	}
+
+	first, ok := st.FirstEntry()
+	if !ok {
+		return int64(st.EntriesAdded)
+	}
+	if st.hasTombstonesAfter(minStreamID) {
+		return -1
+	}
+	switch cmp := id.Compare(first.ID); {
+	case cmp < 0:
+		return int64(st.EntriesAdded) - int64(st.length)
+	case cmp == 0:
+		return int64(st.EntriesAdded) - int64(st.length) + 1
+	}
+	return -1
+}
+
+// Lag returns the number of entries the group has yet to read, or -1 if it
+// cannot be known
+func (st *Stream) Lag(group *StreamGroup) int64 {
+	if st.EntriesAdded == 0 {
+		return 0
+	}
+	if group.EntriesRead >= 0 && !st.hasTombstonesAfter(group.LastID) {
+		return int64(st.EntriesAdded) - group.EntriesRead
+	}
+	if read := st.EstimateEntriesRead(group.LastID); read >= 0 {
+		return int64(st.EntriesAdded) - read
+	}
+	return -1
+}
+
+// Consumer returns the named consumer, creating it if requested. The bool
+// reports whether the consumer was created.
+func (g *StreamGroup) Consumer(name string, create bool) (*StreamConsumer, bool) {
+	if consumer, ok := g.Consumers[name]; ok || !create {
+		return consumer, false
+	}
+	consumer := &StreamConsumer{
+		Name:     name,
+		SeenTime: time.Now(),
+		Pending:  make(map[StreamID]*StreamPendingEntry),
+	}
+	g.Consumers[name] = consumer
+	return consumer, true
+}
+
+// DeleteConsumer removes a consumer along with its pending entries and
+// returns how many entries it had pending
+func (g *StreamGroup) DeleteConsumer(name string) int {
+	consumer, ok := g.Consumers[name]
+	if !ok {
+		return 0
+	}
+	for id := range consumer.Pending {
+		delete(g.Pending, id)
+	}
+	delete(g.Consumers, name)
+	return len(consumer.Pending)
+}
+
+// Deliver records that the entry id was delivered to consumer, moving it
+// from any previous owner
+func (g *StreamGroup) Deliver(id StreamID, consumer *StreamConsumer, now time.Time) *StreamPendingEntry {
+	pe, ok := g.Pending[id]
+	if !ok {
+		pe = &StreamPendingEntry{ID: id}
+		g.Pending[id] = pe
+	} else if pe.Consumer != nil {
+		delete(pe.Consumer.Pending, id)
+	}
+	pe.Consumer = consumer
+	pe.DeliveryTime = now
+	pe.DeliveryCount++
+	consumer.Pending[id] = pe
+	return pe
+}
+
+// Ack removes id from the pending entries list
+func (g *StreamGroup) Ack(id StreamID) bool {
+	pe, ok := g.Pending[id]
+	if !ok {
+		return false
+	}
+	delete(g.Pending, id)
+	delete(pe.Consumer.Pending, id)
+	return true
+}
+
+// sortedPending returns the entries of a pending entries list in ID order
+func sortedPending(pel map[StreamID]*StreamPendingEntry) []*StreamPendingEntry {
+	entries := make([]*StreamPendingEntry, 0, len(pel))
+	for _, pe := range pel {
+		entries = append(entries, pe)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID.Less(entries[j].ID)
+	})
+	return entries
+}
@@ -0,0 +1,899 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-learning/pkg/resp"
+)
+
+// noGroupErr formats the error returned when a key or group is missing
+func noGroupErr(key, group string) resp.Value {
+	return resp.NewError(fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s'", key, group))
+}
+
+// getStreamGroup looks up a consumer group of the stream stored at key
+func (s *Server) getStreamGroup(key, name string) (*Stream, *StreamGroup, resp.Value, bool) {
+	st, errReply, ok := s.getStream(key)
+	if !ok {
+		return nil, nil, errReply, false
+	}
+	if st == nil || st.Groups[name] == nil {
+		return nil, nil, noGroupErr(key, name), false
+	}
+	return st, st.Groups[name], resp.Value{}, true
+}
+
+// parseEntriesRead parses the ENTRIESREAD option of XGROUP CREATE and SETID
+func parseEntriesRead(args []resp.Value) (int64, bool, resp.Value, bool) {
+	if len(args) == 0 {
+		return 0, false, resp.Value{}, true
+	}
+	if len(args) != 2 || strings.ToUpper(args[0].Bulk) != "ENTRIESREAD" {
+		return 0, false, resp.NewError("ERR syntax error"), false
+	}
+	n, err := strconv.ParseInt(args[1].Bulk, 10, 64)
+	if err != nil {
+		return 0, false, resp.NewError("ERR value is not an integer or out of range"), false
+	}
+	if n < -1 {
+		return 0, false, resp.NewError("ERR value for ENTRIESREAD must be positive or -1"), false
+	}
+	return n, true, resp.Value{}, true
+}
+
+// parseGroupID parses the ID of XGROUP CREATE and SETID, where $ stands for
+// the last ID of the stream. It also returns the implied entries-read.
+func parseGroupID(st *Stream, arg string) (StreamID, int64, bool) {
+	if arg == "$" {
+		if st == nil {
+			return StreamID{}, 0, true
+		}
+		return st.LastID, int64(st.EntriesAdded), true
+	}
+	id, ok := parseStreamID(arg, 0)
+	return id, -1, ok
+}
+
+// handleXGroup handles the XGROUP command
+func (s *Server) handleXGroup(args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.NewError("ERR wrong number of arguments for 'xgroup' command")
+	}
+
+	sub := strings.ToUpper(args[0].Bulk)
+	arity := map[string]int{"CREATE": 4, "SETID": 4, "DESTROY": 3, "CREATECONSUMER": 4, "DELCONSUMER": 4}
+	minArgs, known := arity[sub]
+	if !known {
+		return resp.NewError("ERR unknown subcommand '" + args[0].Bulk + "'. Try XGROUP HELP.")
+	}
+	if len(args) < minArgs || (sub != "CREATE" && sub != "SETID" && len(args) != minArgs) {
+		return resp.NewError(fmt.Sprintf("ERR wrong number of arguments for 'xgroup|%s' command", strings.ToLower(sub)))
+	}
+
+	key, groupName := args[1].Bulk, args[2].Bulk
+	st, errReply, ok := s.getStream(key)
+	if !ok {
+		return errReply
+	}
+
+	if sub == "CREATE" {
+		opts := args[4:]
+		mkStream := len(opts) > 0 && strings.ToUpper(opts[0].Bulk) == "MKSTREAM"
+		if mkStream {
+			opts = opts[1:]
+		}
+		entriesRead, hasEntriesRead, errReply, ok := parseEntriesRead(opts)
+		if !ok {
+			return errReply
+		}
+		id, impliedRead, ok := parseGroupID(st, args[3].Bulk)
+		if !ok {
+			return resp.NewError(invalidStreamIDErr)
+		}
+		if !hasEntriesRead {
+			entriesRead = impliedRead
+		}
+
+		if st == nil {
+			if !mkStream {
+				return resp.NewError("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+			}
+			val := NewStreamValue()
+			s.db.SetValue(key, val)
+			st = val.Stream
+		}
+		if _, created := st.CreateGroup(groupName, id, entriesRead); !created {
+			return resp.NewError("BUSYGROUP Consumer Group name already exists")
+		}
+		s.signalModifiedKey(key)
+		s.notifyKeyspaceEvent(notifyStream, "xgroup-create", key)
+		return resp.NewSimpleString("OK")
+	}
+
+	if st == nil {
+		return resp.NewError("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	}
+	group := st.Groups[groupName]
+
+	switch sub {
+	case "SETID":
+		if group == nil {
+			return noGroupErr(key, groupName)
+		}
+		entriesRead, hasEntriesRead, errReply, ok := parseEntriesRead(args[4:])
+		if !ok {
+			return errReply
+		}
+		id, impliedRead, ok := parseGroupID(st, args[3].Bulk)
+		if !ok {
+			return resp.NewError(invalidStreamIDErr)
+		}
+		if !hasEntriesRead {
+			entriesRead = impliedRead
+		}
+		group.LastID = id
+		group.EntriesRead = entriesRead
+		s.signalModifiedKey(key)
+		s.notifyKeyspaceEvent(notifyStream, "xgroup-setid", key)
+		return resp.NewSimpleString("OK")
+
+	case "DESTROY":
+		if group == nil {
+			return resp.NewInteger(0)
+		}
+		delete(st.Groups, groupName)
+		s.signalModifiedKey(key)
+		s.notifyKeyspaceEvent(notifyStream, "xgroup-destroy", key)
+		// Wake up clients blocked on the group so they get an error
+		s.signalKeyAsReady(key)
+		return resp.NewInteger(1)
+
+	case "CREATECONSUMER":
+		if group == nil {
+			return noGroupErr(key, groupName)
+		}
+		if _, created := group.Consumer(args[3].Bulk, true); created {
+			s.signalModifiedKey(key)
+			s.notifyKeyspaceEvent(notifyStream, "xgroup-createconsumer", key)
+			return resp.NewInteger(1)
+		}
+		return resp.NewInteger(0)
+
+	default: // DELCONSUMER
+		if group == nil {
+			return noGroupErr(key, groupName)
+		}
+		pending := group.DeleteConsumer(args[3].Bulk)
+		s.signalModifiedKey(key)
+		s.notifyKeyspaceEvent(notifyStream, "xgroup-delconsumer", key)
+		return resp.NewInteger(pending)
+	}
+}
+
+// streamConsumer looks up a consumer of the group stored at key, creating
+// it if needed
+func (s *Server) streamConsumer(key string, group *StreamGroup, name string) *StreamConsumer {
+	consumer, created := group.Consumer(name, true)
+	if created {
+		s.notifyKeyspaceEvent(notifyStream, "xgroup-createconsumer", key)
+		s.alsoPropagate("XGROUP", "CREATECONSUMER", key, group.Name, name)
+	}
+	return consumer
+}
+
+// propagateClaim propagates the delivery of a pending entry as an XCLAIM
+// that sets its owner, delivery time and count, and the last ID of the
+// group, to their current values
+func (s *Server) propagateClaim(key string, group *StreamGroup, pe *StreamPendingEntry) {
+	s.alsoPropagate("XCLAIM", key, group.Name, pe.Consumer.Name, "0", pe.ID.String(),
+		"TIME", strconv.FormatInt(pe.DeliveryTime.UnixMilli(), 10),
+		"RETRYCOUNT", strconv.FormatInt(pe.DeliveryCount, 10),
+		"FORCE", "JUSTID", "LASTID", group.LastID.String())
+}
+
+// propagateGroupID propagates the position of a group as XGROUP SETID
+func (s *Server) propagateGroupID(key string, group *StreamGroup) {
+	s.alsoPropagate("XGROUP", "SETID", key, group.Name, group.LastID.String(),
+		"ENTRIESREAD", strconv.FormatInt(group.EntriesRead, 10))
+}
+
+// readGroupNew delivers up to count never-delivered entries to consumer
+func readGroupNew(st *Stream, group *StreamGroup, consumer *StreamConsumer, count int, noAck bool) []StreamEntry {
+	start, ok := group.LastID.Incr()
+	if !ok {
+		return nil
+	}
+	entries := st.Range(start, maxStreamID, count, false)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if group.EntriesRead >= 0 && !st.hasTombstonesAfter(entry.ID) {
+			group.EntriesRead++
+		} else {
+			group.EntriesRead = st.EstimateEntriesRead(entry.ID)
+		}
+		group.LastID = entry.ID
+		if !noAck {
+			group.Deliver(entry.ID, consumer, now)
+		}
+	}
+	consumer.ActiveTime = now
+	return entries
+}
+
+// readGroupHistory replays entries already pending for consumer with IDs
+// greater than after, also returning the ones delivered again. Entries
+// deleted from the stream have nil fields.
+func readGroupHistory(st *Stream, consumer *StreamConsumer, after StreamID, count int) (resp.Value, []*StreamPendingEntry) {
+	now := time.Now()
+	values := []resp.Value{}
+	var delivered []*StreamPendingEntry
+	for _, pe := range sortedPending(consumer.Pending) {
+		if !after.Less(pe.ID) {
+			continue
+		}
+		if count > 0 && len(values) == count {
+			break
+		}
+		entry, ok := st.Lookup(pe.ID)
+		if !ok {
+			values = append(values, resp.NewArray([]resp.Value{resp.NewBulkString(pe.ID.String()), resp.NewNullArray()}))
+			continue
+		}
+		pe.DeliveryTime = now
+		pe.DeliveryCount++
+		delivered = append(delivered, pe)
+		values = append(values, streamEntryValue(entry))
+	}
+	return resp.NewArray(values), delivered
+}
+
+// handleXReadGroup handles the XREADGROUP command
+func (s *Server) handleXReadGroup(c *Client, args []resp.Value) resp.Value {
+	if len(args) < 6 {
+		return resp.NewError("ERR wrong number of arguments for 'xreadgroup' command")
+	}
+	if strings.ToUpper(args[0].Bulk) != "GROUP" {
+		return resp.NewError("ERR syntax error")
+	}
+	groupName, consumerName := args[1].Bulk, args[2].Bulk
+
+	count := 0
+	block := time.Duration(-1)
+	noAck := false
+	i := 3
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].Bulk)
+		if opt == "STREAMS" {
+			break
+		}
+		if opt == "NOACK" {
+			noAck = true
+			continue
+		}
+		if i+1 >= len(args) {
+			return resp.NewError("ERR syntax error")
+		}
+		switch opt {
+		case "COUNT":
+			n, err := strconv.Atoi(args[i+1].Bulk)
+			if err != nil {
+				return resp.NewError("ERR value is not an integer or out of range")
+			}
+			if n > 0 {
+				count = n
+			}
+		case "BLOCK":
+			ms, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+			if err != nil {
+				return resp.NewError("ERR timeout is not an integer or out of range")
+			}
+			if ms < 0 {
+				return resp.NewError("ERR timeout is negative")
+			}
+			block = time.Duration(ms) * time.Millisecond
+		default:
+			return resp.NewError("ERR syntax error")
+		}
+		i++
+	}
+	if i >= len(args) {
+		return resp.NewError("ERR syntax error")
+	}
+
+	rest := args[i+1:]
+	if len(rest) == 0 || len(rest)%2 != 0 {
+		return resp.NewError("ERR Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '>' must be specified.")
+	}
+	numStreams := len(rest) / 2
+	keys := make([]string, numStreams)
+	ids := make([]StreamID, numStreams)
+	onlyNew := make([]bool, numStreams)
+	for j := 0; j < numStreams; j++ {
+		keys[j] = rest[j].Bulk
+		if _, errReply, ok := s.getStream(keys[j]); !ok {
+			return errReply
+		}
+		if _, _, _, ok := s.getStreamGroup(keys[j], groupName); !ok {
+			return resp.NewError(fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", keys[j], groupName))
+		}
+
+		idArg := rest[numStreams+j].Bulk
+		switch idArg {
+		case ">":
+			onlyNew[j] = true
+		case "$":
+			return resp.NewError("ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.")
+		default:
+			id, ok := parseStreamID(idArg, 0)
+			if !ok {
+				return resp.NewError(invalidStreamIDErr)
+			}
+			ids[j] = id
+		}
+	}
+
+	// readKey serves a single stream, returning false if there was nothing
+	// new to deliver
+	readKey := func(j int) (resp.Value, bool) {
+		st, group, errReply, ok := s.getStreamGroup(keys[j], groupName)
+		if !ok {
+			return errReply, true
+		}
+		consumer := s.streamConsumer(keys[j], group, consumerName)
+		consumer.SeenTime = time.Now()
+
+		if !onlyNew[j] {
+			history, delivered := readGroupHistory(st, consumer, ids[j], count)
+			for _, pe := range delivered {
+				s.propagateClaim(keys[j], group, pe)
+			}
+			return resp.NewArray([]resp.Value{resp.NewBulkString(keys[j]), history}), true
+		}
+		entries := readGroupNew(st, group, consumer, count, noAck)
+		if len(entries) == 0 {
+			return resp.Value{}, false
+		}
+		if !noAck {
+			for _, entry := range entries {
+				s.propagateClaim(keys[j], group, group.Pending[entry.ID])
+			}
+		}
+		s.propagateGroupID(keys[j], group)
+		return resp.NewArray([]resp.Value{resp.NewBulkString(keys[j]), streamEntriesValue(entries)}), true
+	}
+
+	var result []resp.Value
+	for j := range keys {
+		if value, ok := readKey(j); ok {
+			result = append(result, value)
+		}
+	}
+	if len(result) > 0 {
+		return resp.NewArray(result)
+	}
+	if block < 0 {
+		return resp.NewNullArray()
+	}
+
+	serve := func(key string) (resp.Value, bool) {
+		for j := range keys {
+			if keys[j] != key {
+				continue
+			}
+			value, ok := readKey(j)
+			if !ok {
+				return resp.Value{}, false
+			}
+			if value.Type == resp.ERROR {
+				return value, true
+			}
+			return resp.NewArray([]resp.Value{value}), true
+		}
+		return resp.Value{}, false
+	}
+	return s.blockClient(c, keys, block, resp.NewNullArray(), serve)
+}
+
+// handleXAck handles the XACK command
+func (s *Server) handleXAck(args []resp.Value) resp.Value {
+	if len(args) < 3 {
+		return resp.NewError("ERR wrong number of arguments for 'xack' command")
+	}
+
+	ids := make([]StreamID, len(args)-2)
+	for i, arg := range args[2:] {
+		id, ok := parseStreamID(arg.Bulk, 0)
+		if !ok {
+			return resp.NewError(invalidStreamIDErr)
+		}
+		ids[i] = id
+	}
+
+	st, errReply, ok := s.getStream(args[0].Bulk)
+	if !ok {
+		return errReply
+	}
+	if st == nil || st.Groups[args[1].Bulk] == nil {
+		return resp.NewInteger(0)
+	}
+
+	group := st.Groups[args[1].Bulk]
+	acked := 0
+	for _, id := range ids {
+		if group.Ack(id) {
+			acked++
+		}
+	}
+	return resp.NewInteger(acked)
+}
+
+// handleXPending handles the XPENDING command
+func (s *Server) handleXPending(args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return resp.NewError("ERR wrong number of arguments for 'xpending' command")
+	}
+	key, groupName := args[0].Bulk, args[1].Bulk
+
+	// Parse the extended form: [IDLE min-idle-time] start end count [consumer]
+	extended := len(args) > 2
+	var minIdle time.Duration
+	var start, end StreamID
+	count := 0
+	consumerName := ""
+	if extended {
+		opts := args[2:]
+		if len(opts) >= 2 && strings.ToUpper(opts[0].Bulk) == "IDLE" {
+			ms, err := strconv.ParseInt(opts[1].Bulk, 10, 64)
+			if err != nil {
+				return resp.NewError("ERR value is not an integer or out of range")
+			}
+			minIdle = time.Duration(ms) * time.Millisecond
+			opts = opts[2:]
+		}
+		if len(opts) < 3 || len(opts) > 4 {
+			return resp.NewError("ERR syntax error")
+		}
+		var errReply resp.Value
+		var ok bool
+		if start, errReply, ok = parseRangeID(opts[0].Bulk, true); !ok {
+			return errReply
+		}
+		if end, errReply, ok = parseRangeID(opts[1].Bulk, false); !ok {
+			return errReply
+		}
+		n, err := strconv.Atoi(opts[2].Bulk)
+		if err != nil {
+			return resp.NewError("ERR value is not an integer or out of range")
+		}
+		count = max(n, 0)
+		if len(opts) == 4 {
+			consumerName = opts[3].Bulk
+		}
+	}
+
+	_, group, errReply, ok := s.getStreamGroup(key, groupName)
+	if !ok {
+		return errReply
+	}
+
+	if !extended {
+		if len(group.Pending) == 0 {
+			return resp.NewArray([]resp.Value{resp.NewInteger(0), resp.NewNullBulkString(), resp.NewNullBulkString(), resp.NewNullArray()})
+		}
+		pending := sortedPending(group.Pending)
+		var consumers []resp.Value
+		for _, name := range sortedConsumerNames(group) {
+			if n := len(group.Consumers[name].Pending); n > 0 {
+				consumers = append(consumers, resp.NewArray([]resp.Value{resp.NewBulkString(name), resp.NewBulkString(strconv.Itoa(n))}))
+			}
+		}
+		return resp.NewArray([]resp.Value{
+			resp.NewInteger(len(pending)),
+			resp.NewBulkString(pending[0].ID.String()),
+			resp.NewBulkString(pending[len(pending)-1].ID.String()),
+			resp.NewArray(consumers),
+		})
+	}
+
+	pel := group.Pending
+	if consumerName != "" {
+		consumer, _ := group.Consumer(consumerName, false)
+		if consumer == nil {
+			return resp.NewArray([]resp.Value{})
+		}
+		pel = consumer.Pending
+	}
+
+	now := time.Now()
+	result := []resp.Value{}
+	for _, pe := range sortedPending(pel) {
+		if len(result) == count {
+			break
+		}
+		if pe.ID.Less(start) || end.Less(pe.ID) {
+			continue
+		}
+		idle := now.Sub(pe.DeliveryTime)
+		if idle < minIdle {
+			continue
+		}
+		result = append(result, resp.NewArray([]resp.Value{
+			resp.NewBulkString(pe.ID.String()),
+			resp.NewBulkString(pe.Consumer.Name),
+			resp.NewInteger(int(idle.Milliseconds())),
+			resp.NewInteger(int(pe.DeliveryCount)),
+		}))
+	}
+	return resp.NewArray(result)
+}
+
+// claimEntry transfers a pending entry to consumer as XCLAIM and XAUTOCLAIM
+// do. deliveryTime overrides the delivery time and retryCount, if not
+// negative, the delivery count.
+func claimEntry(group *StreamGroup, pe *StreamPendingEntry, consumer *StreamConsumer, deliveryTime time.Time, retryCount int64, justID bool) {
+	if pe.Consumer != consumer {
+		if pe.Consumer != nil {
+			delete(pe.Consumer.Pending, pe.ID)
+		}
+		pe.Consumer = consumer
+		consumer.Pending[pe.ID] = pe
+	}
+	pe.DeliveryTime = deliveryTime
+	switch {
+	case retryCount >= 0:
+		pe.DeliveryCount = retryCount
+	case !justID:
+		pe.DeliveryCount++
+	}
+	consumer.ActiveTime = time.Now()
+}
+
+// handleXClaim handles the XCLAIM command
+func (s *Server) handleXClaim(args []resp.Value) resp.Value {
+	if len(args) < 5 {
+		return resp.NewError("ERR wrong number of arguments for 'xclaim' command")
+	}
+	key, groupName, consumerName := args[0].Bulk, args[1].Bulk, args[2].Bulk
+
+	minIdleMs, err := strconv.ParseInt(args[3].Bulk, 10, 64)
+	if err != nil {
+		return resp.NewError("ERR Invalid min-idle-time argument for XCLAIM")
+	}
+	minIdle := time.Duration(max(minIdleMs, 0)) * time.Millisecond
+
+	// IDs come first, options follow
+	i := 4
+	var ids []StreamID
+	for ; i < len(args); i++ {
+		id, ok := parseStreamID(args[i].Bulk, 0)
+		if !ok {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return resp.NewError(invalidStreamIDErr)
+	}
+
+	now := time.Now()
+	deliveryTime := now
+	retryCount := int64(-1)
+	force, justID := false, false
+	var lastID *StreamID
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].Bulk)
+		switch opt {
+		case "FORCE":
+			force = true
+			continue
+		case "JUSTID":
+			justID = true
+			continue
+		}
+		if i+1 >= len(args) {
+			return resp.NewError(fmt.Sprintf("ERR Unrecognized XCLAIM option '%s'", args[i].Bulk))
+		}
+		switch opt {
+		case "IDLE", "TIME", "RETRYCOUNT":
+			n, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+			if err != nil {
+				return resp.NewError(fmt.Sprintf("ERR Invalid %s option argument for XCLAIM", opt))
+			}
+			switch opt {
+			case "IDLE":
+				deliveryTime = now.Add(-time.Duration(n) * time.Millisecond)
+			case "TIME":
+				deliveryTime = time.UnixMilli(n)
+			default:
+				retryCount = n
+			}
+		case "LASTID":
+			id, ok := parseStreamID(args[i+1].Bulk, 0)
+			if !ok {
+				return resp.NewError(invalidStreamIDErr)
+			}
+			lastID = &id
+		default:
+			return resp.NewError(fmt.Sprintf("ERR Unrecognized XCLAIM option '%s'", args[i].Bulk))
+		}
+		i++
+	}
+	if deliveryTime.After(now) {
+		deliveryTime = now
+	}
+
+	st, group, errReply, ok := s.getStreamGroup(key, groupName)
+	if !ok {
+		return errReply
+	}
+	if lastID != nil && group.LastID.Less(*lastID) {
+		group.LastID = *lastID
+		s.propagateGroupID(key, group)
+	}
+
+	consumer := s.streamConsumer(key, group, consumerName)
+	consumer.SeenTime = now
+
+	result := []resp.Value{}
+	for _, id := range ids {
+		pe, pending := group.Pending[id]
+		entry, exists := st.Lookup(id)
+		if !pending {
+			if !force || !exists {
+				continue
+			}
+			// FORCE creates the pending entry for an existing stream entry
+			pe = &StreamPendingEntry{ID: id}
+			group.Pending[id] = pe
+		}
+		if !exists {
+			// The entry was deleted from the stream, drop it from the PEL
+			group.Ack(id)
+			s.alsoPropagate("XACK", key, groupName, id.String())
+			continue
+		}
+		if minIdle > 0 && now.Sub(pe.DeliveryTime) < minIdle {
+			continue
+		}
+
+		claimEntry(group, pe, consumer, deliveryTime, retryCount, justID)
+		s.propagateClaim(key, group, pe)
+		if justID {
+			result = append(result, resp.NewBulkString(id.String()))
+		} else {
+			result = append(result, streamEntryValue(entry))
+		}
+	}
+	return resp.NewArray(result)
+}
+
+// handleXAutoClaim handles the XAUTOCLAIM command
+func (s *Server) handleXAutoClaim(args []resp.Value) resp.Value {
+	if len(args) < 5 {
+		return resp.NewError("ERR wrong number of arguments for 'xautoclaim' command")
+	}
+	key, groupName, consumerName := args[0].Bulk, args[1].Bulk, args[2].Bulk
+
+	minIdleMs, err := strconv.ParseInt(args[3].Bulk, 10, 64)
+	if err != nil {
+		return resp.NewError("ERR Invalid min-idle-time argument for XAUTOCLAIM")
+	}
+	minIdle := time.Duration(max(minIdleMs, 0)) * time.Millisecond
+
+	start, errReply, ok := parseRangeID(args[4].Bulk, true)
+	if !ok {
+		return errReply
+	}
+
+	count := 100
+	justID := false
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i].Bulk) {
+		case "JUSTID":
+			justID = true
+		case "COUNT":
+			if i+1 >= len(args) {
+				return resp.NewError("ERR syntax error")
+			}
+			n, err := strconv.Atoi(args[i+1].Bulk)
+			if err != nil || n < 1 || n > 1<<20 {
+				return resp.NewError("ERR COUNT must be > 0")
+			}
+			count = n
+			i++
+		default:
+			return resp.NewError("ERR syntax error")
+		}
+	}
+
+	st, group, errReply, ok := s.getStreamGroup(key, groupName)
+	if !ok {
+		return errReply
+	}
+
+	now := time.Now()
+	consumer := s.streamConsumer(key, group, consumerName)
+	consumer.SeenTime = now
+
+	claimed := []resp.Value{}
+	deleted := []resp.Value{}
+	cursor := minStreamID
+	attempts := count * 10
+	pending := sortedPending(group.Pending)
+	for _, pe := range pending {
+		if pe.ID.Less(start) {
+			continue
+		}
+		if attempts == 0 || len(claimed) == count {
+			cursor = pe.ID
+			break
+		}
+		attempts--
+
+		entry, exists := st.Lookup(pe.ID)
+		if !exists {
+			group.Ack(pe.ID)
+			s.alsoPropagate("XACK", key, groupName, pe.ID.String())
+			deleted = append(deleted, resp.NewBulkString(pe.ID.String()))
+		} else if now.Sub(pe.DeliveryTime) >= minIdle {
+			claimEntry(group, pe, consumer, now, -1, justID)
+			s.propagateClaim(key, group, pe)
+			if justID {
+				claimed = append(claimed, resp.NewBulkString(pe.ID.String()))
+			} else {
+				claimed = append(claimed, streamEntryValue(entry))
+			}
+		}
+	}
+
+	return resp.NewArray([]resp.Value{
+		resp.NewBulkString(cursor.String()),
+		resp.NewArray(claimed),
+		resp.NewArray(deleted),
+	})
+}
+
+// sortedConsumerNames returns the consumer names of a group in sorted order
+func sortedConsumerNames(group *StreamGroup) []string {
+	names := make([]string, 0, len(group.Consumers))
+	for name := range group.Consumers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// nullableInteger formats n as an integer, or a null reply when negative
+func nullableInteger(n int64) resp.Value {
+	if n < 0 {
+		return resp.NewNullBulkString()
+	}
+	return resp.NewInteger(int(n))
+}
+
+// xinfoGroups implements XINFO GROUPS key
+func (s *Server) xinfoGroups(args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return resp.NewError("ERR wrong number of arguments for 'xinfo|groups' command")
+	}
+
+	st, errReply, ok := s.getStream(args[0].Bulk)
+	if !ok {
+		return errReply
+	}
+	if st == nil {
+		return resp.NewError("ERR no such key")
+	}
+
+	groups := []resp.Value{}
+	for _, name := range st.GroupNames() {
+		group := st.Groups[name]
+		groups = append(groups, resp.NewArray([]resp.Value{
+			resp.NewBulkString("name"), resp.NewBulkString(name),
+			resp.NewBulkString("consumers"), resp.NewInteger(len(group.Consumers)),
+			resp.NewBulkString("pending"), resp.NewInteger(len(group.Pending)),
+			resp.NewBulkString("last-delivered-id"), resp.NewBulkString(group.LastID.String()),
+			resp.NewBulkString("entries-read"), nullableInteger(group.EntriesRead),
+			resp.NewBulkString("lag"), nullableInteger(st.Lag(group)),
+		}))
+	}
+	return resp.NewArray(groups)
+}
+
+// xinfoConsumers implements XINFO CONSUMERS key group
+func (s *Server) xinfoConsumers(args []resp.Value) resp.Value {
+	if len(args) != 2 {
+		return resp.NewError("ERR wrong number of arguments for 'xinfo|consumers' command")
+	}
+
+	_, group, errReply, ok := s.getStreamGroup(args[0].Bulk, args[1].Bulk)
+	if !ok {
+		return errReply
+	}
+
+	now := time.Now()
+	consumers := []resp.Value{}
+	for _, name := range sortedConsumerNames(group) {
+		consumer := group.Consumers[name]
+		inactive := int64(-1)
+		if !consumer.ActiveTime.IsZero() {
+			inactive = now.Sub(consumer.ActiveTime).Milliseconds()
+		}
+		consumers = append(consumers, resp.NewArray([]resp.Value{
+			resp.NewBulkString("name"), resp.NewBulkString(name),
+			resp.NewBulkString("pending"), resp.NewInteger(len(consumer.Pending)),
+			resp.NewBulkString("idle"), resp.NewInteger(int(now.Sub(consumer.SeenTime).Milliseconds())),
+			resp.NewBulkString("inactive"), resp.NewInteger(int(inactive)),
+		}))
+	}
+	return resp.NewArray(consumers)
+}
+
+// xinfoFullGroups formats the groups section of XINFO STREAM FULL, listing
+// up to count pending entries per group and consumer (0 means all)
+func xinfoFullGroups(st *Stream, count int) resp.Value {
+	limit := func(pending []*StreamPendingEntry) []*StreamPendingEntry {
+		if count > 0 && len(pending) > count {
+			return pending[:count]
+		}
+		return pending
+	}
+
+	groups := []resp.Value{}
+	for _, name := range st.GroupNames() {
+		group := st.Groups[name]
+
+		pel := []resp.Value{}
+		for _, pe := range limit(sortedPending(group.Pending)) {
+			pel = append(pel, resp.NewArray([]resp.Value{
+				resp.NewBulkString(pe.ID.String()),
+				resp.NewBulkString(pe.Consumer.Name),
+				resp.NewInteger(int(pe.DeliveryTime.UnixMilli())),
+				resp.NewInteger(int(pe.DeliveryCount)),
+			}))
+		}
+
+		consumers := []resp.Value{}
+		for _, cname := range sortedConsumerNames(group) {
+			consumer := group.Consumers[cname]
+			cpel := []resp.Value{}
+			for _, pe := range limit(sortedPending(consumer.Pending)) {
+				cpel = append(cpel, resp.NewArray([]resp.Value{
+					resp.NewBulkString(pe.ID.String()),
+					resp.NewInteger(int(pe.DeliveryTime.UnixMilli())),
+					resp.NewInteger(int(pe.DeliveryCount)),
+				}))
+			}
+			activeTime := int64(-1)
+			if !consumer.ActiveTime.IsZero() {
+				activeTime = consumer.ActiveTime.UnixMilli()
+			}
+			consumers = append(consumers, resp.NewArray([]resp.Value{
+				resp.NewBulkString("name"), resp.NewBulkString(cname),
+				resp.NewBulkString("seen-time"), resp.NewInteger(int(consumer.SeenTime.UnixMilli())),
+				resp.NewBulkString("active-time"), resp.NewInteger(int(activeTime)),
+				resp.NewBulkString("pel-count"), resp.NewInteger(len(consumer.Pending)),
+				resp.NewBulkString("pending"), resp.NewArray(cpel),
+			}))
+		}
+
+		groups = append(groups, resp.NewArray([]resp.Value{
+			resp.NewBulkString("name"), resp.NewBulkString(name),
+			resp.NewBulkString("last-delivered-id"), resp.NewBulkString(group.LastID.String()),
+			resp.NewBulkString("entries-read"), nullableInteger(group.EntriesRead),
+			resp.NewBulkString("lag"), nullableInteger(st.Lag(group)),
+			resp.NewBulkString("pel-count"), resp.NewInteger(len(group.Pending)),
+			resp.NewBulkString("pending"), resp.NewArray(pel),
+			resp.NewBulkString("consumers"), resp.NewArray(consumers),
+		}))
+	}
+	return resp.NewArray(groups)
+}
@@ -0,0 +1,713 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-learning/pkg/resp"
+)
+
+const invalidStreamIDErr = "ERR Invalid stream ID specified as stream command argument"
+
+// parseStreamID parses "<ms>-<seq>" or "<ms>", using missingSeq as the
+// sequence in the latter case
+func parseStreamID(arg string, missingSeq uint64) (StreamID, bool) {
+	msPart, seqPart, hasSeq := strings.Cut(arg, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return StreamID{}, false
+	}
+	if !hasSeq {
+		return StreamID{ms, missingSeq}, true
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return StreamID{}, false
+	}
+	return StreamID{ms, seq}, true
+}
+
+// parseRangeID parses an XRANGE style interval bound: "-" and "+" stand for
+// the smallest and largest IDs and a "(" prefix makes the bound exclusive
+func parseRangeID(arg string, isStart bool) (StreamID, resp.Value, bool) {
+	switch arg {
+	case "-":
+		return minStreamID, resp.Value{}, true
+	case "+":
+		return maxStreamID, resp.Value{}, true
+	}
+
+	exclusive := strings.HasPrefix(arg, "(")
+	if exclusive {
+		arg = arg[1:]
+	}
+
+	missingSeq := uint64(0)
+	if !isStart {
+		missingSeq = math.MaxUint64
+	}
+	id, ok := parseStreamID(arg, missingSeq)
+	if !ok {
+		return StreamID{}, resp.NewError(invalidStreamIDErr), false
+	}
+
+	if exclusive {
+		if isStart {
+			id, ok = id.Incr()
+		} else {
+			id, ok = id.Decr()
+		}
+		if !ok {
+			if isStart {
+				return StreamID{}, resp.NewError("ERR invalid start ID for the interval"), false
+			}
+			return StreamID{}, resp.NewError("ERR invalid end ID for the interval"), false
+		}
+	}
+	return id, resp.Value{}, true
+}
+
+// streamTrimArgs holds the MAXLEN/MINID options of XADD and XTRIM
+type streamTrimArgs struct {
+	maxLen   int
+	minID    StreamID
+	useMinID bool
+	approx   bool
+	limit    int
+	set      bool
+}
+
+// parseStreamTrimArgs parses a MAXLEN|MINID [=|~] threshold clause starting
+// at args[i], returning the index following it
+func parseStreamTrimArgs(args []resp.Value, i int, trim *streamTrimArgs) (int, resp.Value, bool) {
+	if trim.set {
+		return 0, resp.NewError("ERR syntax error, MAXLEN and MINID options at the same time are not compatible"), false
+	}
+	trim.set = true
+	trim.useMinID = strings.ToUpper(args[i].Bulk) == "MINID"
+	i++
+
+	if i < len(args) && (args[i].Bulk == "~" || args[i].Bulk == "=") {
+		trim.approx = args[i].Bulk == "~"
+		i++
+	}
+	if i >= len(args) {
+		return 0, resp.NewError("ERR syntax error"), false
+	}
+
+	if trim.useMinID {
+		id, ok := parseStreamID(args[i].Bulk, 0)
+		if !ok {
+			return 0, resp.NewError(invalidStreamIDErr), false
+		}
+		trim.minID = id
+	} else {
+		maxLen, err := strconv.Atoi(args[i].Bulk)
+		if err != nil {
+			return 0, resp.NewError("ERR value is not an integer or out of range"), false
+		}
+		if maxLen < 0 {
+			return 0, resp.NewError("ERR The MAXLEN argument must be >= 0."), false
+		}
+		trim.maxLen = maxLen
+	}
+	return i + 1, resp.Value{}, true
+}
+
+// parseStreamLimit parses the LIMIT count following a trim clause
+func parseStreamLimit(args []resp.Value, i int, trim *streamTrimArgs) (int, resp.Value, bool) {
+	if i+1 >= len(args) {
+		return 0, resp.NewError("ERR syntax error"), false
+	}
+	limit, err := strconv.Atoi(args[i+1].Bulk)
+	if err != nil || limit < 0 {
+		return 0, resp.NewError("ERR The LIMIT argument must be >= 0."), false
+	}
+	trim.limit = limit
+	return i + 2, resp.Value{}, true
+}
+
+// apply trims the stream according to the parsed options
+func (trim *streamTrimArgs) apply(st *Stream) int {
+	limit := trim.limit
+	if trim.approx && limit == 0 {
+		// Redis bounds the work done by a single approximate trim
+		limit = 100 * streamNodeMaxEntries
+	}
+	if trim.useMinID {
+		return st.TrimMinID(trim.minID, trim.approx, limit)
+	}
+	return st.TrimMaxLen(trim.maxLen, trim.approx, limit)
+}
+
+// getStream looks up the stream stored at key. The reply is an error for a
+// wrong type, and the stream is nil if the key does not exist.
+func (s *Server) getStream(key string) (*Stream, resp.Value, bool) {
+	val, exists := s.db.GetValue(key)
+	if !exists {
+		return nil, resp.Value{}, true
+	}
+	if val.Type != "stream" {
+		return nil, resp.NewError(wrongTypeErr), false
+	}
+	return val.Stream, resp.Value{}, true
+}
+
+// streamEntryValue formats an entry as [id, [field, value, ...]]
+func streamEntryValue(entry StreamEntry) resp.Value {
+	fields := make([]resp.Value, len(entry.Fields))
+	for i, field := range entry.Fields {
+		fields[i] = resp.NewBulkString(field)
+	}
+	return resp.NewArray([]resp.Value{resp.NewBulkString(entry.ID.String()), resp.NewArray(fields)})
+}
+
+// streamEntriesValue formats a list of entries
+func streamEntriesValue(entries []StreamEntry) resp.Value {
+	values := make([]resp.Value, len(entries))
+	for i, entry := range entries {
+		values[i] = streamEntryValue(entry)
+	}
+	return resp.NewArray(values)
+}
+
+// handleXAdd handles the XADD command
+func (s *Server) handleXAdd(args []resp.Value) resp.Value {
+	if len(args) < 4 {
+		return resp.NewError("ERR wrong number of arguments for 'xadd' command")
+	}
+
+	key := args[0].Bulk
+	noMkStream := false
+	var trim streamTrimArgs
+
+	i := 1
+	var errReply resp.Value
+	var ok bool
+parseOptions:
+	for i < len(args) {
+		switch strings.ToUpper(args[i].Bulk) {
+		case "NOMKSTREAM":
+			noMkStream = true
+			i++
+		case "MAXLEN", "MINID":
+			if i, errReply, ok = parseStreamTrimArgs(args, i, &trim); !ok {
+				return errReply
+			}
+		case "LIMIT":
+			if i, errReply, ok = parseStreamLimit(args, i, &trim); !ok {
+				return errReply
+			}
+		default:
+			break parseOptions
+		}
+	}
+
+	if trim.limit > 0 && !trim.approx {
+		return resp.NewError("ERR syntax error, LIMIT cannot be used without the special ~ option")
+	}
+
+	// What remains is the ID followed by field/value pairs
+	if i >= len(args) || (len(args)-i-1) == 0 || (len(args)-i-1)%2 != 0 {
+		return resp.NewError("ERR wrong number of arguments for 'xadd' command")
+	}
+	idArg := args[i].Bulk
+
+	st, errReply, ok := s.getStream(key)
+	if !ok {
+		return errReply
+	}
+	if st == nil && noMkStream {
+		return resp.NewNullBulkString()
+	}
+
+	var id StreamID
+	last := StreamID{}
+	if st != nil {
+		last = st.LastID
+	}
+	switch {
+	case idArg == "*":
+		nowMs := uint64(time.Now().UnixMilli())
+		if nowMs > last.Ms {
+			id = StreamID{nowMs, 0}
+		} else if id, ok = last.Incr(); !ok {
+			return resp.NewError("ERR The stream has exhausted the last possible ID, unable to add more items")
+		}
+	case strings.HasSuffix(idArg, "-*"):
+		ms, err := strconv.ParseUint(strings.TrimSuffix(idArg, "-*"), 10, 64)
+		if err != nil {
+			return resp.NewError(invalidStreamIDErr)
+		}
+		switch {
+		case ms > last.Ms:
+			id = StreamID{ms, 0}
+		case ms == last.Ms && last.Seq < math.MaxUint64:
+			id = StreamID{ms, last.Seq + 1}
+		default:
+			return resp.NewError("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+		}
+	default:
+		if id, ok = parseStreamID(idArg, 0); !ok {
+			return resp.NewError(invalidStreamIDErr)
+		}
+		if id.IsZero() {
+			return resp.NewError("ERR The ID specified in XADD must be greater than 0-0")
+		}
+		if !last.Less(id) {
+			return resp.NewError("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+		}
+	}
+
+	if st == nil {
+		val := NewStreamValue()
+		s.db.SetValue(key, val)
+		st = val.Stream
+	}
+
+	fields := make([]string, 0, len(args)-i-1)
+	for _, arg := range args[i+1:] {
+		fields = append(fields, arg.Bulk)
+	}
+	st.Append(id, fields)
+	s.signalModifiedKey(key)
+	s.notifyKeyspaceEvent(notifyStream, "xadd", key)
+
+	if trim.set && trim.apply(st) > 0 {
+		s.notifyKeyspaceEvent(notifyStream, "xtrim", key)
+	}
+
+	s.signalKeyAsReady(key)
+
+	// Propagate the ID that was generated
+	argv := commandArgv("XADD", args)
+	argv[i+1] = id.String()
+	s.alsoPropagate(argv...)
+	return resp.NewBulkString(id.String())
+}
+
+// handleXRange handles the XRANGE command
+func (s *Server) handleXRange(args []resp.Value) resp.Value {
+	if len(args) < 3 {
+		return resp.NewError("ERR wrong number of arguments for 'xrange' command")
+	}
+	return s.streamRange(args[0].Bulk, args[1].Bulk, args[2].Bulk, args[3:], false)
+}
+
+// handleXRevRange handles the XREVRANGE command
+func (s *Server) handleXRevRange(args []resp.Value) resp.Value {
+	if len(args) < 3 {
+		return resp.NewError("ERR wrong number of arguments for 'xrevrange' command")
+	}
+	return s.streamRange(args[0].Bulk, args[2].Bulk, args[1].Bulk, args[3:], true)
+}
+
+// streamRange implements XRANGE and XREVRANGE
+func (s *Server) streamRange(key, startArg, endArg string, opts []resp.Value, rev bool) resp.Value {
+	start, errReply, ok := parseRangeID(startArg, true)
+	if !ok {
+		return errReply
+	}
+	end, errReply, ok := parseRangeID(endArg, false)
+	if !ok {
+		return errReply
+	}
+
+	count := -1
+	for i := 0; i < len(opts); i += 2 {
+		if strings.ToUpper(opts[i].Bulk) != "COUNT" || i+1 >= len(opts) {
+			return resp.NewError("ERR syntax error")
+		}
+		n, err := strconv.Atoi(opts[i+1].Bulk)
+		if err != nil {
+			return resp.NewError("ERR value is not an integer or out of range")
+		}
+		count = max(n, 0)
+	}
+	if count == 0 {
+		return resp.NewArray([]resp.Value{})
+	}
+	count = max(count, 0)
+
+	st, errReply, ok := s.getStream(key)
+	if !ok {
+		return errReply
+	}
+	if st == nil {
+		return resp.NewArray([]resp.Value{})
+	}
+	return streamEntriesValue(st.Range(start, end, count, rev))
+}
+
+// handleXLen handles the XLEN command
+func (s *Server) handleXLen(args []resp.Value) resp.Value {
+	if len(args) != 1 {
+		return resp.NewError("ERR wrong number of arguments for 'xlen' command")
+	}
+
+	st, errReply, ok := s.getStream(args[0].Bulk)
+	if !ok {
+		return errReply
+	}
+	if st == nil {
+		return resp.NewInteger(0)
+	}
+	return resp.NewInteger(st.Len())
+}
+
+// handleXDel handles the XDEL command
+func (s *Server) handleXDel(args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return resp.NewError("ERR wrong number of arguments for 'xdel' command")
+	}
+
+	// Validate all IDs before touching the stream
+	ids := make([]StreamID, len(args)-1)
+	for i, arg := range args[1:] {
+		id, ok := parseStreamID(arg.Bulk, 0)
+		if !ok {
+			return resp.NewError(invalidStreamIDErr)
+		}
+		ids[i] = id
+	}
+
+	st, errReply, ok := s.getStream(args[0].Bulk)
+	if !ok {
+		return errReply
+	}
+	if st == nil {
+		return resp.NewInteger(0)
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		if st.Delete(id) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		s.signalModifiedKey(args[0].Bulk)
+		s.notifyKeyspaceEvent(notifyStream, "xdel", args[0].Bulk)
+	}
+	return resp.NewInteger(deleted)
+}
+
+// handleXTrim handles the XTRIM command
+func (s *Server) handleXTrim(args []resp.Value) resp.Value {
+	if len(args) < 3 {
+		return resp.NewError("ERR wrong number of arguments for 'xtrim' command")
+	}
+
+	var trim streamTrimArgs
+	var errReply resp.Value
+	var ok bool
+	for i := 1; i < len(args); {
+		switch strings.ToUpper(args[i].Bulk) {
+		case "MAXLEN", "MINID":
+			i, errReply, ok = parseStreamTrimArgs(args, i, &trim)
+		case "LIMIT":
+			i, errReply, ok = parseStreamLimit(args, i, &trim)
+		default:
+			errReply, ok = resp.NewError("ERR syntax error"), false
+		}
+		if !ok {
+			return errReply
+		}
+	}
+	if !trim.set {
+		return resp.NewError("ERR syntax error")
+	}
+	if trim.limit > 0 && !trim.approx {
+		return resp.NewError("ERR syntax error, LIMIT cannot be used without the special ~ option")
+	}
+
+	st, errReply, ok := s.getStream(args[0].Bulk)
+	if !ok {
+		return errReply
+	}
+	if st == nil {
+		return resp.NewInteger(0)
+	}
+	trimmed := trim.apply(st)
+	if trimmed > 0 {
+		s.signalModifiedKey(args[0].Bulk)
+		s.notifyKeyspaceEvent(notifyStream, "xtrim", args[0].Bulk)
+	}
+	return resp.NewInteger(trimmed)
+}
+
+// handleXSetID handles XSETID key last-id [ENTRIESADDED entries-added]
+// [MAXDELETEDID max-deleted-id]
+func (s *Server) handleXSetID(args []resp.Value) resp.Value {
+	if len(args) < 2 {
+		return resp.NewError("ERR wrong number of arguments for 'xsetid' command")
+	}
+
+	key := args[0].Bulk
+	id, ok := parseStreamID(args[1].Bulk, 0)
+	if !ok {
+		return resp.NewError(invalidStreamIDErr)
+	}
+	entriesAdded := int64(-1)
+	var maxDeletedID *StreamID
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return resp.NewError("ERR syntax error")
+		}
+		switch strings.ToUpper(args[i].Bulk) {
+		case "ENTRIESADDED":
+			n, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+			if err != nil {
+				return resp.NewError("ERR value is not an integer or out of range")
+			}
+			if n < 0 {
+				return resp.NewError("ERR entries_added must be positive")
+			}
+			entriesAdded = n
+		case "MAXDELETEDID":
+			maxID, ok := parseStreamID(args[i+1].Bulk, 0)
+			if !ok {
+				return resp.NewError(invalidStreamIDErr)
+			}
+			if id.Less(maxID) {
+				return resp.NewError("ERR The ID specified in XSETID is smaller than the provided max_deleted_entry_id")
+			}
+			maxDeletedID = &maxID
+		default:
+			return resp.NewError("ERR syntax error")
+		}
+	}
+
+	st, errReply, ok := s.getStream(key)
+	if !ok {
+		return errReply
+	}
+	if st == nil {
+		return resp.NewError("ERR no such key")
+	}
+	if entriesAdded >= 0 && entriesAdded < int64(st.Len()) {
+		return resp.NewError("ERR The entries_added specified in XSETID is smaller than the target stream length")
+	}
+	if last, ok := st.LastEntry(); ok && id.Less(last.ID) {
+		return resp.NewError("ERR The ID specified in XSETID is smaller than the target stream top item")
+	}
+
+	st.LastID = id
+	if entriesAdded >= 0 {
+		st.EntriesAdded = uint64(entriesAdded)
+	}
+	if maxDeletedID != nil {
+		st.MaxDeletedID = *maxDeletedID
+	}
+	s.signalModifiedKey(key)
+	s.notifyKeyspaceEvent(notifyStream, "xsetid", key)
+	return resp.NewSimpleString("OK")
+}
+
+// handleXInfo handles the XINFO command
+func (s *Server) handleXInfo(args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.NewError("ERR wrong number of arguments for 'xinfo' command")
+	}
+
+	switch strings.ToUpper(args[0].Bulk) {
+	case "STREAM":
+		return s.xinfoStream(args[1:])
+	case "GROUPS":
+		return s.xinfoGroups(args[1:])
+	case "CONSUMERS":
+		return s.xinfoConsumers(args[1:])
+	default:
+		return resp.NewError("ERR unknown subcommand '" + args[0].Bulk + "'. Try XINFO HELP.")
+	}
+}
+
+// xinfoStream implements XINFO STREAM key [FULL [COUNT count]]
+func (s *Server) xinfoStream(args []resp.Value) resp.Value {
+	if len(args) < 1 {
+		return resp.NewError("ERR wrong number of arguments for 'xinfo|stream' command")
+	}
+
+	full := false
+	count := 10
+	for i := 1; i < len(args); i++ {
+		switch {
+		case strings.ToUpper(args[i].Bulk) == "FULL":
+			full = true
+		case full && strings.ToUpper(args[i].Bulk) == "COUNT" && i+1 < len(args):
+			n, err := strconv.Atoi(args[i+1].Bulk)
+			if err != nil {
+				return resp.NewError("ERR value is not an integer or out of range")
+			}
+			count = n
+			i++
+		default:
+			return resp.NewError("ERR syntax error")
+		}
+	}
+
+	st, errReply, ok := s.getStream(args[0].Bulk)
+	if !ok {
+		return errReply
+	}
+	if st == nil {
+		return resp.NewError("ERR no such key")
+	}
+
+	firstID := StreamID{}
+	if first, ok := st.FirstEntry(); ok {
+		firstID = first.ID
+	}
+	info := []resp.Value{
+		resp.NewBulkString("length"), resp.NewInteger(st.Len()),
+		resp.NewBulkString("radix-tree-keys"), resp.NewInteger(st.NodeCount()),
+		resp.NewBulkString("radix-tree-nodes"), resp.NewInteger(st.NodeCount()),
+		resp.NewBulkString("last-generated-id"), resp.NewBulkString(st.LastID.String()),
+		resp.NewBulkString("max-deleted-entry-id"), resp.NewBulkString(st.MaxDeletedID.String()),
+		resp.NewBulkString("entries-added"), resp.NewInteger(int(st.EntriesAdded)),
+		resp.NewBulkString("recorded-first-entry-id"), resp.NewBulkString(firstID.String()),
+	}
+
+	if full {
+		if count < 0 {
+			count = 0
+		}
+		return resp.NewArray(append(info,
+			resp.NewBulkString("entries"), streamEntriesValue(st.Range(minStreamID, maxStreamID, count, false)),
+			resp.NewBulkString("groups"), xinfoFullGroups(st, count),
+		))
+	}
+
+	info = append(info, resp.NewBulkString("groups"), resp.NewInteger(len(st.Groups)))
+	for _, name := range []string{"first-entry", "last-entry"} {
+		entry, ok := st.FirstEntry()
+		if name == "last-entry" {
+			entry, ok = st.LastEntry()
+		}
+		if ok {
+			info = append(info, resp.NewBulkString(name), streamEntryValue(entry))
+		} else {
+			info = append(info, resp.NewBulkString(name), resp.NewNullBulkString())
+		}
+	}
+	return resp.NewArray(info)
+}
+
+// handleXRead handles the XREAD command
+func (s *Server) handleXRead(c *Client, args []resp.Value) resp.Value {
+	if len(args) < 3 {
+		return resp.NewError("ERR wrong number of arguments for 'xread' command")
+	}
+
+	count := 0
+	block := time.Duration(-1)
+	i := 0
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i].Bulk)
+		if opt == "STREAMS" {
+			break
+		}
+		if i+1 >= len(args) {
+			return resp.NewError("ERR syntax error")
+		}
+		switch opt {
+		case "COUNT":
+			n, err := strconv.Atoi(args[i+1].Bulk)
+			if err != nil {
+				return resp.NewError("ERR value is not an integer or out of range")
+			}
+			if n > 0 {
+				count = n
+			}
+		case "BLOCK":
+			ms, err := strconv.ParseInt(args[i+1].Bulk, 10, 64)
+			if err != nil {
+				return resp.NewError("ERR timeout is not an integer or out of range")
+			}
+			if ms < 0 {
+				return resp.NewError("ERR timeout is negative")
+			}
+			block = time.Duration(ms) * time.Millisecond
+		default:
+			return resp.NewError("ERR syntax error")
+		}
+		i++
+	}
+	if i >= len(args) {
+		return resp.NewError("ERR syntax error")
+	}
+
+	rest := args[i+1:]
+	if len(rest) == 0 || len(rest)%2 != 0 {
+		return resp.NewError("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+	}
+	numStreams := len(rest) / 2
+	keys := make([]string, numStreams)
+	ids := make([]StreamID, numStreams)
+	for j := 0; j < numStreams; j++ {
+		keys[j] = rest[j].Bulk
+		st, errReply, ok := s.getStream(keys[j])
+		if !ok {
+			return errReply
+		}
+
+		idArg := rest[numStreams+j].Bulk
+		if idArg == "$" {
+			// Only entries added from now on
+			if st != nil {
+				ids[j] = st.LastID
+			}
+			continue
+		}
+		id, ok := parseStreamID(idArg, 0)
+		if !ok {
+			return resp.NewError(invalidStreamIDErr)
+		}
+		ids[j] = id
+	}
+
+	// readKey returns the [key, entries] pair for entries newer than the
+	// requested ID
+	readKey := func(j int) (resp.Value, bool) {
+		st, _, ok := s.getStream(keys[j])
+		if !ok || st == nil {
+			return resp.Value{}, false
+		}
+		start, ok := ids[j].Incr()
+		if !ok {
+			return resp.Value{}, false
+		}
+		entries := st.Range(start, maxStreamID, count, false)
+		if len(entries) == 0 {
+			return resp.Value{}, false
+		}
+		return resp.NewArray([]resp.Value{resp.NewBulkString(keys[j]), streamEntriesValue(entries)}), true
+	}
+
+	var result []resp.Value
+	for j := range keys {
+		if value, ok := readKey(j); ok {
+			result = append(result, value)
+		}
+	}
+	if len(result) > 0 {
+		return resp.NewArray(result)
+	}
+	if block < 0 {
+		return resp.NewNullArray()
+	}
+
+	serve := func(key string) (resp.Value, bool) {
+		for j := range keys {
+			if keys[j] == key {
+				if value, ok := readKey(j); ok {
+					return resp.NewArray([]resp.Value{value}), true
+				}
+			}
+		}
+		return resp.Value{}, false
+	}
+	return s.blockClient(c, keys, block, resp.NewNullArray(), serve)
+}
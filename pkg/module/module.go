@@ -0,0 +1,251 @@
+// Package module lets Go code extend the server with new commands and data
+// types without changing it. Modules register what they provide from an
+// init function, and a server binary picks them up by importing the module
+// package and running redisserver.Main:
+//
+//	package main
+//
+//	import (
+//		"redis-learning/pkg/redisserver"
+//
+//		_ "example.com/mymodule"
+//	)
+//
+//	func main() {
+//		redisserver.Main()
+//	}
+package module
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"redis-learning/pkg/resp"
+)
+
+// Flag describes how a command behaves
+type Flag int
+
+// Command flags
+const (
+	Write    Flag = 1 << iota // may modify the dataset
+	NoMulti                   // can't be queued inside MULTI
+	NoScript                  // can't be called from scripts
+)
+
+// KeySpec tells where a command's key arguments are. Positions count the
+// command name as 0; a negative LastKey counts back from the last
+// argument, so -1 means every argument from FirstKey on. A zero FirstKey
+// means the command takes no keys.
+type KeySpec struct {
+	FirstKey int
+	LastKey  int
+	Step     int
+}
+
+// Keys returns the key arguments of argv, which includes the command name
+func (ks KeySpec) Keys(argv []string) []string {
+	if ks.FirstKey <= 0 || ks.FirstKey >= len(argv) {
+		return nil
+	}
+	last := ks.LastKey
+	if last < 0 {
+		last += len(argv)
+	}
+	if last >= len(argv) {
+		last = len(argv) - 1
+	}
+	step := ks.Step
+	if step <= 0 {
+		step = 1
+	}
+	var keys []string
+	for i := ks.FirstKey; i <= last; i += step {
+		keys = append(keys, argv[i])
+	}
+	return keys
+}
+
+// Handler runs a command. args holds the arguments without the command
+// name, and the reply is sent to the client as is.
+type Handler func(ctx Context, args []string) resp.Value
+
+// Command is a command provided by a module
+type Command struct {
+	// Name is matched case insensitively. Built-in commands take
+	// precedence over module commands of the same name.
+	Name string
+
+	// Arity counts the command name itself. A negative arity -N means at
+	// least N arguments.
+	Arity int
+
+	Flags   Flag
+	Keys    KeySpec
+	Handler Handler
+}
+
+// Type is a data type provided by a module. Its values are stored in the
+// keyspace like any other, and TYPE reports them under Name.
+type Type struct {
+	// Name must be exactly 9 characters from A-Z, a-z, 0-9, '-' and '_',
+	// as in Redis: RDB files identify module types by packing the name
+	// into 54 bits.
+	Name string
+
+	// Save serializes a value for DUMP and persistence, and Load does the
+	// reverse. EncodingVersion, between 0 and 1023, is stored alongside
+	// the data, so that Load can tell older encodings apart.
+	EncodingVersion int
+	Save            func(value any) []byte
+	Load            func(data []byte, encodingVersion int) (any, error)
+}
+
+// Context gives command handlers access to the server. Handlers run while
+// holding the server lock, like built-in commands, so everything they do is
+// atomic.
+type Context interface {
+	// Get returns a string value
+	Get(key string) (string, bool, error)
+
+	// Set stores a string value, raising a set event of the string class
+	Set(key, value string)
+
+	// GetValue returns a value of type t
+	GetValue(key string, t *Type) (any, bool, error)
+
+	// SetValue stores a value of type t, raising a set event of the module
+	// class
+	SetValue(key string, t *Type, value any)
+
+	// Delete removes a key of any type, raising a del event
+	Delete(key string) bool
+
+	// KeyType returns what TYPE would reply for key
+	KeyType(key string) string
+
+	// Call runs another command, built-in or not, and returns its reply
+	Call(name string, args ...string) resp.Value
+
+	// NotifyKeyspaceEvent raises a keyspace event of the module class
+	NotifyKeyspaceEvent(event, key string)
+}
+
+// ErrWrongType is returned when a key holds a value of another type
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// TypeNameCharset lists the characters module type names are made of, in
+// the order used to pack them into RDB module IDs
+const TypeNameCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// validTypeName reports whether name can name a module type
+func validTypeName(name string) bool {
+	if len(name) != 9 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if strings.IndexByte(TypeNameCharset, name[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	mu       sync.Mutex
+	commands = make(map[string]*Command)
+	types    = make(map[string]*Type)
+)
+
+// RegisterCommand adds a command. It is meant to be called from init
+// functions, before the server starts.
+func RegisterCommand(cmd Command) error {
+	if cmd.Name == "" || strings.ContainsAny(cmd.Name, " \t\r\n") {
+		return fmt.Errorf("invalid command name %q", cmd.Name)
+	}
+	if cmd.Arity == 0 {
+		return fmt.Errorf("command %s: arity can't be 0", cmd.Name)
+	}
+	if cmd.Handler == nil {
+		return fmt.Errorf("command %s: missing handler", cmd.Name)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	name := strings.ToUpper(cmd.Name)
+	if _, exists := commands[name]; exists {
+		return fmt.Errorf("command %s is already registered", cmd.Name)
+	}
+	commands[name] = &cmd
+	return nil
+}
+
+// MustRegisterCommand is like RegisterCommand but panics on errors
+func MustRegisterCommand(cmd Command) {
+	if err := RegisterCommand(cmd); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterType adds a data type. It is meant to be called from init
+// functions, before the server starts.
+func RegisterType(t *Type) error {
+	if !validTypeName(t.Name) {
+		return fmt.Errorf("invalid type name %q: it must be 9 characters from %s", t.Name, TypeNameCharset)
+	}
+	if t.EncodingVersion < 0 || t.EncodingVersion > 1023 {
+		return fmt.Errorf("type %s: encoding version must be between 0 and 1023", t.Name)
+	}
+	if t.Save == nil || t.Load == nil {
+		return fmt.Errorf("type %s: Save and Load are required", t.Name)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if _, exists := types[t.Name]; exists {
+		return fmt.Errorf("type %s is already registered", t.Name)
+	}
+	types[t.Name] = t
+	return nil
+}
+
+// MustRegisterType is like RegisterType but panics on errors
+func MustRegisterType(t *Type) {
+	if err := RegisterType(t); err != nil {
+		panic(err)
+	}
+}
+
+// Commands returns the registered commands sorted by name
+func Commands() []*Command {
+	mu.Lock()
+	defer mu.Unlock()
+	list := make([]*Command, 0, len(commands))
+	for _, cmd := range commands {
+		list = append(list, cmd)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Types returns the registered types sorted by name
+func Types() []*Type {
+	mu.Lock()
+	defer mu.Unlock()
+	list := make([]*Type, 0, len(types))
+	for _, t := range types {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// LookupType returns the registered type called name, or nil
+func LookupType(name string) *Type {
+	mu.Lock()
+	defer mu.Unlock()
+	return types[name]
+}
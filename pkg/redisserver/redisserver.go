@@ -0,0 +1,186 @@
+// Package redisserver runs the server from outside this module, so that
+// binaries can be built with the commands and types of extra modules
+// registered through package module.
+package redisserver
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"redis-learning/internal/server"
+)
+
+// Server is a Redis server
+type Server struct {
+	srv *server.Server
+}
+
+// New creates a server that will listen on host:port. Modules must be
+// registered before calling it.
+func New(host, port string) *Server {
+	return &Server{srv: server.NewServer(host, port)}
+}
+
+// NewSentinel creates a server running in Sentinel mode, that will listen
+// on host:port. Masters to monitor are added with SentinelConfig.
+func NewSentinel(host, port string) *Server {
+	return &Server{srv: server.NewSentinel(host, port)}
+}
+
+// SentinelConfig runs a SENTINEL subcommand on a server in Sentinel mode,
+// such as MONITOR <name> <host> <port> <quorum> or SET <name> <option>
+// <value>
+func (s *Server) SentinelConfig(args ...string) error {
+	return s.srv.SentinelConfig(args...)
+}
+
+// SetConfig changes a setting, using the names of CONFIG SET. Settings
+// that affect startup, such as dir, dbfilename and appendonly, must be set
+// before calling Start.
+func (s *Server) SetConfig(name, value string) error {
+	return s.srv.SetConfig(name, value)
+}
+
+// Start listens for connections and loads the saved dataset in the
+// background, blocking until the server stops. Until loading is done,
+// clients get LOADING errors for commands that need the dataset.
+func (s *Server) Start() error {
+	return s.srv.Start()
+}
+
+// Stop stops the server without saving
+func (s *Server) Stop() error {
+	return s.srv.Stop()
+}
+
+// Shutdown stops the server, first saving the dataset if save points are
+// configured
+func (s *Server) Shutdown() error {
+	return s.srv.Shutdown()
+}
+
+// Main runs a server configured from the command line flags, shutting it
+// down on SIGINT or SIGTERM
+func Main() {
+	// Parse command line flags
+	host := flag.String("host", "localhost", "Server host")
+	port := flag.String("port", "6379", "Server port")
+	dir := flag.String("dir", "", "Directory snapshots are written to and loaded from")
+	dbfilename := flag.String("dbfilename", "", "Snapshot file name")
+	save := flag.String("save", "", `Save points as "<seconds> <changes> ...", or "none" to disable snapshots`)
+	appendonly := flag.String("appendonly", "", "Whether to log every write to the append only file (yes or no)")
+	appendfsync := flag.String("appendfsync", "", "When to sync the append only file: always, everysec or no")
+	replicaof := flag.String("replicaof", "", `Master to replicate, as "<host> <port>"`)
+	flag.Parse()
+
+	// Create server
+	srv := New(*host, *port)
+	settings := []struct{ name, value string }{
+		{"dir", *dir},
+		{"dbfilename", *dbfilename},
+		{"save", *save},
+		{"appendonly", *appendonly},
+		{"appendfsync", *appendfsync},
+		{"replicaof", *replicaof},
+	}
+	for _, setting := range settings {
+		value := setting.value
+		if value == "" {
+			continue
+		}
+		if setting.name == "save" && value == "none" {
+			value = ""
+		}
+		if err := srv.SetConfig(setting.name, value); err != nil {
+			log.Fatalf("Bad configuration: %v", err)
+		}
+	}
+
+	// Handle graceful shutdown
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		for range c {
+			log.Println("Shutting down server...")
+			if err := srv.Shutdown(); err != nil {
+				log.Printf("Errors trying to shut down the server: %v", err)
+			}
+		}
+	}()
+
+	// Start server
+	log.Printf("Starting Redis server on %s:%s", *host, *port)
+	if err := srv.Start(); err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+}
+
+// monitorFlags collects the repeated -monitor flag
+type monitorFlags []string
+
+func (m *monitorFlags) String() string {
+	return strings.Join(*m, "; ")
+}
+
+func (m *monitorFlags) Set(value string) error {
+	*m = append(*m, value)
+	return nil
+}
+
+// SentinelMain runs a sentinel configured from the command line flags,
+// stopping it on SIGINT or SIGTERM
+func SentinelMain() {
+	// Parse command line flags
+	host := flag.String("host", "localhost", "Sentinel host")
+	port := flag.String("port", "26379", "Sentinel port")
+	var monitors monitorFlags
+	flag.Var(&monitors, "monitor", `Master to monitor, as "<name> <host> <port> <quorum>" (repeatable)`)
+	downAfter := flag.String("down-after-milliseconds", "", "Time after which a master not replying is considered down")
+	failoverTimeout := flag.String("failover-timeout", "", "Failover timeout in milliseconds")
+	parallelSyncs := flag.String("parallel-syncs", "", "Replicas reconfigured at the same time after a failover")
+	flag.Parse()
+
+	// Create sentinel
+	srv := NewSentinel(*host, *port)
+	for _, monitor := range monitors {
+		args := strings.Fields(monitor)
+		if len(args) != 4 {
+			log.Fatalf(`Bad -monitor %q: expected "<name> <host> <port> <quorum>"`, monitor)
+		}
+		if err := srv.SentinelConfig(append([]string{"MONITOR"}, args...)...); err != nil {
+			log.Fatalf("Bad configuration: %v", err)
+		}
+		settings := []struct{ name, value string }{
+			{"down-after-milliseconds", *downAfter},
+			{"failover-timeout", *failoverTimeout},
+			{"parallel-syncs", *parallelSyncs},
+		}
+		for _, setting := range settings {
+			if setting.value == "" {
+				continue
+			}
+			if err := srv.SentinelConfig("SET", args[0], setting.name, setting.value); err != nil {
+				log.Fatalf("Bad configuration: %v", err)
+			}
+		}
+	}
+
+	// Handle graceful shutdown
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+		log.Println("Shutting down sentinel...")
+		srv.Stop()
+	}()
+
+	// Start sentinel
+	log.Printf("Starting Redis Sentinel on %s:%s", *host, *port)
+	if err := srv.Start(); err != nil {
+		log.Fatalf("Sentinel failed to start: %v", err)
+	}
+}
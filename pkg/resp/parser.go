@@ -25,6 +25,11 @@ const (
 	INTEGER = "integer"
 	BULK    = "bulk"
 	ARRAY   = "array"
+
+	// RESP3 only types. Maps keep their keys and values interleaved in
+	// Array and are sent as flat arrays to RESP2 clients.
+	PUSH = "push"
+	MAP  = "map"
 )
 
 // Parser handles RESP protocol parsing
@@ -58,6 +63,17 @@ func (p *Parser) Read() (Value, error) {
 		return p.readBulkString()
 	case '*': // Array
 		return p.readArray()
+	case '>': // Push
+		v, err := p.readArray()
+		v.Type = PUSH
+		return v, err
+	case '%': // Map
+		return p.readMap()
+	case '_': // RESP3 null
+		if _, err := p.readLine(); err != nil {
+			return Value{}, err
+		}
+		return Value{Type: BULK, Null: true}, nil
 	default:
 		return Value{}, fmt.Errorf("unknown RESP type: %c", typeByte)
 	}
@@ -179,6 +195,33 @@ func (p *Parser) readArray() (Value, error) {
 	}, nil
 }
 
+// readMap reads a RESP3 map (%1\r\n+key\r\n:1\r\n)
+func (p *Parser) readMap() (Value, error) {
+	line, err := p.readLine()
+	if err != nil {
+		return Value{}, err
+	}
+
+	length, err := strconv.Atoi(line)
+	if err != nil {
+		return Value{}, fmt.Errorf("invalid map length: %s", line)
+	}
+
+	array := make([]Value, 2*length)
+	for i := range array {
+		val, err := p.Read()
+		if err != nil {
+			return Value{}, err
+		}
+		array[i] = val
+	}
+
+	return Value{
+		Type:  MAP,
+		Array: array,
+	}, nil
+}
+
 // readLine reads a line ending with \r\n
 func (p *Parser) readLine() (string, error) {
 	line, err := p.reader.ReadString('\n')
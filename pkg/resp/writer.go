@@ -8,15 +8,22 @@ import (
 // Writer handles RESP protocol serialization
 type Writer struct {
 	writer io.Writer
+	proto  int
 }
 
 // NewWriter creates a new RESP writer
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{
 		writer: w,
+		proto:  2,
 	}
 }
 
+// SetProtocol selects RESP2 or RESP3 output
+func (w *Writer) SetProtocol(proto int) {
+	w.proto = proto
+}
+
 // Write serializes a Value to RESP format
 func (w *Writer) Write(v Value) error {
 	switch v.Type {
@@ -35,7 +42,17 @@ func (w *Writer) Write(v Value) error {
 		if v.Null {
 			return w.writeNullArray()
 		}
-		return w.writeArray(v.Array)
+		return w.writeArray('*', v.Array)
+	case PUSH:
+		if w.proto < 3 {
+			return w.writeArray('*', v.Array)
+		}
+		return w.writeArray('>', v.Array)
+	case MAP:
+		if w.proto < 3 {
+			return w.writeArray('*', v.Array)
+		}
+		return w.writeMap(v.Array)
 	default:
 		return fmt.Errorf("unknown value type: %s", v.Type)
 	}
@@ -65,15 +82,21 @@ func (w *Writer) writeBulkString(s string) error {
 	return err
 }
 
-// writeNullBulkString writes a null bulk string ($-1\r\n)
+// writeNullBulkString writes a null bulk string ($-1\r\n), or the RESP3
+// null (_\r\n)
 func (w *Writer) writeNullBulkString() error {
+	if w.proto >= 3 {
+		_, err := fmt.Fprintf(w.writer, "_\r\n")
+		return err
+	}
 	_, err := fmt.Fprintf(w.writer, "$-1\r\n")
 	return err
 }
 
-// writeArray writes an array (*2\r\n$5\r\nhello\r\n$5\r\nworld\r\n)
-func (w *Writer) writeArray(arr []Value) error {
-	_, err := fmt.Fprintf(w.writer, "*%d\r\n", len(arr))
+// writeArray writes an array (*2\r\n$5\r\nhello\r\n$5\r\nworld\r\n), or a
+// push frame when prefix is '>'
+func (w *Writer) writeArray(prefix byte, arr []Value) error {
+	_, err := fmt.Fprintf(w.writer, "%c%d\r\n", prefix, len(arr))
 	if err != nil {
 		return err
 	}
@@ -87,8 +110,25 @@ func (w *Writer) writeArray(arr []Value) error {
 	return nil
 }
 
-// writeNullArray writes a null array (*-1\r\n)
+// writeMap writes a RESP3 map of interleaved keys and values
+func (w *Writer) writeMap(arr []Value) error {
+	if _, err := fmt.Fprintf(w.writer, "%%%d\r\n", len(arr)/2); err != nil {
+		return err
+	}
+	for _, val := range arr {
+		if err := w.Write(val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeNullArray writes a null array (*-1\r\n), or the RESP3 null
 func (w *Writer) writeNullArray() error {
+	if w.proto >= 3 {
+		_, err := fmt.Fprintf(w.writer, "_\r\n")
+		return err
+	}
 	_, err := fmt.Fprintf(w.writer, "*-1\r\n")
 	return err
 }
@@ -125,6 +165,17 @@ func NewArray(arr []Value) Value {
 	return Value{Type: ARRAY, Array: arr}
 }
 
+// NewPush creates a RESP3 push value, sent as an array to RESP2 clients
+func NewPush(arr []Value) Value {
+	return Value{Type: PUSH, Array: arr}
+}
+
+// NewMap creates a map value from interleaved keys and values, sent as a
+// flat array to RESP2 clients
+func NewMap(arr []Value) Value {
+	return Value{Type: MAP, Array: arr}
+}
+
 // NewNullArray creates a null array value
 func NewNullArray() Value {
 	return Value{Type: ARRAY, Null: true}